@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// TrimmedRawValue returns the raw text of the value without the whitespace
+// surrounding arrays and objects.
+func TrimmedRawValue(v JsonValue) string {
+	return strings.Trim(v.RawValue, whitespace)
+}
+
+func FormatDetail(node *ViewNode) string {
+	var sb strings.Builder
+
+	raw := TrimmedRawValue(node.Value)
+
+	fmt.Fprintf(&sb, "type   : %s\n", node.Value.ValueType)
+	fmt.Fprintf(&sb, "path   : %s\n", node.Path)
+	fmt.Fprintf(&sb, "offset : %d\n", node.Value.Offset)
+	fmt.Fprintf(&sb, "size   : %d\n", len(raw))
+
+	if decoded := DecodeValue(node.Value); decoded != "" {
+		sb.WriteString("\n")
+		sb.WriteString(decoded)
+	}
+
+	sb.WriteString("\n")
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, []byte(raw), "", "  "); err != nil {
+		sb.WriteString(raw)
+	} else {
+		sb.Write(buf.Bytes())
+	}
+	sb.WriteString("\n")
+
+	return sb.String()
+}
+
+// DecodeValue returns a human readable interpretation of the value, such as
+// the unescaped text of a string or the integer value of a number.
+func DecodeValue(v JsonValue) string {
+	switch v.ValueType {
+	case Object:
+		return fmt.Sprintf("members : %d\n", len(v.ObjectMember))
+	case Array:
+		return fmt.Sprintf("elements : %d\n", len(v.ArrayMember))
+	case Number:
+		if n, err := strconv.ParseInt(v.RawValue, 10, 64); err == nil {
+			return fmt.Sprintf("int : %d (0x%x)\n", n, n)
+		}
+		if f, err := strconv.ParseFloat(v.RawValue, 64); err == nil {
+			return fmt.Sprintf("float : %g\n", f)
+		}
+	case String:
+		var s string
+		if err := json.Unmarshal([]byte(v.RawValue), &s); err != nil {
+			return ""
+		}
+
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "decoded :\n%s\n", s)
+		if b, ok := decodeBase64(s); ok {
+			fmt.Fprintf(&sb, "base64 :\n%s\n", b)
+		}
+		return sb.String()
+	}
+	return ""
+}
+
+func decodeBase64(s string) (string, bool) {
+	if len(s) < 4 {
+		return "", false
+	}
+
+	for _, encoding := range []*base64.Encoding{
+		base64.StdEncoding,
+		base64.URLEncoding,
+		base64.RawStdEncoding,
+		base64.RawURLEncoding,
+	} {
+		b, err := encoding.DecodeString(s)
+		if err != nil {
+			continue
+		}
+		if !isPrintable(b) {
+			return "", false
+		}
+		return string(b), true
+	}
+	return "", false
+}
+
+func isPrintable(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDecodeValue(t *testing.T) {
+	testcases := []struct {
+		input    string
+		expected string
+	}{
+		{`"a\nb"`, "decoded :\na\nb\n"},
+		{`"aGVsbG8="`, "decoded :\naGVsbG8=\nbase64 :\nhello\n"},
+		{`"abc"`, "decoded :\nabc\n"},
+		{`255`, "int : 255 (0xff)\n"},
+		{`1.5e+3`, "float : 1500\n"},
+		{`[1, 2]`, "elements : 2\n"},
+		{`{"a":1}`, "members : 1\n"},
+		{`null`, ""},
+	}
+
+	for _, tt := range testcases {
+		t.Run(tt.input, func(t *testing.T) {
+			v, _, err := parse(tt.input, 0)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.expected, DecodeValue(v))
+		})
+	}
+}
+
+func TestFormatDetail(t *testing.T) {
+	v, _, err := parse(`{"a": [ {"b":1} ]}`, 0)
+	assert.Nil(t, err)
+
+	node := &ViewNode{Path: "$.a", Value: v.ObjectMember[0].Value}
+	expected := "type   : array\n" +
+		"path   : $.a\n" +
+		"offset : 6\n" +
+		"size   : 11\n" +
+		"\n" +
+		"elements : 1\n" +
+		"\n" +
+		"[\n" +
+		"  {\n" +
+		"    \"b\": 1\n" +
+		"  }\n" +
+		"]\n"
+	assert.Equal(t, expected, FormatDetail(node))
+}
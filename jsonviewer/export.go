@@ -0,0 +1,557 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// flatRow is an object flattened into dotted column names.
+type flatRow struct {
+	columns []string
+	values  map[string]JsonValue
+}
+
+func (r *flatRow) set(column string, v JsonValue) {
+	if _, ok := r.values[column]; !ok {
+		r.columns = append(r.columns, column)
+	}
+	r.values[column] = v
+}
+
+func flatten(prefix string, v JsonValue, row *flatRow) error {
+	join := func(name string) string {
+		if prefix == "" {
+			return name
+		}
+		return prefix + "." + name
+	}
+
+	switch {
+	case v.ValueType == Object && len(v.ObjectMember) > 0:
+		for _, pair := range v.ObjectMember {
+			key, err := DecodeString(pair.Key)
+			if err != nil {
+				return err
+			}
+			if err := flatten(join(key), pair.Value, row); err != nil {
+				return err
+			}
+		}
+	case v.ValueType == Array && len(v.ArrayMember) > 0:
+		for i, member := range v.ArrayMember {
+			if err := flatten(join(strconv.Itoa(i)), member, row); err != nil {
+				return err
+			}
+		}
+	default:
+		if prefix == "" {
+			prefix = "value"
+		}
+		row.set(prefix, v)
+	}
+	return nil
+}
+
+// flattenRows turns an array of objects, or a single object, into rows with a
+// shared list of columns in order of first appearance.
+func flattenRows(v JsonValue) ([]string, []*flatRow, error) {
+	var members []JsonValue
+	switch v.ValueType {
+	case Array:
+		members = v.ArrayMember
+	case Object:
+		members = []JsonValue{v}
+	default:
+		return nil, nil, fmt.Errorf("%s cannot be converted to rows", v.ValueType)
+	}
+
+	var columns []string
+	seen := map[string]bool{}
+	rows := make([]*flatRow, 0, len(members))
+
+	for _, member := range members {
+		row := &flatRow{values: map[string]JsonValue{}}
+		if err := flatten("", member, row); err != nil {
+			return nil, nil, err
+		}
+		for _, column := range row.columns {
+			if !seen[column] {
+				seen[column] = true
+				columns = append(columns, column)
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	return columns, rows, nil
+}
+
+func DecodeString(v JsonValue) (string, error) {
+	var s string
+	if err := json.Unmarshal([]byte(v.RawValue), &s); err != nil {
+		return "", err
+	}
+	return s, nil
+}
+
+func ExportCSV(w io.Writer, v JsonValue) error {
+	columns, rows, err := flattenRows(v)
+	if err != nil {
+		return err
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		record := make([]string, len(columns))
+		for i, column := range columns {
+			value, ok := row.values[column]
+			if !ok {
+				continue
+			}
+			switch value.ValueType {
+			case Null:
+			case String:
+				if record[i], err = DecodeString(value); err != nil {
+					return err
+				}
+			default:
+				record[i] = TrimmedRawValue(value)
+			}
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func sqlColumnType(rows []*flatRow, column string) string {
+	columnType := ""
+	for _, row := range rows {
+		value, ok := row.values[column]
+		if !ok {
+			continue
+		}
+
+		var t string
+		switch value.ValueType {
+		case Null:
+			continue
+		case True, False:
+			t = "BOOLEAN"
+		case Number:
+			if _, err := strconv.ParseInt(value.RawValue, 10, 64); err == nil {
+				t = "INTEGER"
+			} else {
+				t = "REAL"
+			}
+		default:
+			t = "TEXT"
+		}
+
+		switch {
+		case columnType == "" || columnType == t:
+			columnType = t
+		case (columnType == "INTEGER" && t == "REAL") || (columnType == "REAL" && t == "INTEGER"):
+			columnType = "REAL"
+		default:
+			columnType = "TEXT"
+		}
+	}
+
+	if columnType == "" {
+		return "TEXT"
+	}
+	return columnType
+}
+
+func quoteSQLIdentifier(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+func quoteSQLString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func sqlLiteral(v JsonValue) (string, error) {
+	switch v.ValueType {
+	case Null:
+		return "NULL", nil
+	case True:
+		return "TRUE", nil
+	case False:
+		return "FALSE", nil
+	case Number:
+		return v.RawValue, nil
+	case String:
+		s, err := DecodeString(v)
+		if err != nil {
+			return "", err
+		}
+		return quoteSQLString(s), nil
+	default:
+		return quoteSQLString(TrimmedRawValue(v)), nil
+	}
+}
+
+func ExportSQL(w io.Writer, v JsonValue, table string) error {
+	columns, rows, err := flattenRows(v)
+	if err != nil {
+		return err
+	}
+
+	quotedColumns := make([]string, len(columns))
+	definitions := make([]string, len(columns))
+	for i, column := range columns {
+		quotedColumns[i] = quoteSQLIdentifier(column)
+		definitions[i] = fmt.Sprintf("  %s %s", quotedColumns[i], sqlColumnType(rows, column))
+	}
+
+	if _, err := fmt.Fprintf(w, "CREATE TABLE %s (\n%s\n);\n", quoteSQLIdentifier(table), strings.Join(definitions, ",\n")); err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		values := make([]string, len(columns))
+		for i, column := range columns {
+			value, ok := row.values[column]
+			if !ok {
+				values[i] = "NULL"
+				continue
+			}
+			if values[i], err = sqlLiteral(value); err != nil {
+				return err
+			}
+		}
+
+		if _, err := fmt.Fprintf(
+			w,
+			"INSERT INTO %s (%s) VALUES (%s);\n",
+			quoteSQLIdentifier(table),
+			strings.Join(quotedColumns, ", "),
+			strings.Join(values, ", "),
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type inferredKind int
+
+const (
+	inferredNull inferredKind = iota
+	inferredBool
+	inferredInt
+	inferredFloat
+	inferredString
+	inferredObject
+	inferredArray
+	inferredMixed
+)
+
+// inferredType is the type of one or more JSON values merged together.
+type inferredType struct {
+	kind     inferredKind
+	nullable bool
+	objects  int
+	fields   []*inferredField
+	elem     *inferredType
+}
+
+type inferredField struct {
+	key   string
+	typ   *inferredType
+	count int
+}
+
+func inferType(v JsonValue) (*inferredType, error) {
+	switch v.ValueType {
+	case True, False:
+		return &inferredType{kind: inferredBool}, nil
+	case Number:
+		if _, err := strconv.ParseInt(v.RawValue, 10, 64); err == nil {
+			return &inferredType{kind: inferredInt}, nil
+		}
+		return &inferredType{kind: inferredFloat}, nil
+	case String:
+		return &inferredType{kind: inferredString}, nil
+	case Array:
+		t := &inferredType{kind: inferredArray}
+		for _, member := range v.ArrayMember {
+			elem, err := inferType(member)
+			if err != nil {
+				return nil, err
+			}
+			t.elem = mergeType(t.elem, elem)
+		}
+		return t, nil
+	case Object:
+		t := &inferredType{kind: inferredObject, objects: 1}
+		for _, pair := range v.ObjectMember {
+			key, err := DecodeString(pair.Key)
+			if err != nil {
+				return nil, err
+			}
+			typ, err := inferType(pair.Value)
+			if err != nil {
+				return nil, err
+			}
+			t.fields = append(t.fields, &inferredField{key: key, typ: typ, count: 1})
+		}
+		return t, nil
+	default:
+		return &inferredType{kind: inferredNull}, nil
+	}
+}
+
+func mergeType(a *inferredType, b *inferredType) *inferredType {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	case b.kind == inferredNull:
+		a.nullable = true
+		return a
+	case a.kind == inferredNull:
+		b.nullable = true
+		return b
+	}
+
+	a.nullable = a.nullable || b.nullable
+
+	switch {
+	case a.kind == b.kind && a.kind == inferredObject:
+		a.objects += b.objects
+		for _, field := range b.fields {
+			var found *inferredField
+			for _, f := range a.fields {
+				if f.key == field.key {
+					found = f
+					break
+				}
+			}
+			if found == nil {
+				a.fields = append(a.fields, field)
+			} else {
+				found.typ = mergeType(found.typ, field.typ)
+				found.count += field.count
+			}
+		}
+	case a.kind == b.kind && a.kind == inferredArray:
+		a.elem = mergeType(a.elem, b.elem)
+	case a.kind == b.kind:
+	case (a.kind == inferredInt && b.kind == inferredFloat) || (a.kind == inferredFloat && b.kind == inferredInt):
+		a.kind = inferredFloat
+	default:
+		a.kind = inferredMixed
+	}
+	return a
+}
+
+var goInitialisms = map[string]bool{
+	"API":  true,
+	"HTML": true,
+	"HTTP": true,
+	"ID":   true,
+	"IP":   true,
+	"JSON": true,
+	"SQL":  true,
+	"URL":  true,
+	"URI":  true,
+	"UUID": true,
+}
+
+func GoIdentifier(key string) string {
+	words := strings.FieldsFunc(key, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	var sb strings.Builder
+	for _, word := range words {
+		if upper := strings.ToUpper(word); goInitialisms[upper] {
+			sb.WriteString(upper)
+			continue
+		}
+		runes := []rune(word)
+		sb.WriteRune(unicode.ToUpper(runes[0]))
+		sb.WriteString(string(runes[1:]))
+	}
+
+	name := sb.String()
+	if name == "" {
+		return "Field"
+	}
+	if unicode.IsDigit([]rune(name)[0]) {
+		return "X" + name
+	}
+	return name
+}
+
+// validJSONTagName reports whether encoding/json accepts key as the name in a
+// struct tag. It ignores names with other characters, such as commas, quotes
+// and backquotes.
+func validJSONTagName(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, r := range key {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("!#$%&()*+-./:;<=>?@[]^_{|}~ ", r) {
+			return false
+		}
+	}
+	return true
+}
+
+type goStructGenerator struct {
+	names map[string]bool
+	defs  []string
+}
+
+func (g *goStructGenerator) uniqueName(name string, used map[string]bool) string {
+	unique := name
+	for i := 2; used[unique]; i++ {
+		unique = fmt.Sprintf("%s%d", name, i)
+	}
+	used[unique] = true
+	return unique
+}
+
+func (g *goStructGenerator) goType(t *inferredType, name string) string {
+	if t == nil {
+		return "interface{}"
+	}
+
+	var s string
+	switch t.kind {
+	case inferredBool:
+		s = "bool"
+	case inferredInt:
+		s = "int64"
+	case inferredFloat:
+		s = "float64"
+	case inferredString:
+		s = "string"
+	case inferredArray:
+		return "[]" + g.goType(t.elem, name+"Item")
+	case inferredObject:
+		s = g.defineStruct(t, name)
+	default:
+		return "interface{}"
+	}
+
+	if t.nullable {
+		return "*" + s
+	}
+	return s
+}
+
+func (g *goStructGenerator) defineStruct(t *inferredType, name string) string {
+	name = g.uniqueName(name, g.names)
+	index := len(g.defs)
+	g.defs = append(g.defs, "")
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "type %s struct {\n", name)
+
+	fieldNames := map[string]bool{}
+	for _, field := range t.fields {
+		fieldName := g.uniqueName(GoIdentifier(field.key), fieldNames)
+		fmt.Fprintf(&sb, "%s %s", fieldName, g.goType(field.typ, fieldName))
+
+		tag := field.key
+		if !validJSONTagName(tag) {
+			tag = ""
+		}
+		if field.count < t.objects {
+			tag += ",omitempty"
+		}
+		if tag != "" {
+			fmt.Fprintf(&sb, " `json:%s`", strconv.Quote(tag))
+		}
+		if !validJSONTagName(field.key) {
+			fmt.Fprintf(&sb, " // the key %s cannot be written in a json tag", strconv.Quote(field.key))
+		}
+		sb.WriteString("\n")
+	}
+	sb.WriteString("}\n")
+
+	g.defs[index] = sb.String()
+	return name
+}
+
+func ExportGoStruct(w io.Writer, v JsonValue, name string) error {
+	t, err := inferType(v)
+	if err != nil {
+		return err
+	}
+
+	g := &goStructGenerator{names: map[string]bool{}}
+	if t.kind == inferredObject {
+		g.defineStruct(t, name)
+	} else {
+		g.names[name] = true
+		root := fmt.Sprintf("type %s %s\n", name, g.goType(t, name))
+		g.defs = append([]string{root}, g.defs...)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(strings.Join(g.defs, "\n"))
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(src)
+	return err
+}
+
+// FindValue returns the value at the given path below v, which is located at
+// basePath.
+func FindValue(v JsonValue, basePath string, path string) (JsonValue, bool) {
+	for {
+		if basePath == path {
+			return v, true
+		}
+		if !isDescendantPath(basePath, path) {
+			return JsonValue{}, false
+		}
+
+		found := false
+		switch v.ValueType {
+		case Array:
+			for i, member := range v.ArrayMember {
+				memberPath := ArrayMemberPath(basePath, i)
+				if isDescendantPath(memberPath, path) {
+					v, basePath, found = member, memberPath, true
+					break
+				}
+			}
+		case Object:
+			for _, pair := range v.ObjectMember {
+				memberPath := ObjectMemberPath(basePath, pair.Key)
+				if isDescendantPath(memberPath, path) {
+					v, basePath, found = pair.Value, memberPath, true
+					break
+				}
+			}
+		}
+		if !found {
+			return JsonValue{}, false
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func parseTestValue(t *testing.T, input string) JsonValue {
+	t.Helper()
+	v, _, err := parse(input, 0)
+	assert.Nil(t, err)
+	return v
+}
+
+func TestExportCSV(t *testing.T) {
+	testcases := []struct {
+		input    string
+		expected string
+	}{
+		{
+			`[{"a":1,"b":{"c":"x,y"}},{"a":null,"d":[true,false]}]`,
+			"a,b.c,d.0,d.1\n1,\"x,y\",,\n,,true,false\n",
+		},
+		{
+			`{"a":"A","b":{}}`,
+			"a,b\nA,{}\n",
+		},
+		{
+			`[1,"2"]`,
+			"value\n1\n2\n",
+		},
+	}
+
+	for _, tt := range testcases {
+		t.Run(tt.input, func(t *testing.T) {
+			var buf bytes.Buffer
+			assert.Nil(t, ExportCSV(&buf, parseTestValue(t, tt.input)))
+			assert.Equal(t, tt.expected, buf.String())
+		})
+	}
+
+	var buf bytes.Buffer
+	assert.NotNil(t, ExportCSV(&buf, parseTestValue(t, `"a"`)))
+}
+
+func TestExportSQL(t *testing.T) {
+	var buf bytes.Buffer
+	v := parseTestValue(t, `[{"id":1,"name":"O'Neil","score":1.5},{"id":2,"score":2,"ok":true}]`)
+
+	assert.Nil(t, ExportSQL(&buf, v, "users"))
+	expected := `CREATE TABLE "users" (
+  "id" INTEGER,
+  "name" TEXT,
+  "score" REAL,
+  "ok" BOOLEAN
+);
+INSERT INTO "users" ("id", "name", "score", "ok") VALUES (1, 'O''Neil', 1.5, NULL);
+INSERT INTO "users" ("id", "name", "score", "ok") VALUES (2, NULL, 2, TRUE);
+`
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestExportGoStruct(t *testing.T) {
+	testcases := []struct {
+		input    string
+		expected string
+	}{
+		{
+			`{"user_id":1,"profile":{"home-url":"x","tags":["a"]},"items":[{"n":1},{"n":2.5,"opt":null}]}`,
+			"type Root struct {\n" +
+				"\tUserID  int64       `json:\"user_id\"`\n" +
+				"\tProfile Profile     `json:\"profile\"`\n" +
+				"\tItems   []ItemsItem `json:\"items\"`\n" +
+				"}\n" +
+				"\n" +
+				"type Profile struct {\n" +
+				"\tHomeURL string   `json:\"home-url\"`\n" +
+				"\tTags    []string `json:\"tags\"`\n" +
+				"}\n" +
+				"\n" +
+				"type ItemsItem struct {\n" +
+				"\tN   float64     `json:\"n\"`\n" +
+				"\tOpt interface{} `json:\"opt,omitempty\"`\n" +
+				"}\n",
+		},
+		{
+			`[1, null, 2]`,
+			"type Root []*int64\n",
+		},
+		{
+			`{"1":true,"a":"x","A":1}`,
+			"type Root struct {\n" +
+				"\tX1 bool   `json:\"1\"`\n" +
+				"\tA  string `json:\"a\"`\n" +
+				"\tA2 int64  `json:\"A\"`\n" +
+				"}\n",
+		},
+		{
+			"[{\"a`b\":1,\"c,d\":2},{\"c,d\":3}]",
+			"type Root []RootItem\n" +
+				"\n" +
+				"type RootItem struct {\n" +
+				"\tAB int64 `json:\",omitempty\"` // the key \"a`b\" cannot be written in a json tag\n" +
+				"\tCD int64 // the key \"c,d\" cannot be written in a json tag\n" +
+				"}\n",
+		},
+	}
+
+	for _, tt := range testcases {
+		t.Run(tt.input, func(t *testing.T) {
+			var buf bytes.Buffer
+			assert.Nil(t, ExportGoStruct(&buf, parseTestValue(t, tt.input), "Root"))
+			assert.Equal(t, tt.expected, buf.String())
+		})
+	}
+}
+
+func TestFindValue(t *testing.T) {
+	v := parseTestValue(t, `{"a":[1,{"b":true}]}`)
+
+	found, ok := FindValue(v, RootPath, "$.a[1].b")
+	assert.True(t, ok)
+	assert.Equal(t, "true", found.RawValue)
+
+	_, ok = FindValue(v, RootPath, "$.a[2]")
+	assert.False(t, ok)
+}
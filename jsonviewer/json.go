@@ -24,15 +24,37 @@ type JsonPair struct {
 	Value JsonValue
 }
 
+func (t ValueType) String() string {
+	switch t {
+	case False, True:
+		return "boolean"
+	case Null:
+		return "null"
+	case Object:
+		return "object"
+	case Array:
+		return "array"
+	case Number:
+		return "number"
+	case String:
+		return "string"
+	default:
+		return "invalid"
+	}
+}
+
 type JsonValue struct {
 	ValueType    ValueType
 	RawValue     string
+	Offset       int
 	ObjectMember []JsonPair
 	ArrayMember  []JsonValue
 }
 
 var NotMatched = fmt.Errorf("not match")
 
+const whitespace = "\x20\x09\x0a\x0d"
+
 type ParseFunc func(input string, pos int) (JsonValue, int, error)
 
 func and(fs ...ParseFunc) ParseFunc {
@@ -413,11 +435,18 @@ func parseObject(input string, pos int) (JsonValue, int, error) {
 }
 
 func parse(input string, pos int) (JsonValue, int, error) {
-	return or(
+	v, i, err := or(
 		parseLiteral,
 		parseNumber,
 		parseString,
 		parseArray,
 		parseObject,
 	)(input, pos)
+	if err != nil {
+		return v, i, err
+	}
+
+	// arrays and objects include the surrounding whitespace in RawValue
+	v.Offset = pos + len(v.RawValue) - len(strings.TrimLeft(v.RawValue, whitespace))
+	return v, i, nil
 }
@@ -221,11 +221,11 @@ func TestParseArray(t *testing.T) {
 	}{
 		{`[]`, 2, []JsonValue{}},
 		{`[1]`, 3, []JsonValue{
-			{ValueType: Number, RawValue: "1"},
+			{ValueType: Number, RawValue: "1", Offset: 1},
 		}},
 		{`[1,"2"]`, 7, []JsonValue{
-			{ValueType: Number, RawValue: "1"},
-			{ValueType: String, RawValue: `"2"`},
+			{ValueType: Number, RawValue: "1", Offset: 1},
+			{ValueType: String, RawValue: `"2"`, Offset: 3},
 		}},
 	}
 
@@ -251,7 +251,7 @@ func TestParseObject(t *testing.T) {
 			[]JsonPair{
 				{
 					Key:   JsonValue{ValueType: String, RawValue: `"a"`},
-					Value: JsonValue{ValueType: String, RawValue: `"b"`},
+					Value: JsonValue{ValueType: String, RawValue: `"b"`, Offset: 5},
 				},
 			},
 		},
@@ -259,11 +259,11 @@ func TestParseObject(t *testing.T) {
 			[]JsonPair{
 				{
 					Key:   JsonValue{ValueType: String, RawValue: `"a"`},
-					Value: JsonValue{ValueType: String, RawValue: `"b"`},
+					Value: JsonValue{ValueType: String, RawValue: `"b"`, Offset: 5},
 				},
 				{
 					Key:   JsonValue{ValueType: String, RawValue: `"c"`},
-					Value: JsonValue{ValueType: String, RawValue: `"d"`},
+					Value: JsonValue{ValueType: String, RawValue: `"d"`, Offset: 13},
 				},
 			},
 		},
@@ -278,3 +278,15 @@ func TestParseObject(t *testing.T) {
 		})
 	}
 }
+
+func TestParseOffset(t *testing.T) {
+	v, _, err := parse(`{ "a" : [ 1 , { "b" : null } ] }`, 0)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 0, v.Offset)
+	a := v.ObjectMember[0].Value
+	assert.Equal(t, 8, a.Offset)
+	assert.Equal(t, 10, a.ArrayMember[0].Offset)
+	assert.Equal(t, 14, a.ArrayMember[1].Offset)
+	assert.Equal(t, 22, a.ArrayMember[1].ObjectMember[0].Value.Offset)
+}
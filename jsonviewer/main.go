@@ -1,172 +1,192 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
 )
 
-func main() {
+const RootPath = "$"
 
-	input, err := io.ReadAll(os.Stdin)
-	if err != nil {
-		log.Fatal(err)
+var identifierPattern = regexp.MustCompile(`^"[A-Za-z_][A-Za-z0-9_]*"$`)
+
+type Exporter struct {
+	DefaultName string
+	Export      func(w io.Writer, v JsonValue, name string) error
+}
+
+var exporters = map[string]Exporter{
+	"csv": {
+		Export: func(w io.Writer, v JsonValue, name string) error {
+			return ExportCSV(w, v)
+		},
+	},
+	"sql": {
+		DefaultName: "data",
+		Export:      ExportSQL,
+	},
+	"gostruct": {
+		DefaultName: "Root",
+		Export:      ExportGoStruct,
+	},
+}
+
+func readInput(args []string) ([]byte, string, error) {
+	if len(args) == 0 {
+		input, err := io.ReadAll(os.Stdin)
+		return input, "", err
 	}
 
-	jsonValue, _, err := parse(string(input), 0)
+	path, err := filepath.Abs(args[0])
 	if err != nil {
-		log.Fatal(err)
+		return nil, "", err
 	}
+	input, err := os.ReadFile(path)
+	return input, path, err
+}
 
-	app := tview.NewApplication()
+func runExport(command string, args []string) error {
+	exporter := exporters[command]
 
-	inputField := tview.NewInputField()
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	path := flags.String("path", RootPath, "path of the value to export")
+	name := flags.String("name", exporter.DefaultName, "table or type name")
+	output := flags.String("o", "", "output file")
+	flags.Parse(args)
 
-	tree := tview.NewTreeView()
+	input, _, err := readInput(flags.Args())
+	if err != nil {
+		return err
+	}
 
-	flex := tview.NewFlex().SetDirection(tview.FlexRow)
-	flex.AddItem(tree, 0, 1, true)
-	flex.AddItem(inputField, 1, 1, false)
+	jsonValue, _, err := parse(string(input), 0)
+	if err != nil {
+		return err
+	}
 
-	app.SetRoot(flex, true).SetFocus(tree)
+	v, ok := FindValue(jsonValue, RootPath, *path)
+	if !ok {
+		return fmt.Errorf("%s not found", *path)
+	}
+
+	if *output == "" {
+		return exporter.Export(os.Stdout, v, *name)
+	}
+	return exportFile(*output, exporter, v, *name)
+}
 
-	root, err := CreateTreeNode(jsonValue)
+func exportFile(name string, exporter Exporter, v JsonValue, exportName string) error {
+	f, err := os.Create(name)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if err := exporter.Export(f, v, exportName); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// runCommand executes a command entered on the command line, such as
+// ":csv out.csv", against the selected node.
+func runCommand(command string, node *ViewNode) (string, error) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty command")
+	}
+
+	exporter, ok := exporters[fields[0]]
+	if !ok {
+		return "", fmt.Errorf("unknown command: %s", fields[0])
+	}
+	if len(fields) < 2 {
+		return "", fmt.Errorf("usage: :%s FILE [NAME]", fields[0])
+	}
+	name := exporter.DefaultName
+	if len(fields) > 2 {
+		name = fields[2]
 	}
-	tree.SetRoot(root)
-	AddChildren(root)
 
-	tree.SetCurrentNode(root)
+	if err := exportFile(fields[1], exporter, node.Value, name); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("exported %s to %s", node.Path, fields[1]), nil
+}
 
-	tree.SetSelectedFunc(func(node *tview.TreeNode) {
-		children := node.GetChildren()
-		if len(children) == 0 {
-			AddChildren(node)
-		} else {
-			node.SetExpanded(!node.IsExpanded())
-		}
-	})
-
-	tree.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
-		switch event.Key() {
-		case tcell.KeyLeft:
-		case tcell.KeyRight:
-			node := tree.GetCurrentNode()
-			if node != nil {
-				children := node.GetChildren()
-				if len(children) == 0 {
-					AddChildren(node)
-				}
+func main() {
+	if len(os.Args) > 1 {
+		if _, ok := exporters[os.Args[1]]; ok {
+			if err := runExport(os.Args[1], os.Args[2:]); err != nil {
+				log.Fatal(err)
 			}
-		case tcell.KeyTab:
-			app.SetFocus(inputField)
+			return
 		}
-		return event
-	})
+	}
 
-	inputField.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
-		switch event.Key() {
-		case tcell.KeyTab:
-			app.SetFocus(tree)
-		}
-		return event
-	})
+	flag.Parse()
 
-	if err := app.Run(); err != nil {
+	input, path, err := readInput(flag.Args())
+	if err != nil {
 		log.Fatal(err)
 	}
-}
 
-func CreateTreeNode(jsonValue JsonValue) (*tview.TreeNode, error) {
-	var child *tview.TreeNode
+	jsonValue, _, err := parse(string(input), 0)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	switch jsonValue.ValueType {
-	case Array:
-		child = tview.NewTreeNode("[...]")
-	case Object:
-		child = tview.NewTreeNode("{...}")
-	default:
-		child = tview.NewTreeNode(jsonValue.RawValue)
+	stateDir, err := StateDir()
+	if err != nil {
+		log.Fatal(err)
+	}
+	state, restored, err := LoadState(stateDir, path, ContentHash(input))
+	if err != nil {
+		log.Fatal(err)
 	}
+	state.Path = path
 
-	child.SetReference(jsonValue)
-	return child, nil
-}
+	app := tview.NewApplication()
+	ui := NewUI(app, jsonValue, &state)
+	if restored {
+		ui.Restore()
+	}
 
-func AddChildren(parentNode *tview.TreeNode) error {
+	if err := app.Run(); err != nil {
+		log.Fatal(err)
+	}
 
-	parentObj := parentNode.GetReference().(JsonValue)
+	ui.Save()
+	// the session itself worked, so a state which cannot be saved is not fatal
+	if err := SaveState(stateDir, state); err != nil {
+		log.Printf("warning: cannot save the state: %v", err)
+	}
+}
 
-	switch parentObj.ValueType {
-	case Array:
-		for _, a := range parentObj.ArrayMember {
-			child, err := CreateTreeNode(a)
-			if err != nil {
-				return err
-			}
-			parentNode.AddChild(child)
-		}
-	case Object:
-		maxLen := 0
-		for _, pair := range parentObj.ObjectMember {
-			if maxLen < len(pair.Key.RawValue) {
-				maxLen = len(pair.Key.RawValue)
-			}
-		}
+func ObjectMemberPath(parentPath string, key JsonValue) string {
+	if identifierPattern.MatchString(key.RawValue) {
+		return parentPath + "." + key.RawValue[1:len(key.RawValue)-1]
+	}
+	return parentPath + "[" + key.RawValue + "]"
+}
 
-		for _, pair := range parentObj.ObjectMember {
-			var child *tview.TreeNode
-
-			switch pair.Value.ValueType {
-			case Array:
-				var s string
-				if len(pair.Value.ArrayMember) == 0 {
-					s = "[ ]"
-				} else {
-					s = "[...]"
-				}
-				child = tview.NewTreeNode(
-					fmt.Sprintf(
-						"%s%s : %s",
-						pair.Key.RawValue,
-						strings.Repeat(" ", maxLen-len(pair.Key.RawValue)),
-						s,
-					),
-				)
-			case Object:
-				var s string
-				if len(pair.Value.ObjectMember) == 0 {
-					s = "{ }"
-				} else {
-					s = "{...}"
-				}
-				child = tview.NewTreeNode(
-					fmt.Sprintf(
-						"%s%s : %s",
-						pair.Key.RawValue,
-						strings.Repeat(" ", maxLen-len(pair.Key.RawValue)),
-						s,
-					),
-				)
-			default:
-				child = tview.NewTreeNode(
-					fmt.Sprintf(
-						"%s%s : %s",
-						pair.Key.RawValue,
-						strings.Repeat(" ", maxLen-len(pair.Key.RawValue)),
-						pair.Value.RawValue,
-					),
-				)
-			}
+func ArrayMemberPath(parentPath string, index int) string {
+	return fmt.Sprintf("%s[%d]", parentPath, index)
+}
 
-			child.SetReference(pair.Value)
-			parentNode.AddChild(child)
-		}
+// isDescendantPath reports whether path points at the node itself or one of
+// its descendants.
+func isDescendantPath(nodePath string, path string) bool {
+	if !strings.HasPrefix(path, nodePath) {
+		return false
+	}
+	if len(path) == len(nodePath) {
+		return true
 	}
-	return nil
+	return path[len(nodePath)] == '.' || path[len(nodePath)] == '['
 }
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestObjectMemberPath(t *testing.T) {
+	testcases := []struct {
+		key      string
+		expected string
+	}{
+		{`"a"`, `$.a`},
+		{`"_a1"`, `$._a1`},
+		{`"1a"`, `$["1a"]`},
+		{`"a.b"`, `$["a.b"]`},
+		{`"A"`, `$.A`},
+		{`"\u0041"`, `$["\u0041"]`},
+	}
+
+	for _, tt := range testcases {
+		t.Run(tt.key, func(t *testing.T) {
+			assert.Equal(t, tt.expected, ObjectMemberPath(RootPath, JsonValue{ValueType: String, RawValue: tt.key}))
+		})
+	}
+}
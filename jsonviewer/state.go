@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const maxQueryHistory = 100
+
+// maxStatesPerPath bounds the states kept for the contents a path has had,
+// and for the inputs read from standard input.
+const maxStatesPerPath = 10
+
+type State struct {
+	Path      string   `json:"path"`
+	Hash      string   `json:"hash"`
+	Expanded  []string `json:"expanded"`
+	Selected  string   `json:"selected"`
+	Bookmarks []string `json:"bookmarks"`
+	Queries   []string `json:"queries"`
+}
+
+func StateDir() (string, error) {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "jsonviewer"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "state", "jsonviewer"), nil
+}
+
+func ContentHash(input []byte) string {
+	sum := sha256.Sum256(input)
+	return hex.EncodeToString(sum[:])
+}
+
+func stateFileDir(dir string, path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return filepath.Join(dir, hex.EncodeToString(sum[:16]))
+}
+
+// LoadState returns the state saved for the given file path and content hash.
+// When the file has been modified since, the most recently saved state for the
+// same path is used instead. The second return value reports whether any state
+// was found.
+func LoadState(dir string, path string, hash string) (State, bool, error) {
+	fileDir := stateFileDir(dir, path)
+
+	state, err := readState(filepath.Join(fileDir, hash+".json"))
+	if err == nil {
+		return state, true, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return State{}, false, err
+	}
+
+	// standard input has no identity other than its content
+	if path == "" {
+		return State{Path: path, Hash: hash}, false, nil
+	}
+
+	entries, err := os.ReadDir(fileDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return State{Path: path, Hash: hash}, false, nil
+	} else if err != nil {
+		return State{}, false, err
+	}
+
+	var latest fs.FileInfo
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if latest == nil || latest.ModTime().Before(info.ModTime()) {
+			latest = info
+		}
+	}
+	if latest == nil {
+		return State{Path: path, Hash: hash}, false, nil
+	}
+
+	state, err = readState(filepath.Join(fileDir, latest.Name()))
+	if err != nil {
+		return State{}, false, err
+	}
+	state.Hash = hash
+	return state, true, nil
+}
+
+func readState(name string) (State, error) {
+	var state State
+
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return State{}, err
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		return State{}, err
+	}
+	return state, nil
+}
+
+func SaveState(dir string, state State) error {
+	fileDir := stateFileDir(dir, state.Path)
+	if err := os.MkdirAll(fileDir, 0o700); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(fileDir, state.Hash+".json"), b, 0o600); err != nil {
+		return err
+	}
+	return pruneStates(fileDir)
+}
+
+// pruneStates removes all but the most recently saved states.
+func pruneStates(fileDir string) error {
+	entries, err := os.ReadDir(fileDir)
+	if err != nil {
+		return err
+	}
+	if len(entries) <= maxStatesPerPath {
+		return nil
+	}
+
+	infos := make([]fs.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().After(infos[j].ModTime())
+	})
+	for i := maxStatesPerPath; i < len(infos); i++ {
+		if err := os.Remove(filepath.Join(fileDir, infos[i].Name())); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *State) AddQuery(query string) {
+	for i, q := range s.Queries {
+		if q == query {
+			s.Queries = append(s.Queries[:i], s.Queries[i+1:]...)
+			break
+		}
+	}
+	s.Queries = append(s.Queries, query)
+	if len(s.Queries) > maxQueryHistory {
+		s.Queries = s.Queries[len(s.Queries)-maxQueryHistory:]
+	}
+}
+
+func (s *State) ToggleBookmark(path string) bool {
+	for i, b := range s.Bookmarks {
+		if b == path {
+			s.Bookmarks = append(s.Bookmarks[:i], s.Bookmarks[i+1:]...)
+			return false
+		}
+	}
+	s.Bookmarks = append(s.Bookmarks, path)
+	return true
+}
+
+func (s *State) IsBookmarked(path string) bool {
+	for _, b := range s.Bookmarks {
+		if b == path {
+			return true
+		}
+	}
+	return false
+}
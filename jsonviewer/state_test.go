@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSaveLoadState(t *testing.T) {
+	dir := t.TempDir()
+
+	state := State{
+		Path:      "/tmp/a.json",
+		Hash:      "hash1",
+		Expanded:  []string{"$", "$.a"},
+		Selected:  "$.a[0]",
+		Bookmarks: []string{"$.b"},
+		Queries:   []string{"$.a"},
+	}
+	assert.Nil(t, SaveState(dir, state))
+
+	loaded, ok, err := LoadState(dir, "/tmp/a.json", "hash1")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, state, loaded)
+
+	// modified content falls back to the latest state of the same path
+	loaded, ok, err = LoadState(dir, "/tmp/a.json", "hash2")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "hash2", loaded.Hash)
+	assert.Equal(t, state.Expanded, loaded.Expanded)
+
+	_, ok, err = LoadState(dir, "/tmp/b.json", "hash1")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	_, ok, err = LoadState(dir, "", "hash1")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
+
+func TestLoadStateLatest(t *testing.T) {
+	dir := t.TempDir()
+
+	assert.Nil(t, SaveState(dir, State{Path: "/tmp/a.json", Hash: "old", Selected: "$.old"}))
+	assert.Nil(t, SaveState(dir, State{Path: "/tmp/a.json", Hash: "new", Selected: "$.new"}))
+
+	past := time.Now().Add(-time.Hour)
+	assert.Nil(t, os.Chtimes(filepath.Join(stateFileDir(dir, "/tmp/a.json"), "old.json"), past, past))
+
+	loaded, ok, err := LoadState(dir, "/tmp/a.json", "other")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "$.new", loaded.Selected)
+}
+
+func TestSaveStatePrune(t *testing.T) {
+	dir := t.TempDir()
+	fileDir := stateFileDir(dir, "/tmp/a.json")
+
+	for i := 0; i < maxStatesPerPath+5; i++ {
+		hash := fmt.Sprintf("hash%d", i)
+		assert.Nil(t, SaveState(dir, State{Path: "/tmp/a.json", Hash: hash}))
+		past := time.Now().Add(time.Duration(i-100) * time.Minute)
+		assert.Nil(t, os.Chtimes(filepath.Join(fileDir, hash+".json"), past, past))
+	}
+
+	entries, err := os.ReadDir(fileDir)
+	assert.Nil(t, err)
+	assert.Equal(t, maxStatesPerPath, len(entries))
+	_, err = os.Stat(filepath.Join(fileDir, "hash4.json"))
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+	_, err = os.Stat(filepath.Join(fileDir, "hash5.json"))
+	assert.Nil(t, err)
+}
+
+func TestStateQueries(t *testing.T) {
+	var state State
+
+	state.AddQuery("$.a")
+	state.AddQuery("$.b")
+	state.AddQuery("$.a")
+	assert.Equal(t, []string{"$.b", "$.a"}, state.Queries)
+
+	for i := 0; i < maxQueryHistory+10; i++ {
+		state.AddQuery(ArrayMemberPath("$", i))
+	}
+	assert.Equal(t, maxQueryHistory, len(state.Queries))
+	assert.Equal(t, ArrayMemberPath("$", maxQueryHistory+9), state.Queries[maxQueryHistory-1])
+}
+
+func TestStateBookmarks(t *testing.T) {
+	var state State
+
+	assert.True(t, state.ToggleBookmark("$.a"))
+	assert.True(t, state.IsBookmarked("$.a"))
+	assert.False(t, state.ToggleBookmark("$.a"))
+	assert.False(t, state.IsBookmarked("$.a"))
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+	"strings"
+)
+
+// TreeWidget draws the lines of a ViewModel and translates key and mouse
+// events into view model operations.
+type TreeWidget struct {
+	*tview.Box
+	model     *ViewModel
+	offset    int
+	height    int
+	highlight func(node *ViewNode) bool
+}
+
+func NewTreeWidget(model *ViewModel) *TreeWidget {
+	return &TreeWidget{
+		Box:   tview.NewBox(),
+		model: model,
+	}
+}
+
+// SetHighlightFunc sets a function which decides whether a node is drawn in
+// the highlight color, e.g. because it is bookmarked.
+func (w *TreeWidget) SetHighlightFunc(highlight func(node *ViewNode) bool) *TreeWidget {
+	w.highlight = highlight
+	return w
+}
+
+func nodePrefix(node *ViewNode) string {
+	indent := strings.Repeat("  ", node.Depth)
+	switch {
+	case !node.HasMembers():
+		return indent + "  "
+	case node.IsLoaded() && node.Expanded:
+		return indent + "- "
+	default:
+		return indent + "+ "
+	}
+}
+
+func (w *TreeWidget) Draw(screen tcell.Screen) {
+	w.Box.DrawForSubclass(screen, w)
+	x, y, width, height := w.GetInnerRect()
+	w.height = height
+
+	lines := w.model.Lines()
+	selected := w.model.SelectedIndex(lines)
+
+	// keep the selected line on screen
+	if selected >= 0 {
+		if selected < w.offset {
+			w.offset = selected
+		} else if selected >= w.offset+height {
+			w.offset = selected - height + 1
+		}
+	}
+	if w.offset > len(lines)-height {
+		w.offset = len(lines) - height
+	}
+	if w.offset < 0 {
+		w.offset = 0
+	}
+
+	for row := 0; row < height && w.offset+row < len(lines); row++ {
+		node := lines[w.offset+row]
+
+		color := tview.Styles.PrimaryTextColor
+		if w.highlight != nil && w.highlight(node) {
+			color = tcell.ColorYellow
+		}
+
+		text := tview.Escape(nodePrefix(node) + node.Text)
+		tview.Print(screen, text, x, y+row, width, tview.AlignLeft, color)
+
+		if w.offset+row == selected {
+			for col := x; col < x+width; col++ {
+				mainc, combc, style, _ := screen.GetContent(col, y+row)
+				screen.SetContent(col, y+row, mainc, combc, style.Reverse(true))
+			}
+		}
+	}
+}
+
+func (w *TreeWidget) InputHandler() func(event *tcell.EventKey, setFocus func(p tview.Primitive)) {
+	return w.WrapInputHandler(func(event *tcell.EventKey, setFocus func(p tview.Primitive)) {
+		switch event.Key() {
+		case tcell.KeyDown:
+			w.model.Move(1)
+		case tcell.KeyUp:
+			w.model.Move(-1)
+		case tcell.KeyRight:
+			w.model.Right()
+		case tcell.KeyLeft:
+			w.model.Left()
+		case tcell.KeyHome:
+			w.model.SelectFirst()
+		case tcell.KeyEnd:
+			w.model.SelectLast()
+		case tcell.KeyPgDn, tcell.KeyCtrlF:
+			w.model.Move(w.height)
+		case tcell.KeyPgUp, tcell.KeyCtrlB:
+			w.model.Move(-w.height)
+		case tcell.KeyEnter:
+			w.model.Toggle(w.model.Selected())
+		case tcell.KeyRune:
+			switch event.Rune() {
+			case 'j':
+				w.model.Move(1)
+			case 'k':
+				w.model.Move(-1)
+			case 'l':
+				w.model.Right()
+			case 'h':
+				w.model.Left()
+			case 'g':
+				w.model.SelectFirst()
+			case 'G':
+				w.model.SelectLast()
+			case ' ':
+				w.model.Toggle(w.model.Selected())
+			}
+		}
+	})
+}
+
+func (w *TreeWidget) MouseHandler() func(action tview.MouseAction, event *tcell.EventMouse, setFocus func(p tview.Primitive)) (bool, tview.Primitive) {
+	return w.WrapMouseHandler(func(action tview.MouseAction, event *tcell.EventMouse, setFocus func(p tview.Primitive)) (bool, tview.Primitive) {
+		x, y := event.Position()
+		if !w.InRect(x, y) {
+			return false, nil
+		}
+
+		switch action {
+		case tview.MouseLeftDown:
+			setFocus(w)
+			return true, nil
+		case tview.MouseLeftClick:
+			_, rectY, _, _ := w.GetInnerRect()
+			lines := w.model.Lines()
+			if i := w.offset + y - rectY; 0 <= i && i < len(lines) {
+				w.model.Select(lines[i])
+				w.model.Toggle(lines[i])
+			}
+			return true, nil
+		case tview.MouseScrollUp:
+			w.scroll(-1)
+			return true, nil
+		case tview.MouseScrollDown:
+			w.scroll(1)
+			return true, nil
+		}
+		return false, nil
+	})
+}
+
+// scroll moves the view without leaving the selection off screen.
+func (w *TreeWidget) scroll(delta int) {
+	lines := w.model.Lines()
+	w.offset += delta
+	if w.offset > len(lines)-w.height {
+		w.offset = len(lines) - w.height
+	}
+	if w.offset < 0 {
+		w.offset = 0
+	}
+
+	selected := w.model.SelectedIndex(lines)
+	if selected < w.offset {
+		w.model.Move(w.offset - selected)
+	} else if selected >= w.offset+w.height {
+		w.model.Move(w.offset + w.height - 1 - selected)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+	"strings"
+)
+
+const (
+	splitProportion       = 10
+	defaultTreeProportion = 6
+)
+
+// UI wires the view model and the state to the tview primitives of the
+// viewer: the tree, the detail pane and the query/command line.
+type UI struct {
+	App         *tview.Application
+	Model       *ViewModel
+	Tree        *TreeWidget
+	Detail      *tview.TextView
+	CommandLine *tview.InputField
+
+	state          *State
+	split          *tview.Flex
+	treeProportion int
+	history        int
+	detailNode     *ViewNode
+	dragging       bool
+}
+
+func NewUI(app *tview.Application, jsonValue JsonValue, state *State) *UI {
+	ui := &UI{
+		App:            app,
+		Model:          NewViewModel(jsonValue),
+		Detail:         tview.NewTextView(),
+		CommandLine:    tview.NewInputField(),
+		state:          state,
+		treeProportion: defaultTreeProportion,
+		history:        len(state.Queries),
+	}
+
+	ui.Tree = NewTreeWidget(ui.Model)
+	ui.Tree.SetHighlightFunc(func(node *ViewNode) bool {
+		return state.IsBookmarked(node.Path)
+	})
+
+	ui.Detail.SetBorder(true)
+	ui.Detail.SetWrap(true)
+
+	ui.split = tview.NewFlex().SetDirection(tview.FlexColumn)
+	ui.split.AddItem(ui.Tree, 0, ui.treeProportion, true)
+	ui.split.AddItem(ui.Detail, 0, splitProportion-ui.treeProportion, false)
+
+	flex := tview.NewFlex().SetDirection(tview.FlexRow)
+	flex.AddItem(ui.split, 0, 1, true)
+	flex.AddItem(ui.CommandLine, 1, 1, false)
+
+	app.SetRoot(flex, true).SetFocus(ui.Tree)
+	app.EnableMouse(true)
+
+	app.SetMouseCapture(ui.captureMouse)
+	app.SetBeforeDrawFunc(func(screen tcell.Screen) bool {
+		ui.updateDetail()
+		return false
+	})
+	ui.Tree.SetInputCapture(ui.captureTreeKey)
+	ui.Detail.SetInputCapture(ui.captureDetailKey)
+	ui.CommandLine.SetInputCapture(ui.captureCommandLineKey)
+	ui.CommandLine.SetDoneFunc(ui.execute)
+
+	return ui
+}
+
+// Restore applies the expanded nodes and the selection of the saved state.
+func (ui *UI) Restore() {
+	ui.Model.RestoreExpanded(ui.state.Expanded)
+	ui.Model.Select(ui.Model.Reveal(ui.state.Selected))
+}
+
+// Save records the expanded nodes and the selection into the state.
+func (ui *UI) Save() {
+	ui.state.Expanded = ui.Model.ExpandedPaths()
+	ui.state.Selected = ui.Model.Selected().Path
+}
+
+func (ui *UI) updateDetail() {
+	if node := ui.Model.Selected(); node != ui.detailNode {
+		ui.detailNode = node
+		ui.Detail.SetText(FormatDetail(node))
+		ui.Detail.ScrollToBeginning()
+	}
+}
+
+func (ui *UI) resize(delta int) {
+	ui.treeProportion += delta
+	if ui.treeProportion < 1 {
+		ui.treeProportion = 1
+	} else if ui.treeProportion > splitProportion-1 {
+		ui.treeProportion = splitProportion - 1
+	}
+	ui.split.ResizeItem(ui.Tree, 0, ui.treeProportion)
+	ui.split.ResizeItem(ui.Detail, 0, splitProportion-ui.treeProportion)
+}
+
+// captureMouse lets the left border of the detail pane be dragged to resize
+// the panes.
+func (ui *UI) captureMouse(event *tcell.EventMouse, action tview.MouseAction) (*tcell.EventMouse, tview.MouseAction) {
+	x, y := event.Position()
+	detailX, detailY, _, detailHeight := ui.Detail.GetRect()
+	splitX, _, splitWidth, _ := ui.split.GetRect()
+
+	switch action {
+	case tview.MouseLeftDown:
+		if x == detailX && detailY <= y && y < detailY+detailHeight {
+			ui.dragging = true
+			return nil, action
+		}
+	case tview.MouseMove:
+		if ui.dragging && splitWidth > 0 {
+			ui.resize((x-splitX)*splitProportion/splitWidth - ui.treeProportion)
+			return nil, action
+		}
+	case tview.MouseLeftUp:
+		if ui.dragging {
+			ui.dragging = false
+			return nil, action
+		}
+	}
+	return event, action
+}
+
+func (ui *UI) captureTreeKey(event *tcell.EventKey) *tcell.EventKey {
+	switch event.Key() {
+	case tcell.KeyTab:
+		ui.App.SetFocus(ui.Detail)
+		return nil
+	case tcell.KeyRune:
+		switch event.Rune() {
+		case 'b':
+			ui.state.ToggleBookmark(ui.Model.Selected().Path)
+			return nil
+		case 'n':
+			ui.Model.Select(ui.Model.NextBookmark(ui.state.Bookmarks))
+			return nil
+		case '/':
+			ui.CommandLine.SetText("/")
+			ui.App.SetFocus(ui.CommandLine)
+			return nil
+		case ':':
+			ui.CommandLine.SetText(":")
+			ui.App.SetFocus(ui.CommandLine)
+			return nil
+		case '<':
+			ui.resize(-1)
+			return nil
+		case '>':
+			ui.resize(1)
+			return nil
+		}
+	}
+	return event
+}
+
+func (ui *UI) captureDetailKey(event *tcell.EventKey) *tcell.EventKey {
+	switch event.Key() {
+	case tcell.KeyTab:
+		ui.App.SetFocus(ui.CommandLine)
+		return nil
+	case tcell.KeyRune:
+		switch event.Rune() {
+		case '<':
+			ui.resize(-1)
+			return nil
+		case '>':
+			ui.resize(1)
+			return nil
+		}
+	}
+	return event
+}
+
+func (ui *UI) captureCommandLineKey(event *tcell.EventKey) *tcell.EventKey {
+	queries := ui.state.Queries
+
+	switch event.Key() {
+	case tcell.KeyTab:
+		ui.App.SetFocus(ui.Tree)
+		return nil
+	case tcell.KeyUp:
+		if ui.history > 0 {
+			ui.history--
+			ui.CommandLine.SetText(queries[ui.history])
+		}
+		return nil
+	case tcell.KeyDown:
+		if ui.history < len(queries)-1 {
+			ui.history++
+			ui.CommandLine.SetText(queries[ui.history])
+		} else {
+			ui.history = len(queries)
+			ui.CommandLine.SetText("")
+		}
+		return nil
+	}
+	return event
+}
+
+// execute runs the text of the command line: ":" starts an export command,
+// "/" filters the tree and anything else is a path to jump to.
+func (ui *UI) execute(key tcell.Key) {
+	if key != tcell.KeyEnter {
+		return
+	}
+	query := strings.TrimSpace(ui.CommandLine.GetText())
+	if query == "" {
+		return
+	}
+	ui.state.AddQuery(query)
+	ui.history = len(ui.state.Queries)
+
+	switch {
+	case strings.HasPrefix(query, ":"):
+		message, err := runCommand(query[1:], ui.Model.Selected())
+		if err != nil {
+			message = err.Error()
+		}
+		ui.CommandLine.SetText("")
+		ui.CommandLine.SetPlaceholder(message)
+	case strings.HasPrefix(query, "/"):
+		ui.Model.SetFilter(query[1:])
+		ui.CommandLine.SetText("")
+		ui.App.SetFocus(ui.Tree)
+	default:
+		if ui.Model.Filter() != "" {
+			ui.Model.SetFilter("")
+		}
+		if node := ui.Model.Reveal(query); node != nil {
+			ui.Model.Select(node)
+			ui.CommandLine.SetText("")
+			ui.App.SetFocus(ui.Tree)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+type uiHarness struct {
+	t      *testing.T
+	screen tcell.SimulationScreen
+	ui     *UI
+	drawn  chan struct{}
+}
+
+func newUIHarness(t *testing.T, input string, state *State) *uiHarness {
+	t.Helper()
+
+	screen := tcell.NewSimulationScreen("UTF-8")
+	assert.Nil(t, screen.Init())
+	screen.SetSize(60, 12)
+
+	app := tview.NewApplication().SetScreen(screen)
+	h := &uiHarness{
+		t:      t,
+		screen: screen,
+		ui:     NewUI(app, parseTestValue(t, input), state),
+		drawn:  make(chan struct{}, 16),
+	}
+	app.SetAfterDrawFunc(func(screen tcell.Screen) {
+		select {
+		case h.drawn <- struct{}{}:
+		default:
+		}
+	})
+
+	done := make(chan error)
+	go func() {
+		done <- app.Run()
+	}()
+	t.Cleanup(func() {
+		app.Stop()
+		assert.Nil(t, <-done)
+	})
+
+	h.wait()
+	return h
+}
+
+// wait blocks until the application has drawn the screen.
+func (h *uiHarness) wait() {
+	h.t.Helper()
+	select {
+	case <-h.drawn:
+	case <-time.After(5 * time.Second):
+		h.t.Fatal("timed out waiting for the screen to be drawn")
+	}
+}
+
+func (h *uiHarness) key(key tcell.Key) {
+	h.t.Helper()
+	h.screen.InjectKey(key, 0, tcell.ModNone)
+	h.wait()
+}
+
+func (h *uiHarness) rune(r rune) {
+	h.t.Helper()
+	h.screen.InjectKey(tcell.KeyRune, r, tcell.ModNone)
+	h.wait()
+}
+
+func (h *uiHarness) text(s string) {
+	h.t.Helper()
+	for _, r := range s {
+		h.rune(r)
+	}
+}
+
+func (h *uiHarness) click(x, y int) {
+	h.t.Helper()
+	h.screen.InjectMouse(x, y, tcell.Button1, tcell.ModNone)
+	h.wait()
+	h.screen.InjectMouse(x, y, tcell.ButtonNone, tcell.ModNone)
+	h.wait()
+}
+
+// lines returns the rendered screen as text, one string per row.
+func (h *uiHarness) lines() []string {
+	var lines []string
+	h.ui.App.QueueUpdate(func() {
+		cells, width, height := h.screen.GetContents()
+		for y := 0; y < height; y++ {
+			var sb strings.Builder
+			for x := 0; x < width; x++ {
+				sb.WriteString(string(cells[y*width+x].Runes))
+			}
+			lines = append(lines, strings.TrimRight(sb.String(), " "))
+		}
+	})
+	return lines
+}
+
+// treeLines returns the rendered rows of the tree pane.
+func (h *uiHarness) treeLines() []string {
+	var lines []string
+	x, _, width, height := h.ui.Tree.GetInnerRect()
+	for _, line := range h.lines()[:height] {
+		runes := []rune(line + strings.Repeat(" ", x+width))
+		row := strings.TrimRight(string(runes[x:x+width]), " ")
+		if row != "" {
+			lines = append(lines, row)
+		}
+	}
+	return lines
+}
+
+const uiTestInput = `{"a":[1,{"b":true}],"c":"hello"}`
+
+func TestUINavigation(t *testing.T) {
+	h := newUIHarness(t, uiTestInput, &State{})
+
+	assert.Equal(t, []string{
+		`- {...}`,
+		`  + "a" : [...]`,
+		`    "c" : "hello"`,
+	}, h.treeLines())
+
+	h.key(tcell.KeyDown)
+	assert.Equal(t, "$.a", h.ui.Model.Selected().Path)
+
+	h.key(tcell.KeyEnter)
+	assert.Equal(t, []string{
+		`- {...}`,
+		`  - "a" : [...]`,
+		`      1`,
+		`    + {...}`,
+		`    "c" : "hello"`,
+	}, h.treeLines())
+
+	h.rune('j')
+	h.rune('j')
+	h.key(tcell.KeyRight)
+	assert.Equal(t, []string{
+		`- {...}`,
+		`  - "a" : [...]`,
+		`      1`,
+		`    - {...}`,
+		`        "b" : true`,
+		`    "c" : "hello"`,
+	}, h.treeLines())
+
+	h.key(tcell.KeyLeft)
+	h.key(tcell.KeyLeft)
+	assert.Equal(t, "$.a", h.ui.Model.Selected().Path)
+
+	h.key(tcell.KeyEnter)
+	assert.Equal(t, []string{
+		`- {...}`,
+		`  + "a" : [...]`,
+		`    "c" : "hello"`,
+	}, h.treeLines())
+}
+
+func TestUIDetail(t *testing.T) {
+	h := newUIHarness(t, uiTestInput, &State{})
+
+	h.rune('G')
+	screen := strings.Join(h.lines(), "\n")
+	assert.Contains(t, screen, "type   : string")
+	assert.Contains(t, screen, "path   : $.c")
+	assert.Contains(t, screen, "offset : 24")
+}
+
+func TestUIQuery(t *testing.T) {
+	state := &State{}
+	h := newUIHarness(t, uiTestInput, state)
+
+	h.key(tcell.KeyTab)
+	h.key(tcell.KeyTab)
+	h.text("$.a[1].b")
+	h.key(tcell.KeyEnter)
+
+	assert.Equal(t, "$.a[1].b", h.ui.Model.Selected().Path)
+	assert.Equal(t, []string{"$.a[1].b"}, state.Queries)
+	assert.Equal(t, []string{
+		`- {...}`,
+		`  - "a" : [...]`,
+		`      1`,
+		`    - {...}`,
+		`        "b" : true`,
+		`    "c" : "hello"`,
+	}, h.treeLines())
+
+	h.rune('/')
+	h.text("hel")
+	h.key(tcell.KeyEnter)
+	assert.Equal(t, []string{
+		`- {...}`,
+		`    "c" : "hello"`,
+	}, h.treeLines())
+}
+
+func TestUIBookmark(t *testing.T) {
+	state := &State{}
+	h := newUIHarness(t, uiTestInput, state)
+
+	h.rune('G')
+	h.rune('b')
+	assert.Equal(t, []string{"$.c"}, state.Bookmarks)
+
+	h.rune('g')
+	h.rune('n')
+	assert.Equal(t, "$.c", h.ui.Model.Selected().Path)
+}
+
+func TestUIMouse(t *testing.T) {
+	h := newUIHarness(t, uiTestInput, &State{})
+
+	x, y, _, _ := h.ui.Tree.GetInnerRect()
+	h.click(x+4, y+1)
+
+	assert.Equal(t, "$.a", h.ui.Model.Selected().Path)
+	assert.Equal(t, []string{
+		`- {...}`,
+		`  - "a" : [...]`,
+		`      1`,
+		`    + {...}`,
+		`    "c" : "hello"`,
+	}, h.treeLines())
+}
+
+func TestUIRestore(t *testing.T) {
+	state := &State{
+		Expanded: []string{"$", "$.a", "$.gone"},
+		Selected: "$.a[1]",
+	}
+	h := newUIHarness(t, uiTestInput, state)
+	h.ui.App.QueueUpdateDraw(h.ui.Restore)
+	h.wait()
+
+	assert.Equal(t, "$.a[1]", h.ui.Model.Selected().Path)
+	assert.Equal(t, []string{
+		`- {...}`,
+		`  - "a" : [...]`,
+		`      1`,
+		`    + {...}`,
+		`    "c" : "hello"`,
+	}, h.treeLines())
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ViewNode is a node of the tree shown by the viewer. Children are created
+// lazily the first time the node is loaded.
+type ViewNode struct {
+	Path     string
+	Text     string
+	Value    JsonValue
+	Parent   *ViewNode
+	Depth    int
+	Expanded bool
+	loaded   bool
+	children []*ViewNode
+}
+
+func (n *ViewNode) Children() []*ViewNode {
+	return n.children
+}
+
+func (n *ViewNode) IsLoaded() bool {
+	return n.loaded
+}
+
+// HasMembers reports whether the node is a non-empty array or object.
+func (n *ViewNode) HasMembers() bool {
+	switch n.Value.ValueType {
+	case Array:
+		return len(n.Value.ArrayMember) > 0
+	case Object:
+		return len(n.Value.ObjectMember) > 0
+	}
+	return false
+}
+
+// ViewModel holds the expansion state, the selection and the filter of the
+// tree independently of how it is rendered.
+type ViewModel struct {
+	root     *ViewNode
+	selected *ViewNode
+	filter   string
+	visible  map[*ViewNode]bool
+}
+
+func NewViewModel(jsonValue JsonValue) *ViewModel {
+	root := &ViewNode{
+		Path:     RootPath,
+		Text:     valueText(jsonValue),
+		Value:    jsonValue,
+		Expanded: true,
+	}
+	root.load()
+
+	return &ViewModel{
+		root:     root,
+		selected: root,
+	}
+}
+
+func (m *ViewModel) Root() *ViewNode {
+	return m.root
+}
+
+func (m *ViewModel) Selected() *ViewNode {
+	return m.selected
+}
+
+func (m *ViewModel) Select(node *ViewNode) {
+	if node != nil {
+		m.selected = node
+	}
+}
+
+func valueText(v JsonValue) string {
+	switch v.ValueType {
+	case Array:
+		return "[...]"
+	case Object:
+		return "{...}"
+	default:
+		return v.RawValue
+	}
+}
+
+func memberText(v JsonValue) string {
+	switch v.ValueType {
+	case Array:
+		if len(v.ArrayMember) == 0 {
+			return "[ ]"
+		}
+		return "[...]"
+	case Object:
+		if len(v.ObjectMember) == 0 {
+			return "{ }"
+		}
+		return "{...}"
+	default:
+		return v.RawValue
+	}
+}
+
+func (n *ViewNode) load() {
+	if n.loaded {
+		return
+	}
+	n.loaded = true
+
+	switch n.Value.ValueType {
+	case Array:
+		for i, a := range n.Value.ArrayMember {
+			n.children = append(n.children, &ViewNode{
+				Path:     ArrayMemberPath(n.Path, i),
+				Text:     valueText(a),
+				Value:    a,
+				Parent:   n,
+				Depth:    n.Depth + 1,
+				Expanded: true,
+			})
+		}
+	case Object:
+		maxLen := 0
+		for _, pair := range n.Value.ObjectMember {
+			if maxLen < len(pair.Key.RawValue) {
+				maxLen = len(pair.Key.RawValue)
+			}
+		}
+
+		for _, pair := range n.Value.ObjectMember {
+			n.children = append(n.children, &ViewNode{
+				Path: ObjectMemberPath(n.Path, pair.Key),
+				Text: fmt.Sprintf(
+					"%s%s : %s",
+					pair.Key.RawValue,
+					strings.Repeat(" ", maxLen-len(pair.Key.RawValue)),
+					memberText(pair.Value),
+				),
+				Value:    pair.Value,
+				Parent:   n,
+				Depth:    n.Depth + 1,
+				Expanded: true,
+			})
+		}
+	}
+}
+
+// Toggle loads and expands a node seen for the first time, and otherwise
+// flips its expansion.
+func (m *ViewModel) Toggle(node *ViewNode) {
+	if !node.loaded {
+		node.load()
+		node.Expanded = true
+		return
+	}
+	node.Expanded = !node.Expanded
+}
+
+func (m *ViewModel) Expand(node *ViewNode) {
+	node.load()
+	node.Expanded = true
+}
+
+func (m *ViewModel) Collapse(node *ViewNode) {
+	node.Expanded = false
+}
+
+// Lines returns the nodes in display order. While a filter is set, only the
+// matching nodes and their ancestors are listed.
+func (m *ViewModel) Lines() []*ViewNode {
+	var lines []*ViewNode
+
+	var walk func(node *ViewNode)
+	walk = func(node *ViewNode) {
+		lines = append(lines, node)
+		if m.visible == nil && !node.Expanded {
+			return
+		}
+		for _, child := range node.children {
+			if m.visible == nil || m.visible[child] {
+				walk(child)
+			}
+		}
+	}
+	if m.visible == nil || m.visible[m.root] {
+		walk(m.root)
+	}
+	return lines
+}
+
+func (m *ViewModel) SelectedIndex(lines []*ViewNode) int {
+	for i, line := range lines {
+		if line == m.selected {
+			return i
+		}
+	}
+	return -1
+}
+
+// Move moves the selection by delta lines, stopping at the first and the last
+// line.
+func (m *ViewModel) Move(delta int) {
+	lines := m.Lines()
+	if len(lines) == 0 {
+		return
+	}
+
+	i := m.SelectedIndex(lines) + delta
+	if i < 0 {
+		i = 0
+	} else if i >= len(lines) {
+		i = len(lines) - 1
+	}
+	m.selected = lines[i]
+}
+
+func (m *ViewModel) SelectFirst() {
+	if lines := m.Lines(); len(lines) > 0 {
+		m.selected = lines[0]
+	}
+}
+
+func (m *ViewModel) SelectLast() {
+	if lines := m.Lines(); len(lines) > 0 {
+		m.selected = lines[len(lines)-1]
+	}
+}
+
+// Right expands the selected node, or moves to its first child when it is
+// already expanded.
+func (m *ViewModel) Right() {
+	node := m.selected
+	if m.visible == nil && (!node.loaded || !node.Expanded) {
+		m.Expand(node)
+		return
+	}
+	for _, child := range node.children {
+		if m.visible == nil || m.visible[child] {
+			m.selected = child
+			return
+		}
+	}
+}
+
+// Left collapses the selected node, or moves to its parent when it is already
+// collapsed.
+func (m *ViewModel) Left() {
+	node := m.selected
+	if m.visible == nil && node.Expanded && len(node.children) > 0 {
+		m.Collapse(node)
+		return
+	}
+	if node.Parent != nil {
+		m.selected = node.Parent
+	}
+}
+
+// Find returns the node at the given path, loading the nodes on the way.
+// Nodes loaded here are left collapsed.
+func (m *ViewModel) Find(path string) *ViewNode {
+	node := m.root
+	for {
+		if node.Path == path {
+			return node
+		}
+		if !isDescendantPath(node.Path, path) {
+			return nil
+		}
+
+		if !node.loaded {
+			node.load()
+			node.Expanded = false
+		}
+
+		var next *ViewNode
+		for _, child := range node.children {
+			if isDescendantPath(child.Path, path) {
+				next = child
+				break
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		node = next
+	}
+}
+
+// Reveal returns the node at the given path and expands all its ancestors.
+func (m *ViewModel) Reveal(path string) *ViewNode {
+	node := m.Find(path)
+	if node == nil {
+		return nil
+	}
+
+	for parent := node.Parent; parent != nil; parent = parent.Parent {
+		parent.Expanded = true
+	}
+	return node
+}
+
+func (m *ViewModel) walk(node *ViewNode, f func(node *ViewNode)) {
+	f(node)
+	for _, child := range node.children {
+		m.walk(child, f)
+	}
+}
+
+// RestoreExpanded expands the nodes at the given paths and collapses every
+// other loaded node. Paths which do not exist in the document are ignored.
+func (m *ViewModel) RestoreExpanded(paths []string) {
+	m.walk(m.root, func(node *ViewNode) {
+		node.Expanded = false
+	})
+
+	for _, path := range paths {
+		if node := m.Find(path); node != nil {
+			m.Expand(node)
+		}
+	}
+}
+
+func (m *ViewModel) ExpandedPaths() []string {
+	var paths []string
+	m.walk(m.root, func(node *ViewNode) {
+		if node.Expanded && len(node.children) > 0 {
+			paths = append(paths, node.Path)
+		}
+	})
+	return paths
+}
+
+// NextBookmark returns the bookmarked node following the selected one,
+// wrapping around to the first bookmark.
+func (m *ViewModel) NextBookmark(bookmarks []string) *ViewNode {
+	start := 0
+	for i, b := range bookmarks {
+		if b == m.selected.Path {
+			start = i + 1
+			break
+		}
+	}
+
+	for i := 0; i < len(bookmarks); i++ {
+		if node := m.Reveal(bookmarks[(start+i)%len(bookmarks)]); node != nil {
+			return node
+		}
+	}
+	return nil
+}
+
+func (m *ViewModel) Filter() string {
+	return m.filter
+}
+
+// SetFilter limits the lines to the nodes whose key or value contains the
+// text, ignoring case. An empty text clears the filter.
+func (m *ViewModel) SetFilter(text string) {
+	m.filter = text
+	if text == "" {
+		m.visible = nil
+		m.Reveal(m.selected.Path)
+		return
+	}
+
+	text = strings.ToLower(text)
+	m.visible = map[*ViewNode]bool{}
+
+	var search func(v JsonValue, key string, path string)
+	search = func(v JsonValue, key string, path string) {
+		if strings.Contains(strings.ToLower(key), text) ||
+			(v.ValueType != Array && v.ValueType != Object && strings.Contains(strings.ToLower(v.RawValue), text)) {
+			for node := m.Find(path); node != nil; node = node.Parent {
+				m.visible[node] = true
+			}
+		}
+
+		switch v.ValueType {
+		case Array:
+			for i, member := range v.ArrayMember {
+				search(member, "", ArrayMemberPath(path, i))
+			}
+		case Object:
+			for _, pair := range v.ObjectMember {
+				search(pair.Value, pair.Key.RawValue, ObjectMemberPath(path, pair.Key))
+			}
+		}
+	}
+	search(m.root.Value, "", m.root.Path)
+
+	if !m.visible[m.selected] {
+		m.SelectFirst()
+	}
+}
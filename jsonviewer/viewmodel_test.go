@@ -0,0 +1,140 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func newTestViewModel(t *testing.T, input string) *ViewModel {
+	t.Helper()
+	return NewViewModel(parseTestValue(t, input))
+}
+
+func linePaths(m *ViewModel) []string {
+	var paths []string
+	for _, line := range m.Lines() {
+		paths = append(paths, line.Path)
+	}
+	return paths
+}
+
+func TestViewModelLazyLoad(t *testing.T) {
+	m := newTestViewModel(t, `{"a":[1,{"b":true}],"c":2}`)
+
+	assert.Equal(t, []string{"$", "$.a", "$.c"}, linePaths(m))
+	assert.Equal(t, `"a" : [...]`, m.Lines()[1].Text)
+	assert.Equal(t, `"c" : 2`, m.Lines()[2].Text)
+
+	a := m.Find("$.a")
+	assert.False(t, a.IsLoaded())
+
+	m.Toggle(a)
+	assert.True(t, a.IsLoaded())
+	assert.Equal(t, []string{"$", "$.a", "$.a[0]", "$.a[1]", "$.c"}, linePaths(m))
+
+	m.Toggle(a)
+	assert.Equal(t, []string{"$", "$.a", "$.c"}, linePaths(m))
+}
+
+func TestViewModelNavigation(t *testing.T) {
+	m := newTestViewModel(t, `{"a":[1,2],"c":2}`)
+
+	m.Move(1)
+	assert.Equal(t, "$.a", m.Selected().Path)
+
+	m.Right()
+	assert.Equal(t, "$.a", m.Selected().Path)
+	assert.True(t, m.Selected().IsLoaded())
+
+	m.Right()
+	assert.Equal(t, "$.a[0]", m.Selected().Path)
+
+	m.Left()
+	assert.Equal(t, "$.a", m.Selected().Path)
+
+	m.Left()
+	assert.Equal(t, []string{"$", "$.a", "$.c"}, linePaths(m))
+
+	m.SelectLast()
+	assert.Equal(t, "$.c", m.Selected().Path)
+
+	m.Move(10)
+	assert.Equal(t, "$.c", m.Selected().Path)
+
+	m.Move(-10)
+	assert.Equal(t, "$", m.Selected().Path)
+}
+
+func TestViewModelFind(t *testing.T) {
+	m := newTestViewModel(t, `{"a":[1,{"b":true}],"ab":null,"a.b":2}`)
+
+	testcases := []struct {
+		path  string
+		found bool
+		value string
+	}{
+		{`$`, true, `{"a":[1,{"b":true}],"ab":null,"a.b":2}`},
+		{`$.a[1].b`, true, `true`},
+		{`$.ab`, true, `null`},
+		{`$["a.b"]`, true, `2`},
+		{`$.a[2]`, false, ``},
+		{`$.c`, false, ``},
+	}
+
+	for _, tt := range testcases {
+		t.Run(tt.path, func(t *testing.T) {
+			node := m.Find(tt.path)
+			if !tt.found {
+				assert.Nil(t, node)
+				return
+			}
+			assert.NotNil(t, node)
+			assert.Equal(t, tt.value, node.Value.RawValue)
+		})
+	}
+}
+
+func TestViewModelRestoreExpanded(t *testing.T) {
+	m := newTestViewModel(t, `{"a":[1,{"b":true}],"c":{"d":[]}}`)
+
+	m.RestoreExpanded([]string{"$", "$.a[1]", "$.x"})
+	assert.Equal(t, []string{"$", "$.a[1]"}, m.ExpandedPaths())
+	assert.Equal(t, []string{"$", "$.a", "$.c"}, linePaths(m))
+
+	node := m.Reveal("$.a[1].b")
+	assert.NotNil(t, node)
+	assert.Equal(t, []string{"$", "$.a", "$.a[1]"}, m.ExpandedPaths())
+}
+
+func TestViewModelNextBookmark(t *testing.T) {
+	m := newTestViewModel(t, `{"a":1,"b":2,"c":3}`)
+	bookmarks := []string{"$.c", "$.x", "$.a"}
+
+	m.Select(m.NextBookmark(bookmarks))
+	assert.Equal(t, "$.c", m.Selected().Path)
+
+	m.Select(m.NextBookmark(bookmarks))
+	assert.Equal(t, "$.a", m.Selected().Path)
+
+	m.Select(m.NextBookmark(bookmarks))
+	assert.Equal(t, "$.c", m.Selected().Path)
+}
+
+func TestViewModelFilter(t *testing.T) {
+	m := newTestViewModel(t, `{"user":{"name":"Alice","age":3},"items":[{"name":"x"},{"id":1}]}`)
+
+	m.SetFilter("NAME")
+	assert.Equal(t, []string{"$", "$.user", "$.user.name", "$.items", "$.items[0]", "$.items[0].name"}, linePaths(m))
+
+	m.SetFilter("alice")
+	assert.Equal(t, []string{"$", "$.user", "$.user.name"}, linePaths(m))
+	assert.Equal(t, "$", m.Selected().Path)
+
+	m.Select(m.Find("$.user.name"))
+	m.SetFilter("")
+	assert.Equal(t, []string{"$", "$.user", "$.user.name", "$.user.age", "$.items"}, linePaths(m))
+	assert.Equal(t, "$.user.name", m.Selected().Path)
+
+	m.SetFilter("nothing")
+	assert.Empty(t, m.Lines())
+}
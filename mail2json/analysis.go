@@ -0,0 +1,439 @@
+package main
+
+import (
+	"net"
+	"net/textproto"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Analysis is the delivery path of a message and the authentication results
+// the receiving servers recorded.
+type Analysis struct {
+	Hops                  []Hop         `json:"hops"`
+	AuthenticationResults []AuthResults `json:"authenticationResults,omitempty"`
+	ARC                   []ARCSet      `json:"arc,omitempty"`
+}
+
+// Hop is a Received header. Hops are ordered from the originating server to
+// the final one, and Delay is the number of seconds since the previous hop.
+type Hop struct {
+	From       string `json:"from,omitempty"`
+	FromHost   string `json:"fromHost,omitempty"`
+	FromIP     string `json:"fromIp,omitempty"`
+	By         string `json:"by,omitempty"`
+	With       string `json:"with,omitempty"`
+	ID         string `json:"id,omitempty"`
+	For        string `json:"for,omitempty"`
+	TLS        bool   `json:"tls,omitempty"`
+	TLSVersion string `json:"tlsVersion,omitempty"`
+	TLSCipher  string `json:"tlsCipher,omitempty"`
+	Date       string `json:"date,omitempty"`
+	Delay      *int64 `json:"delay,omitempty"`
+	Raw        string `json:"raw"`
+}
+
+// AuthResults is an Authentication-Results header as defined in RFC 8601.
+// SPF, DKIM and DMARC are the verdicts of the methods; the verdict of DKIM is
+// pass when any of the signatures passed.
+type AuthResults struct {
+	AuthServID string       `json:"authservId"`
+	SPF        string       `json:"spf,omitempty"`
+	DKIM       string       `json:"dkim,omitempty"`
+	DMARC      string       `json:"dmarc,omitempty"`
+	Results    []AuthResult `json:"results,omitempty"`
+}
+
+type AuthResult struct {
+	Method     string            `json:"method"`
+	Result     string            `json:"result"`
+	Reason     string            `json:"reason,omitempty"`
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+// ARCSet is an ARC set of RFC 8617: the ARC-Authentication-Results,
+// ARC-Message-Signature and ARC-Seal headers of an instance. Domain, Selector
+// and Algorithm are those of the seal.
+type ARCSet struct {
+	Instance         int           `json:"instance"`
+	ChainValidation  string        `json:"chainValidation,omitempty"`
+	Domain           string        `json:"domain,omitempty"`
+	Selector         string        `json:"selector,omitempty"`
+	Algorithm        string        `json:"algorithm,omitempty"`
+	MessageSignature *ARCSignature `json:"messageSignature,omitempty"`
+	AuthResults      *AuthResults  `json:"authResults,omitempty"`
+}
+
+// ARCSignature is an ARC-Message-Signature header, which may be made with
+// another key than the seal.
+type ARCSignature struct {
+	Domain    string `json:"domain,omitempty"`
+	Selector  string `json:"selector,omitempty"`
+	Algorithm string `json:"algorithm,omitempty"`
+}
+
+// Analyze parses the Received, Authentication-Results and ARC headers.
+func Analyze(header textproto.MIMEHeader) *Analysis {
+	analysis := &Analysis{Hops: ParseReceivedChain(header.Values("Received"))}
+	for _, value := range header.Values("Authentication-Results") {
+		if results, ok := ParseAuthenticationResults(value); ok {
+			analysis.AuthenticationResults = append(analysis.AuthenticationResults, results)
+		}
+	}
+	analysis.ARC = parseARCSets(header)
+	return analysis
+}
+
+// ParseReceivedChain parses the Received headers in header order, which is
+// the reverse of the delivery order, into the hops in delivery order.
+func ParseReceivedChain(values []string) []Hop {
+	hops := []Hop{}
+	var last time.Time
+	for i := len(values) - 1; i >= 0; i-- {
+		hop, t := ParseReceived(values[i])
+		if !t.IsZero() {
+			if !last.IsZero() {
+				delay := int64(t.Sub(last) / time.Second)
+				hop.Delay = &delay
+			}
+			last = t
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
+
+var receivedClauses = map[string]bool{"from": true, "by": true, "via": true, "with": true, "id": true, "for": true}
+
+var (
+	ipLiteralPattern = regexp.MustCompile(`\[(?:IPv6:)?([0-9A-Fa-f:.]+)\]`)
+	tlsPatterns      = []*regexp.Regexp{
+		// Gmail, Sendmail and Microsoft
+		regexp.MustCompile(`version=(TLS[\w.]+),?\s+cipher=([\w-]+)`),
+		// Postfix
+		regexp.MustCompile(`using (TLSv?[\d.]+) with cipher ([\w-]+)`),
+		// Exim
+		regexp.MustCompile(`\((TLS[\d.]+)\)\s+tls\s+([\w-]+)`),
+	}
+)
+
+// ParseReceived parses a Received header of RFC 5321 section 4.4. It returns
+// the time of the hop, or the zero time if the date cannot be parsed.
+func ParseReceived(value string) (Hop, time.Time) {
+	hop := Hop{Raw: value}
+
+	var t time.Time
+	clauses := value
+	if i := strings.LastIndex(value, ";"); i >= 0 {
+		clauses = value[:i]
+		if parsed, err := ParseDate(strings.TrimSpace(value[i+1:])); err == nil {
+			t = parsed
+			hop.Date = t.Format(time.RFC3339)
+		}
+	}
+
+	values := map[string]string{}
+	comments := map[string][]string{}
+	clause := ""
+	for _, token := range receivedTokens(clauses) {
+		if strings.HasPrefix(token, "(") {
+			comments[clause] = append(comments[clause], strings.TrimSuffix(token[1:], ")"))
+			continue
+		}
+		name := strings.ToLower(token)
+		if receivedClauses[name] && (clause == "" || values[clause] != "") {
+			clause = name
+			continue
+		}
+		if values[clause] == "" {
+			values[clause] = token
+		}
+	}
+
+	hop.From = values["from"]
+	if m := ipLiteralPattern.FindStringSubmatch(hop.From); m != nil {
+		hop.FromIP = m[1]
+	}
+	// the host and the address are reported in the first comment, which may
+	// be followed by comments about TLS and the like
+	for i, comment := range comments["from"] {
+		for _, word := range strings.Fields(comment) {
+			switch {
+			case ipLiteralPattern.MatchString(word):
+				if hop.FromIP == "" {
+					hop.FromIP = ipLiteralPattern.FindStringSubmatch(word)[1]
+				}
+			case net.ParseIP(strings.Trim(word, "[]")) != nil:
+				if hop.FromIP == "" {
+					hop.FromIP = strings.Trim(word, "[]")
+				}
+			case strings.Contains(word, "=") || strings.EqualFold(word, "helo") || strings.EqualFold(word, "ehlo") || strings.EqualFold(word, "unknown"):
+			default:
+				if i == 0 && hop.FromHost == "" && strings.Contains(word, ".") {
+					hop.FromHost = word
+				}
+			}
+		}
+	}
+	hop.By = values["by"]
+	hop.With = values["with"]
+	hop.ID = values["id"]
+	hop.For = strings.Trim(values["for"], "<>")
+
+	for _, pattern := range tlsPatterns {
+		if m := pattern.FindStringSubmatch(value); m != nil {
+			hop.TLS, hop.TLSVersion, hop.TLSCipher = true, m[1], m[2]
+			break
+		}
+	}
+	// RFC 3848: ESMTPS, ESMTPSA, LMTPS and so on are received over TLS
+	with := strings.ToUpper(hop.With)
+	if strings.Contains(with, "MTP") && (strings.HasSuffix(with, "S") || strings.HasSuffix(with, "SA")) {
+		hop.TLS = true
+	}
+	return hop, t
+}
+
+// receivedTokens splits the clauses of a Received header into words and
+// comments, which keep their parentheses and may be nested.
+func receivedTokens(s string) []string {
+	var tokens []string
+	for i := 0; i < len(s); {
+		switch {
+		case s[i] == ' ' || s[i] == '\t' || s[i] == '\r' || s[i] == '\n':
+			i++
+		case s[i] == '(':
+			depth, j := 0, i
+			for ; j < len(s); j++ {
+				if s[j] == '(' {
+					depth++
+				} else if s[j] == ')' {
+					if depth--; depth == 0 {
+						break
+					}
+				}
+			}
+			if j == len(s) {
+				j--
+			}
+			tokens = append(tokens, s[i:j+1])
+			i = j + 1
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" \t\r\n(", rune(s[j])) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	return tokens
+}
+
+// removeComments removes the comments of a structured header value, leaving
+// quoted strings alone.
+func removeComments(s string) string {
+	var sb strings.Builder
+	depth := 0
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && (quoted || depth > 0):
+			if depth == 0 {
+				sb.WriteString(s[i : i+2])
+			}
+			i++
+			continue
+		case c == '"' && depth == 0:
+			quoted = !quoted
+		case c == '(' && !quoted:
+			depth++
+			continue
+		case c == ')' && !quoted && depth > 0:
+			depth--
+			if depth == 0 {
+				sb.WriteByte(' ')
+			}
+			continue
+		}
+		if depth == 0 {
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// splitUnquoted splits s at the separators outside of quoted strings.
+func splitUnquoted(s string, sep byte) []string {
+	var values []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				values = append(values, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(values, s[start:])
+}
+
+// ParseAuthenticationResults parses an Authentication-Results header such as
+// "mx.example.com; spf=pass smtp.mailfrom=example.com; dkim=pass header.d=example.com".
+// It reports false when the header has no authserv-id.
+func ParseAuthenticationResults(value string) (AuthResults, bool) {
+	segments := splitUnquoted(removeComments(value), ';')
+	fields := strings.Fields(segments[0])
+	if len(fields) == 0 {
+		return AuthResults{}, false
+	}
+
+	results := AuthResults{AuthServID: fields[0]}
+	for _, segment := range segments[1:] {
+		fields := quotedFields(segment)
+		if len(fields) == 0 || strings.EqualFold(fields[0], "none") {
+			continue
+		}
+		method, result, ok := strings.Cut(fields[0], "=")
+		if !ok {
+			continue
+		}
+		method, _, _ = strings.Cut(method, "/")
+		r := AuthResult{Method: strings.ToLower(method), Result: strings.ToLower(result)}
+
+		for _, field := range fields[1:] {
+			name, value, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+			value = unquote(value)
+			if strings.EqualFold(name, "reason") {
+				r.Reason = value
+				continue
+			}
+			if r.Properties == nil {
+				r.Properties = map[string]string{}
+			}
+			r.Properties[strings.ToLower(name)] = value
+		}
+		results.Results = append(results.Results, r)
+	}
+
+	results.SPF = verdict(results.Results, "spf")
+	results.DKIM = verdict(results.Results, "dkim")
+	results.DMARC = verdict(results.Results, "dmarc")
+	return results, true
+}
+
+// quotedFields splits s at the white space outside of quoted strings.
+func quotedFields(s string) []string {
+	var fields []string
+	for _, field := range splitUnquoted(strings.NewReplacer("\t", " ", "\r", " ", "\n", " ").Replace(s), ' ') {
+		if field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && strings.HasPrefix(s, `"`) && strings.HasSuffix(s, `"`) {
+		if v, err := strconv.Unquote(s); err == nil {
+			return v
+		}
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// verdict returns pass if any result of the method passed, and the first
+// result otherwise.
+func verdict(results []AuthResult, method string) string {
+	v := ""
+	for _, r := range results {
+		if r.Method != method {
+			continue
+		}
+		if r.Result == "pass" {
+			return r.Result
+		}
+		if v == "" {
+			v = r.Result
+		}
+	}
+	return v
+}
+
+// parseARCSets groups the ARC headers by their instance.
+func parseARCSets(header textproto.MIMEHeader) []ARCSet {
+	sets := map[int]*ARCSet{}
+	set := func(i int) *ARCSet {
+		if sets[i] == nil {
+			sets[i] = &ARCSet{Instance: i}
+		}
+		return sets[i]
+	}
+
+	for _, value := range header.Values("Arc-Authentication-Results") {
+		// "i=1; authserv-id; results"
+		instance, rest, _ := strings.Cut(value, ";")
+		i, err := arcInstance(instance)
+		if err != nil {
+			continue
+		}
+		if results, ok := ParseAuthenticationResults(rest); ok {
+			set(i).AuthResults = &results
+		}
+	}
+	for _, value := range header.Values("Arc-Seal") {
+		tags, err := ParseTagList(value)
+		if err != nil {
+			continue
+		}
+		i, err := arcInstance("i=" + tags["i"])
+		if err != nil {
+			continue
+		}
+		s := set(i)
+		s.ChainValidation = strings.ToLower(tags["cv"])
+		s.Domain = tags["d"]
+		s.Selector = tags["s"]
+		s.Algorithm = tags["a"]
+	}
+	for _, value := range header.Values("Arc-Message-Signature") {
+		tags, err := ParseTagList(value)
+		if err != nil {
+			continue
+		}
+		i, err := arcInstance("i=" + tags["i"])
+		if err != nil {
+			continue
+		}
+		set(i).MessageSignature = &ARCSignature{Domain: tags["d"], Selector: tags["s"], Algorithm: tags["a"]}
+	}
+
+	var result []ARCSet
+	for _, s := range sets {
+		result = append(result, *s)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Instance < result[j].Instance })
+	return result
+}
+
+func arcInstance(s string) (int, error) {
+	name, value, _ := strings.Cut(strings.TrimSpace(s), "=")
+	if strings.TrimSpace(name) != "i" {
+		return 0, strconv.ErrSyntax
+	}
+	return strconv.Atoi(strings.TrimSpace(value))
+}
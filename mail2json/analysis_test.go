@@ -0,0 +1,216 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseReceived(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected Hop
+	}{
+		{
+			"from mail-sor-f41.google.com (mail-sor-f41.google.com. [209.85.220.41])\r\n" +
+				"        by mx.google.com with SMTPS id a2sor123.2024.01.02.03.04.05\r\n" +
+				"        for <bob@example.com>\r\n" +
+				"        (Google Transport Security);\r\n" +
+				"        Tue, 02 Jan 2024 03:04:05 -0800 (PST)",
+			Hop{
+				From:     "mail-sor-f41.google.com",
+				FromHost: "mail-sor-f41.google.com.",
+				FromIP:   "209.85.220.41",
+				By:       "mx.google.com",
+				With:     "SMTPS",
+				ID:       "a2sor123.2024.01.02.03.04.05",
+				For:      "bob@example.com",
+				TLS:      true,
+				Date:     "2024-01-02T03:04:05-08:00",
+			},
+		},
+		{
+			"from mail.example.org (unknown [IPv6:2001:db8::1])\r\n" +
+				"\t(using TLSv1.3 with cipher TLS_AES_256_GCM_SHA384 (256/256 bits))\r\n" +
+				"\t(No client certificate requested)\r\n" +
+				"\tby mx.example.com (Postfix) with ESMTPS id 4T3xyz;\r\n" +
+				"\tTue,  2 Jan 2024 12:04:10 +0100 (CET)",
+			Hop{
+				From:       "mail.example.org",
+				FromIP:     "2001:db8::1",
+				By:         "mx.example.com",
+				With:       "ESMTPS",
+				ID:         "4T3xyz",
+				TLS:        true,
+				TLSVersion: "TLSv1.3",
+				TLSCipher:  "TLS_AES_256_GCM_SHA384",
+				Date:       "2024-01-02T12:04:10+01:00",
+			},
+		},
+		{
+			"from [192.0.2.1] (helo=client.example.net)\r\n" +
+				"\tby smtp.example.com with esmtpsa  (TLS1.2) tls TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256\r\n" +
+				"\t(Exim 4.96)\r\n" +
+				"\t(envelope-from <alice@example.net>)\r\n" +
+				"\tid 1rKl0b-000abc-2F; Tue, 02 Jan 2024 11:04:00 +0000",
+			Hop{
+				From:       "[192.0.2.1]",
+				FromIP:     "192.0.2.1",
+				By:         "smtp.example.com",
+				With:       "esmtpsa",
+				ID:         "1rKl0b-000abc-2F",
+				TLS:        true,
+				TLSVersion: "TLS1.2",
+				TLSCipher:  "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+				Date:       "2024-01-02T11:04:00Z",
+			},
+		},
+		{
+			"by 2002:a05:6358:1234 with SMTP id x1csp; Tue, 2 Jan 2024 03:04:06 -0800",
+			Hop{
+				By:   "2002:a05:6358:1234",
+				With: "SMTP",
+				ID:   "x1csp",
+				Date: "2024-01-02T03:04:06-08:00",
+			},
+		},
+		{
+			"from localhost (HELO queue) (127.0.0.1) by localhost with SMTP; broken date",
+			Hop{
+				From:   "localhost",
+				FromIP: "127.0.0.1",
+				By:     "localhost",
+				With:   "SMTP",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		hop, _ := ParseReceived(tt.input)
+		tt.expected.Raw = tt.input
+		assert.Equal(t, tt.expected, hop, tt.input)
+	}
+}
+
+func TestParseReceivedChain(t *testing.T) {
+	hops := ParseReceivedChain([]string{
+		"by mx.example.com with LMTP; Tue, 2 Jan 2024 12:05:00 +0100",
+		"from relay.example.net by mx.example.com with ESMTP; Tue, 2 Jan 2024 11:04:10 +0000",
+		"from client by relay.example.net with ESMTPSA; Tue, 2 Jan 2024 11:04:00 +0000",
+	})
+
+	if assert.Len(t, hops, 3) {
+		assert.Equal(t, "relay.example.net", hops[0].By)
+		assert.Nil(t, hops[0].Delay)
+		assert.Equal(t, int64(10), *hops[1].Delay)
+		assert.Equal(t, int64(50), *hops[2].Delay)
+	}
+}
+
+func TestParseAuthenticationResults(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected AuthResults
+		ok       bool
+	}{
+		{
+			"mx.google.com;\r\n" +
+				"       dkim=pass header.i=@example.com header.s=s1 header.b=AbCd;\r\n" +
+				"       dkim=fail (body hash did not verify) header.i=@other.example header.s=s2;\r\n" +
+				"       spf=softfail (google.com: domain of transitioning alice@example.com does not designate 192.0.2.1 as permitted sender) smtp.mailfrom=alice@example.com;\r\n" +
+				"       dmarc=pass (p=REJECT sp=REJECT dis=NONE) header.from=example.com",
+			AuthResults{
+				AuthServID: "mx.google.com",
+				SPF:        "softfail",
+				DKIM:       "pass",
+				DMARC:      "pass",
+				Results: []AuthResult{
+					{Method: "dkim", Result: "pass", Properties: map[string]string{"header.i": "@example.com", "header.s": "s1", "header.b": "AbCd"}},
+					{Method: "dkim", Result: "fail", Properties: map[string]string{"header.i": "@other.example", "header.s": "s2"}},
+					{Method: "spf", Result: "softfail", Properties: map[string]string{"smtp.mailfrom": "alice@example.com"}},
+					{Method: "dmarc", Result: "pass", Properties: map[string]string{"header.from": "example.com"}},
+				},
+			},
+			true,
+		},
+		{
+			"example.org 1; auth=pass (cram-md5) smtp.auth=sender@example.net; spf=fail reason=\"not; permitted\" smtp.mailfrom=example.net",
+			AuthResults{
+				AuthServID: "example.org",
+				SPF:        "fail",
+				Results: []AuthResult{
+					{Method: "auth", Result: "pass", Properties: map[string]string{"smtp.auth": "sender@example.net"}},
+					{Method: "spf", Result: "fail", Reason: "not; permitted", Properties: map[string]string{"smtp.mailfrom": "example.net"}},
+				},
+			},
+			true,
+		},
+		{"example.com; none", AuthResults{AuthServID: "example.com"}, true},
+		{" (comment only) ", AuthResults{}, false},
+	}
+
+	for _, tt := range tests {
+		results, ok := ParseAuthenticationResults(tt.input)
+		assert.Equal(t, tt.ok, ok, tt.input)
+		assert.Equal(t, tt.expected, results, tt.input)
+	}
+}
+
+func TestReadMailAnalysis(t *testing.T) {
+	input := "ARC-Seal: i=2; a=rsa-sha256; t=1704193450; cv=pass; d=relay.example; s=arc; b=AAAA\r\n" +
+		"ARC-Authentication-Results: i=2; relay.example; dkim=pass header.d=example.com; spf=pass smtp.mailfrom=example.com\r\n" +
+		"ARC-Message-Signature: i=2; a=rsa-sha256; c=relaxed/relaxed; d=relay.example; s=ams; h=from:subject; bh=CCCC; b=DDDD\r\n" +
+		"ARC-Seal: i=1; a=rsa-sha256; t=1704193440; cv=none; d=example.com; s=arc; b=BBBB\r\n" +
+		"ARC-Authentication-Results: i=1; mx.example.com; spf=pass smtp.mailfrom=example.com\r\n" +
+		"Authentication-Results: mx.example.net; dmarc=pass header.from=example.com; arc=pass\r\n" +
+		"Received: from relay.example by mx.example.net with ESMTPS; Tue, 2 Jan 2024 11:04:10 +0000\r\n" +
+		"Received: from client by relay.example with ESMTPSA; Tue, 2 Jan 2024 11:04:00 +0000\r\n" +
+		"Subject: test\r\n" +
+		"\r\n" +
+		"body\r\n"
+
+	part := readTestMail(t, input, Option{analyze: true})
+	if assert.NotNil(t, part.Analysis) {
+		assert.Len(t, part.Analysis.Hops, 2)
+		assert.Equal(t, "relay.example", part.Analysis.Hops[0].By)
+		assert.Equal(t, int64(10), *part.Analysis.Hops[1].Delay)
+		assert.Equal(t, "pass", part.Analysis.AuthenticationResults[0].DMARC)
+		assert.Equal(t, []ARCSet{
+			{
+				Instance:        1,
+				ChainValidation: "none",
+				Domain:          "example.com",
+				Selector:        "arc",
+				Algorithm:       "rsa-sha256",
+				AuthResults: &AuthResults{
+					AuthServID: "mx.example.com",
+					SPF:        "pass",
+					Results:    []AuthResult{{Method: "spf", Result: "pass", Properties: map[string]string{"smtp.mailfrom": "example.com"}}},
+				},
+			},
+			{
+				Instance:        2,
+				ChainValidation: "pass",
+				Domain:          "relay.example",
+				Selector:        "arc",
+				Algorithm:       "rsa-sha256",
+				MessageSignature: &ARCSignature{
+					Domain:    "relay.example",
+					Selector:  "ams",
+					Algorithm: "rsa-sha256",
+				},
+				AuthResults: &AuthResults{
+					AuthServID: "relay.example",
+					SPF:        "pass",
+					DKIM:       "pass",
+					Results: []AuthResult{
+						{Method: "dkim", Result: "pass", Properties: map[string]string{"header.d": "example.com"}},
+						{Method: "spf", Result: "pass", Properties: map[string]string{"smtp.mailfrom": "example.com"}},
+					},
+				},
+			},
+		}, part.Analysis.ARC)
+	}
+
+	part = readTestMail(t, input, Option{})
+	assert.Nil(t, part.Analysis)
+}
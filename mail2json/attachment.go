@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// how the body of an attachment is written to the JSON
+const (
+	AttachmentBodyRaw    = "raw"
+	AttachmentBodyBase64 = "base64"
+	AttachmentBodyOmit   = "omit"
+)
+
+const maxFilenameLength = 200
+
+type Attachment struct {
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"contentType"`
+	Size        int    `json:"size"`
+	SHA256      string `json:"sha256"`
+	MD5         string `json:"md5"`
+	Path        string `json:"path,omitempty"`
+	// set to hash or drop when the content was removed by Redact
+	Redacted string `json:"redacted,omitempty"`
+}
+
+// IsAttachment reports whether a part is reported as an attachment: every part
+// which is not text, and text parts with an attachment disposition.
+func IsAttachment(mediaType string, header textproto.MIMEHeader) bool {
+	if !strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+	disposition, _, err := ParseParams(header.Get("Content-Disposition"))
+	return err == nil && strings.EqualFold(disposition, "attachment")
+}
+
+// AttachmentFilename returns the filename from the Content-Disposition header,
+// falling back to the name parameter of the Content-Type header.
+func AttachmentFilename(header textproto.MIMEHeader) string {
+	for _, h := range []struct {
+		name  string
+		param string
+	}{
+		{"Content-Disposition", "filename"},
+		{"Content-Type", "name"},
+	} {
+		_, params, err := ParseParams(header.Get(h.name))
+		if err != nil {
+			continue
+		}
+		for _, p := range params {
+			if p.Name == h.param && p.Value != "" {
+				return p.Value
+			}
+		}
+	}
+	return ""
+}
+
+func NewAttachment(b []byte, mediaType string, filename string) *Attachment {
+	sha256sum := sha256.Sum256(b)
+	md5sum := md5.Sum(b)
+
+	return &Attachment{
+		Filename:    filename,
+		ContentType: mediaType,
+		Size:        len(b),
+		SHA256:      hex.EncodeToString(sha256sum[:]),
+		MD5:         hex.EncodeToString(md5sum[:]),
+	}
+}
+
+// SanitizeFilename turns a filename taken from a message into a name which is
+// safe to create in the extraction directory: directory components, control
+// characters and characters reserved on common file systems are removed.
+func SanitizeFilename(name string, mediaType string) string {
+	name = strings.ReplaceAll(name, `\`, "/")
+	name = name[strings.LastIndex(name, "/")+1:]
+
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.Trim(name, " .")
+
+	if len(name) > maxFilenameLength {
+		ext := filepath.Ext(name)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		name = strings.ToValidUTF8(name[:maxFilenameLength-len(ext)], "") + ext
+	}
+
+	if name == "" {
+		name = "attachment"
+		if exts, err := mime.ExtensionsByType(mediaType); err == nil && len(exts) > 0 {
+			name += exts[0]
+		}
+	}
+	return name
+}
+
+// ExtractAttachment writes the decoded attachment to the directory and returns
+// the path of the created file. An existing file is never overwritten; a
+// number is appended to the name instead.
+func ExtractAttachment(dir string, attachment *Attachment, b []byte) (string, error) {
+	f, err := createAttachmentFile(dir, attachment)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// createAttachmentFile creates the file an attachment is extracted to.
+func createAttachmentFile(dir string, attachment *Attachment) (*os.File, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	name := SanitizeFilename(attachment.Filename, attachment.ContentType)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	for i := 2; ; i++ {
+		f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if errors.Is(err, fs.ErrExist) {
+			name = fmt.Sprintf("%s-%d%s", base, i, ext)
+			continue
+		}
+		return f, err
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAttachmentFilename(t *testing.T) {
+	testcases := []struct {
+		header   textproto.MIMEHeader
+		expected string
+	}{
+		{
+			textproto.MIMEHeader{
+				"Content-Type":        {`application/pdf; name="type.pdf"`},
+				"Content-Disposition": {`attachment; filename="disposition.pdf"`},
+			},
+			"disposition.pdf",
+		},
+		{
+			textproto.MIMEHeader{
+				"Content-Type": {`application/pdf; name="type.pdf"`},
+			},
+			"type.pdf",
+		},
+		{
+			textproto.MIMEHeader{
+				"Content-Disposition": {`attachment; filename*=UTF-8''%E6%97%A5%E6%9C%AC.pdf`},
+			},
+			"日本.pdf",
+		},
+		{
+			textproto.MIMEHeader{
+				"Content-Disposition": {`attachment; filename="nihon.pdf"; filename*=UTF-8''%E6%97%A5%E6%9C%AC.pdf`},
+			},
+			"日本.pdf",
+		},
+		{
+			textproto.MIMEHeader{
+				"Content-Type": {`application/octet-stream`},
+			},
+			"",
+		},
+	}
+
+	for _, tt := range testcases {
+		t.Run(tt.expected, func(t *testing.T) {
+			assert.Equal(t, tt.expected, AttachmentFilename(tt.header))
+		})
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	testcases := []struct {
+		name      string
+		mediaType string
+		expected  string
+	}{
+		{"report.pdf", "application/pdf", "report.pdf"},
+		{"../../etc/passwd", "text/plain", "passwd"},
+		{`..\..\windows\system.ini`, "text/plain", "system.ini"},
+		{"/abs/path.txt", "text/plain", "path.txt"},
+		{"..", "application/pdf", "attachment.pdf"},
+		{"", "image/png", "attachment.png"},
+		{"a\x00b<c>:d.txt", "text/plain", "a_b_c__d.txt"},
+		{" .hidden ", "text/plain", "hidden"},
+	}
+
+	for _, tt := range testcases {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, SanitizeFilename(tt.name, tt.mediaType))
+		})
+	}
+}
+
+func TestExtractAttachment(t *testing.T) {
+	dir := t.TempDir()
+	attachment := NewAttachment([]byte("data"), "text/plain", "../a.txt")
+
+	path, err := ExtractAttachment(dir, attachment, []byte("data"))
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, "a.txt"), path)
+
+	path, err = ExtractAttachment(dir, attachment, []byte("data"))
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, "a-2.txt"), path)
+
+	b, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "data", string(b))
+}
+
+func TestReadMailAttachment(t *testing.T) {
+	input := "Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"body\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/octet-stream; name=\"data.bin\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"aGVs\r\n" +
+		"bG8=\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/csv\r\n" +
+		"Content-Disposition: attachment; filename=\"data.csv\"\r\n" +
+		"\r\n" +
+		"a,b\r\n" +
+		"--b--\r\n"
+
+	dir := t.TempDir()
+	part := readTestMail(t, input, Option{extractDir: dir, attachmentBody: AttachmentBodyBase64})
+
+	assert.Nil(t, part.Parts[0].Attachment)
+
+	assert.Equal(t, &Attachment{
+		Filename:    "data.bin",
+		ContentType: "application/octet-stream",
+		Size:        5,
+		SHA256:      "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		MD5:         "5d41402abc4b2a76b9719d911017c592",
+		Path:        filepath.Join(dir, "data.bin"),
+	}, part.Parts[1].Attachment)
+	assert.Equal(t, "aGVsbG8=", part.Parts[1].Body)
+
+	assert.Equal(t, "data.csv", part.Parts[2].Attachment.Filename)
+	assert.Equal(t, "a,b", part.Parts[2].Body)
+
+	b, err := os.ReadFile(filepath.Join(dir, "data.bin"))
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(b))
+
+	part = readTestMail(t, input, Option{attachmentBody: AttachmentBodyOmit})
+	assert.Equal(t, "", part.Parts[1].Body)
+	assert.Equal(t, "", part.Parts[1].Attachment.Path)
+
+	part = readTestMail(t, input, Option{attachmentBody: AttachmentBodyRaw})
+	assert.Equal(t, "aGVs\r\nbG8=", part.Parts[1].Body)
+}
@@ -0,0 +1,615 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata"
+)
+
+// Calendar is an iCalendar object as defined in RFC 5545. Method is set for
+// scheduling messages such as invitations (REQUEST) and replies (REPLY).
+type Calendar struct {
+	Method string  `json:"method,omitempty"`
+	ProdID string  `json:"prodId,omitempty"`
+	Events []Event `json:"events"`
+}
+
+type Event struct {
+	UID          string      `json:"uid,omitempty"`
+	Sequence     int         `json:"sequence,omitempty"`
+	Status       string      `json:"status,omitempty"`
+	Summary      string      `json:"summary,omitempty"`
+	Description  string      `json:"description,omitempty"`
+	Location     string      `json:"location,omitempty"`
+	Organizer    *Attendee   `json:"organizer,omitempty"`
+	Attendees    []Attendee  `json:"attendees,omitempty"`
+	Start        *DateTime   `json:"start,omitempty"`
+	End          *DateTime   `json:"end,omitempty"`
+	Duration     string      `json:"duration,omitempty"`
+	RecurrenceID *DateTime   `json:"recurrenceId,omitempty"`
+	Recurrence   *Recurrence `json:"recurrence,omitempty"`
+	ExDates      []DateTime  `json:"exDates,omitempty"`
+}
+
+type Attendee struct {
+	Name     string `json:"name,omitempty"`
+	Email    string `json:"email"`
+	Role     string `json:"role,omitempty"`
+	PartStat string `json:"partStat,omitempty"`
+	RSVP     bool   `json:"rsvp,omitempty"`
+}
+
+// DateTime is a date or a date-time value. Time is the value in RFC 3339
+// format with the UTC offset resolved from the TZID; it has no offset for
+// floating times and is empty when the TZID is unknown.
+type DateTime struct {
+	Value    string `json:"value"`
+	TZID     string `json:"tzid,omitempty"`
+	Time     string `json:"time,omitempty"`
+	Date     bool   `json:"date,omitempty"`
+	Floating bool   `json:"floating,omitempty"`
+}
+
+// Recurrence is a RRULE. Rule is the rule as written; the other fields are
+// its commonly used parts.
+type Recurrence struct {
+	Rule       string   `json:"rule"`
+	Freq       string   `json:"freq,omitempty"`
+	Interval   int      `json:"interval,omitempty"`
+	Count      int      `json:"count,omitempty"`
+	Until      string   `json:"until,omitempty"`
+	ByDay      []string `json:"byDay,omitempty"`
+	ByMonthDay []int    `json:"byMonthDay,omitempty"`
+	ByMonth    []int    `json:"byMonth,omitempty"`
+}
+
+// kinds of parts read by -calendar
+const (
+	calendarKind = "calendar"
+	vcardKind    = "vcard"
+)
+
+// CalendarKind tells whether a part is an iCalendar object or a vCard, by the
+// media type or, for generic media types, by the file extension.
+func CalendarKind(mediaType string, filename string) string {
+	switch mediaType {
+	case "text/calendar", "text/x-vcalendar", "application/ics":
+		return calendarKind
+	case "text/vcard", "text/x-vcard", "text/directory":
+		return vcardKind
+	}
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".ics", ".ical", ".ifb", ".vcs":
+		return calendarKind
+	case ".vcf", ".vcard":
+		return vcardKind
+	}
+	return ""
+}
+
+// readCalendar parses an iCalendar object or the vCards of the body.
+func (p *Part) readCalendar(b []byte, kind string, charset string) error {
+	text, _, _ := DecodeText(b, charset)
+	var err error
+	if kind == vcardKind {
+		p.Contacts, err = ParseContacts(text)
+	} else {
+		p.Calendar, err = ParseCalendar(text)
+	}
+	return err
+}
+
+// contentLine is a property of iCalendar and vCard data with its parameters.
+// Parameter names are upper case.
+type contentLine struct {
+	name   string
+	params map[string][]string
+	value  string
+}
+
+func (l contentLine) param(name string) string {
+	if v := l.params[name]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// component is a BEGIN/END block such as VEVENT or VCARD.
+type component struct {
+	name       string
+	lines      []contentLine
+	components []*component
+}
+
+func (c *component) get(name string) (contentLine, bool) {
+	for _, l := range c.lines {
+		if l.name == name {
+			return l, true
+		}
+	}
+	return contentLine{}, false
+}
+
+func (c *component) text(name string) string {
+	if l, ok := c.get(name); ok {
+		return unescapeText(l.value)
+	}
+	return ""
+}
+
+// unfoldLines joins the continuation lines of folded content lines. The soft
+// line breaks of quoted-printable values of vCard 2.1 are joined as well.
+func unfoldLines(text string) []string {
+	var lines []string
+	qpContinued := false
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		switch {
+		case qpContinued:
+			lines[len(lines)-1] += line
+		case len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")):
+			lines[len(lines)-1] += line[1:]
+		case line == "":
+			continue
+		default:
+			lines = append(lines, line)
+		}
+
+		last := lines[len(lines)-1]
+		name, _, _ := strings.Cut(last, ":")
+		qpContinued = strings.HasSuffix(last, "=") && strings.Contains(strings.ToUpper(name), "QUOTED-PRINTABLE")
+		if qpContinued {
+			lines[len(lines)-1] = strings.TrimSuffix(last, "=")
+		}
+	}
+	return lines
+}
+
+// parseContentLine parses "NAME;PARAM=a,"b";PARAM2=c:value". Parameters
+// without a value, as in "TEL;WORK;VOICE:" of vCard 2.1, are types.
+func parseContentLine(line string) (contentLine, error) {
+	l := contentLine{params: map[string][]string{}}
+
+	i := strings.IndexAny(line, ";:")
+	if i <= 0 {
+		return l, fmt.Errorf("invalid content line: %q", line)
+	}
+	l.name = strings.ToUpper(line[:i])
+	// the group prefix of vCard properties such as "item1.EMAIL"
+	if j := strings.LastIndex(l.name, "."); j >= 0 {
+		l.name = l.name[j+1:]
+	}
+
+	for line[i] == ';' {
+		line = line[i+1:]
+		j := strings.IndexAny(line, "=;:")
+		if j < 0 {
+			return l, fmt.Errorf("invalid parameter in %s", l.name)
+		}
+		name := strings.ToUpper(line[:j])
+		if line[j] != '=' {
+			l.params["TYPE"] = append(l.params["TYPE"], name)
+			i = j
+			continue
+		}
+
+		line = line[j+1:]
+		for {
+			var value string
+			if strings.HasPrefix(line, `"`) {
+				end := strings.Index(line[1:], `"`)
+				if end < 0 {
+					return l, fmt.Errorf("unterminated quoted parameter %s in %s", name, l.name)
+				}
+				value, line = line[1:end+1], line[end+2:]
+			} else {
+				end := strings.IndexAny(line, ",;:")
+				if end < 0 {
+					return l, fmt.Errorf("invalid parameter %s in %s", name, l.name)
+				}
+				value, line = line[:end], line[end:]
+			}
+			l.params[name] = append(l.params[name], value)
+			if !strings.HasPrefix(line, ",") {
+				break
+			}
+			line = line[1:]
+		}
+		if line == "" {
+			return l, fmt.Errorf("no value in %s", l.name)
+		}
+		i = 0
+	}
+
+	l.value = line[i+1:]
+	return l, nil
+}
+
+// parseComponents parses the content lines into the tree of components.
+func parseComponents(text string) ([]*component, error) {
+	var roots []*component
+	var stack []*component
+	for _, line := range unfoldLines(text) {
+		l, err := parseContentLine(line)
+		if err != nil {
+			return nil, err
+		}
+
+		switch l.name {
+		case "BEGIN":
+			c := &component{name: strings.ToUpper(l.value)}
+			if len(stack) == 0 {
+				roots = append(roots, c)
+			} else {
+				parent := stack[len(stack)-1]
+				parent.components = append(parent.components, c)
+			}
+			stack = append(stack, c)
+		case "END":
+			if len(stack) == 0 || stack[len(stack)-1].name != strings.ToUpper(l.value) {
+				return nil, fmt.Errorf("unexpected END:%s", l.value)
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			if len(stack) > 0 {
+				c := stack[len(stack)-1]
+				c.lines = append(c.lines, l)
+			}
+		}
+	}
+	if len(stack) > 0 {
+		return nil, fmt.Errorf("END:%s not found", stack[len(stack)-1].name)
+	}
+	return roots, nil
+}
+
+// unescapeText unescapes a TEXT value.
+func unescapeText(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			sb.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n', 'N':
+			sb.WriteByte('\n')
+		default:
+			sb.WriteByte(s[i])
+		}
+	}
+	return sb.String()
+}
+
+// splitValue splits a value at the separators which are not escaped.
+func splitValue(s string, sep byte) []string {
+	var values []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case sep:
+			values = append(values, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(values, s[start:])
+}
+
+var errNoCalendar = errors.New("VCALENDAR not found")
+
+// ParseCalendar parses the events of an iCalendar object.
+func ParseCalendar(text string) (*Calendar, error) {
+	roots, err := parseComponents(text)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, root := range roots {
+		if root.name != "VCALENDAR" {
+			continue
+		}
+
+		calendar := &Calendar{
+			Method: strings.ToUpper(root.text("METHOD")),
+			ProdID: root.text("PRODID"),
+			Events: []Event{},
+		}
+		zones := map[string]*component{}
+		for _, c := range root.components {
+			if c.name == "VTIMEZONE" {
+				zones[c.text("TZID")] = c
+			}
+		}
+		for _, c := range root.components {
+			if c.name == "VEVENT" {
+				calendar.Events = append(calendar.Events, parseEvent(c, zones))
+			}
+		}
+		return calendar, nil
+	}
+	return nil, errNoCalendar
+}
+
+func parseEvent(c *component, zones map[string]*component) Event {
+	event := Event{
+		UID:         c.text("UID"),
+		Status:      strings.ToUpper(c.text("STATUS")),
+		Summary:     c.text("SUMMARY"),
+		Description: c.text("DESCRIPTION"),
+		Location:    c.text("LOCATION"),
+		Duration:    c.text("DURATION"),
+	}
+	event.Sequence, _ = strconv.Atoi(c.text("SEQUENCE"))
+
+	for _, l := range c.lines {
+		switch l.name {
+		case "ORGANIZER":
+			organizer := parseAttendee(l)
+			event.Organizer = &organizer
+		case "ATTENDEE":
+			event.Attendees = append(event.Attendees, parseAttendee(l))
+		case "DTSTART":
+			event.Start = parseDateTime(l, l.value, zones)
+		case "DTEND":
+			event.End = parseDateTime(l, l.value, zones)
+		case "RECURRENCE-ID":
+			event.RecurrenceID = parseDateTime(l, l.value, zones)
+		case "RRULE":
+			event.Recurrence = ParseRecurrence(l.value)
+		case "EXDATE":
+			for _, v := range strings.Split(l.value, ",") {
+				event.ExDates = append(event.ExDates, *parseDateTime(l, v, zones))
+			}
+		}
+	}
+	return event
+}
+
+// parseAttendee reads an ATTENDEE or ORGANIZER property, whose value is a
+// mailto URI.
+func parseAttendee(l contentLine) Attendee {
+	email := l.value
+	if len(email) > 7 && strings.EqualFold(email[:7], "mailto:") {
+		email = email[7:]
+	}
+	if email == "" {
+		email = l.param("EMAIL")
+	}
+	return Attendee{
+		Name:     l.param("CN"),
+		Email:    email,
+		Role:     strings.ToUpper(l.param("ROLE")),
+		PartStat: strings.ToUpper(l.param("PARTSTAT")),
+		RSVP:     strings.EqualFold(l.param("RSVP"), "TRUE"),
+	}
+}
+
+const (
+	icalDate     = "20060102"
+	icalDateTime = "20060102T150405"
+)
+
+// parseDateTime parses a DATE or DATE-TIME value, resolving the TZID with
+// the IANA time zone database or the VTIMEZONE of the calendar.
+func parseDateTime(l contentLine, value string, zones map[string]*component) *DateTime {
+	dt := &DateTime{Value: value, TZID: l.param("TZID")}
+
+	if strings.EqualFold(l.param("VALUE"), "DATE") || len(value) == len(icalDate) {
+		dt.Date = true
+		if t, err := time.Parse(icalDate, value); err == nil {
+			dt.Time = t.Format(time.DateOnly)
+		}
+		return dt
+	}
+
+	if strings.HasSuffix(value, "Z") {
+		if t, err := time.Parse(icalDateTime, strings.TrimSuffix(value, "Z")); err == nil {
+			dt.Time = t.Format(time.RFC3339)
+		}
+		return dt
+	}
+
+	t, err := time.Parse(icalDateTime, value)
+	if err != nil {
+		return dt
+	}
+	if dt.TZID == "" {
+		dt.Floating = true
+		dt.Time = t.Format("2006-01-02T15:04:05")
+		return dt
+	}
+	loc := loadLocation(dt.TZID)
+	if zone, ok := zones[dt.TZID]; loc == nil && ok {
+		if offset, ok := zoneOffset(zone, t); ok {
+			loc = time.FixedZone(dt.TZID, offset)
+		}
+	}
+	if loc != nil {
+		dt.Time = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, loc).Format(time.RFC3339)
+	}
+	return dt
+}
+
+// loadLocation returns the IANA time zone of the TZID, which some clients
+// prefix with a path such as "/mozilla.org/20050126_1/Europe/Berlin".
+func loadLocation(tzid string) *time.Location {
+	if tzid == "" || tzid == "Local" {
+		return nil
+	}
+	if loc, err := time.LoadLocation(tzid); err == nil {
+		return loc
+	}
+	parts := strings.Split(strings.TrimPrefix(tzid, "/"), "/")
+	for i := 1; i < len(parts); i++ {
+		if loc, err := time.LoadLocation(strings.Join(parts[i:], "/")); err == nil {
+			return loc
+		}
+	}
+	return nil
+}
+
+// zoneOffset returns the UTC offset in seconds of a local time in the
+// VTIMEZONE: the TZOFFSETTO of the observance which took effect last. Yearly
+// rules by month and weekday or month day, as written by mail clients, are
+// supported.
+func zoneOffset(zone *component, local time.Time) (int, bool) {
+	var latest time.Time
+	offset, found := 0, false
+	for _, c := range zone.components {
+		if c.name != "STANDARD" && c.name != "DAYLIGHT" {
+			continue
+		}
+		to, err := parseUTCOffset(c.text("TZOFFSETTO"))
+		if err != nil {
+			continue
+		}
+		start, err := time.Parse(icalDateTime, c.text("DTSTART"))
+		if err != nil {
+			continue
+		}
+
+		onsets := []time.Time{start}
+		if l, ok := c.get("RRULE"); ok {
+			onsets = yearlyOnsets(ParseRecurrence(l.value), start, local.Year())
+		}
+		for _, onset := range onsets {
+			if onset.After(local) || onset.Before(start) || onset.Before(latest) {
+				continue
+			}
+			latest, offset, found = onset, to, true
+		}
+	}
+	return offset, found
+}
+
+// yearlyOnsets returns the onsets of a yearly rule in the year and the year
+// before.
+func yearlyOnsets(rule *Recurrence, start time.Time, year int) []time.Time {
+	if rule.Freq != "YEARLY" {
+		return nil
+	}
+	month := start.Month()
+	if len(rule.ByMonth) > 0 {
+		month = time.Month(rule.ByMonth[0])
+	}
+	var until time.Time
+	if rule.Until != "" {
+		until, _ = time.Parse(icalDateTime, strings.TrimSuffix(rule.Until, "Z"))
+	}
+
+	var onsets []time.Time
+	for y := year - 1; y <= year; y++ {
+		day := start.Day()
+		if len(rule.ByMonthDay) > 0 {
+			day = rule.ByMonthDay[0]
+		}
+		if len(rule.ByDay) > 0 {
+			var ok bool
+			if day, ok = nthWeekday(y, month, rule.ByDay[0]); !ok {
+				continue
+			}
+		}
+		onset := time.Date(y, month, day, start.Hour(), start.Minute(), start.Second(), 0, time.UTC)
+		if until.IsZero() || !onset.After(until) {
+			onsets = append(onsets, onset)
+		}
+	}
+	return onsets
+}
+
+var weekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// nthWeekday returns the day of month of a BYDAY value such as "2SU" (the
+// second Sunday) or "-1SU" (the last Sunday).
+func nthWeekday(year int, month time.Month, byDay string) (int, bool) {
+	if len(byDay) < 2 {
+		return 0, false
+	}
+	weekday, ok := weekdays[byDay[len(byDay)-2:]]
+	if !ok {
+		return 0, false
+	}
+	n := 1
+	if s := byDay[:len(byDay)-2]; s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n == 0 {
+			return 0, false
+		}
+	}
+
+	if n > 0 {
+		first := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+		day := 1 + (int(weekday)-int(first.Weekday())+7)%7 + (n-1)*7
+		return day, day <= time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+	}
+	last := time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC)
+	day := last.Day() - (int(last.Weekday())-int(weekday)+7)%7 + (n+1)*7
+	return day, day >= 1
+}
+
+// parseUTCOffset parses a UTC-OFFSET value such as "+0900" into seconds.
+func parseUTCOffset(s string) (int, error) {
+	if len(s) != 5 && len(s) != 7 || s[0] != '+' && s[0] != '-' {
+		return 0, fmt.Errorf("invalid UTC offset: %q", s)
+	}
+	n, err := strconv.Atoi(s[1:])
+	if err != nil {
+		return 0, fmt.Errorf("invalid UTC offset: %q", s)
+	}
+	if len(s) == 5 {
+		n *= 100
+	}
+	offset := n/10000*3600 + n/100%100*60 + n%100
+	if s[0] == '-' {
+		offset = -offset
+	}
+	return offset, nil
+}
+
+// ParseRecurrence parses a RRULE value such as "FREQ=WEEKLY;BYDAY=MO,WE".
+func ParseRecurrence(rule string) *Recurrence {
+	r := &Recurrence{Rule: rule}
+	for _, part := range strings.Split(rule, ";") {
+		name, value, _ := strings.Cut(part, "=")
+		switch strings.ToUpper(name) {
+		case "FREQ":
+			r.Freq = strings.ToUpper(value)
+		case "INTERVAL":
+			r.Interval, _ = strconv.Atoi(value)
+		case "COUNT":
+			r.Count, _ = strconv.Atoi(value)
+		case "UNTIL":
+			r.Until = value
+		case "BYDAY":
+			r.ByDay = strings.Split(strings.ToUpper(value), ",")
+		case "BYMONTHDAY":
+			r.ByMonthDay = atoiList(value)
+		case "BYMONTH":
+			r.ByMonth = atoiList(value)
+		}
+	}
+	return r
+}
+
+func atoiList(s string) []int {
+	var values []int
+	for _, v := range strings.Split(s, ",") {
+		if n, err := strconv.Atoi(v); err == nil {
+			values = append(values, n)
+		}
+	}
+	return values
+}
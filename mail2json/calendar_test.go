@@ -0,0 +1,175 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCalendar(t *testing.T) {
+	input := "BEGIN:VCALENDAR\r\n" +
+		"PRODID:-//Example//Calendar//EN\r\n" +
+		"VERSION:2.0\r\n" +
+		"METHOD:REQUEST\r\n" +
+		"BEGIN:VTIMEZONE\r\n" +
+		"TZID:W. Europe Standard Time\r\n" +
+		"BEGIN:STANDARD\r\n" +
+		"DTSTART:16010101T030000\r\n" +
+		"TZOFFSETFROM:+0200\r\n" +
+		"TZOFFSETTO:+0100\r\n" +
+		"RRULE:FREQ=YEARLY;INTERVAL=1;BYDAY=-1SU;BYMONTH=10\r\n" +
+		"END:STANDARD\r\n" +
+		"BEGIN:DAYLIGHT\r\n" +
+		"DTSTART:16010101T020000\r\n" +
+		"TZOFFSETFROM:+0100\r\n" +
+		"TZOFFSETTO:+0200\r\n" +
+		"RRULE:FREQ=YEARLY;INTERVAL=1;BYDAY=-1SU;BYMONTH=3\r\n" +
+		"END:DAYLIGHT\r\n" +
+		"END:VTIMEZONE\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"UID:event-1@example.com\r\n" +
+		"SEQUENCE:2\r\n" +
+		"SUMMARY:Weekly sync\\, planning\r\n" +
+		"DESCRIPTION:Agenda:\\n1. status\r\n" +
+		"LOCATION:Room 1\r\n" +
+		"ORGANIZER;CN=\"Smith, Alice\":mailto:alice@example.com\r\n" +
+		"ATTENDEE;CN=Bob;ROLE=REQ-PARTICIPANT;PARTSTAT=NEEDS-ACTION;RSVP=TRUE:mai\r\n" +
+		" lto:bob@example.com\r\n" +
+		"ATTENDEE;ROLE=OPT-PARTICIPANT;PARTSTAT=ACCEPTED:MAILTO:carol@example.com\r\n" +
+		"DTSTART;TZID=W. Europe Standard Time:20240715T100000\r\n" +
+		"DTEND;TZID=W. Europe Standard Time:20240715T110000\r\n" +
+		"RRULE:FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,WE;UNTIL=20241231T000000Z\r\n" +
+		"EXDATE;TZID=W. Europe Standard Time:20240729T100000,20240812T100000\r\n" +
+		"END:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+
+	calendar, err := ParseCalendar(input)
+	assert.Nil(t, err)
+	assert.Equal(t, &Calendar{
+		Method: "REQUEST",
+		ProdID: "-//Example//Calendar//EN",
+		Events: []Event{{
+			UID:         "event-1@example.com",
+			Sequence:    2,
+			Summary:     "Weekly sync, planning",
+			Description: "Agenda:\n1. status",
+			Location:    "Room 1",
+			Organizer:   &Attendee{Name: "Smith, Alice", Email: "alice@example.com"},
+			Attendees: []Attendee{
+				{Name: "Bob", Email: "bob@example.com", Role: "REQ-PARTICIPANT", PartStat: "NEEDS-ACTION", RSVP: true},
+				{Email: "carol@example.com", Role: "OPT-PARTICIPANT", PartStat: "ACCEPTED"},
+			},
+			Start: &DateTime{Value: "20240715T100000", TZID: "W. Europe Standard Time", Time: "2024-07-15T10:00:00+02:00"},
+			End:   &DateTime{Value: "20240715T110000", TZID: "W. Europe Standard Time", Time: "2024-07-15T11:00:00+02:00"},
+			Recurrence: &Recurrence{
+				Rule:     "FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,WE;UNTIL=20241231T000000Z",
+				Freq:     "WEEKLY",
+				Interval: 2,
+				Until:    "20241231T000000Z",
+				ByDay:    []string{"MO", "WE"},
+			},
+			ExDates: []DateTime{
+				{Value: "20240729T100000", TZID: "W. Europe Standard Time", Time: "2024-07-29T10:00:00+02:00"},
+				{Value: "20240812T100000", TZID: "W. Europe Standard Time", Time: "2024-08-12T10:00:00+02:00"},
+			},
+		}},
+	}, calendar)
+
+	_, err = ParseCalendar("BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nEND:VCALENDAR\r\n")
+	assert.NotNil(t, err)
+	_, err = ParseCalendar("BEGIN:VCARD\r\nEND:VCARD\r\n")
+	assert.Equal(t, errNoCalendar, err)
+}
+
+func TestParseDateTime(t *testing.T) {
+	zone := "BEGIN:VTIMEZONE\r\n" +
+		"TZID:Eastern\r\n" +
+		"BEGIN:STANDARD\r\n" +
+		"DTSTART:19671029T020000\r\n" +
+		"RRULE:FREQ=YEARLY;BYDAY=1SU;BYMONTH=11\r\n" +
+		"TZOFFSETFROM:-0400\r\n" +
+		"TZOFFSETTO:-0500\r\n" +
+		"END:STANDARD\r\n" +
+		"BEGIN:DAYLIGHT\r\n" +
+		"DTSTART:19870405T020000\r\n" +
+		"RRULE:FREQ=YEARLY;BYDAY=2SU;BYMONTH=3\r\n" +
+		"TZOFFSETFROM:-0500\r\n" +
+		"TZOFFSETTO:-0400\r\n" +
+		"END:DAYLIGHT\r\n" +
+		"END:VTIMEZONE\r\n"
+
+	tests := []struct {
+		line     string
+		expected DateTime
+	}{
+		{"DTSTART:20240102T030405Z", DateTime{Value: "20240102T030405Z", Time: "2024-01-02T03:04:05Z"}},
+		{"DTSTART;VALUE=DATE:20240102", DateTime{Value: "20240102", Time: "2024-01-02", Date: true}},
+		{"DTSTART:20240102T030405", DateTime{Value: "20240102T030405", Time: "2024-01-02T03:04:05", Floating: true}},
+		{"DTSTART;TZID=Asia/Tokyo:20240102T030405", DateTime{Value: "20240102T030405", TZID: "Asia/Tokyo", Time: "2024-01-02T03:04:05+09:00"}},
+		{"DTSTART;TZID=/mozilla.org/20050126_1/Europe/Berlin:20240702T030405", DateTime{Value: "20240702T030405", TZID: "/mozilla.org/20050126_1/Europe/Berlin", Time: "2024-07-02T03:04:05+02:00"}},
+		{"DTSTART;TZID=Eastern:20240102T030405", DateTime{Value: "20240102T030405", TZID: "Eastern", Time: "2024-01-02T03:04:05-05:00"}},
+		{"DTSTART;TZID=Eastern:20240312T030405", DateTime{Value: "20240312T030405", TZID: "Eastern", Time: "2024-03-12T03:04:05-04:00"}},
+		{"DTSTART;TZID=Unknown:20240102T030405", DateTime{Value: "20240102T030405", TZID: "Unknown"}},
+	}
+
+	for _, tt := range tests {
+		calendar, err := ParseCalendar("BEGIN:VCALENDAR\r\n" + zone + "BEGIN:VEVENT\r\n" + tt.line + "\r\nEND:VEVENT\r\nEND:VCALENDAR\r\n")
+		if assert.Nil(t, err, tt.line) {
+			assert.Equal(t, &tt.expected, calendar.Events[0].Start, tt.line)
+		}
+	}
+}
+
+func TestNthWeekday(t *testing.T) {
+	tests := []struct {
+		year     int
+		month    int
+		byDay    string
+		expected int
+	}{
+		{2024, 3, "-1SU", 31},
+		{2024, 10, "-1SU", 27},
+		{2024, 3, "2SU", 10},
+		{2024, 11, "SU", 3},
+		{2024, 2, "5TH", 29},
+	}
+
+	for _, tt := range tests {
+		day, ok := nthWeekday(tt.year, time.Month(tt.month), tt.byDay)
+		assert.True(t, ok, tt.byDay)
+		assert.Equal(t, tt.expected, day, tt.byDay)
+	}
+
+	_, ok := nthWeekday(2024, time.February, "5FR")
+	assert.False(t, ok)
+}
+
+func TestReadMailCalendar(t *testing.T) {
+	input := "Subject: Invitation\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/calendar; charset=utf-8; method=REQUEST\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"QkVHSU46VkNBTEVOREFSDQpNRVRIT0Q6UkVRVUVTVA0KQkVHSU46VkVWRU5UDQpVSUQ6MQ0KRU5E\r\n" +
+		"OlZFVkVOVA0KRU5EOlZDQUxFTkRBUg0K\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/octet-stream; name=invite.ics\r\n" +
+		"\r\n" +
+		"BEGIN:VCALENDAR\r\n" +
+		"BEGIN:VEVENT\r\n" +
+		"--b--\r\n"
+
+	part := readTestMail(t, input, Option{calendar: true})
+	assert.Equal(t, &Calendar{Method: "REQUEST", Events: []Event{{UID: "1"}}}, part.Parts[0].Calendar)
+	assert.Nil(t, part.Parts[1].Calendar)
+	assert.Equal(t, []Defect{{Code: InvalidCalendarDefect, Detail: "END:VEVENT not found"}}, part.Parts[1].Defects)
+
+	part = readTestMail(t, input, Option{})
+	assert.Nil(t, part.Parts[0].Calendar)
+
+	_, err := ReadMail(strings.NewReader(input), Option{calendar: true, strict: true})
+	assert.NotNil(t, err)
+}
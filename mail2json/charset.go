@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// CharsetEncoding returns the encoding for a MIME charset name. Names are
+// resolved as in the WHATWG Encoding Standard, so that e.g. iso-8859-1 maps to
+// windows-1252 and gb2312 to GBK like mail clients do.
+func CharsetEncoding(charset string) (encoding.Encoding, error) {
+	charset = strings.Trim(strings.TrimSpace(charset), `"`)
+	e, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported charset: %s", charset)
+	}
+	return e, nil
+}
+
+// NewCharsetReader converts the input from the charset to UTF-8. It has the
+// signature of mime.WordDecoder.CharsetReader.
+func NewCharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	e, err := CharsetEncoding(charset)
+	if err != nil {
+		return nil, err
+	}
+	return e.NewDecoder().Reader(input), nil
+}
+
+func normalizeCharset(charset string) string {
+	return strings.ToLower(strings.Trim(strings.TrimSpace(charset), `"`))
+}
+
+func isUTF8Charset(charset string) bool {
+	return charset == "utf-8" || charset == "utf8"
+}
+
+// DecodeText converts a text body to UTF-8. The declared charset is used when
+// the text is valid in it; otherwise the charset is guessed from the content.
+// It returns the text, the charset actually used and warnings about the
+// conversion.
+func DecodeText(b []byte, declared string) (string, string, []string) {
+	var warnings []string
+	declared = normalizeCharset(declared)
+
+	if declared != "" {
+		text, err := decodeCharset(declared, b)
+		switch {
+		case err != nil:
+			warnings = append(warnings, err.Error())
+		case !isUTF8Charset(declared) && !isASCII(b) && utf8.Valid(b) && isSingleByteCharset(declared):
+			// a common mislabeling: UTF-8 text declared as us-ascii or latin1
+			warnings = append(warnings, fmt.Sprintf("text is not %s but valid utf-8", declared))
+		case strings.ContainsRune(text, utf8.RuneError) && !bytes.Contains(b, []byte(string(utf8.RuneError))):
+			warnings = append(warnings, fmt.Sprintf("text contains bytes invalid in %s", declared))
+		default:
+			return text, declared, nil
+		}
+	}
+
+	detected := DetectCharset(b)
+	if declared == "" && detected != "us-ascii" {
+		warnings = append(warnings, fmt.Sprintf("charset not declared, detected %s", detected))
+	} else if declared != "" {
+		warnings = append(warnings, fmt.Sprintf("detected %s", detected))
+	}
+
+	text, err := decodeCharset(detected, b)
+	if err != nil {
+		// unreachable for the detected charsets, but keep the raw text
+		return string(b), "", append(warnings, err.Error())
+	}
+	if strings.ContainsRune(text, utf8.RuneError) {
+		warnings = append(warnings, "text contains invalid characters")
+	}
+	return text, detected, warnings
+}
+
+func decodeCharset(charset string, b []byte) (string, error) {
+	if isUTF8Charset(charset) {
+		return strings.ToValidUTF8(string(b), string(utf8.RuneError)), nil
+	}
+	return convertCharset(charset, b)
+}
+
+func isASCII(b []byte) bool {
+	for _, c := range b {
+		if c >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+func isSingleByteCharset(charset string) bool {
+	return charset == "us-ascii" ||
+		charset == "ascii" ||
+		strings.HasPrefix(charset, "iso-8859-") ||
+		strings.HasPrefix(charset, "windows-125") ||
+		strings.HasPrefix(charset, "cp125") ||
+		charset == "latin1"
+}
+
+// multibyteCandidates are tried in order when guessing the charset of text
+// which is neither ASCII nor UTF-8.
+var multibyteCandidates = []string{"shift_jis", "euc-jp", "gbk"}
+
+// DetectCharset guesses the charset of a text. It recognizes UTF-8 and
+// ISO-2022-JP by their structure, and tells the Japanese and Chinese multibyte
+// encodings apart from windows-1252 by how the decoded text looks.
+func DetectCharset(b []byte) string {
+	if bytes.Contains(b, []byte("\x1b$B")) || bytes.Contains(b, []byte("\x1b$@")) || bytes.Contains(b, []byte("\x1b(J")) {
+		return "iso-2022-jp"
+	}
+	if isASCII(b) {
+		return "us-ascii"
+	}
+	if utf8.Valid(b) {
+		return "utf-8"
+	}
+
+	// Latin text has high bytes scattered between ASCII letters, while the
+	// multibyte encodings always use them in pairs.
+	if isolatedHighBytes(b)*2 > highBytes(b) {
+		return "windows-1252"
+	}
+
+	best := "windows-1252"
+	bestScore := 0
+	for _, charset := range multibyteCandidates {
+		text, err := convertCharset(charset, b)
+		if err != nil || strings.ContainsRune(text, utf8.RuneError) {
+			continue
+		}
+
+		kana, han := 0, 0
+		for _, r := range text {
+			switch {
+			case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+				kana++
+			case unicode.Is(unicode.Han, r):
+				han++
+			}
+		}
+
+		score := han
+		if charset != "gbk" {
+			// Japanese text without kana is more likely to be Chinese
+			if kana == 0 {
+				score = han / 2
+			} else {
+				score = kana*2 + han
+			}
+		}
+		if score > bestScore {
+			best, bestScore = charset, score
+		}
+	}
+	return best
+}
+
+func highBytes(b []byte) int {
+	n := 0
+	for _, c := range b {
+		if c >= 0x80 {
+			n++
+		}
+	}
+	return n
+}
+
+func isolatedHighBytes(b []byte) int {
+	n := 0
+	for i, c := range b {
+		if c < 0x80 {
+			continue
+		}
+		if (i == 0 || b[i-1] < 0x80) && (i == len(b)-1 || b[i+1] < 0x80) {
+			n++
+		}
+	}
+	return n
+}
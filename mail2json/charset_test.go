@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"testing"
+)
+
+func TestDecodeText(t *testing.T) {
+	sjis, _ := japanese.ShiftJIS.NewEncoder().Bytes([]byte("こんにちは、世界"))
+	eucjp, _ := japanese.EUCJP.NewEncoder().Bytes([]byte("こんにちは、世界"))
+	iso2022jp, _ := japanese.ISO2022JP.NewEncoder().Bytes([]byte("こんにちは、世界"))
+	gb2312, _ := simplifiedchinese.GBK.NewEncoder().Bytes([]byte("你好世界，这是一个测试"))
+
+	testcases := []struct {
+		name     string
+		input    []byte
+		declared string
+		text     string
+		charset  string
+		warnings int
+	}{
+		{"utf-8", []byte("こんにちは"), "UTF-8", "こんにちは", "utf-8", 0},
+		{"shift_jis", sjis, "Shift_JIS", "こんにちは、世界", "shift_jis", 0},
+		{"euc-jp", eucjp, "euc-jp", "こんにちは、世界", "euc-jp", 0},
+		{"iso-2022-jp", iso2022jp, `"ISO-2022-JP"`, "こんにちは、世界", "iso-2022-jp", 0},
+		{"gb2312", gb2312, "gb2312", "你好世界，这是一个测试", "gb2312", 0},
+		{"windows-1252", []byte("caf\xe9 cr\xe8me \x93quoted\x94"), "windows-1252", "café crème “quoted”", "windows-1252", 0},
+		{"ascii", []byte("hello"), "", "hello", "us-ascii", 0},
+		{"missing sjis", sjis, "", "こんにちは、世界", "shift_jis", 1},
+		{"missing euc-jp", eucjp, "", "こんにちは、世界", "euc-jp", 1},
+		{"missing iso-2022-jp", iso2022jp, "", "こんにちは、世界", "iso-2022-jp", 1},
+		{"missing gbk", gb2312, "", "你好世界，这是一个测试", "gbk", 1},
+		{"missing latin1", []byte("caf\xe9 cr\xe8me"), "", "café crème", "windows-1252", 1},
+		{"wrong iso-2022-jp", sjis, "iso-2022-jp", "こんにちは、世界", "shift_jis", 2},
+		{"wrong ascii", []byte("café"), "us-ascii", "café", "utf-8", 2},
+		{"wrong utf-8", sjis, "utf-8", "こんにちは、世界", "shift_jis", 2},
+		{"unknown", []byte("hello"), "x-unknown", "hello", "us-ascii", 2},
+		{"undetectable", []byte("a\xff\xfeb"), "", "aÿþb", "windows-1252", 1},
+	}
+
+	for _, tt := range testcases {
+		t.Run(tt.name, func(t *testing.T) {
+			text, charset, warnings := DecodeText(tt.input, tt.declared)
+			assert.Equal(t, tt.text, text)
+			assert.Equal(t, tt.charset, charset)
+			assert.Equal(t, tt.warnings, len(warnings), warnings)
+		})
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	maxHeaderLineLength = 78
+	base64LineLength    = 76
+	maxBodyLineLength   = 998
+)
+
+// addressHeaders are formatted with net/mail, which encodes the display names
+// without touching the addresses.
+var addressHeaders = map[string]bool{
+	"Bcc":             true,
+	"Cc":              true,
+	"From":            true,
+	"Reply-To":        true,
+	"Resent-Bcc":      true,
+	"Resent-Cc":       true,
+	"Resent-From":     true,
+	"Resent-Reply-To": true,
+	"Resent-Sender":   true,
+	"Resent-To":       true,
+	"Sender":          true,
+	"To":              true,
+}
+
+// WriteMail serializes a part in the JSON form as a MIME message.
+func WriteMail(w io.Writer, part *Part, option Option) error {
+	b, err := ComposePart(part, option)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// ComposePart serializes a part with its header. Multipart boundaries are
+// generated when missing or found in the content, and bodies are encoded
+// with option.transferEncoding, or with an encoding suitable for the content
+// if it is empty.
+func ComposePart(part *Part, option Option) ([]byte, error) {
+	for _, field := range part.Headers {
+		if !validHeaderName(field.Name) {
+			return nil, fmt.Errorf("invalid header name %q", field.Name)
+		}
+	}
+	header := textproto.MIMEHeader{}
+	for name, values := range part.Header {
+		if !validHeaderName(name) {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+		for _, value := range values {
+			if strings.ContainsAny(value, "\r\n") {
+				return nil, fmt.Errorf("invalid value of header %s: %q", name, value)
+			}
+		}
+		header[textproto.CanonicalMIMEHeaderKey(name)] = append([]string(nil), values...)
+	}
+
+	var body []byte
+	var err error
+	switch {
+	case part.Parts != nil:
+		body, err = composeMultipart(part, header, option)
+	case part.Message != nil:
+		body, err = ComposePart(part.Message, option)
+		header.Del("Content-Transfer-Encoding")
+		if err == nil && !isASCII(body) {
+			header.Set("Content-Transfer-Encoding", "8bit")
+		}
+	default:
+		body, err = composeBody(part, header, option)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	writeHeader(&buf, header, part.Headers)
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.Bytes(), nil
+}
+
+func composeMultipart(part *Part, header textproto.MIMEHeader, option Option) ([]byte, error) {
+	mediaType, params := contentTypeParams(header)
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		mediaType = "multipart/mixed"
+	}
+
+	var children [][]byte
+	for i := range part.Parts {
+		child, err := ComposePart(&part.Parts[i], option)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+
+	boundary := params["boundary"]
+	for _, child := range children {
+		if boundary != "" && bytes.Contains(child, []byte("--"+boundary)) {
+			boundary = ""
+		}
+	}
+	if boundary == "" {
+		var err error
+		if boundary, err = newBoundary(); err != nil {
+			return nil, err
+		}
+	}
+	params["boundary"] = boundary
+	header.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+
+	var buf bytes.Buffer
+	for _, child := range children {
+		buf.WriteString("--" + boundary + "\r\n")
+		buf.Write(child)
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("--" + boundary + "--\r\n")
+	return buf.Bytes(), nil
+}
+
+// newBoundary returns a random boundary. "=_" cannot appear in base64 or
+// quoted-printable content.
+func newBoundary() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("boundary: %w", err)
+	}
+	return "=_" + hex.EncodeToString(b), nil
+}
+
+// validHeaderName reports whether name is a field name of RFC 5322: printable
+// ASCII characters other than the colon.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] < 33 || name[i] > 126 || name[i] == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+func contentTypeParams(header textproto.MIMEHeader) (string, map[string]string) {
+	params := map[string]string{}
+	mediaType, list, err := ParseParams(header.Get("Content-Type"))
+	if err != nil || mediaType == "" {
+		return "text/plain", params
+	}
+	for _, p := range list {
+		params[p.Name] = p.Value
+	}
+	return strings.ToLower(mediaType), params
+}
+
+// partContent returns the decoded content of a single part. Depending on the
+// options of mail2json the body is still transfer encoded, converted to
+// UTF-8, base64 encoded or omitted from the JSON.
+func partContent(part *Part) ([]byte, error) {
+	if a := part.Attachment; a != nil {
+		if a.Redacted != "" {
+			return nil, nil
+		}
+		if b, err := base64.StdEncoding.DecodeString(part.Body); err == nil {
+			if sum := sha256.Sum256(b); hex.EncodeToString(sum[:]) == a.SHA256 {
+				return b, nil
+			}
+		}
+		if part.Body == "" && a.Size > 0 {
+			if a.Path == "" {
+				return nil, fmt.Errorf("body of attachment %q omitted", a.Filename)
+			}
+			return os.ReadFile(a.Path)
+		}
+	}
+
+	if part.Charset != "" {
+		return []byte(part.Body), nil
+	}
+
+	encoding := textproto.MIMEHeader(part.Header).Get("Content-Transfer-Encoding")
+	b, err := DecodeTransferEncoding([]byte(part.Body), encoding)
+	if err != nil {
+		b, _ = DecodeTransferEncodingLeniently([]byte(part.Body), encoding)
+	}
+	return b, nil
+}
+
+func composeBody(part *Part, header textproto.MIMEHeader, option Option) ([]byte, error) {
+	if part.Truncated != nil {
+		return nil, fmt.Errorf("body truncated from %d bytes", part.Truncated.Size)
+	}
+	content, err := partContent(part)
+	if err != nil {
+		return nil, err
+	}
+
+	mediaType, params := contentTypeParams(header)
+	isText := strings.HasPrefix(mediaType, "text/")
+	if part.Charset != "" {
+		// the body was converted to UTF-8
+		params["charset"] = "utf-8"
+		header.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+	}
+
+	encoding := option.transferEncoding
+	if encoding == "" {
+		encoding = strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding")))
+		switch {
+		case encoding == "base64" || encoding == "quoted-printable":
+		case encoding == "binary":
+		case encoding == "8bit" && !hasLongLines(content) && bytes.IndexByte(content, 0) < 0:
+		case isASCII(content) && !hasLongLines(content):
+		case isText:
+			encoding = "quoted-printable"
+		default:
+			encoding = "base64"
+		}
+	}
+
+	switch encoding {
+	case "base64":
+		header.Set("Content-Transfer-Encoding", encoding)
+		return encodeBase64(content), nil
+	case "quoted-printable":
+		header.Set("Content-Transfer-Encoding", encoding)
+		var buf bytes.Buffer
+		w := quotedprintable.NewWriter(&buf)
+		w.Binary = !isText
+		w.Write(content)
+		w.Close()
+		return buf.Bytes(), nil
+	default:
+		return content, nil
+	}
+}
+
+func hasLongLines(b []byte) bool {
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		if len(line) > maxBodyLineLength {
+			return true
+		}
+	}
+	return false
+}
+
+func encodeBase64(b []byte) []byte {
+	s := base64.StdEncoding.EncodeToString(b)
+	var buf bytes.Buffer
+	for len(s) > base64LineLength {
+		buf.WriteString(s[:base64LineLength] + "\r\n")
+		s = s[base64LineLength:]
+	}
+	if s != "" {
+		buf.WriteString(s + "\r\n")
+	}
+	return buf.Bytes()
+}
+
+// writeHeader writes the header fields in the order of the ordered header
+// fields, if any, followed by the remaining fields sorted by name.
+func writeHeader(buf *bytes.Buffer, header textproto.MIMEHeader, fields []HeaderField) {
+	written := map[string]int{}
+	for _, field := range fields {
+		name := textproto.CanonicalMIMEHeaderKey(field.Name)
+		if values := header[name]; written[name] < len(values) {
+			writeHeaderField(buf, field.Name, values[written[name]])
+			written[name]++
+		}
+	}
+
+	var names []string
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range header[name][written[name]:] {
+			writeHeaderField(buf, name, value)
+		}
+	}
+}
+
+func writeHeaderField(buf *bytes.Buffer, name string, value string) {
+	buf.WriteString(foldHeaderLine(name + ": " + EncodeHeaderValue(name, value)))
+}
+
+// EncodeHeaderValue encodes a header value containing non-ASCII characters:
+// parameters as described in RFC 2231 and anything else as RFC 2047
+// encoded-words.
+func EncodeHeaderValue(name string, value string) string {
+	if isASCII([]byte(value)) {
+		return value
+	}
+
+	name = textproto.CanonicalMIMEHeaderKey(name)
+	if parameterizedHeaders[name] {
+		token, params, err := ParseParams(value)
+		if err == nil {
+			m := map[string]string{}
+			for _, p := range params {
+				m[p.Name] = p.Value
+			}
+			if formatted := mime.FormatMediaType(token, m); formatted != "" {
+				return formatted
+			}
+		}
+	}
+	if addressHeaders[name] {
+		if list, err := addressParser.ParseList(value); err == nil {
+			var addresses []string
+			for _, a := range list {
+				addresses = append(addresses, a.String())
+			}
+			return strings.Join(addresses, ", ")
+		}
+	}
+
+	// encode runs of words with non-ASCII characters, keeping the others
+	words := strings.Split(value, " ")
+	var encoded []string
+	for i := 0; i < len(words); {
+		if isASCII([]byte(words[i])) {
+			encoded = append(encoded, words[i])
+			i++
+			continue
+		}
+		j := i
+		for j < len(words) && !isASCII([]byte(words[j])) {
+			j++
+		}
+		encoded = append(encoded, mime.QEncoding.Encode("utf-8", strings.Join(words[i:j], " ")))
+		i = j
+	}
+	return strings.Join(encoded, " ")
+}
+
+// foldHeaderLine folds a header field at spaces so that lines do not exceed
+// 78 characters where possible, and terminates it with CRLF.
+func foldHeaderLine(line string) string {
+	var b strings.Builder
+	length := 0
+	for i, word := range strings.Split(line, " ") {
+		if i > 0 {
+			// the field name stays on the line of the first word
+			if i > 1 && word != "" && length+1+len(word) > maxHeaderLineLength {
+				b.WriteString("\r\n")
+				length = 0
+			}
+			b.WriteByte(' ')
+			length++
+		}
+		b.WriteString(word)
+		length += len(word)
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
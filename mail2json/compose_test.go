@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestEncodeHeaderValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected string
+	}{
+		{"Subject", "hello", "hello"},
+		{"Subject", "café au lait", "=?utf-8?q?caf=C3=A9?= au lait"},
+		{"Subject", "Re: 日本 語 test", "Re: =?utf-8?q?=E6=97=A5=E6=9C=AC_=E8=AA=9E?= test"},
+		{"From", "Jöhn Doe <john@example.com>, bob@example.com", "=?utf-8?q?J=C3=B6hn_Doe?= <john@example.com>, <bob@example.com>"},
+		{"Content-Disposition", "attachment; filename=\"résumé.pdf\"", "attachment; filename*=utf-8''r%C3%A9sum%C3%A9.pdf"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, EncodeHeaderValue(tt.name, tt.value), tt.value)
+	}
+}
+
+func TestFoldHeaderLine(t *testing.T) {
+	assert.Equal(t, "Subject: short\r\n", foldHeaderLine("Subject: short"))
+	assert.Equal(t,
+		"Subject: "+strings.Repeat("a", 60)+"\r\n "+strings.Repeat("b", 20)+"\r\n",
+		foldHeaderLine("Subject: "+strings.Repeat("a", 60)+" "+strings.Repeat("b", 20)))
+	assert.Equal(t, "X: "+strings.Repeat("a", 100)+"\r\n", foldHeaderLine("X: "+strings.Repeat("a", 100)))
+}
+
+var roundTripMail = "From: =?ISO-8859-1?Q?J=F6rg?= <joerg@example.com>\r\n" +
+	"To: alice@example.com, \"Bob\" <bob@example.com>\r\n" +
+	"Subject: =?UTF-8?B?5pel5pys6Kqe44Gu5Lu25ZCN?= and a rather long subject which needs folding\r\n" +
+	"Received: from a by b\r\n" +
+	"Received: from c by d\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"caf=E9 --outer\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: 8bit\r\n" +
+	"\r\n" +
+	"<p>café</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"Content-Disposition: attachment; filename*=utf-8''r%C3%A9sum%C3%A9.bin\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"AAECA/8=\r\n" +
+	"--outer\r\n" +
+	"Content-Type: message/rfc822\r\n" +
+	"\r\n" +
+	"Subject: =?UTF-8?Q?=C3=A9t=C3=A9?=\r\n" +
+	"\r\n" +
+	"inner body\r\n" +
+	"--outer--\r\n"
+
+type roundTripPart struct {
+	Header    map[string]string
+	MediaType string
+	Content   string
+	Parts     []roundTripPart
+	Message   *roundTripPart
+}
+
+// summarize keeps what a round trip must preserve: the decoded headers other
+// than the MIME transport headers, the media types and the decoded contents.
+func summarize(t *testing.T, part *Part) roundTripPart {
+	summary := roundTripPart{Header: map[string]string{}}
+	for name, values := range part.Header {
+		if name == "Content-Transfer-Encoding" || name == "Content-Type" {
+			continue
+		}
+		for _, value := range values {
+			if addressHeaders[name] {
+				b, _ := json.Marshal(ParseAddressList([]string{value}))
+				value = string(b)
+			} else {
+				value = DecodeHeaderValue(name, value)
+			}
+			summary.Header[name] += value + "\n"
+		}
+	}
+	summary.MediaType, _ = contentTypeParams(part.Header)
+
+	for i := range part.Parts {
+		summary.Parts = append(summary.Parts, summarize(t, &part.Parts[i]))
+	}
+	if part.Message != nil {
+		message := summarize(t, part.Message)
+		summary.Message = &message
+	}
+	if part.Parts == nil && part.Message == nil {
+		content, err := partContent(part)
+		assert.Nil(t, err)
+		summary.Content = string(content)
+	}
+	return summary
+}
+
+func TestComposeRoundTrip(t *testing.T) {
+	options := []Option{
+		{},
+		{decodeTransferEncoding: true},
+		{decodeHeader: true, orderedHeaders: true, attachmentBody: AttachmentBodyBase64},
+		{decodeTransferEncoding: true, transferEncoding: "base64"},
+		{decodeHeader: true, transferEncoding: "quoted-printable"},
+	}
+
+	for _, option := range options {
+		option.maxDepth = defaultMaxDepth
+		original := readTestMail(t, roundTripMail, option)
+
+		// go through the JSON form as json2mail does
+		b, err := json.Marshal(original)
+		assert.Nil(t, err)
+		var decoded Part
+		assert.Nil(t, json.Unmarshal(b, &decoded))
+
+		var buf bytes.Buffer
+		assert.Nil(t, WriteMail(&buf, &decoded, option))
+		composed := buf.String()
+		for _, line := range strings.Split(composed, "\r\n") {
+			assert.LessOrEqual(t, len(line), maxHeaderLineLength, line)
+		}
+
+		reparsed := readTestMail(t, composed, option)
+		assert.Empty(t, reparsed.Defects)
+		assert.Equal(t, summarize(t, original), summarize(t, reparsed), "%+v\n%s", option, composed)
+
+		if option.orderedHeaders {
+			var names, reparsedNames []string
+			for _, field := range original.Headers {
+				names = append(names, field.Name)
+			}
+			for _, field := range reparsed.Headers {
+				reparsedNames = append(reparsedNames, field.Name)
+			}
+			assert.Equal(t, names, reparsedNames)
+		}
+	}
+}
+
+func TestComposeInvalidPart(t *testing.T) {
+	tests := []struct {
+		name string
+		part Part
+	}{
+		{"CRLF in value", Part{Header: map[string][]string{"Subject": {"a\r\nBcc: eve@example.com"}}}},
+		{"LF in value", Part{Header: map[string][]string{"Subject": {"a\nb"}}}},
+		{"colon in name", Part{Header: map[string][]string{"X-A:b": {"c"}}}},
+		{"space in name", Part{Header: map[string][]string{"X A": {"c"}}}},
+		{"ordered name", Part{Headers: []HeaderField{{Name: "X\r\nA", Value: "c"}}}},
+		{"truncated", Part{Body: "abc", Truncated: &Truncated{Size: 10}}},
+		{"truncated child", Part{
+			Header: map[string][]string{"Content-Type": {"multipart/mixed"}},
+			Parts:  []Part{{Body: "abc", Truncated: &Truncated{Size: 10}}},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			assert.NotNil(t, WriteMail(&buf, &tt.part, Option{}))
+			assert.Empty(t, buf.String())
+		})
+	}
+}
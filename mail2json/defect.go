@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// defect codes, named after the defect classes of Python's email package
+const (
+	InvalidHeaderDefect           = "InvalidHeaderDefect"
+	NoBoundaryInMultipartDefect   = "NoBoundaryInMultipartDefect"
+	StartBoundaryNotFoundDefect   = "StartBoundaryNotFoundDefect"
+	CloseBoundaryNotFoundDefect   = "CloseBoundaryNotFoundDefect"
+	InvalidBase64CharactersDefect = "InvalidBase64CharactersDefect"
+	InvalidBase64PaddingDefect    = "InvalidBase64PaddingDefect"
+	InvalidBase64LengthDefect     = "InvalidBase64LengthDefect"
+)
+
+// defect codes which Python's email package does not have, named in the same
+// way
+const (
+	InvalidQuotedPrintableDefect = "InvalidQuotedPrintableDefect"
+	InvalidEmbeddedMessageDefect = "InvalidEmbeddedMessageDefect"
+	InvalidCalendarDefect        = "InvalidCalendarDefect"
+)
+
+// Defect is a problem found in a part which did not stop it from being read.
+type Defect struct {
+	Code   string `json:"code"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// defect records a defect of the part, or returns the error in strict mode.
+func (p *Part) defect(option Option, code string, err error) error {
+	if option.strict {
+		return err
+	}
+	p.Defects = append(p.Defects, Defect{Code: code, Detail: err.Error()})
+	return nil
+}
+
+// readMessageHeader reads the header of a message and returns it with the
+// position of the body. A malformed header is a defect of the message.
+func (p *Part) readMessageHeader(b []byte, option Option) (mail.Header, int, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(b))
+	if err == nil {
+		body, err := io.ReadAll(msg.Body)
+		if err != nil {
+			return nil, 0, err
+		}
+		return msg.Header, len(b) - len(body), nil
+	}
+	if err := p.defect(option, InvalidHeaderDefect, err); err != nil {
+		return nil, 0, err
+	}
+	header, end := readMalformedHeader(b)
+	return header, end, nil
+}
+
+// readMalformedHeader reads a message header which mail.ReadMessage
+// rejected. The fields before the first malformed line are kept and the body
+// starts at that line, as if the blank line before it were missing. It
+// returns the header and the position of the body.
+func readMalformedHeader(b []byte) (mail.Header, int) {
+	end := 0
+	for end < len(b) {
+		line := b[end:]
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i+1]
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			// the separator line
+			end += len(line)
+			break
+		}
+		if !isHeaderLine(line, end == 0) {
+			break
+		}
+		end += len(line)
+	}
+
+	fields := bytes.TrimRight(b[:end], "\r\n")
+	r := io.MultiReader(bytes.NewReader(fields), strings.NewReader("\r\n\r\n"))
+	header, err := textproto.NewReader(bufio.NewReader(r)).ReadMIMEHeader()
+	if err != nil {
+		return mail.Header{}, 0
+	}
+	return mail.Header(header), end
+}
+
+// isHeaderLine reports whether a line which is not blank can belong to a
+// header: a field or, after the first line, a continuation of one.
+func isHeaderLine(line []byte, first bool) bool {
+	line = bytes.TrimRight(line, "\r\n")
+	if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+		return !first
+	}
+	name, _, ok := bytes.Cut(line, []byte(":"))
+	return ok && isHeaderName(name)
+}
+
+// readPartHeader reads the header of a body part and returns it with the
+// position of the body. A part with a broken header is read as a body
+// without header.
+func (p *Part) readPartHeader(b []byte, option Option) (textproto.MIMEHeader, int, error) {
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(b)))
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		if err := p.defect(option, InvalidHeaderDefect, fmt.Errorf("multipart: %w", err)); err != nil {
+			return nil, 0, err
+		}
+		return textproto.MIMEHeader{}, 0, nil
+	}
+	content, err := io.ReadAll(tp.R)
+	if err != nil {
+		return nil, 0, err
+	}
+	return header, len(b) - len(content), nil
+}
+
+func isHeaderName(name []byte) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for _, c := range name {
+		if c <= ' ' || c >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// DecodeTransferEncodingLeniently decodes a body which DecodeTransferEncoding
+// rejected, salvaging as much of it as possible.
+func DecodeTransferEncodingLeniently(b []byte, contentTransferEncoding string) ([]byte, []Defect) {
+	switch strings.ToLower(strings.TrimSpace(contentTransferEncoding)) {
+	case "base64":
+		return decodeBase64Leniently(b)
+	case "quoted-printable":
+		decoded, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(b)))
+		if err != nil {
+			return b, []Defect{{Code: InvalidQuotedPrintableDefect, Detail: err.Error()}}
+		}
+		return decoded, nil
+	default:
+		return b, nil
+	}
+}
+
+func isBase64(line []byte) bool {
+	for _, c := range line {
+		if !('A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '+' || c == '/' || c == '=') {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeBase64Leniently skips lines with characters outside of the base64
+// alphabet and repairs the padding.
+func decodeBase64Leniently(b []byte) ([]byte, []Defect) {
+	var defects []Defect
+	var data []byte
+
+	for i, line := range bytes.Split(b, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if !isBase64(line) {
+			defects = append(defects, Defect{
+				Code:   InvalidBase64CharactersDefect,
+				Detail: fmt.Sprintf("line %d skipped", i+1),
+			})
+			continue
+		}
+		data = append(data, line...)
+	}
+
+	trimmed := bytes.TrimRight(data, "=")
+	padding := len(data) - len(trimmed)
+	if bytes.IndexByte(trimmed, '=') >= 0 {
+		trimmed = bytes.ReplaceAll(trimmed, []byte("="), nil)
+		padding = -1
+	}
+	if len(trimmed)%4 == 1 {
+		trimmed = trimmed[:len(trimmed)-1]
+		defects = append(defects, Defect{Code: InvalidBase64LengthDefect, Detail: "last character dropped"})
+	}
+	if padding != (4-len(trimmed)%4)%4 {
+		defects = append(defects, Defect{Code: InvalidBase64PaddingDefect})
+	}
+
+	decoded := make([]byte, base64.RawStdEncoding.DecodedLen(len(trimmed)))
+	n, _ := base64.RawStdEncoding.Decode(decoded, trimmed)
+	return decoded[:n], defects
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func defectCodes(defects []Defect) []string {
+	var codes []string
+	for _, d := range defects {
+		codes = append(codes, d.Code)
+	}
+	return codes
+}
+
+func TestDecodeBase64Leniently(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		defects  []string
+	}{
+		{"aGVs\r\nbG8=\r\n", "hello", nil},
+		{"aGVs\r\n!!broken!!\r\nbG8=\r\n", "hello", []string{InvalidBase64CharactersDefect}},
+		{"aGVsbG8\r\n", "hello", []string{InvalidBase64PaddingDefect}},
+		{"aGVsbG8===\r\n", "hello", []string{InvalidBase64PaddingDefect}},
+		{"aGVsbG8hX\r\n", "hello!", []string{InvalidBase64LengthDefect}},
+	}
+
+	for _, tt := range tests {
+		actual, defects := decodeBase64Leniently([]byte(tt.input))
+		assert.Equal(t, tt.expected, string(actual), tt.input)
+		assert.Equal(t, tt.defects, defectCodes(defects), tt.input)
+	}
+}
+
+func TestReadMailDefects(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		check   func(t *testing.T, part *Part)
+		defects []string
+	}{
+		{
+			name: "no boundary",
+			input: "Content-Type: multipart/mixed\r\n" +
+				"\r\n" +
+				"body\r\n",
+			check: func(t *testing.T, part *Part) {
+				assert.Equal(t, "body\r\n", part.Body)
+				assert.Nil(t, part.Parts)
+			},
+			defects: []string{NoBoundaryInMultipartDefect},
+		},
+		{
+			name: "start boundary not found",
+			input: "Content-Type: multipart/mixed; boundary=b\r\n" +
+				"\r\n" +
+				"body\r\n",
+			check: func(t *testing.T, part *Part) {
+				assert.Equal(t, "body\r\n", part.Body)
+			},
+			defects: []string{StartBoundaryNotFoundDefect},
+		},
+		{
+			name: "truncated",
+			input: "Content-Type: multipart/mixed; boundary=b\r\n" +
+				"\r\n" +
+				"--b\r\n" +
+				"\r\n" +
+				"first\r\n" +
+				"--b\r\n" +
+				"\r\n" +
+				"second\r\n",
+			check: func(t *testing.T, part *Part) {
+				assert.Equal(t, 2, len(part.Parts))
+				assert.Equal(t, "first", part.Parts[0].Body)
+				assert.Equal(t, "second", part.Parts[1].Body)
+			},
+			defects: []string{CloseBoundaryNotFoundDefect},
+		},
+		{
+			name: "malformed header line",
+			input: "Subject: test\r\n" +
+				"Content-Type: text/plain\r\n" +
+				"this is not a header\r\n" +
+				"\r\n" +
+				"body\r\n",
+			check: func(t *testing.T, part *Part) {
+				assert.Equal(t, []string{"test"}, part.Header["Subject"])
+				assert.Equal(t, "this is not a header\r\n\r\nbody\r\n", part.Body)
+			},
+			defects: []string{InvalidHeaderDefect},
+		},
+		{
+			name: "invalid content type",
+			input: "Content-Type: text/plain; charset\r\n" +
+				"\r\n" +
+				"body\r\n",
+			check: func(t *testing.T, part *Part) {
+				assert.Equal(t, "body\r\n", part.Body)
+			},
+			defects: []string{InvalidHeaderDefect},
+		},
+		{
+			name: "bad base64",
+			input: "Content-Type: text/plain\r\n" +
+				"Content-Transfer-Encoding: base64\r\n" +
+				"\r\n" +
+				"aGVs\r\n" +
+				"#garbage#\r\n" +
+				"bG8=\r\n",
+			check: func(t *testing.T, part *Part) {
+				assert.Equal(t, "hello", part.Body)
+			},
+			defects: []string{InvalidBase64CharactersDefect},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			option := Option{decodeTransferEncoding: true}
+			part := readTestMail(t, tt.input, option)
+			tt.check(t, part)
+			assert.Equal(t, tt.defects, defectCodes(part.Defects))
+
+			option.strict = true
+			_, err := ReadMail(strings.NewReader(tt.input), option)
+			assert.NotNil(t, err)
+		})
+	}
+}
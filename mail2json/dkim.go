@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DKIM verification results, named as in RFC 8601
+const (
+	DKIMPass      = "pass"
+	DKIMFail      = "fail"
+	DKIMTempError = "temperror"
+	DKIMPermError = "permerror"
+)
+
+// DKIMResult is the verification result of a DKIM-Signature header.
+type DKIMResult struct {
+	Result     string `json:"result"`
+	Reason     string `json:"reason,omitempty"`
+	Domain     string `json:"domain,omitempty"`
+	Selector   string `json:"selector,omitempty"`
+	Algorithm  string `json:"algorithm,omitempty"`
+	Identity   string `json:"identity,omitempty"`
+	BodyLength *int64 `json:"bodyLength,omitempty"`
+}
+
+// KeyResolver looks up the TXT records of a DKIM key such as
+// "selector._domainkey.example.com".
+type KeyResolver interface {
+	LookupTXT(name string) ([]string, error)
+}
+
+// ErrKeyNotFound is returned by a KeyResolver when the name does not exist.
+var ErrKeyNotFound = errors.New("key not found")
+
+// DNSResolver looks up keys in the DNS.
+type DNSResolver struct {
+	Resolver *net.Resolver
+	Timeout  time.Duration
+}
+
+func (d DNSResolver) LookupTXT(name string) ([]string, error) {
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ctx := context.Background()
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	records, err := resolver.LookupTXT(ctx, name)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil, fmt.Errorf("%s: %w", name, ErrKeyNotFound)
+	}
+	return records, err
+}
+
+// MapResolver serves keys from memory, for offline verification and tests.
+type MapResolver map[string][]string
+
+func (m MapResolver) LookupTXT(name string) ([]string, error) {
+	records, ok := m[strings.ToLower(strings.TrimSuffix(name, "."))]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, ErrKeyNotFound)
+	}
+	return records, nil
+}
+
+// LoadKeyFile reads a MapResolver from a file with one record per line: the
+// name followed by the TXT record, e.g.
+//
+//	selector._domainkey.example.com v=DKIM1; k=rsa; p=MIIB...
+//
+// Empty lines and lines starting with "#" are ignored.
+func LoadKeyFile(path string) (MapResolver, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	resolver := MapResolver{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, record, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: record missing", path, n)
+		}
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		resolver[name] = append(resolver[name], strings.TrimSpace(record))
+	}
+	return resolver, scanner.Err()
+}
+
+// dkimError carries the result a verification failure is reported as.
+type dkimError struct {
+	result string
+	reason string
+}
+
+func (e *dkimError) Error() string {
+	return e.reason
+}
+
+func permError(format string, a ...interface{}) error {
+	return &dkimError{DKIMPermError, fmt.Sprintf(format, a...)}
+}
+
+// ParseTagList parses a DKIM tag list such as "v=1; a=rsa-sha256; ...".
+func ParseTagList(s string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, spec := range strings.Split(s, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid tag: %q", strings.TrimSpace(spec))
+		}
+		name = strings.TrimSpace(name)
+		if _, ok := tags[name]; ok {
+			return nil, fmt.Errorf("duplicate tag: %s", name)
+		}
+		tags[name] = strings.TrimSpace(value)
+	}
+	return tags, nil
+}
+
+var wspPattern = regexp.MustCompile(`[ \t]+`)
+
+func removeWhitespace(s string) string {
+	return strings.Join(strings.Fields(s), "")
+}
+
+// toCRLF turns bare LF line breaks, as found in mbox files, into CRLF.
+func toCRLF(b []byte) []byte {
+	if !bytes.Contains(b, []byte("\n")) || bytes.Count(b, []byte("\n")) == bytes.Count(b, []byte("\r\n")) {
+		return b
+	}
+	b = bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(b, []byte("\n"), []byte("\r\n"))
+}
+
+// CanonicalizeBody applies the simple or relaxed body canonicalization of
+// RFC 6376 section 3.4.
+func CanonicalizeBody(body []byte, relaxed bool) []byte {
+	lines := strings.Split(string(toCRLF(body)), "\r\n")
+	for i := range lines {
+		if relaxed {
+			lines[i] = strings.TrimRight(wspPattern.ReplaceAllString(lines[i], " "), " ")
+		}
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		if relaxed {
+			return nil
+		}
+		return []byte("\r\n")
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// CanonicalizeHeader applies the simple or relaxed header canonicalization of
+// RFC 6376 section 3.4 to a raw header field.
+func CanonicalizeHeader(raw string, relaxed bool) string {
+	raw = string(toCRLF([]byte(raw)))
+	if !strings.HasSuffix(raw, "\r\n") {
+		raw += "\r\n"
+	}
+	if !relaxed {
+		return raw
+	}
+
+	name, value, _ := strings.Cut(raw, ":")
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = strings.TrimSpace(wspPattern.ReplaceAllString(value, " "))
+	return strings.ToLower(strings.TrimRight(name, " \t")) + ":" + value + "\r\n"
+}
+
+// removeSignatureValue empties the b= tag of a raw DKIM-Signature header.
+func removeSignatureValue(raw string) string {
+	name, value, _ := strings.Cut(raw, ":")
+	specs := strings.Split(value, ";")
+	for i, spec := range specs {
+		tag, _, ok := strings.Cut(spec, "=")
+		if ok && strings.TrimSpace(tag) == "b" {
+			specs[i] = spec[:strings.Index(spec, "=")+1]
+		}
+	}
+	return name + ":" + strings.Join(specs, ";")
+}
+
+// selectHeaders returns the header fields named in the h= tag. A name which
+// occurs several times selects the instances from the bottom up.
+func selectHeaders(fields []HeaderField, names []string) []HeaderField {
+	used := map[int]bool{}
+	var selected []HeaderField
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fields[i].Name, name) {
+				used[i] = true
+				selected = append(selected, fields[i])
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// ParseDKIMKey parses the TXT record of a DKIM key.
+func ParseDKIMKey(record string) (crypto.PublicKey, string, error) {
+	tags, err := ParseTagList(record)
+	if err != nil {
+		return nil, "", err
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, "", fmt.Errorf("unsupported key version: %s", v)
+	}
+	keyType := "rsa"
+	if k, ok := tags["k"]; ok {
+		keyType = k
+	}
+	p := removeWhitespace(tags["p"])
+	if p == "" {
+		return nil, "", errors.New("key revoked")
+	}
+	b, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid key: %w", err)
+	}
+
+	switch keyType {
+	case "rsa":
+		if key, err := x509.ParsePKIXPublicKey(b); err == nil {
+			if rsaKey, ok := key.(*rsa.PublicKey); ok {
+				return rsaKey, keyType, nil
+			}
+			return nil, "", errors.New("not an rsa key")
+		}
+		key, err := x509.ParsePKCS1PublicKey(b)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid key: %w", err)
+		}
+		return key, keyType, nil
+	case "ed25519":
+		if len(b) != ed25519.PublicKeySize {
+			return nil, "", errors.New("invalid ed25519 key size")
+		}
+		return ed25519.PublicKey(b), keyType, nil
+	default:
+		return nil, "", fmt.Errorf("unsupported key type: %s", keyType)
+	}
+}
+
+// VerifyDKIM verifies every DKIM-Signature header of a message given as its
+// raw header fields and raw body.
+func VerifyDKIM(fields []HeaderField, body []byte, resolver KeyResolver, now time.Time) []DKIMResult {
+	var results []DKIMResult
+	for _, field := range fields {
+		if !strings.EqualFold(field.Name, "DKIM-Signature") {
+			continue
+		}
+		result := DKIMResult{Result: DKIMPass}
+		if err := verifySignature(&result, field, fields, body, resolver, now); err != nil {
+			result.Result = DKIMPermError
+			var e *dkimError
+			if errors.As(err, &e) {
+				result.Result = e.result
+			}
+			result.Reason = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func verifySignature(result *DKIMResult, signature HeaderField, fields []HeaderField, body []byte, resolver KeyResolver, now time.Time) error {
+	tags, err := ParseTagList(signature.Value)
+	if err != nil {
+		return permError("%v", err)
+	}
+	result.Domain = tags["d"]
+	result.Selector = tags["s"]
+	result.Algorithm = tags["a"]
+	result.Identity = tags["i"]
+
+	for _, name := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[name]; !ok {
+			return permError("tag %s missing", name)
+		}
+	}
+	if tags["v"] != "1" {
+		return permError("unsupported version: %s", tags["v"])
+	}
+
+	var keyType string
+	switch result.Algorithm {
+	case "rsa-sha256":
+		keyType = "rsa"
+	case "ed25519-sha256":
+		keyType = "ed25519"
+	default:
+		return permError("unsupported algorithm: %s", result.Algorithm)
+	}
+
+	headerCanon, bodyCanon, _ := strings.Cut(tags["c"], "/")
+	for _, c := range []*string{&headerCanon, &bodyCanon} {
+		switch *c {
+		case "":
+			*c = "simple"
+		case "simple", "relaxed":
+		default:
+			return permError("unsupported canonicalization: %s", tags["c"])
+		}
+	}
+
+	var names []string
+	fromSigned := false
+	for _, name := range strings.Split(tags["h"], ":") {
+		name = strings.TrimSpace(name)
+		names = append(names, name)
+		fromSigned = fromSigned || strings.EqualFold(name, "From")
+	}
+	if !fromSigned {
+		return permError("From header not signed")
+	}
+
+	if result.Identity != "" {
+		_, domain, _ := strings.Cut(result.Identity, "@")
+		domain = strings.ToLower(domain)
+		d := strings.ToLower(result.Domain)
+		if domain != d && !strings.HasSuffix(domain, "."+d) {
+			return permError("identity %s not in domain %s", result.Identity, result.Domain)
+		}
+	}
+	if x, ok := tags["x"]; ok {
+		expires, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return permError("invalid expiration: %s", x)
+		}
+		if now.Unix() > expires {
+			return permError("signature expired")
+		}
+	}
+
+	// the body hash is checked before the key lookup, so that offline
+	// verification still reports altered bodies
+	canonicalBody := CanonicalizeBody(body, bodyCanon == "relaxed")
+	if l, ok := tags["l"]; ok {
+		length, err := strconv.ParseInt(l, 10, 64)
+		if err != nil || length < 0 {
+			return permError("invalid body length: %s", l)
+		}
+		result.BodyLength = &length
+		if length > int64(len(canonicalBody)) {
+			return &dkimError{DKIMFail, "body shorter than the signed length"}
+		}
+		canonicalBody = canonicalBody[:length]
+	}
+	bodyHash, err := base64.StdEncoding.DecodeString(removeWhitespace(tags["bh"]))
+	if err != nil {
+		return permError("invalid body hash: %v", err)
+	}
+	if sum := sha256.Sum256(canonicalBody); !bytes.Equal(sum[:], bodyHash) {
+		return &dkimError{DKIMFail, "body hash mismatch"}
+	}
+
+	key, err := lookupKey(resolver, result)
+	if err != nil {
+		return err
+	}
+	if got, ok := keyTypeOf(key); !ok || got != keyType {
+		return permError("key type does not match algorithm %s", result.Algorithm)
+	}
+
+	hash := sha256.New()
+	for _, field := range selectHeaders(fields, names) {
+		hash.Write([]byte(CanonicalizeHeader(field.Raw, headerCanon == "relaxed")))
+	}
+	unsigned := CanonicalizeHeader(removeSignatureValue(signature.Raw), headerCanon == "relaxed")
+	hash.Write([]byte(strings.TrimSuffix(unsigned, "\r\n")))
+	digest := hash.Sum(nil)
+
+	sig, err := base64.StdEncoding.DecodeString(removeWhitespace(tags["b"]))
+	if err != nil {
+		return permError("invalid signature: %v", err)
+	}
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, digest, sig) {
+			err = errors.New("invalid signature")
+		}
+	}
+	if err != nil {
+		return &dkimError{DKIMFail, "signature verification failed"}
+	}
+	return nil
+}
+
+func keyTypeOf(key crypto.PublicKey) (string, bool) {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		return "rsa", true
+	case ed25519.PublicKey:
+		return "ed25519", true
+	}
+	return "", false
+}
+
+// lookupKey returns the first key of the signing domain which can verify the
+// signature.
+func lookupKey(resolver KeyResolver, result *DKIMResult) (crypto.PublicKey, error) {
+	records, err := resolver.LookupTXT(result.Selector + "._domainkey." + result.Domain)
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, permError("no key for signature")
+	} else if err != nil {
+		return nil, &dkimError{DKIMTempError, err.Error()}
+	}
+	if len(records) == 0 {
+		return nil, permError("no key for signature")
+	}
+
+	for _, record := range records {
+		var key crypto.PublicKey
+		key, _, err = ParseDKIMKey(record)
+		if err == nil {
+			if err = checkKeyRecord(record, result); err == nil {
+				return key, nil
+			}
+		}
+	}
+	return nil, permError("%v", err)
+}
+
+// checkKeyRecord applies the restrictions of a key record, see RFC 6376
+// 3.6.1: the hash algorithms of h=, the service types of s=, and the flag s
+// of t=, which requires the identity to be in the signing domain itself.
+func checkKeyRecord(record string, result *DKIMResult) error {
+	tags, err := ParseTagList(record)
+	if err != nil {
+		return err
+	}
+	_, hashAlgorithm, _ := strings.Cut(result.Algorithm, "-")
+	if h, ok := tags["h"]; ok && !hasTagListValue(h, hashAlgorithm) {
+		return fmt.Errorf("key does not allow %s", hashAlgorithm)
+	}
+	if s, ok := tags["s"]; ok && !hasTagListValue(s, "*") && !hasTagListValue(s, "email") {
+		return fmt.Errorf("key not for email: %s", s)
+	}
+	if hasTagListValue(tags["t"], "s") && result.Identity != "" {
+		_, domain, _ := strings.Cut(result.Identity, "@")
+		if !strings.EqualFold(domain, result.Domain) {
+			return fmt.Errorf("identity %s not allowed in a subdomain of %s", result.Identity, result.Domain)
+		}
+	}
+	return nil
+}
+
+// hasTagListValue reports whether a colon separated tag value contains value.
+func hasTagListValue(list string, value string) bool {
+	for _, v := range strings.Split(list, ":") {
+		if strings.EqualFold(strings.TrimSpace(v), value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCanonicalize(t *testing.T) {
+	// the example of RFC 6376 section 3.4.6
+	header := "A: X\r\nB : Y\t\r\n\tZ  \r\n"
+	body := " C \r\nD \t E\r\n\r\n\r\n"
+
+	var relaxed, simple string
+	for _, field := range ReadHeaderFields([]byte(header + "\r\n")) {
+		relaxed += CanonicalizeHeader(field.Raw, true)
+		simple += CanonicalizeHeader(field.Raw, false)
+	}
+	assert.Equal(t, "a:X\r\nb:Y Z\r\n", relaxed)
+	assert.Equal(t, header, simple)
+
+	assert.Equal(t, " C\r\nD E\r\n", string(CanonicalizeBody([]byte(body), true)))
+	assert.Equal(t, " C \r\nD \t E\r\n", string(CanonicalizeBody([]byte(body), false)))
+
+	assert.Equal(t, "\r\n", string(CanonicalizeBody(nil, false)))
+	assert.Equal(t, "", string(CanonicalizeBody([]byte("\r\n\r\n"), true)))
+	assert.Equal(t, "a\r\nb\r\n", string(CanonicalizeBody([]byte("a\nb"), false)))
+}
+
+func TestRemoveSignatureValue(t *testing.T) {
+	assert.Equal(t,
+		"DKIM-Signature: v=1; b=; bh=abc;\r\n\td=example.com\r\n",
+		removeSignatureValue("DKIM-Signature: v=1; b=dGVz\r\n\tdA==; bh=abc;\r\n\td=example.com\r\n"))
+	assert.Equal(t, "DKIM-Signature: v=1; b=", removeSignatureValue("DKIM-Signature: v=1; b=dGVzdA==\r\n"))
+}
+
+// signDKIM prepends a DKIM-Signature header to a message.
+func signDKIM(t *testing.T, message string, tags string, key crypto.Signer) string {
+	t.Helper()
+	header, body, _ := strings.Cut(message, "\r\n\r\n")
+	fields := ReadHeaderFields([]byte(header + "\r\n\r\n"))
+
+	parsed, err := ParseTagList(tags)
+	assert.Nil(t, err)
+	headerCanon, bodyCanon, _ := strings.Cut(parsed["c"], "/")
+
+	canonicalBody := CanonicalizeBody([]byte(body), bodyCanon == "relaxed")
+	if l, ok := parsed["l"]; ok {
+		n := 0
+		for _, c := range l {
+			n = n*10 + int(c-'0')
+		}
+		canonicalBody = canonicalBody[:n]
+	}
+	bodyHash := sha256.Sum256(canonicalBody)
+	signature := "DKIM-Signature: " + tags + "; bh=" + base64.StdEncoding.EncodeToString(bodyHash[:]) + "; b="
+
+	hash := sha256.New()
+	for _, field := range selectHeaders(fields, strings.Split(parsed["h"], ":")) {
+		hash.Write([]byte(CanonicalizeHeader(field.Raw, headerCanon == "relaxed")))
+	}
+	hash.Write([]byte(strings.TrimSuffix(CanonicalizeHeader(signature, headerCanon == "relaxed"), "\r\n")))
+	digest := hash.Sum(nil)
+
+	var opts crypto.SignerOpts = crypto.SHA256
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		opts = crypto.Hash(0)
+	}
+	sig, err := key.Sign(rand.Reader, digest, opts)
+	assert.Nil(t, err)
+
+	return signature + base64.StdEncoding.EncodeToString(sig) + "\r\n" + message
+}
+
+type failingResolver struct{}
+
+func (failingResolver) LookupTXT(name string) ([]string, error) {
+	return nil, errors.New("timeout")
+}
+
+func TestVerifyDKIM(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.Nil(t, err)
+	rsaPublic, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	assert.Nil(t, err)
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	resolver := MapResolver{
+		"rsa._domainkey.example.com":     {"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(rsaPublic)},
+		"ed._domainkey.example.com":      {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edPublic)},
+		"revoked._domainkey.example.com": {"v=DKIM1; p="},
+		"strict._domainkey.example.com":  {"v=DKIM1; k=ed25519; t=y:s; p=" + base64.StdEncoding.EncodeToString(edPublic)},
+		"sha1._domainkey.example.com":    {"v=DKIM1; k=ed25519; h=sha1; p=" + base64.StdEncoding.EncodeToString(edPublic)},
+		"hashes._domainkey.example.com":  {"v=DKIM1; k=ed25519; h=sha1:sha256; s=email; p=" + base64.StdEncoding.EncodeToString(edPublic)},
+		"service._domainkey.example.com": {"v=DKIM1; k=ed25519; s=other; p=" + base64.StdEncoding.EncodeToString(edPublic)},
+	}
+
+	message := "From: Alice <alice@example.com>\r\n" +
+		"To: bob@example.com\r\n" +
+		"Subject:  a   test\r\n" +
+		"\r\n" +
+		"Hello  \r\n" +
+		"world\r\n" +
+		"\r\n"
+	relaxedRSA := "v=1; a=rsa-sha256; c=relaxed/relaxed; d=example.com; s=rsa; h=from:to:subject"
+	simpleEd := "v=1; a=ed25519-sha256; c=simple/simple; d=example.com; i=@mail.example.com; s=ed; h=From:Subject:Subject"
+
+	tests := []struct {
+		name     string
+		input    string
+		resolver KeyResolver
+		result   string
+		reason   string
+	}{
+		{"rsa relaxed", signDKIM(t, message, relaxedRSA, rsaKey), resolver, DKIMPass, ""},
+		{"ed25519 simple", signDKIM(t, message, simpleEd, edKey), resolver, DKIMPass, ""},
+		{
+			"relaxed survives whitespace changes",
+			strings.Replace(signDKIM(t, message, relaxedRSA, rsaKey), "Hello  \r\n", "Hello\r\n", 1),
+			resolver, DKIMPass, "",
+		},
+		{
+			"simple body altered",
+			strings.Replace(signDKIM(t, message, simpleEd, edKey), "Hello  \r\n", "Hello\r\n", 1),
+			resolver, DKIMFail, "body hash mismatch",
+		},
+		{
+			"header altered",
+			strings.Replace(signDKIM(t, message, relaxedRSA, rsaKey), "a   test", "another test", 1),
+			resolver, DKIMFail, "signature verification failed",
+		},
+		{
+			"body length",
+			signDKIM(t, message, relaxedRSA+"; l=7", rsaKey) + "appended\r\n",
+			resolver, DKIMPass, "",
+		},
+		{
+			"key type mismatch",
+			signDKIM(t, message, strings.Replace(relaxedRSA, "s=rsa", "s=ed", 1), rsaKey),
+			resolver, DKIMPermError, "key type does not match algorithm rsa-sha256",
+		},
+		{
+			"identity in a subdomain with t=s",
+			signDKIM(t, message, strings.Replace(simpleEd, "s=ed", "s=strict", 1), edKey),
+			resolver, DKIMPermError, "identity @mail.example.com not allowed in a subdomain of example.com",
+		},
+		{
+			"identity in the domain with t=s",
+			signDKIM(t, message, strings.NewReplacer("s=ed", "s=strict", "@mail.", "@").Replace(simpleEd), edKey),
+			resolver, DKIMPass, "",
+		},
+		{
+			"hash algorithm not allowed",
+			signDKIM(t, message, strings.Replace(simpleEd, "s=ed", "s=sha1", 1), edKey),
+			resolver, DKIMPermError, "key does not allow sha256",
+		},
+		{
+			"hash algorithm and service type allowed",
+			signDKIM(t, message, strings.Replace(simpleEd, "s=ed", "s=hashes", 1), edKey),
+			resolver, DKIMPass, "",
+		},
+		{
+			"service type not allowed",
+			signDKIM(t, message, strings.Replace(simpleEd, "s=ed", "s=service", 1), edKey),
+			resolver, DKIMPermError, "key not for email: other",
+		},
+		{
+			"revoked key",
+			signDKIM(t, message, strings.Replace(relaxedRSA, "s=rsa", "s=revoked", 1), rsaKey),
+			resolver, DKIMPermError, "key revoked",
+		},
+		{
+			"no key",
+			signDKIM(t, message, strings.Replace(relaxedRSA, "s=rsa", "s=none", 1), rsaKey),
+			resolver, DKIMPermError, "no key for signature",
+		},
+		{"lookup failure", signDKIM(t, message, relaxedRSA, rsaKey), failingResolver{}, DKIMTempError, "timeout"},
+		{
+			"expired",
+			signDKIM(t, message, relaxedRSA+"; x=1000", rsaKey),
+			resolver, DKIMPermError, "signature expired",
+		},
+		{
+			"from not signed",
+			signDKIM(t, message, strings.Replace(relaxedRSA, "h=from:", "h=", 1), rsaKey),
+			resolver, DKIMPermError, "From header not signed",
+		},
+		{
+			"unsupported algorithm",
+			signDKIM(t, message, strings.Replace(relaxedRSA, "rsa-sha256", "rsa-sha1", 1), rsaKey),
+			resolver, DKIMPermError, "unsupported algorithm: rsa-sha1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			part := readTestMail(t, tt.input, Option{dkimResolver: tt.resolver})
+			if assert.Equal(t, 1, len(part.DKIM)) {
+				assert.Equal(t, tt.result, part.DKIM[0].Result)
+				assert.Equal(t, tt.reason, part.DKIM[0].Reason)
+				assert.Equal(t, "example.com", part.DKIM[0].Domain)
+			}
+		})
+	}
+
+	// a message converted to LF line endings, as in mbox files
+	lf := strings.ReplaceAll(signDKIM(t, message, simpleEd, edKey), "\r\n", "\n")
+	part := readTestMail(t, lf, Option{dkimResolver: resolver})
+	assert.Equal(t, DKIMPass, part.DKIM[0].Result)
+
+	part = readTestMail(t, message, Option{dkimResolver: resolver})
+	assert.Nil(t, part.DKIM)
+}
+
+func TestVerifyDKIMRFC8463(t *testing.T) {
+	// the ed25519 example of RFC 8463 appendix A, signed independently of
+	// this implementation
+	input := "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+		" d=football.example.com; i=@football.example.com;\r\n" +
+		" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+		" subject : date : message-id : from : subject : date;\r\n" +
+		" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+		" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+		" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n" +
+		"From: Joe SixPack <joe@football.example.com>\r\n" +
+		"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+		"Subject: Is dinner ready?\r\n" +
+		"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+		"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+		"\r\n" +
+		"Hi.\r\n" +
+		"\r\n" +
+		"We lost the game.  Are you hungry yet?\r\n" +
+		"\r\n" +
+		"Joe.\r\n"
+	resolver := MapResolver{
+		"brisbane._domainkey.football.example.com": {"v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="},
+	}
+
+	header, body, _ := strings.Cut(input, "\r\n\r\n")
+	results := VerifyDKIM(ReadHeaderFields([]byte(header+"\r\n\r\n")), []byte(body), resolver, time.Now())
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, DKIMPass, results[0].Result, results[0].Reason)
+	assert.Equal(t, "@football.example.com", results[0].Identity)
+
+	tampered := strings.Replace(body, "hungry", "Hungry", 1)
+	results = VerifyDKIM(ReadHeaderFields([]byte(header+"\r\n\r\n")), []byte(tampered), resolver, time.Now())
+	assert.Equal(t, DKIMFail, results[0].Result)
+}
+
+func TestLoadKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	content := "# keys\n" +
+		"\n" +
+		"sel._domainkey.Example.com. v=DKIM1; k=ed25519; p=AAAA\n"
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0o600))
+
+	resolver, err := LoadKeyFile(path)
+	assert.Nil(t, err)
+	records, err := resolver.LookupTXT("sel._domainkey.example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"v=DKIM1; k=ed25519; p=AAAA"}, records)
+
+	_, err = resolver.LookupTXT("other._domainkey.example.com")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+}
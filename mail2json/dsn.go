@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+// bounce classes of failed deliveries
+const (
+	BounceHard = "hard"
+	BounceSoft = "soft"
+)
+
+// DeliveryStatus is a delivery status notification as defined in RFC 3464.
+// Heuristic is set when it was guessed from the text of a bounce which does
+// not follow the RFC.
+type DeliveryStatus struct {
+	ReportingMTA      string            `json:"reportingMta,omitempty"`
+	ArrivalDate       string            `json:"arrivalDate,omitempty"`
+	Recipients        []RecipientStatus `json:"recipients"`
+	OriginalMessageID string            `json:"originalMessageId,omitempty"`
+	Heuristic         bool              `json:"heuristic,omitempty"`
+}
+
+type RecipientStatus struct {
+	FinalRecipient    string `json:"finalRecipient,omitempty"`
+	OriginalRecipient string `json:"originalRecipient,omitempty"`
+	Action            string `json:"action,omitempty"`
+	Status            string `json:"status,omitempty"`
+	DiagnosticCode    string `json:"diagnosticCode,omitempty"`
+	RemoteMTA         string `json:"remoteMta,omitempty"`
+	LastAttemptDate   string `json:"lastAttemptDate,omitempty"`
+	Bounce            string `json:"bounce,omitempty"`
+}
+
+// ClassifyBounce tells hard bounces from soft ones by the status code and
+// the action. A full mailbox is treated as a soft bounce although it is
+// reported as a permanent failure.
+func ClassifyBounce(action string, status string) string {
+	switch {
+	case strings.HasPrefix(status, "4."):
+		return BounceSoft
+	case status == "5.2.2":
+		return BounceSoft
+	case strings.HasPrefix(status, "5."):
+		return BounceHard
+	case strings.EqualFold(action, "delayed"):
+		return BounceSoft
+	case strings.EqualFold(action, "failed"):
+		return BounceHard
+	}
+	return ""
+}
+
+// typedValue removes the type of a field such as "rfc822; user@example.com".
+func typedValue(value string) string {
+	if _, v, ok := strings.Cut(value, ";"); ok {
+		return strings.TrimSpace(v)
+	}
+	return strings.TrimSpace(value)
+}
+
+var statusPattern = regexp.MustCompile(`\b[245]\.\d{1,3}\.\d{1,3}\b`)
+
+// ParseDeliveryStatus parses the body of a message/delivery-status part: a
+// group of per-message fields followed by a group of fields per recipient. A
+// malformed group is read up to the malformed line and the rest of it is
+// skipped; the first such error is returned with the fields of all groups.
+func ParseDeliveryStatus(b []byte) (*DeliveryStatus, error) {
+	dsn := &DeliveryStatus{Recipients: []RecipientStatus{}}
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(b)))
+
+	var malformed error
+	first := true
+	for {
+		fields, err := tp.ReadMIMEHeader()
+		if len(fields) > 0 {
+			if first {
+				dsn.ReportingMTA = typedValue(fields.Get("Reporting-Mta"))
+				dsn.ArrivalDate = strings.TrimSpace(fields.Get("Arrival-Date"))
+				first = false
+			} else {
+				recipient := RecipientStatus{
+					FinalRecipient:    typedValue(fields.Get("Final-Recipient")),
+					OriginalRecipient: typedValue(fields.Get("Original-Recipient")),
+					Action:            strings.ToLower(strings.TrimSpace(fields.Get("Action"))),
+					Status:            statusPattern.FindString(fields.Get("Status")),
+					DiagnosticCode:    typedValue(fields.Get("Diagnostic-Code")),
+					RemoteMTA:         typedValue(fields.Get("Remote-Mta")),
+					LastAttemptDate:   strings.TrimSpace(fields.Get("Last-Attempt-Date")),
+				}
+				recipient.Bounce = ClassifyBounce(recipient.Action, recipient.Status)
+				dsn.Recipients = append(dsn.Recipients, recipient)
+			}
+		}
+		if err == nil {
+			continue
+		}
+		if err == io.EOF {
+			return dsn, malformed
+		}
+		if malformed == nil {
+			malformed = err
+		}
+		// skip the rest of the group
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return dsn, malformed
+			}
+			if line == "" {
+				break
+			}
+		}
+	}
+}
+
+func isDeliveryStatus(mediaType string) bool {
+	return mediaType == "message/delivery-status" || mediaType == "message/global-delivery-status"
+}
+
+// findParts returns the parts of a subtree, not descending into embedded
+// messages, for which match returns true.
+func findParts(part *Part, match func(*Part) bool) []*Part {
+	var found []*Part
+	if match(part) {
+		found = append(found, part)
+	}
+	for i := range part.Parts {
+		found = append(found, findParts(&part.Parts[i], match)...)
+	}
+	return found
+}
+
+// originalMessageID returns the Message-ID of the returned message or its
+// header included in a report.
+func originalMessageID(part *Part) string {
+	for _, p := range findParts(part, func(p *Part) bool { return IsEmbeddedMessage(p.mediaType()) }) {
+		header := textproto.MIMEHeader(nil)
+		if p.Message != nil {
+			header = p.Message.header()
+		} else if content, err := partContent(p); err == nil {
+			header, _ = textproto.NewReader(bufio.NewReader(bytes.NewReader(content))).ReadMIMEHeader()
+		}
+		if ids := ParseMessageIDs(header.Values("Message-Id")); len(ids) > 0 {
+			return ids[0]
+		}
+	}
+	return ""
+}
+
+// ReadDeliveryStatus returns the delivery status of a bounce: the parsed
+// delivery-status part of a multipart/report, or failing that, what can be
+// guessed from the text of a message which looks like a bounce. The
+// delivery-status part must have been read with the -dsn option.
+func ReadDeliveryStatus(part *Part) *DeliveryStatus {
+	reports := findParts(part, func(p *Part) bool { return isDeliveryStatus(p.mediaType()) })
+	if len(reports) > 0 {
+		if reports[0].deliveryStatus == nil {
+			return nil
+		}
+		dsn := *reports[0].deliveryStatus
+		dsn.OriginalMessageID = originalMessageID(part)
+		return &dsn
+	}
+
+	if !looksLikeBounce(part.header()) {
+		return nil
+	}
+	texts := findParts(part, func(p *Part) bool { return p.Parts == nil && p.mediaType() == "text/plain" })
+	if len(texts) == 0 {
+		return nil
+	}
+	content, err := partContent(texts[0])
+	if err != nil {
+		return nil
+	}
+	dsn := GuessDeliveryStatus(content)
+	if dsn == nil {
+		return nil
+	}
+	dsn.OriginalMessageID = originalMessageID(part)
+	return dsn
+}
+
+var (
+	bounceSenderPattern  = regexp.MustCompile(`(?i)mailer-daemon|postmaster`)
+	bounceSubjectPattern = regexp.MustCompile(`(?i)undeliver|undelivered|delivery (status notification|failure|has failed)|mail delivery failed|returned mail|failure notice|delivery failure`)
+	bounceEndPattern     = regexp.MustCompile(`(?i)^\s*-+\s*(below this line|this is a copy|original message)|^\s*original message follows`)
+	smtpCodePattern      = regexp.MustCompile(`\b([45])\d\d\b`)
+	bounceAddressPattern = regexp.MustCompile(`[^\s<>@":;,()\[\]]+@[^\s<>@":;,()\[\]]+\.[A-Za-z]{2,}`)
+)
+
+func looksLikeBounce(header textproto.MIMEHeader) bool {
+	return bounceSenderPattern.MatchString(header.Get("From")) ||
+		bounceSubjectPattern.MatchString(DecodeHeaderValue("Subject", header.Get("Subject")))
+}
+
+// GuessDeliveryStatus finds failed recipients in the text of a bounce which
+// is not a delivery status notification, such as those of qmail and Exim: a
+// line with an SMTP code belongs to the address on the line itself, or else
+// to the last address above it. The copy of the returned message is skipped.
+func GuessDeliveryStatus(b []byte) *DeliveryStatus {
+	dsn := &DeliveryStatus{Recipients: []RecipientStatus{}, Heuristic: true}
+	seen := map[string]bool{}
+	recipient := ""
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if bounceEndPattern.MatchString(line) {
+			break
+		}
+
+		address := bounceAddressPattern.FindString(line)
+		if address != "" {
+			recipient = strings.ToLower(address)
+		}
+		code := smtpCodePattern.FindStringSubmatch(line)
+		if code == nil || recipient == "" || seen[recipient] {
+			continue
+		}
+		seen[recipient] = true
+
+		status := statusPattern.FindString(line)
+		if status == "" {
+			status = code[1] + ".0.0"
+		}
+		action := "failed"
+		if code[1] == "4" {
+			action = "delayed"
+		}
+		dsn.Recipients = append(dsn.Recipients, RecipientStatus{
+			FinalRecipient: recipient,
+			Action:         action,
+			Status:         status,
+			DiagnosticCode: line,
+			Bounce:         ClassifyBounce(action, status),
+		})
+	}
+	if len(dsn.Recipients) == 0 {
+		return nil
+	}
+	return dsn
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestClassifyBounce(t *testing.T) {
+	tests := []struct {
+		action   string
+		status   string
+		expected string
+	}{
+		{"failed", "5.1.1", BounceHard},
+		{"failed", "5.2.2", BounceSoft},
+		{"delayed", "4.4.1", BounceSoft},
+		{"failed", "", BounceHard},
+		{"delayed", "", BounceSoft},
+		{"delivered", "2.0.0", ""},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, ClassifyBounce(tt.action, tt.status), tt.action+" "+tt.status)
+	}
+}
+
+const deliveryStatusTestMail = "From: Mail Delivery System <MAILER-DAEMON@mx.example.com>\r\n" +
+	"Subject: Undelivered Mail Returned to Sender\r\n" +
+	"Content-Type: multipart/report; report-type=delivery-status; boundary=b\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"I'm sorry to have to inform you that your message could not be delivered.\r\n" +
+	"--b\r\n" +
+	"Content-Type: message/delivery-status\r\n" +
+	"\r\n" +
+	"Reporting-MTA: dns; mx.example.com\r\n" +
+	"Arrival-Date: Mon, 2 Jan 2006 15:04:05 +0000\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; alice@example.org\r\n" +
+	"Original-Recipient: rfc822;Alice@example.org\r\n" +
+	"Action: failed\r\n" +
+	"Status: 5.1.1\r\n" +
+	"Remote-MTA: dns; mx.example.org\r\n" +
+	"Diagnostic-Code: smtp; 550 5.1.1 <alice@example.org>: Recipient address\r\n" +
+	"    rejected: User unknown\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; bob@example.org\r\n" +
+	"Action: delayed\r\n" +
+	"Status: 4.4.1 (connection timed out)\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/rfc822-headers\r\n" +
+	"\r\n" +
+	"Message-ID: <original@example.com>\r\n" +
+	"Subject: hello\r\n" +
+	"--b--\r\n"
+
+func TestReadMailDeliveryStatus(t *testing.T) {
+	input := deliveryStatusTestMail
+	part := readTestMail(t, input, Option{deliveryStatus: true})
+	assert.Equal(t, &DeliveryStatus{
+		ReportingMTA: "mx.example.com",
+		ArrivalDate:  "Mon, 2 Jan 2006 15:04:05 +0000",
+		Recipients: []RecipientStatus{
+			{
+				FinalRecipient:    "alice@example.org",
+				OriginalRecipient: "Alice@example.org",
+				Action:            "failed",
+				Status:            "5.1.1",
+				DiagnosticCode:    "550 5.1.1 <alice@example.org>: Recipient address rejected: User unknown",
+				RemoteMTA:         "mx.example.org",
+				Bounce:            BounceHard,
+			},
+			{
+				FinalRecipient: "bob@example.org",
+				Action:         "delayed",
+				Status:         "4.4.1",
+				Bounce:         BounceSoft,
+			},
+		},
+		OriginalMessageID: "original@example.com",
+	}, part.DeliveryStatus)
+
+	// the report is kept when the bodies of attachments are omitted
+	omitted := readTestMail(t, input, Option{deliveryStatus: true, attachmentBody: AttachmentBodyOmit})
+	assert.Equal(t, part.DeliveryStatus, omitted.DeliveryStatus)
+
+	// and when the body is truncated
+	truncated := readTestMail(t, input, Option{deliveryStatus: true, maxBodySize: 40})
+	assert.Equal(t, part.DeliveryStatus, truncated.DeliveryStatus)
+
+	part = readTestMail(t, input, Option{})
+	assert.Nil(t, part.DeliveryStatus)
+}
+
+func TestParseDeliveryStatusMalformed(t *testing.T) {
+	dsn, err := ParseDeliveryStatus([]byte("Reporting-MTA: dns; mx.example.com\r\n" +
+		"\r\n" +
+		"Final-Recipient: rfc822; alice@example.org\r\n" +
+		"Action: failed\r\n" +
+		"this line is not a field\r\n" +
+		"Status: 5.1.1\r\n" +
+		"\r\n" +
+		"Final-Recipient: rfc822; bob@example.org\r\n" +
+		"Action: delayed\r\n" +
+		"Status: 4.4.1\r\n"))
+	assert.NotNil(t, err)
+	assert.Equal(t, "mx.example.com", dsn.ReportingMTA)
+	assert.Equal(t, []RecipientStatus{
+		{FinalRecipient: "alice@example.org", Action: "failed", Bounce: BounceHard},
+		{FinalRecipient: "bob@example.org", Action: "delayed", Status: "4.4.1", Bounce: BounceSoft},
+	}, dsn.Recipients)
+
+	input := strings.Replace(deliveryStatusTestMail, "Action: delayed\r\n", "Action delayed\r\n", 1)
+	part := readTestMail(t, input, Option{deliveryStatus: true})
+	assert.Len(t, part.DeliveryStatus.Recipients, 2)
+	assert.Equal(t, InvalidHeaderDefect, part.Parts[1].Defects[0].Code)
+}
+
+func TestGuessDeliveryStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []RecipientStatus
+	}{
+		{
+			"qmail",
+			"From: MAILER-DAEMON@mx.example.com\r\n" +
+				"Subject: failure notice\r\n" +
+				"\r\n" +
+				"Hi. This is the qmail-send program at mx.example.com.\r\n" +
+				"I'm afraid I wasn't able to deliver your message to the following addresses.\r\n" +
+				"This is a permanent error; I've given up. Sorry it didn't work out.\r\n" +
+				"\r\n" +
+				"<alice@example.org>:\r\n" +
+				"192.0.2.1 does not like recipient.\r\n" +
+				"Remote host said: 550 5.1.1 User unknown\r\n" +
+				"Giving up on 192.0.2.1.\r\n" +
+				"\r\n" +
+				"--- Below this line is a copy of the message.\r\n" +
+				"\r\n" +
+				"To: carol@example.org\r\n" +
+				"Subject: 550 reasons\r\n",
+			[]RecipientStatus{{
+				FinalRecipient: "alice@example.org",
+				Action:         "failed",
+				Status:         "5.1.1",
+				DiagnosticCode: "Remote host said: 550 5.1.1 User unknown",
+				Bounce:         BounceHard,
+			}},
+		},
+		{
+			"exim",
+			"From: Mail Delivery System <Mailer-Daemon@mx.example.com>\r\n" +
+				"Subject: Mail delivery failed: returning message to sender\r\n" +
+				"\r\n" +
+				"This message was created automatically by mail delivery software.\r\n" +
+				"\r\n" +
+				"A message that you sent could not be delivered to one or more of its\r\n" +
+				"recipients. This is a permanent error. The following address(es) failed:\r\n" +
+				"\r\n" +
+				"  Bob@Example.org\r\n" +
+				"    SMTP error from remote mail server after RCPT TO:<bob@example.org>:\r\n" +
+				"    host mx.example.org [192.0.2.1]: 452 mailbox full\r\n",
+			[]RecipientStatus{{
+				FinalRecipient: "bob@example.org",
+				Action:         "delayed",
+				Status:         "4.0.0",
+				DiagnosticCode: "host mx.example.org [192.0.2.1]: 452 mailbox full",
+				Bounce:         BounceSoft,
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		part := readTestMail(t, tt.input, Option{deliveryStatus: true})
+		if assert.NotNil(t, part.DeliveryStatus, tt.name) {
+			assert.True(t, part.DeliveryStatus.Heuristic, tt.name)
+			assert.Equal(t, tt.expected, part.DeliveryStatus.Recipients, tt.name)
+		}
+	}
+
+	part := readTestMail(t, "From: alice@example.com\r\nSubject: hello\r\n\r\n550 <bob@example.org>\r\n", Option{deliveryStatus: true})
+	assert.Nil(t, part.DeliveryStatus)
+}
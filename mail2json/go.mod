@@ -1,3 +1,20 @@
 module github.com/shirokurostone/zatsu/mail2json
 
 go 1.20
+
+require (
+	github.com/ProtonMail/go-crypto v1.0.0
+	github.com/stretchr/testify v1.8.4
+	go.mozilla.org/pkcs7 v0.10.0
+	golang.org/x/net v0.17.0
+	golang.org/x/text v0.14.0
+)
+
+require (
+	github.com/cloudflare/circl v1.3.3 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/crypto v0.14.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
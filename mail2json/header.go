@@ -0,0 +1,359 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var wordDecoder = &mime.WordDecoder{CharsetReader: NewCharsetReader}
+
+// structuredHeaders are not decoded because encoded-words are not allowed in
+// them, and decoding could change their meaning.
+var structuredHeaders = map[string]bool{
+	"Arc-Authentication-Results": true,
+	"Arc-Message-Signature":      true,
+	"Arc-Seal":                   true,
+	"Authentication-Results":     true,
+	"Content-Id":                 true,
+	"Content-Transfer-Encoding":  true,
+	"Date":                       true,
+	"Dkim-Signature":             true,
+	"In-Reply-To":                true,
+	"Message-Id":                 true,
+	"Mime-Version":               true,
+	"Received":                   true,
+	"References":                 true,
+	"Return-Path":                true,
+}
+
+// parameterizedHeaders carry RFC 2045 parameters, which may be encoded as
+// described in RFC 2231.
+var parameterizedHeaders = map[string]bool{
+	"Content-Disposition": true,
+	"Content-Type":        true,
+}
+
+// DecodeHeader returns a copy of the header in which RFC 2047 encoded-words in
+// unstructured and phrase fields, and RFC 2231 encoded parameters, are
+// converted to UTF-8.
+func DecodeHeader(header map[string][]string) map[string][]string {
+	decoded := make(map[string][]string, len(header))
+	for name, values := range header {
+		decodedValues := make([]string, len(values))
+		for i, value := range values {
+			decodedValues[i] = DecodeHeaderValue(name, value)
+		}
+		decoded[name] = decodedValues
+	}
+	return decoded
+}
+
+func DecodeHeaderValue(name string, value string) string {
+	name = textproto.CanonicalMIMEHeaderKey(name)
+
+	if parameterizedHeaders[name] {
+		if decoded, err := DecodeParameterizedValue(value); err == nil {
+			return decoded
+		}
+		return value
+	}
+	if structuredHeaders[name] || !strings.Contains(value, "=?") {
+		return value
+	}
+	if addressHeaders[name] {
+		if decoded, ok := decodeAddressList(value); ok {
+			return decoded
+		}
+	}
+
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// decodeAddressList decodes only the display names of an address list, and
+// quotes them again where needed, so that a decoded comma or angle bracket does
+// not change the addresses.
+func decodeAddressList(value string) (string, bool) {
+	list, err := addressParser.ParseList(value)
+	if err != nil {
+		return "", false
+	}
+	formatted := make([]string, len(list))
+	for i, address := range list {
+		// Some mailers put encoded-words in quoted names, which
+		// net/mail leaves as they are.
+		if strings.Contains(address.Name, "=?") {
+			if name, err := wordDecoder.DecodeHeader(address.Name); err == nil {
+				address.Name = name
+			}
+		}
+		formatted[i] = formatAddress(address)
+	}
+	return strings.Join(formatted, ", "), true
+}
+
+// formatAddress is mail.Address.String, except that a non-ASCII display name
+// is kept in UTF-8 instead of being encoded again.
+func formatAddress(address *mail.Address) string {
+	if address.Name == "" || isASCII([]byte(address.Name)) {
+		return address.String()
+	}
+	name := address.Name
+	if strings.ContainsAny(name, "()<>[]:;@\\,.\"") {
+		name = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name) + `"`
+	}
+	return name + " " + (&mail.Address{Address: address.Address}).String()
+}
+
+type Param struct {
+	Name  string
+	Value string
+}
+
+// DecodeParameterizedValue decodes the parameters of a header such as
+// Content-Type, reassembling RFC 2231 continuations and converting the values
+// to UTF-8. Encoded-words, which some mailers put in quoted parameter values,
+// are decoded as well.
+func DecodeParameterizedValue(value string) (string, error) {
+	token, params, err := ParseParams(value)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	sb.WriteString(token)
+	for _, p := range params {
+		fmt.Fprintf(&sb, "; %s=%s", p.Name, quoteParamValue(p.Value))
+	}
+	return sb.String(), nil
+}
+
+func quoteParamValue(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return r <= ' ' || r >= 0x7f || strings.ContainsRune(`()<>@,;:\"/[]?=`, r)
+	}) < 0 {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+type paramSegment struct {
+	index     int
+	continued bool
+	encoded   bool
+	value     string
+}
+
+// ParseParams splits a parameterized header value into its leading token and
+// its decoded parameters, in order of first appearance.
+func ParseParams(value string) (string, []Param, error) {
+	fields := splitParams(value)
+	token := strings.TrimSpace(fields[0])
+
+	var names []string
+	segments := map[string][]paramSegment{}
+
+	for _, field := range fields[1:] {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		key, v, ok := strings.Cut(field, "=")
+		if !ok {
+			return "", nil, fmt.Errorf("invalid parameter: %s", field)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		v = strings.TrimSpace(v)
+
+		segment := paramSegment{}
+		if strings.HasSuffix(key, "*") {
+			segment.encoded = true
+			key = key[:len(key)-1]
+		}
+		if name, index, ok := strings.Cut(key, "*"); ok {
+			n, err := strconv.Atoi(index)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid parameter: %s", field)
+			}
+			key = name
+			segment.index = n
+			segment.continued = true
+		}
+
+		if strings.HasPrefix(v, `"`) {
+			unquoted, err := unquoteParamValue(v)
+			if err != nil {
+				return "", nil, err
+			}
+			v = unquoted
+		}
+		segment.value = v
+
+		if _, ok := segments[key]; !ok {
+			names = append(names, key)
+		}
+		segments[key] = append(segments[key], segment)
+	}
+
+	params := make([]Param, 0, len(names))
+	for _, name := range names {
+		v, err := joinParamSegments(selectParamSegments(segments[name]))
+		if err != nil {
+			return "", nil, err
+		}
+		params = append(params, Param{Name: name, Value: v})
+	}
+	return token, params, nil
+}
+
+// splitParams splits at semicolons outside of quoted strings.
+func splitParams(s string) []string {
+	var fields []string
+	start := 0
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if quoted {
+				i++
+			}
+		case '"':
+			quoted = !quoted
+		case ';':
+			if !quoted {
+				fields = append(fields, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(fields, s[start:])
+}
+
+func unquoteParamValue(s string) (string, error) {
+	if len(s) < 2 || !strings.HasSuffix(s, `"`) {
+		return "", fmt.Errorf("unterminated quoted string: %s", s)
+	}
+	s = s[1 : len(s)-1]
+
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String(), nil
+}
+
+// selectParamSegments picks one form of a parameter given in several, as
+// mailers do for readers without RFC 2231 support: continuations over an
+// extended value over a plain value.
+func selectParamSegments(segments []paramSegment) []paramSegment {
+	var continued, extended, plain []paramSegment
+	for _, segment := range segments {
+		switch {
+		case segment.continued:
+			continued = append(continued, segment)
+		case segment.encoded:
+			extended = append(extended, segment)
+		default:
+			plain = append(plain, segment)
+		}
+	}
+	switch {
+	case continued != nil:
+		return continued
+	case extended != nil:
+		return extended[:1]
+	default:
+		return plain[:1]
+	}
+}
+
+func joinParamSegments(segments []paramSegment) (string, error) {
+	sort.SliceStable(segments, func(i, j int) bool {
+		return segments[i].index < segments[j].index
+	})
+
+	charset := ""
+	var raw []byte
+	var sb strings.Builder
+
+	flush := func() error {
+		if raw == nil {
+			return nil
+		}
+		s := string(raw)
+		raw = nil
+		if charset != "" {
+			decoded, err := convertCharset(charset, []byte(s))
+			if err != nil {
+				return err
+			}
+			s = decoded
+		}
+		sb.WriteString(s)
+		return nil
+	}
+
+	for i, segment := range segments {
+		if !segment.encoded {
+			if err := flush(); err != nil {
+				return "", err
+			}
+			v := segment.value
+			if strings.Contains(v, "=?") {
+				if decoded, err := wordDecoder.DecodeHeader(v); err == nil {
+					v = decoded
+				}
+			}
+			sb.WriteString(v)
+			continue
+		}
+
+		v := segment.value
+		if i == 0 {
+			// charset'language'value
+			parts := strings.SplitN(v, "'", 3)
+			if len(parts) != 3 {
+				return "", fmt.Errorf("invalid extended parameter: %s", v)
+			}
+			charset = strings.ToLower(parts[0])
+			if charset == "us-ascii" || charset == "utf-8" {
+				charset = ""
+			}
+			v = parts[2]
+		}
+
+		unescaped, err := url.PathUnescape(v)
+		if err != nil {
+			return "", err
+		}
+		raw = append(raw, unescaped...)
+	}
+	if err := flush(); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+func convertCharset(charset string, b []byte) (string, error) {
+	e, err := CharsetEncoding(charset)
+	if err != nil {
+		return "", err
+	}
+	decoded, err := e.NewDecoder().Bytes(b)
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
+}
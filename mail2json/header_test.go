@@ -0,0 +1,91 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDecodeHeaderValue(t *testing.T) {
+	testcases := []struct {
+		name     string
+		value    string
+		expected string
+	}{
+		{"Subject", "=?UTF-8?B?44GC44GE44GG?=", "あいう"},
+		{"Subject", "=?ISO-2022-JP?B?GyRCJCIkJCQmGyhC?=", "あいう"},
+		{"Subject", "=?iso-8859-1?Q?caf=E9?= au lait", "café au lait"},
+		{"Subject", "=?UTF-8?Q?a?= =?UTF-8?Q?b?=", "ab"},
+		{"Subject", "plain text", "plain text"},
+		{"From", "=?Shift_JIS?B?grGC8YLJgr+CzQ==?= <a@example.com>", "こんにちは <a@example.com>"},
+		{"To", `"=?UTF-8?B?44GC?=" <a@example.com>`, `あ <a@example.com>`},
+		{"From", "=?UTF-8?Q?Doe=2C_John?= <j@x>", `"Doe, John" <j@x>`},
+		{"To", "=?UTF-8?Q?=E6=97=A5=2C?= <a@example.com>, b@example.com", `"日," <a@example.com>, <b@example.com>`},
+		{"Message-ID", "<=?UTF-8?B?44GC?=@example.com>", "<=?UTF-8?B?44GC?=@example.com>"},
+		{"Subject", "=?unknown?B?44GC?=", "=?unknown?B?44GC?="},
+		{
+			"Content-Type",
+			`application/pdf; name="=?UTF-8?B?5pel5pys6KqeLnBkZg==?="`,
+			`application/pdf; name="日本語.pdf"`,
+		},
+		{
+			"Content-Disposition",
+			`attachment; filename*=UTF-8''%E6%97%A5%E6%9C%AC%E8%AA%9E.pdf`,
+			`attachment; filename="日本語.pdf"`,
+		},
+		{
+			"Content-Disposition",
+			`attachment; filename*0*=ISO-2022-JP''%1B%24B%46%7C%4B%5C; filename*1*=%38%6C%1B%28B; filename*2=".txt"`,
+			`attachment; filename="日本語.txt"`,
+		},
+		{
+			"Content-Type",
+			`text/plain; charset=us-ascii; title*=us-ascii'en-us'This%20is%20%2A%2A%2Afun%2A%2A%2A`,
+			`text/plain; charset=us-ascii; title="This is ***fun***"`,
+		},
+		{
+			"Content-Type",
+			`multipart/mixed; boundary="a;b\"c"`,
+			`multipart/mixed; boundary="a;b\"c"`,
+		},
+	}
+
+	for _, tt := range testcases {
+		t.Run(tt.value, func(t *testing.T) {
+			assert.Equal(t, tt.expected, DecodeHeaderValue(tt.name, tt.value))
+		})
+	}
+}
+
+func TestParseParams(t *testing.T) {
+	token, params, err := ParseParams(`attachment; FILENAME*1="b"; filename*0="a"; size=10`)
+	assert.Nil(t, err)
+	assert.Equal(t, "attachment", token)
+	assert.Equal(t, []Param{{Name: "filename", Value: "ab"}, {Name: "size", Value: "10"}}, params)
+
+	// the RFC 2231 form is preferred to the plain one sent along with it
+	_, params, err = ParseParams(`attachment; filename="a.pdf"; filename*=UTF-8''%E3%81%82.pdf`)
+	assert.Nil(t, err)
+	assert.Equal(t, []Param{{Name: "filename", Value: "あ.pdf"}}, params)
+
+	_, params, err = ParseParams(`attachment; filename*0*=UTF-8''%E3%81%82; filename="a.pdf"; filename*1=".pdf"`)
+	assert.Nil(t, err)
+	assert.Equal(t, []Param{{Name: "filename", Value: "あ.pdf"}}, params)
+
+	_, _, err = ParseParams(`attachment; filename`)
+	assert.NotNil(t, err)
+}
+
+func TestReadMailDecodeHeader(t *testing.T) {
+	input := "Subject: =?UTF-8?B?44GC?=\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"body\r\n"
+
+	part := readTestMail(t, input, Option{decodeHeader: true})
+	assert.Equal(t, []string{"あ"}, part.Header["Subject"])
+	assert.Equal(t, []string{"=?UTF-8?B?44GC?="}, part.RawHeader["Subject"])
+
+	part = readTestMail(t, input, Option{})
+	assert.Equal(t, []string{"=?UTF-8?B?44GC?="}, part.Header["Subject"])
+	assert.Nil(t, part.RawHeader)
+}
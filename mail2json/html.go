@@ -0,0 +1,333 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Link is a hyperlink of an HTML part. Mismatch is set when the visible text
+// shows a domain other than the one the link points to, a common trait of
+// phishing mail.
+type Link struct {
+	URL        string `json:"url"`
+	Text       string `json:"text,omitempty"`
+	Domain     string `json:"domain,omitempty"`
+	TextDomain string `json:"textDomain,omitempty"`
+	Mismatch   bool   `json:"mismatch,omitempty"`
+}
+
+// image references of HTML parts
+const (
+	ImageCID    = "cid"
+	ImageRemote = "remote"
+)
+
+type Image struct {
+	Src  string `json:"src"`
+	Kind string `json:"kind"`
+	Alt  string `json:"alt,omitempty"`
+}
+
+var domainPattern = regexp.MustCompile(`(?i)(?:^|[^a-z0-9.-])((?:[a-z0-9](?:[a-z0-9-]*[a-z0-9])?\.)+[a-z]{2,})(?:$|[^a-z0-9-])`)
+
+// textDomain returns the domain shown in the visible text of a link.
+func textDomain(text string) string {
+	if u, err := url.Parse(strings.TrimSpace(text)); err == nil && u.Host != "" {
+		return strings.ToLower(u.Hostname())
+	}
+	if m := domainPattern.FindStringSubmatch(text); m != nil {
+		return strings.ToLower(m[1])
+	}
+	return ""
+}
+
+// linkDomain returns the domain a link points to, including the domain of
+// mailto: addresses.
+func linkDomain(href string) string {
+	u, err := url.Parse(strings.TrimSpace(href))
+	if err != nil {
+		return ""
+	}
+	if strings.EqualFold(u.Scheme, "mailto") {
+		address, _, _ := strings.Cut(u.Opaque, "?")
+		if _, domain, ok := strings.Cut(address, "@"); ok {
+			return strings.ToLower(domain)
+		}
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+func sameDomain(a string, b string) bool {
+	return a == b || strings.HasSuffix(a, "."+b) || strings.HasSuffix(b, "."+a)
+}
+
+func NewLink(href string, text string) Link {
+	link := Link{
+		URL:        href,
+		Text:       text,
+		Domain:     linkDomain(href),
+		TextDomain: textDomain(text),
+	}
+	link.Mismatch = link.Domain != "" && link.TextDomain != "" && !sameDomain(link.Domain, link.TextDomain)
+	return link
+}
+
+// htmlRenderer writes the text of an HTML document line by line. Block
+// elements start new lines, and links are numbered as footnotes.
+type htmlRenderer struct {
+	buf         strings.Builder
+	prefixes    []string
+	atLineStart bool
+	space       bool
+	newlines    int
+	pre         int
+	lists       []int
+	footnotes   []string
+	// footnoteOf numbers the footnotes by URL, so that repeated links share
+	// one
+	footnoteOf map[string]int
+	links      []Link
+	images     []Image
+}
+
+func (r *htmlRenderer) write(s string) {
+	if r.atLineStart {
+		r.buf.WriteString(strings.Join(r.prefixes, ""))
+		r.atLineStart = false
+	}
+	r.buf.WriteString(s)
+	r.newlines = 0
+}
+
+func (r *htmlRenderer) lineBreak() {
+	r.buf.WriteString("\n")
+	r.atLineStart = true
+	r.space = false
+	r.newlines++
+}
+
+// block ends the current line and adds blank lines up to n line breaks.
+func (r *htmlRenderer) block(n int) {
+	if r.buf.Len() == 0 {
+		return
+	}
+	if !r.atLineStart {
+		r.lineBreak()
+	}
+	for r.newlines < n {
+		r.lineBreak()
+	}
+}
+
+func (r *htmlRenderer) text(s string) {
+	if r.pre > 0 {
+		for i, line := range strings.Split(s, "\n") {
+			if i > 0 {
+				r.lineBreak()
+			}
+			if line != "" {
+				r.write(line)
+			}
+		}
+		return
+	}
+
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		r.space = r.space || s != ""
+		return
+	}
+	first, _ := utf8.DecodeRuneInString(s)
+	last, _ := utf8.DecodeLastRuneInString(s)
+	r.space = r.space || unicode.IsSpace(first)
+	for i, word := range words {
+		if (i > 0 || r.space) && !r.atLineStart {
+			r.write(" ")
+		}
+		r.write(word)
+	}
+	r.space = unicode.IsSpace(last)
+}
+
+func attr(n *html.Node, name string) string {
+	for _, a := range n.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// textContent returns the visible text of a node with collapsed whitespace.
+func textContent(n *html.Node) string {
+	var b strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		switch {
+		case n.Type == html.TextNode:
+			b.WriteString(n.Data + " ")
+		case n.Type == html.ElementNode && n.DataAtom == atom.Img:
+			b.WriteString(attr(n, "alt") + " ")
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+func (r *htmlRenderer) children(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		r.render(c)
+	}
+}
+
+func (r *htmlRenderer) render(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		r.text(n.Data)
+		return
+	case html.DocumentNode:
+		r.children(n)
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Head, atom.Script, atom.Style, atom.Template, atom.Title:
+	case atom.Br:
+		r.lineBreak()
+	case atom.Hr:
+		r.block(1)
+		r.write("----")
+		r.block(1)
+	case atom.P, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.Table:
+		r.block(2)
+		r.children(n)
+		r.block(2)
+	case atom.Pre:
+		r.block(2)
+		r.pre++
+		r.children(n)
+		r.pre--
+		r.block(2)
+	case atom.Blockquote:
+		r.block(2)
+		r.prefixes = append(r.prefixes, "> ")
+		r.children(n)
+		r.block(1)
+		r.prefixes = r.prefixes[:len(r.prefixes)-1]
+		r.block(2)
+	case atom.Ul, atom.Ol:
+		r.block(1)
+		r.lists = append(r.lists, 0)
+		if n.DataAtom == atom.Ul {
+			r.lists[len(r.lists)-1] = -1
+		}
+		r.children(n)
+		r.lists = r.lists[:len(r.lists)-1]
+		r.block(1)
+	case atom.Li:
+		r.block(1)
+		marker := "* "
+		if len(r.lists) > 0 && r.lists[len(r.lists)-1] >= 0 {
+			r.lists[len(r.lists)-1]++
+			marker = fmt.Sprintf("%d. ", r.lists[len(r.lists)-1])
+		}
+		r.write(marker)
+		r.prefixes = append(r.prefixes, strings.Repeat(" ", len(marker)))
+		r.space = false
+		r.children(n)
+		r.prefixes = r.prefixes[:len(r.prefixes)-1]
+		r.block(1)
+	case atom.Tr, atom.Div, atom.Section, atom.Article, atom.Header, atom.Footer, atom.Center, atom.Dd, atom.Dt:
+		r.block(1)
+		r.children(n)
+		r.block(1)
+	case atom.Td, atom.Th:
+		if !r.atLineStart {
+			r.space = true
+		}
+		r.children(n)
+		r.space = true
+	case atom.A:
+		r.renderLink(n)
+	case atom.Img:
+		r.renderImage(n)
+	default:
+		r.children(n)
+	}
+}
+
+func (r *htmlRenderer) renderLink(n *html.Node) {
+	href := strings.TrimSpace(attr(n, "href"))
+	r.children(n)
+	if href == "" || strings.HasPrefix(href, "#") {
+		return
+	}
+
+	text := textContent(n)
+	r.links = append(r.links, NewLink(href, text))
+	if text != href && "mailto:"+text != href {
+		number, ok := r.footnoteOf[href]
+		if !ok {
+			r.footnotes = append(r.footnotes, href)
+			number = len(r.footnotes)
+			r.footnoteOf[href] = number
+		}
+		r.write(fmt.Sprintf("[%d]", number))
+	}
+}
+
+func (r *htmlRenderer) renderImage(n *html.Node) {
+	src := strings.TrimSpace(attr(n, "src"))
+	alt := strings.Join(strings.Fields(attr(n, "alt")), " ")
+	if alt != "" {
+		r.text(alt)
+	}
+
+	lower := strings.ToLower(src)
+	switch {
+	case strings.HasPrefix(lower, "cid:"):
+		r.images = append(r.images, Image{Src: src, Kind: ImageCID, Alt: alt})
+	case strings.HasPrefix(lower, "http:"), strings.HasPrefix(lower, "https:"), strings.HasPrefix(lower, "//"):
+		r.images = append(r.images, Image{Src: src, Kind: ImageRemote, Alt: alt})
+	}
+}
+
+// RenderHTML returns the text of an HTML document with block structure and
+// lists preserved and links numbered as footnotes, together with the links
+// and the cid: and remote image references of the document.
+func RenderHTML(s string) (string, []Link, []Image) {
+	doc, err := html.Parse(strings.NewReader(s))
+	if err != nil {
+		// html.Parse only fails on read errors
+		return s, nil, nil
+	}
+
+	r := &htmlRenderer{atLineStart: true, footnoteOf: map[string]int{}}
+	r.render(doc)
+
+	var text strings.Builder
+	text.WriteString(strings.TrimRight(r.buf.String(), "\n"))
+	if len(r.footnotes) > 0 {
+		text.WriteString("\n")
+		for i, href := range r.footnotes {
+			fmt.Fprintf(&text, "\n[%d] %s", i+1, href)
+		}
+	}
+	if text.Len() > 0 {
+		text.WriteString("\n")
+	}
+	return text.String(), r.links, r.images
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRenderHTML(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			"paragraphs",
+			"<html><head><title>t</title><style>p {}</style></head><body><h1>Title</h1><p>Hello,\n  <b>world</b>!</p><p>Line<br>break</p></body></html>",
+			"Title\n\nHello, world!\n\nLine\nbreak\n",
+		},
+		{
+			"lists",
+			"<ul><li>one</li><li>two<ol><li>a</li><li>b</li></ol></li></ul><p>after</p>",
+			"* one\n* two\n  1. a\n  2. b\n\nafter\n",
+		},
+		{
+			"links",
+			"<p>Visit <a href=\"https://example.com/\">our site</a> or <a href=\"https://example.org\">https://example.org</a>.</p>",
+			"Visit our site[1] or https://example.org.\n\n[1] https://example.com/\n",
+		},
+		{
+			"repeated links",
+			"<p><a href=\"https://example.com/a\">a</a> <a href=\"https://example.com/b\">b</a> <a href=\"https://example.com/a\">again</a></p>",
+			"a[1] b[2] again[1]\n\n[1] https://example.com/a\n[2] https://example.com/b\n",
+		},
+		{
+			"blockquote and pre",
+			"<p>said:</p><blockquote><p>quoted</p><p>text</p></blockquote><pre>a  b\n  c</pre>",
+			"said:\n\n> quoted\n\n> text\n\na  b\n  c\n",
+		},
+		{
+			"table",
+			"<table><tr><td>a</td><td>b</td></tr><tr><td>c</td><td>d &amp; e</td></tr></table>",
+			"a b\nc d & e\n",
+		},
+		{"empty", "", ""},
+	}
+
+	for _, tt := range tests {
+		actual, _, _ := RenderHTML(tt.input)
+		assert.Equal(t, tt.expected, actual, tt.name)
+	}
+}
+
+func TestRenderHTMLLinks(t *testing.T) {
+	input := "<a href=\"https://evil.example.net/login\">https://www.mybank.com/login</a>" +
+		"<a href=\"https://www.mybank.com/help\">mybank.com</a>" +
+		"<a href=\"mailto:support@mybank.com\">Support</a>" +
+		"<a href=\"#top\">top</a>" +
+		"<a href=\"https://tracker.example.net/\"><img src=\"https://tracker.example.net/pixel.gif\" alt=\"logo\"></a>" +
+		"<img src=\"cid:part1@example.com\">"
+
+	_, links, images := RenderHTML(input)
+	assert.Equal(t, []Link{
+		{URL: "https://evil.example.net/login", Text: "https://www.mybank.com/login", Domain: "evil.example.net", TextDomain: "www.mybank.com", Mismatch: true},
+		{URL: "https://www.mybank.com/help", Text: "mybank.com", Domain: "www.mybank.com", TextDomain: "mybank.com"},
+		{URL: "mailto:support@mybank.com", Text: "Support", Domain: "mybank.com"},
+		{URL: "https://tracker.example.net/", Text: "logo", Domain: "tracker.example.net"},
+	}, links)
+	assert.Equal(t, []Image{
+		{Src: "https://tracker.example.net/pixel.gif", Kind: ImageRemote, Alt: "logo"},
+		{Src: "cid:part1@example.com", Kind: ImageCID},
+	}, images)
+}
+
+func TestReadMailRenderHTML(t *testing.T) {
+	input := "Content-Type: text/html; charset=iso-8859-1\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"<p>caf=E9 <a href=3D\"https://example.com\">menu</a></p>\r\n"
+
+	part := readTestMail(t, input, Option{renderHTML: true})
+	assert.Equal(t, "café menu[1]\n\n[1] https://example.com\n", part.Text)
+	assert.Equal(t, 1, len(part.Links))
+	assert.Equal(t, "<p>caf=E9 <a href=3D\"https://example.com\">menu</a></p>\r\n", part.Body)
+
+	part = readTestMail(t, input, Option{})
+	assert.Equal(t, "", part.Text)
+	assert.Nil(t, part.Links)
+}
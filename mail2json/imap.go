@@ -0,0 +1,802 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// IMAPMessage is the IMAP metadata of a fetched message.
+type IMAPMessage struct {
+	Mailbox      string    `json:"mailbox"`
+	UIDValidity  uint32    `json:"uidValidity"`
+	UID          uint32    `json:"uid"`
+	Flags        []string  `json:"flags"`
+	InternalDate time.Time `json:"internalDate"`
+}
+
+// IMAPConfig configures FetchIMAP. Auth is "plain" or "login", or empty to
+// prefer AUTHENTICATE PLAIN when the server offers it. Checkpoint is the file
+// the last fetched UID is kept in, so that the next run only fetches newer
+// messages. The UID only advances over messages the server returned, so the
+// messages after one it did not return are fetched again by the next run,
+// while a message which cannot be parsed is reported and skipped. Flush,
+// when set, is called before the checkpoint is saved, so that it never moves
+// past messages which were emitted but not written yet.
+type IMAPConfig struct {
+	Password       string
+	Auth           string
+	Since          time.Time
+	From           string
+	Unseen         bool
+	Checkpoint     string
+	AllowPlaintext bool
+	TLSConfig      *tls.Config
+	Flush          func() error
+}
+
+// IMAPCheckpoint is the state kept in the checkpoint file. It only applies
+// to the mailbox of the same user on the same server.
+type IMAPCheckpoint struct {
+	Host        string `json:"host"`
+	User        string `json:"user"`
+	Mailbox     string `json:"mailbox"`
+	UIDValidity uint32 `json:"uidValidity"`
+	UID         uint32 `json:"uid"`
+}
+
+const imapFetchBatch = 50
+
+// the largest literal read from the server, which bounds the size of a
+// fetched message
+const maxIMAPLiteral = 64 << 20
+
+// the most a response may hold besides its literals: its status text,
+// strings, atoms and lists
+const maxIMAPResponse = 1 << 20
+
+// date-time of RFC 3501, e.g. "17-Jul-1996 02:44:25 -0700"
+const imapDateTimeLayout = "_2-Jan-2006 15:04:05 -0700"
+
+// IsIMAPURL reports whether a path argument is an imap:// or imaps:// URL.
+func IsIMAPURL(path string) bool {
+	return strings.HasPrefix(path, "imap://") || strings.HasPrefix(path, "imaps://")
+}
+
+// FetchIMAP fetches the messages of the mailbox in an imap:// or imaps://
+// URL which match the search of the config, and passes each of them to emit.
+// imaps connects with TLS, and imap upgrades the connection with STARTTLS
+// unless plaintext is allowed. The mailbox is opened read-only, so messages
+// are not marked as seen. A message which cannot be parsed is reported to
+// onError and skipped.
+func FetchIMAP(rawURL string, config IMAPConfig, option Option, emit func(*Part) error, onError func(error)) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	mailbox := strings.TrimPrefix(u.Path, "/")
+	if mailbox == "" {
+		mailbox = "INBOX"
+	}
+	if u.User == nil {
+		return fmt.Errorf("%s: user not given", u.Redacted())
+	}
+	password, ok := u.User.Password()
+	if !ok {
+		password = config.Password
+	}
+
+	c, err := dialIMAP(u, config)
+	if err != nil {
+		return fmt.Errorf("%s: %w", u.Redacted(), err)
+	}
+	defer c.close()
+
+	if err := c.login(u.User.Username(), password, config.Auth); err != nil {
+		return fmt.Errorf("%s: %w", u.Redacted(), err)
+	}
+
+	checkpoint := IMAPCheckpoint{Host: strings.ToLower(u.Host), User: u.User.Username(), Mailbox: mailbox}
+	if err := c.fetchMailbox(checkpoint, config, option, emit, onError); err != nil {
+		return fmt.Errorf("%s: %w", u.Redacted(), err)
+	}
+	c.command("LOGOUT")
+	return nil
+}
+
+func dialIMAP(u *url.URL, config IMAPConfig) (*imapConn, error) {
+	host := u.Hostname()
+	tlsConfig := config.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+
+	port := u.Port()
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	var conn net.Conn
+	var err error
+	if u.Scheme == "imaps" {
+		if port == "" {
+			port = "993"
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(host, port), tlsConfig)
+	} else {
+		if port == "" {
+			port = "143"
+		}
+		conn, err = dialer.Dial("tcp", net.JoinHostPort(host, port))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := newIMAPConn(conn)
+	greeting, err := c.readResponse()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if len(greeting) < 2 || !strings.EqualFold(imapAtom(greeting[1]), "OK") && !strings.EqualFold(imapAtom(greeting[1]), "PREAUTH") {
+		conn.Close()
+		return nil, fmt.Errorf("server rejected the connection: %s", c.text)
+	}
+	if err := c.capability(); err != nil {
+		c.close()
+		return nil, err
+	}
+
+	if u.Scheme == "imap" {
+		if c.caps["STARTTLS"] {
+			if _, err := c.command("STARTTLS"); err != nil {
+				c.close()
+				return nil, err
+			}
+			tlsConn := tls.Client(conn, tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			c.setConn(tlsConn)
+			// capabilities may change after STARTTLS, see RFC 3501 6.2.1
+			if err := c.capability(); err != nil {
+				c.close()
+				return nil, err
+			}
+		} else if !config.AllowPlaintext {
+			c.close()
+			return nil, errors.New("server does not support STARTTLS")
+		}
+	}
+	return c, nil
+}
+
+// imapConn is an IMAP4rev1 client connection as defined in RFC 3501, with
+// just the commands to fetch messages.
+type imapConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+	tag  int
+	caps map[string]bool
+	// the text of the last status response
+	text string
+	// what is left of maxIMAPResponse for the response being read
+	remaining int
+}
+
+func newIMAPConn(conn net.Conn) *imapConn {
+	c := &imapConn{}
+	c.setConn(conn)
+	return c
+}
+
+func (c *imapConn) setConn(conn net.Conn) {
+	c.conn = conn
+	c.r = bufio.NewReader(conn)
+	c.w = bufio.NewWriter(conn)
+}
+
+func (c *imapConn) nextTag() string {
+	c.tag++
+	return "A" + strconv.Itoa(c.tag)
+}
+
+func (c *imapConn) close() error {
+	return c.conn.Close()
+}
+
+// command sends a command and returns its untagged responses. The arguments
+// are sent as atoms, except imapString values which are quoted or sent as
+// literals.
+func (c *imapConn) command(args ...interface{}) ([][]interface{}, error) {
+	return c.commandFunc(nil, args...)
+}
+
+// commandFunc sends a command and passes each untagged response to handle,
+// or collects them when handle is nil.
+func (c *imapConn) commandFunc(handle func([]interface{}) error, args ...interface{}) ([][]interface{}, error) {
+	tag := c.nextTag()
+	c.w.WriteString(tag)
+	for _, arg := range args {
+		c.w.WriteByte(' ')
+		s, ok := arg.(imapString)
+		if !ok {
+			fmt.Fprint(c.w, arg)
+			continue
+		}
+		if isQuotable(string(s)) {
+			c.w.WriteString(quoteIMAP(string(s)))
+			continue
+		}
+		// a literal waits for the continuation request
+		fmt.Fprintf(c.w, "{%d}\r\n", len(s))
+		if err := c.continuation(); err != nil {
+			return nil, err
+		}
+		c.w.WriteString(string(s))
+	}
+	c.w.WriteString("\r\n")
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	return c.readUntilTagged(tag, handle)
+}
+
+// continuation flushes the pending command and waits for the continuation
+// request of the server.
+func (c *imapConn) continuation() error {
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	for {
+		fields, err := c.readResponse()
+		if err != nil {
+			return err
+		}
+		switch imapAtom(fields[0]) {
+		case "+":
+			return nil
+		case "*":
+			continue
+		default:
+			return fmt.Errorf("IMAP: %s", c.text)
+		}
+	}
+}
+
+func (c *imapConn) readUntilTagged(tag string, handle func([]interface{}) error) ([][]interface{}, error) {
+	var untagged [][]interface{}
+	for {
+		fields, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		switch imapAtom(fields[0]) {
+		case "*":
+			if handle == nil {
+				untagged = append(untagged, fields)
+			} else if err := handle(fields); err != nil {
+				return nil, err
+			}
+		case tag:
+			if len(fields) < 2 || !strings.EqualFold(imapAtom(fields[1]), "OK") {
+				return nil, fmt.Errorf("IMAP: %s", c.text)
+			}
+			return untagged, nil
+		}
+	}
+}
+
+func (c *imapConn) capability() error {
+	responses, err := c.command("CAPABILITY")
+	if err != nil {
+		return err
+	}
+	c.caps = map[string]bool{}
+	for _, fields := range responses {
+		if len(fields) > 1 && strings.EqualFold(imapAtom(fields[1]), "CAPABILITY") {
+			for _, f := range fields[2:] {
+				c.caps[strings.ToUpper(imapAtom(f))] = true
+			}
+		}
+	}
+	return nil
+}
+
+func (c *imapConn) login(user string, password string, auth string) error {
+	if auth == "" && c.caps["AUTH=PLAIN"] {
+		auth = "plain"
+	}
+	switch auth {
+	case "plain":
+		return c.authenticatePlain(user, password)
+	case "", "login":
+		if c.caps["LOGINDISABLED"] {
+			return errors.New("LOGIN is disabled by the server")
+		}
+		_, err := c.command("LOGIN", imapString(user), imapString(password))
+		return err
+	default:
+		return fmt.Errorf("unsupported authentication: %s", auth)
+	}
+}
+
+// authenticatePlain authenticates with the PLAIN SASL mechanism of RFC 4616,
+// sending the credentials with the command when the server supports SASL-IR.
+func (c *imapConn) authenticatePlain(user string, password string) error {
+	tag := c.nextTag()
+	credentials := base64.StdEncoding.EncodeToString([]byte("\x00" + user + "\x00" + password))
+	if c.caps["SASL-IR"] {
+		fmt.Fprintf(c.w, "%s AUTHENTICATE PLAIN %s\r\n", tag, credentials)
+	} else {
+		fmt.Fprintf(c.w, "%s AUTHENTICATE PLAIN\r\n", tag)
+		if err := c.continuation(); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.w, "%s\r\n", credentials)
+	}
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	_, err := c.readUntilTagged(tag, nil)
+	return err
+}
+
+// fetchMailbox examines the mailbox of the checkpoint and fetches the
+// messages matching the search.
+func (c *imapConn) fetchMailbox(checkpoint IMAPCheckpoint, config IMAPConfig, option Option, emit func(*Part) error, onError func(error)) error {
+	mailbox := checkpoint.Mailbox
+	responses, err := c.command("EXAMINE", imapString(EncodeMailboxName(mailbox)))
+	if err != nil {
+		return err
+	}
+	var uidValidity uint32
+	for _, fields := range responses {
+		if code, arg := imapResponseCode(fields); code == "UIDVALIDITY" {
+			v, _ := strconv.ParseUint(arg, 10, 32)
+			uidValidity = uint32(v)
+		}
+	}
+
+	checkpoint.UIDValidity = uidValidity
+	if config.Checkpoint != "" {
+		saved, err := LoadIMAPCheckpoint(config.Checkpoint)
+		if err != nil {
+			return err
+		}
+		// UIDs are only kept while the UIDVALIDITY stays the same
+		if saved.Host == checkpoint.Host && saved.User == checkpoint.User && saved.Mailbox == mailbox && saved.UIDValidity == uidValidity {
+			checkpoint.UID = saved.UID
+		}
+	}
+
+	responses, err = c.command(append([]interface{}{"UID", "SEARCH"}, IMAPSearchCriteria(checkpoint.UID, config)...)...)
+	if err != nil {
+		return err
+	}
+	var uids []uint32
+	for _, fields := range responses {
+		if len(fields) < 2 || !strings.EqualFold(imapAtom(fields[1]), "SEARCH") {
+			continue
+		}
+		for _, f := range fields[2:] {
+			// n:* always matches the last message, even below n
+			if uid, err := strconv.ParseUint(imapAtom(f), 10, 32); err == nil && uint32(uid) > checkpoint.UID {
+				uids = append(uids, uint32(uid))
+			}
+		}
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+
+	// the checkpoint stops before the first message which was not fetched
+	stopped := false
+	for start := 0; start < len(uids); start += imapFetchBatch {
+		end := start + imapFetchBatch
+		if end > len(uids) {
+			end = len(uids)
+		}
+		batch := uids[start:end]
+		set := make([]string, len(batch))
+		for i, uid := range batch {
+			set[i] = strconv.FormatUint(uint64(uid), 10)
+		}
+
+		// messages are emitted as they arrive, so that only one is held in
+		// memory
+		fetched := map[uint32]bool{}
+		handle := func(fields []interface{}) error {
+			if len(fields) < 4 || !strings.EqualFold(imapAtom(fields[2]), "FETCH") {
+				return nil
+			}
+			info, body, err := readFetchResponse(fields[3], mailbox, uidValidity)
+			if err != nil {
+				onError(fmt.Errorf("%s: %w", mailbox, err))
+				return nil
+			}
+			// a message which cannot be parsed would fail again
+			fetched[info.UID] = true
+			msg, err := ReadMail(bytes.NewReader(body), option)
+			if err != nil {
+				onError(fmt.Errorf("%s: UID %d: %w", mailbox, info.UID, err))
+				return nil
+			}
+			msg.IMAP = info
+			return emit(msg)
+		}
+		if _, err := c.commandFunc(handle, "UID", "FETCH", strings.Join(set, ","), "(UID FLAGS INTERNALDATE BODY.PEEK[])"); err != nil {
+			return err
+		}
+		for i := 0; i < len(batch) && !stopped; i++ {
+			if fetched[batch[i]] {
+				checkpoint.UID = batch[i]
+				continue
+			}
+			stopped = true
+			if config.Checkpoint != "" {
+				onError(fmt.Errorf("%s: UID %d was not fetched, the checkpoint stays before it", mailbox, batch[i]))
+			}
+		}
+		if config.Checkpoint != "" {
+			if config.Flush != nil {
+				if err := config.Flush(); err != nil {
+					return err
+				}
+			}
+			if err := SaveIMAPCheckpoint(config.Checkpoint, checkpoint); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readFetchResponse returns the metadata and the body of a message from the
+// attributes of a FETCH response.
+func readFetchResponse(attrs interface{}, mailbox string, uidValidity uint32) (*IMAPMessage, []byte, error) {
+	list, ok := attrs.([]interface{})
+	if !ok {
+		return nil, nil, errors.New("IMAP: invalid FETCH response")
+	}
+
+	info := &IMAPMessage{Mailbox: mailbox, UIDValidity: uidValidity, Flags: []string{}}
+	var body []byte
+	for i := 0; i+1 < len(list); i += 2 {
+		switch strings.ToUpper(imapAtom(list[i])) {
+		case "UID":
+			uid, err := strconv.ParseUint(imapAtom(list[i+1]), 10, 32)
+			if err != nil {
+				return nil, nil, fmt.Errorf("IMAP: invalid UID: %w", err)
+			}
+			info.UID = uint32(uid)
+		case "FLAGS":
+			flags, _ := list[i+1].([]interface{})
+			for _, f := range flags {
+				info.Flags = append(info.Flags, imapAtom(f))
+			}
+		case "INTERNALDATE":
+			date, err := time.Parse(imapDateTimeLayout, imapAtom(list[i+1]))
+			if err == nil {
+				info.InternalDate = date
+			}
+		case "BODY[]":
+			body, _ = list[i+1].([]byte)
+		}
+	}
+	if body == nil {
+		return nil, nil, fmt.Errorf("IMAP: UID %d: body not returned", info.UID)
+	}
+	return info, body, nil
+}
+
+// IMAPSearchCriteria returns the UID SEARCH criteria for the messages after
+// the UID matching the config.
+func IMAPSearchCriteria(after uint32, config IMAPConfig) []interface{} {
+	criteria := []interface{}{"UID", strconv.FormatUint(uint64(after)+1, 10) + ":*"}
+	if !config.Since.IsZero() {
+		criteria = append(criteria, "SINCE", config.Since.Format("2-Jan-2006"))
+	}
+	if config.From != "" {
+		criteria = append(criteria, "FROM", imapString(config.From))
+	}
+	if config.Unseen {
+		criteria = append(criteria, "UNSEEN")
+	}
+	return criteria
+}
+
+// LoadIMAPCheckpoint reads a checkpoint file. A missing file is an empty
+// checkpoint.
+func LoadIMAPCheckpoint(path string) (IMAPCheckpoint, error) {
+	var checkpoint IMAPCheckpoint
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return checkpoint, nil
+	} else if err != nil {
+		return checkpoint, err
+	}
+	if err := json.Unmarshal(b, &checkpoint); err != nil {
+		return checkpoint, fmt.Errorf("%s: %w", path, err)
+	}
+	return checkpoint, nil
+}
+
+// SaveIMAPCheckpoint replaces the checkpoint file.
+func SaveIMAPCheckpoint(path string, checkpoint IMAPCheckpoint) error {
+	b, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// imapString is a command argument sent as a string rather than an atom.
+type imapString string
+
+func isQuotable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func quoteIMAP(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// imapAtom returns an atom or a string field as a string.
+func imapAtom(field interface{}) string {
+	switch v := field.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+// imapResponseCode returns the response code of a status response, such as
+// UIDVALIDITY in "* OK [UIDVALIDITY 3857529045] UIDs valid".
+func imapResponseCode(fields []interface{}) (string, string) {
+	if len(fields) < 3 {
+		return "", ""
+	}
+	text, _ := fields[2].(string)
+	if !strings.HasPrefix(text, "[") {
+		return "", ""
+	}
+	end := strings.IndexByte(text, ']')
+	if end < 0 {
+		return "", ""
+	}
+	code, arg, _ := strings.Cut(text[1:end], " ")
+	return strings.ToUpper(code), arg
+}
+
+// readResponse reads a response line with its literals. Atoms are returned
+// as strings, quoted strings and literals as []byte, and parenthesized lists
+// as []interface{}. The text of status responses is returned as a single
+// string.
+func (c *imapConn) readResponse() ([]interface{}, error) {
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+	c.remaining = maxIMAPResponse
+
+	var fields []interface{}
+	for {
+		if len(fields) == 1 && imapAtom(fields[0]) == "+" || len(fields) == 2 && isIMAPStatus(imapAtom(fields[1])) {
+			text, err := c.readString('\n')
+			if err != nil {
+				return nil, err
+			}
+			c.text = strings.TrimRight(strings.TrimLeft(text, " "), "\r\n")
+			return append(fields, c.text), nil
+		}
+
+		b, err := c.readByte()
+		if err != nil {
+			return nil, err
+		}
+		switch b {
+		case ' ':
+		case '\r':
+		case '\n':
+			if len(fields) == 0 {
+				return nil, errors.New("IMAP: empty response")
+			}
+			return fields, nil
+		default:
+			c.unreadByte()
+			field, err := c.readField()
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, field)
+		}
+	}
+}
+
+// readByte reads a byte of a response within maxIMAPResponse.
+func (c *imapConn) readByte() (byte, error) {
+	if c.remaining <= 0 {
+		return 0, fmt.Errorf("IMAP: response longer than %d bytes", maxIMAPResponse)
+	}
+	c.remaining--
+	return c.r.ReadByte()
+}
+
+func (c *imapConn) unreadByte() {
+	c.r.UnreadByte()
+	c.remaining++
+}
+
+// readString reads up to and including the delimiter like
+// bufio.Reader.ReadString, within maxIMAPResponse.
+func (c *imapConn) readString(delim byte) (string, error) {
+	var buf strings.Builder
+	for {
+		b, err := c.readByte()
+		if err != nil {
+			return "", err
+		}
+		buf.WriteByte(b)
+		if b == delim {
+			return buf.String(), nil
+		}
+	}
+}
+
+func isIMAPStatus(s string) bool {
+	switch strings.ToUpper(s) {
+	case "OK", "NO", "BAD", "BYE", "PREAUTH":
+		return true
+	}
+	return false
+}
+
+func (c *imapConn) readField() (interface{}, error) {
+	b, err := c.readByte()
+	if err != nil {
+		return nil, err
+	}
+	switch b {
+	case '(':
+		var list []interface{}
+		for {
+			b, err := c.readByte()
+			if err != nil {
+				return nil, err
+			}
+			switch b {
+			case ')':
+				return list, nil
+			case ' ':
+			case '\r', '\n':
+				return nil, errors.New("IMAP: unterminated list")
+			default:
+				c.unreadByte()
+				field, err := c.readField()
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, field)
+			}
+		}
+	case '"':
+		var buf bytes.Buffer
+		for {
+			b, err := c.readByte()
+			if err != nil {
+				return nil, err
+			}
+			switch b {
+			case '"':
+				return buf.Bytes(), nil
+			case '\\':
+				if b, err = c.readByte(); err != nil {
+					return nil, err
+				}
+			case '\r', '\n':
+				return nil, errors.New("IMAP: unterminated string")
+			}
+			buf.WriteByte(b)
+		}
+	case '{':
+		spec, err := c.readString('}')
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSuffix(spec, "}"), "+"))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("IMAP: invalid literal {%s", spec)
+		}
+		if n > maxIMAPLiteral {
+			return nil, fmt.Errorf("IMAP: literal of %d bytes exceeds the limit of %d bytes", n, maxIMAPLiteral)
+		}
+		if line, err := c.readString('\n'); err != nil || strings.TrimRight(line, "\r\n") != "" {
+			return nil, errors.New("IMAP: invalid literal")
+		}
+		literal := make([]byte, n)
+		if _, err := io.ReadFull(c.r, literal); err != nil {
+			return nil, err
+		}
+		return literal, nil
+	}
+
+	// an atom, which may have a section in brackets such as BODY[HEADER.FIELDS (FROM)]
+	c.unreadByte()
+	var buf bytes.Buffer
+	depth := 0
+	for {
+		b, err := c.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if depth == 0 && (b == ' ' || b == '(' || b == ')' || b == '\r' || b == '\n') {
+			c.unreadByte()
+			return buf.String(), nil
+		}
+		switch b {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		}
+		buf.WriteByte(b)
+	}
+}
+
+// EncodeMailboxName encodes a mailbox name in the modified UTF-7 of RFC 3501
+// 5.1.3.
+func EncodeMailboxName(name string) string {
+	var buf strings.Builder
+	var pending []rune
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		var b []byte
+		for _, u := range utf16.Encode(pending) {
+			b = append(b, byte(u>>8), byte(u))
+		}
+		buf.WriteByte('&')
+		buf.WriteString(strings.ReplaceAll(base64.RawStdEncoding.EncodeToString(b), "/", ","))
+		buf.WriteByte('-')
+		pending = nil
+	}
+	for _, r := range name {
+		switch {
+		case r == '&':
+			flush()
+			buf.WriteString("&-")
+		case r >= 0x20 && r <= 0x7e:
+			flush()
+			buf.WriteRune(r)
+		default:
+			pending = append(pending, r)
+		}
+	}
+	flush()
+	return buf.String()
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeIMAPMessage struct {
+	uid   uint32
+	flags string
+	date  string
+	body  string
+}
+
+// fakeIMAPServer answers the commands FetchIMAP sends, for a single mailbox.
+type fakeIMAPServer struct {
+	caps        string
+	tlsConfig   *tls.Config
+	uidValidity uint32
+
+	mu       sync.Mutex
+	messages []fakeIMAPMessage
+	// UIDs whose FETCH is not answered
+	unfetched map[uint32]bool
+	logins    []string
+	searches  []string
+}
+
+func (f *fakeIMAPServer) start(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func (f *fakeIMAPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(w, format+"\r\n", args...)
+		w.Flush()
+	}
+
+	reply("* OK fake IMAP ready")
+	caps := f.caps
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		tag, command, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		verb, args, _ := strings.Cut(command, " ")
+
+		f.mu.Lock()
+		switch strings.ToUpper(verb) {
+		case "CAPABILITY":
+			reply("* CAPABILITY IMAP4rev1 %s", caps)
+			reply("%s OK done", tag)
+		case "STARTTLS":
+			reply("%s OK begin TLS", tag)
+			tlsConn := tls.Server(conn, f.tlsConfig)
+			if tlsConn.Handshake() != nil {
+				f.mu.Unlock()
+				return
+			}
+			conn = tlsConn
+			r = bufio.NewReader(conn)
+			w = bufio.NewWriter(conn)
+			caps = strings.ReplaceAll(caps, "STARTTLS", "")
+		case "LOGIN":
+			f.logins = append(f.logins, "LOGIN "+args)
+			reply("%s OK logged in", tag)
+		case "AUTHENTICATE":
+			reply("+ ")
+			credentials, _ := r.ReadString('\n')
+			b, _ := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+			f.logins = append(f.logins, "PLAIN "+string(b))
+			reply("%s OK authenticated", tag)
+		case "EXAMINE":
+			reply("* %d EXISTS", len(f.messages))
+			reply("* FLAGS (\\Answered \\Flagged \\Deleted \\Seen \\Draft)")
+			reply("* OK [UIDVALIDITY %d] UIDs valid", f.uidValidity)
+			reply("%s OK [READ-ONLY] examined", tag)
+		case "UID":
+			subcommand, args, _ := strings.Cut(args, " ")
+			if strings.EqualFold(subcommand, "SEARCH") {
+				f.searches = append(f.searches, args)
+				reply("* SEARCH%s", f.search(args))
+				reply("%s OK searched", tag)
+			} else {
+				set, _, _ := strings.Cut(args, " ")
+				for _, s := range strings.Split(set, ",") {
+					uid, _ := strconv.ParseUint(s, 10, 32)
+					for i, m := range f.messages {
+						if m.uid == uint32(uid) && !f.unfetched[m.uid] {
+							fmt.Fprintf(w, "* %d FETCH (UID %d FLAGS (%s) INTERNALDATE \"%s\" BODY[] {%d}\r\n%s)\r\n", i+1, m.uid, m.flags, m.date, len(m.body), m.body)
+						}
+					}
+				}
+				reply("%s OK fetched", tag)
+			}
+		case "LOGOUT":
+			reply("* BYE logging out")
+			reply("%s OK done", tag)
+			f.mu.Unlock()
+			return
+		default:
+			reply("%s BAD unknown command", tag)
+		}
+		f.mu.Unlock()
+	}
+}
+
+// search answers "UID n:*" like a server: with the last message when none
+// is at or above n.
+func (f *fakeIMAPServer) search(criteria string) string {
+	fields := strings.Fields(criteria)
+	start, _ := strconv.ParseUint(strings.TrimSuffix(fields[1], ":*"), 10, 32)
+	result := ""
+	for _, m := range f.messages {
+		if m.uid >= uint32(start) {
+			result += " " + strconv.FormatUint(uint64(m.uid), 10)
+		}
+	}
+	if result == "" && len(f.messages) > 0 {
+		result = " " + strconv.FormatUint(uint64(f.messages[len(f.messages)-1].uid), 10)
+	}
+	return result
+}
+
+func (f *fakeIMAPServer) add(m fakeIMAPMessage) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.messages = append(f.messages, m)
+}
+
+func fetchAll(t *testing.T, url string, config IMAPConfig) ([]*Part, error) {
+	t.Helper()
+	var messages []*Part
+	err := FetchIMAP(url, config, Option{maxDepth: defaultMaxDepth}, func(msg *Part) error {
+		messages = append(messages, msg)
+		return nil
+	}, func(err error) { t.Error(err) })
+	return messages, err
+}
+
+func TestFetchIMAP(t *testing.T) {
+	server := &fakeIMAPServer{uidValidity: 7}
+	server.add(fakeIMAPMessage{3, `\Seen`, "17-Jul-1996 02:44:25 -0700", "Subject: first\r\n\r\nbody\r\n"})
+	server.add(fakeIMAPMessage{5, ``, " 1-Feb-2024 10:00:00 +0900", "Subject: second\r\n\r\nbody\r\n"})
+	addr := server.start(t)
+
+	config := IMAPConfig{
+		AllowPlaintext: true,
+		Unseen:         true,
+		Checkpoint:     filepath.Join(t.TempDir(), "checkpoint.json"),
+	}
+	url := "imap://alice:se%22cret@" + addr + "/INBOX"
+
+	messages, err := fetchAll(t, url, config)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(messages))
+	assert.Equal(t, []string{"first"}, messages[0].Header["Subject"])
+	assert.Equal(t, &IMAPMessage{
+		Mailbox:      "INBOX",
+		UIDValidity:  7,
+		UID:          3,
+		Flags:        []string{`\Seen`},
+		InternalDate: time.Date(1996, 7, 17, 2, 44, 25, 0, time.FixedZone("", -7*60*60)),
+	}, messages[0].IMAP)
+	assert.Equal(t, uint32(5), messages[1].IMAP.UID)
+	assert.Equal(t, []string{}, messages[1].IMAP.Flags)
+	assert.Equal(t, []string{`LOGIN "alice" "se\"cret"`}, server.logins)
+
+	checkpoint, err := LoadIMAPCheckpoint(config.Checkpoint)
+	assert.Nil(t, err)
+	assert.Equal(t, IMAPCheckpoint{Host: addr, User: "alice", Mailbox: "INBOX", UIDValidity: 7, UID: 5}, checkpoint)
+
+	// only the new message is fetched
+	messages, err = fetchAll(t, url, config)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(messages))
+
+	server.add(fakeIMAPMessage{8, `\Flagged`, "2-Feb-2024 10:00:00 +0900", "Subject: third\r\n\r\nbody\r\n"})
+	messages, err = fetchAll(t, url, config)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(messages))
+	assert.Equal(t, []string{"third"}, messages[0].Header["Subject"])
+	assert.Equal(t, []string{"UID 1:* UNSEEN", "UID 6:* UNSEEN", "UID 6:* UNSEEN"}, server.searches)
+
+	// a new UIDVALIDITY starts over
+	server.uidValidity = 8
+	messages, err = fetchAll(t, url, config)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(messages))
+}
+
+func TestFetchIMAPCheckpoint(t *testing.T) {
+	server := &fakeIMAPServer{uidValidity: 1, unfetched: map[uint32]bool{2: true}}
+	for uid := uint32(1); uid <= 3; uid++ {
+		server.add(fakeIMAPMessage{uid, ``, "1-Feb-2024 10:00:00 +0000", fmt.Sprintf("Subject: %d\r\n\r\nbody\r\n", uid)})
+	}
+	addr := server.start(t)
+	config := IMAPConfig{AllowPlaintext: true, Checkpoint: filepath.Join(t.TempDir(), "checkpoint.json")}
+
+	fetch := func(user string) ([]uint32, []error) {
+		var uids []uint32
+		var errs []error
+		err := FetchIMAP("imap://"+user+":secret@"+addr+"/INBOX", config, Option{maxDepth: defaultMaxDepth}, func(msg *Part) error {
+			uids = append(uids, msg.IMAP.UID)
+			return nil
+		}, func(err error) { errs = append(errs, err) })
+		assert.Nil(t, err)
+		return uids, errs
+	}
+
+	// the checkpoint stops before the message which was not fetched
+	uids, errs := fetch("alice")
+	assert.Equal(t, []uint32{1, 3}, uids)
+	assert.Equal(t, 1, len(errs))
+	checkpoint, err := LoadIMAPCheckpoint(config.Checkpoint)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), checkpoint.UID)
+
+	server.mu.Lock()
+	server.unfetched = nil
+	server.mu.Unlock()
+
+	// the checkpoint is not saved when the output cannot be flushed
+	config.Flush = func() error { return errors.New("disk full") }
+	err = FetchIMAP("imap://alice:secret@"+addr+"/INBOX", config, Option{maxDepth: defaultMaxDepth}, func(*Part) error { return nil }, func(error) {})
+	assert.ErrorContains(t, err, "disk full")
+	config.Flush = nil
+	uids, errs = fetch("alice")
+	assert.Equal(t, []uint32{2, 3}, uids)
+	assert.Equal(t, 0, len(errs))
+
+	// the checkpoint of another user does not apply
+	uids, _ = fetch("bob")
+	assert.Equal(t, []uint32{1, 2, 3}, uids)
+	assert.Equal(t, []string{"UID 1:*", "UID 2:*", "UID 2:*", "UID 1:*"}, server.searches)
+}
+
+func TestFetchIMAPParseFailure(t *testing.T) {
+	server := &fakeIMAPServer{uidValidity: 1}
+	server.add(fakeIMAPMessage{1, ``, "1-Feb-2024 10:00:00 +0000", "not a header\r\n"})
+	server.add(fakeIMAPMessage{2, ``, "1-Feb-2024 10:00:00 +0000", "Subject: 2\r\n\r\nbody\r\n"})
+	addr := server.start(t)
+	config := IMAPConfig{AllowPlaintext: true, Checkpoint: filepath.Join(t.TempDir(), "checkpoint.json")}
+
+	// a message which cannot be parsed is skipped for good
+	var uids []uint32
+	var errs []error
+	err := FetchIMAP("imap://alice:secret@"+addr+"/INBOX", config, Option{strict: true, maxDepth: defaultMaxDepth}, func(msg *Part) error {
+		uids = append(uids, msg.IMAP.UID)
+		return nil
+	}, func(err error) { errs = append(errs, err) })
+	assert.Nil(t, err)
+	assert.Equal(t, []uint32{2}, uids)
+	assert.Equal(t, 1, len(errs))
+
+	checkpoint, err := LoadIMAPCheckpoint(config.Checkpoint)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), checkpoint.UID)
+}
+
+func TestFetchIMAPStartTLS(t *testing.T) {
+	cert, key := newTestCertificate(t, "imap.example.com", "postmaster@example.com")
+	server := &fakeIMAPServer{
+		caps:        "STARTTLS AUTH=PLAIN",
+		tlsConfig:   &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}}},
+		uidValidity: 1,
+	}
+	server.add(fakeIMAPMessage{1, ``, "1-Feb-2024 10:00:00 +0000", "Subject: secure\r\n\r\nbody\r\n"})
+	addr := server.start(t)
+
+	config := IMAPConfig{Password: "secret", TLSConfig: &tls.Config{InsecureSkipVerify: true}}
+	messages, err := fetchAll(t, "imap://alice@"+addr+"/INBOX", config)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(messages))
+	assert.Equal(t, []string{"PLAIN \x00alice\x00secret"}, server.logins)
+}
+
+func TestFetchIMAPRequiresTLS(t *testing.T) {
+	server := &fakeIMAPServer{}
+	addr := server.start(t)
+
+	_, err := fetchAll(t, "imap://alice:secret@"+addr+"/INBOX", IMAPConfig{})
+	assert.ErrorContains(t, err, "STARTTLS")
+	assert.NotContains(t, err.Error(), "secret")
+	assert.Equal(t, 0, len(server.logins))
+}
+
+func TestIMAPSearchCriteria(t *testing.T) {
+	config := IMAPConfig{
+		Since:  time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		From:   "alice@example.com",
+		Unseen: true,
+	}
+	assert.Equal(t, []interface{}{"UID", "43:*", "SINCE", "1-Feb-2024", "FROM", imapString("alice@example.com"), "UNSEEN"}, IMAPSearchCriteria(42, config))
+	assert.Equal(t, []interface{}{"UID", "1:*"}, IMAPSearchCriteria(0, IMAPConfig{}))
+}
+
+func TestReadIMAPResponse(t *testing.T) {
+	testcases := []struct {
+		response string
+		expected []interface{}
+	}{
+		{
+			"* 1 FETCH (UID 3 FLAGS (\\Seen $Label1) INTERNALDATE \"17-Jul-1996 02:44:25 -0700\" BODY[] {6}\r\nab\r\ncd)\r\n",
+			[]interface{}{"*", "1", "FETCH", []interface{}{"UID", "3", "FLAGS", []interface{}{`\Seen`, "$Label1"}, "INTERNALDATE", []byte("17-Jul-1996 02:44:25 -0700"), "BODY[]", []byte("ab\r\ncd")}},
+		},
+		{
+			"* OK [UIDVALIDITY 3857529045] UIDs \"valid\r\n",
+			[]interface{}{"*", "OK", "[UIDVALIDITY 3857529045] UIDs \"valid"},
+		},
+		{
+			"* 2 FETCH (BODY[HEADER.FIELDS (FROM)] \"a \\\"b\\\"\")\r\n",
+			[]interface{}{"*", "2", "FETCH", []interface{}{"BODY[HEADER.FIELDS (FROM)]", []byte(`a "b"`)}},
+		},
+		{
+			"+ \r\n",
+			[]interface{}{"+", ""},
+		},
+	}
+
+	for _, tt := range testcases {
+		t.Run(tt.response, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go func() {
+				server.Write([]byte(tt.response))
+				server.Close()
+			}()
+
+			fields, err := newIMAPConn(client).readResponse()
+			assert.Nil(t, err)
+			assert.Equal(t, tt.expected, fields)
+		})
+	}
+}
+
+func TestReadIMAPResponseLiteralTooLarge(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		server.Write([]byte("* 1 FETCH (BODY[] {99999999999}\r\n"))
+		server.Close()
+	}()
+
+	_, err := newIMAPConn(client).readResponse()
+	assert.ErrorContains(t, err, "exceeds the limit")
+}
+
+func TestReadIMAPResponseTooLong(t *testing.T) {
+	long := strings.Repeat("a", maxIMAPResponse+1)
+	testcases := []struct {
+		name     string
+		response string
+	}{
+		{"status", "* OK " + long + "\r\n"},
+		{"quoted", "* 1 FETCH (BODY[] \"" + long + "\")\r\n"},
+		{"atom", "* 1 FETCH (UID " + long + ")\r\n"},
+		{"list", "* 1 FETCH (FLAGS (" + strings.Repeat("a ", maxIMAPResponse/2+1) + "))\r\n"},
+	}
+
+	for _, tt := range testcases {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go func() {
+				server.Write([]byte(tt.response))
+				server.Close()
+			}()
+
+			_, err := newIMAPConn(client).readResponse()
+			assert.ErrorContains(t, err, "response longer than")
+		})
+	}
+}
+
+func TestEncodeMailboxName(t *testing.T) {
+	testcases := []struct {
+		name     string
+		expected string
+	}{
+		{"INBOX", "INBOX"},
+		{"Tom & Jerry", "Tom &- Jerry"},
+		{"日本語", "&ZeVnLIqe-"},
+		{"~peter/mail/台北/日本語", "~peter/mail/&U,BTFw-/&ZeVnLIqe-"},
+	}
+
+	for _, tt := range testcases {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, EncodeMailboxName(tt.name))
+		})
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+)
+
+// HeaderField is a header field as it appears in the message: the name in its
+// original case, the unfolded value and the raw bytes including folding and
+// the line break.
+type HeaderField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	Raw   string `json:"raw"`
+}
+
+// Offsets locates a part in the source message: where its header starts,
+// where its body starts and where it ends.
+type Offsets struct {
+	Start int64 `json:"start"`
+	Body  int64 `json:"body"`
+	End   int64 `json:"end"`
+}
+
+// ReadHeaderFields splits a header section into its fields in their original
+// order, stopping at the blank line which ends the header.
+func ReadHeaderFields(b []byte) []HeaderField {
+	var fields []HeaderField
+	var raw []byte
+
+	flush := func() {
+		if raw == nil {
+			return
+		}
+		name, value, _ := strings.Cut(string(raw), ":")
+		value = strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+		fields = append(fields, HeaderField{
+			Name:  strings.TrimRight(name, " \t"),
+			Value: strings.TrimSpace(value),
+			Raw:   string(raw),
+		})
+		raw = nil
+	}
+
+	for len(b) > 0 {
+		line := b
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			line = b[:i+1]
+		}
+		b = b[len(line):]
+
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			flush()
+		}
+		raw = append(raw, line...)
+	}
+	flush()
+	return fields
+}
+
+// setLayout records the ordered header fields and the offsets of a part whose
+// header and body are b, with the body starting at bodyStart. A negative
+// offset means the position in the source is unknown.
+func (p *Part) setLayout(b []byte, bodyStart int, offset int64, option Option) {
+	if !option.orderedHeaders {
+		return
+	}
+
+	p.Headers = ReadHeaderFields(b[:bodyStart])
+	if option.decodeHeader {
+		for i, field := range p.Headers {
+			p.Headers[i].Value = DecodeHeaderValue(field.Name, field.Value)
+		}
+	}
+
+	if offset >= 0 {
+		p.Offsets = &Offsets{
+			Start: offset,
+			Body:  offset + int64(bodyStart),
+			End:   offset + int64(len(b)),
+		}
+	}
+}
+
+// splitMultipart returns the start and end of each part of a multipart body
+// as found by multipartScanner. It reports whether the close delimiter was
+// found.
+func splitMultipart(b []byte, boundary string) ([][2]int, bool) {
+	var spans [][2]int
+	s := newMultipartScanner(bytes.NewReader(b), boundary)
+	for {
+		// reading from memory does not fail
+		ok, _ := s.Next()
+		if !ok {
+			break
+		}
+		io.Copy(io.Discard, s)
+		spans = append(spans, [2]int{int(s.start), int(s.end)})
+	}
+	return spans, s.closed
+}
+
+// kinds of the lines of a multipart body
+const (
+	multipartData = iota
+	multipartDelimiter
+	multipartClose
+)
+
+// multipartScanner reads the parts of a multipart body as defined in RFC
+// 2046 without holding them in memory. A part ends before the line break
+// preceding the next delimiter line, or before the line break at the end of
+// a truncated body. Lines are read in pieces, so a delimiter is only
+// recognized at the start of a line.
+type multipartScanner struct {
+	r         *bufio.Reader
+	delimiter []byte
+	// preamble receives the body before the first delimiter, which is the
+	// whole body when there is none
+	preamble io.Writer
+
+	offset     int64
+	lineOffset int64
+	atStart    bool
+
+	inPart    bool
+	following bool
+	done      bool
+	closed    bool
+	// the start and the end of the current part; the end is set once the
+	// part is read
+	start int64
+	end   int64
+
+	pending []byte
+	// the end of the part read so far which may be the line break before
+	// the delimiter
+	held []byte
+}
+
+func newMultipartScanner(r io.Reader, boundary string) *multipartScanner {
+	delimiter := []byte("--" + boundary)
+	size := 4096
+	if len(delimiter)+4 > size {
+		size = len(delimiter) + 4
+	}
+	return &multipartScanner{r: bufio.NewReaderSize(r, size), delimiter: delimiter, atStart: true}
+}
+
+// Next advances to the next part, skipping the rest of the current one, and
+// reports whether there is one.
+func (s *multipartScanner) Next() (bool, error) {
+	if s.inPart {
+		if _, err := io.Copy(io.Discard, s); err != nil {
+			return false, err
+		}
+	}
+	for !s.following && !s.done {
+		line, kind, err := s.readLine()
+		if err == io.EOF {
+			s.done = true
+			break
+		} else if err != nil {
+			return false, err
+		}
+		switch kind {
+		case multipartClose:
+			s.done = true
+			s.closed = true
+		case multipartDelimiter:
+			s.following = true
+		default:
+			if s.preamble != nil {
+				if _, err := s.preamble.Write(line); err != nil {
+					return false, err
+				}
+			}
+		}
+	}
+	if !s.following {
+		return false, nil
+	}
+	s.following = false
+	s.inPart = true
+	s.start = s.offset
+	return true, nil
+}
+
+// Read reads the body of the current part.
+func (s *multipartScanner) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		if !s.inPart {
+			return 0, io.EOF
+		}
+		if err := s.scanPart(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *multipartScanner) scanPart() error {
+	line, kind, err := s.readLine()
+	if err == io.EOF {
+		// a truncated last part ends as if the delimiter followed it
+		s.end = s.offset
+		if bytes.HasSuffix(s.held, []byte("\n")) {
+			s.end -= int64(len(s.held))
+		} else {
+			s.pending = s.held
+		}
+		s.held = nil
+		s.inPart = false
+		s.done = true
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if kind != multipartData {
+		s.end = s.lineOffset - int64(len(s.held))
+		s.held = nil
+		s.inPart = false
+		if kind == multipartClose {
+			s.done = true
+			s.closed = true
+		} else {
+			s.following = true
+		}
+		return nil
+	}
+
+	b := append(s.held, line...)
+	n := 0
+	if bytes.HasSuffix(b, []byte("\r\n")) {
+		n = 2
+	} else if bytes.HasSuffix(b, []byte("\n")) || bytes.HasSuffix(b, []byte("\r")) {
+		n = 1
+	}
+	s.pending = b[:len(b)-n]
+	s.held = append([]byte(nil), b[len(b)-n:]...)
+	return nil
+}
+
+// readLine reads the next line, or a piece of a long one, and tells whether
+// it is a delimiter line. The rest of a long delimiter line is skipped.
+func (s *multipartScanner) readLine() ([]byte, int, error) {
+	atStart := s.atStart
+	s.lineOffset = s.offset
+	line, err := s.r.ReadSlice('\n')
+	if len(line) == 0 {
+		return nil, multipartData, err
+	}
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, multipartData, err
+	}
+	line = append([]byte(nil), line...)
+	s.offset += int64(len(line))
+	s.atStart = line[len(line)-1] == '\n'
+
+	if !atStart || !bytes.HasPrefix(line, s.delimiter) {
+		return line, multipartData, nil
+	}
+	rest := bytes.TrimRight(line[len(s.delimiter):], " \t\r\n")
+	kind := multipartDelimiter
+	if bytes.HasPrefix(rest, []byte("--")) {
+		kind = multipartClose
+	} else if len(rest) != 0 {
+		return line, multipartData, nil
+	}
+
+	for !s.atStart {
+		more, err := s.r.ReadSlice('\n')
+		s.offset += int64(len(more))
+		if err == io.EOF {
+			break
+		} else if err != nil && err != bufio.ErrBufferFull {
+			return nil, kind, err
+		}
+		s.atStart = len(more) > 0 && more[len(more)-1] == '\n'
+	}
+	return line, kind, nil
+}
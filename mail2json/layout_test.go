@@ -0,0 +1,83 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestReadHeaderFields(t *testing.T) {
+	input := "Received: from a\r\n" +
+		"\tby b\r\n" +
+		"subject: one\r\n" +
+		"Received: from c\r\n" +
+		"X-Empty:\r\n" +
+		"\r\n" +
+		"Not-A-Header: body\r\n"
+
+	assert.Equal(t, []HeaderField{
+		{Name: "Received", Value: "from a\tby b", Raw: "Received: from a\r\n\tby b\r\n"},
+		{Name: "subject", Value: "one", Raw: "subject: one\r\n"},
+		{Name: "Received", Value: "from c", Raw: "Received: from c\r\n"},
+		{Name: "X-Empty", Value: "", Raw: "X-Empty:\r\n"},
+	}, ReadHeaderFields([]byte(input)))
+}
+
+func TestSplitMultipart(t *testing.T) {
+	tests := []struct {
+		input  string
+		spans  []string
+		closed bool
+	}{
+		{"preamble\r\n--b\r\none\r\n--b \r\ntwo\r\n--b--\r\nepilogue\r\n", []string{"one", "two"}, true},
+		{"--b\none\n--bb\n--b--\n", []string{"one\n--bb"}, true},
+		{"--b\r\none\r\n", []string{"one"}, false},
+		{"no boundary\r\n", nil, false},
+	}
+
+	for _, tt := range tests {
+		spans, closed := splitMultipart([]byte(tt.input), "b")
+		var actual []string
+		for _, span := range spans {
+			actual = append(actual, tt.input[span[0]:span[1]])
+		}
+		assert.Equal(t, tt.spans, actual, tt.input)
+		assert.Equal(t, tt.closed, closed, tt.input)
+	}
+}
+
+func TestReadMailOrderedHeaders(t *testing.T) {
+	input := "Subject: =?UTF-8?B?w6k=?=\r\n" +
+		"content-type: multipart/mixed;\r\n" +
+		" boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"one\r\n" +
+		"--b\r\n" +
+		"Content-Type: message/rfc822\r\n" +
+		"\r\n" +
+		"Subject: inner\r\n" +
+		"\r\n" +
+		"two\r\n" +
+		"--b--\r\n"
+
+	part := readTestMail(t, input, Option{orderedHeaders: true, decodeHeader: true, maxDepth: defaultMaxDepth})
+	assert.Equal(t, []HeaderField{
+		{Name: "Subject", Value: "é", Raw: "Subject: =?UTF-8?B?w6k=?=\r\n"},
+		{Name: "content-type", Value: "multipart/mixed; boundary=b", Raw: "content-type: multipart/mixed;\r\n boundary=b\r\n"},
+	}, part.Headers)
+	assert.Equal(t, &Offsets{Start: 0, Body: 74, End: int64(len(input))}, part.Offsets)
+
+	text := part.Parts[0]
+	assert.Equal(t, "Content-Type: text/plain\r\n\r\none", input[text.Offsets.Start:text.Offsets.End])
+	assert.Equal(t, "one", input[text.Offsets.Body:text.Offsets.End])
+
+	inner := part.Parts[1].Message
+	assert.Equal(t, "Subject: inner\r\n\r\ntwo", input[inner.Offsets.Start:inner.Offsets.End])
+	assert.Equal(t, "two", input[inner.Offsets.Body:inner.Offsets.End])
+
+	part = readTestMail(t, input, Option{})
+	assert.Nil(t, part.Headers)
+	assert.Nil(t, part.Offsets)
+}
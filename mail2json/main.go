@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"flag"
@@ -9,150 +11,711 @@ import (
 	"io"
 	"log"
 	"mime"
-	"mime/multipart"
 	"mime/quotedprintable"
-	"net/mail"
+	"net/http"
+	"net/textproto"
 	"os"
 	"strings"
+	"time"
 )
 
 type Part struct {
-	Header map[string][]string `json:"header"`
-	Body   string              `json:"body,omitempty"`
-	Parts  []Part              `json:"parts,omitempty"`
+	Source         *Source             `json:"source,omitempty"`
+	Envelope       *Envelope           `json:"envelope,omitempty"`
+	IMAP           *IMAPMessage        `json:"imap,omitempty"`
+	Header         map[string][]string `json:"header"`
+	Headers        []HeaderField       `json:"headers,omitempty"`
+	Offsets        *Offsets            `json:"offsets,omitempty"`
+	RawHeader      map[string][]string `json:"rawHeader,omitempty"`
+	Parsed         *Parsed             `json:"parsed,omitempty"`
+	Analysis       *Analysis           `json:"analysis,omitempty"`
+	Body           string              `json:"body,omitempty"`
+	Charset        string              `json:"charset,omitempty"`
+	DecodeWarnings []string            `json:"decodeWarnings,omitempty"`
+	Attachment     *Attachment         `json:"attachment,omitempty"`
+	Truncated      *Truncated          `json:"truncated,omitempty"`
+	Message        *Part               `json:"message,omitempty"`
+	Defects        []Defect            `json:"defects,omitempty"`
+	DKIM           []DKIMResult        `json:"dkim,omitempty"`
+	Security       *Security           `json:"security,omitempty"`
+	Text           string              `json:"text,omitempty"`
+	Links          []Link              `json:"links,omitempty"`
+	Images         []Image             `json:"images,omitempty"`
+	PartID         string              `json:"partId,omitempty"`
+	Disposition    string              `json:"disposition,omitempty"`
+	Preferred      []string            `json:"preferred,omitempty"`
+	CIDReferences  []CIDReference      `json:"cidReferences,omitempty"`
+	Summary        *Summary            `json:"summary,omitempty"`
+	DeliveryStatus *DeliveryStatus     `json:"deliveryStatus,omitempty"`
+	Calendar       *Calendar           `json:"calendar,omitempty"`
+	Contacts       []Contact           `json:"contacts,omitempty"`
+	ThreadID       string              `json:"threadId,omitempty"`
+	ParentID       string              `json:"parentId,omitempty"`
+	Parts          []Part              `json:"parts,omitempty"`
+
+	// deliveryStatus is the report of a delivery-status part, parsed from
+	// the whole body before it is truncated.
+	deliveryStatus *DeliveryStatus
 }
 
 type Option struct {
 	decodeTransferEncoding bool
+	decodeHeader           bool
+	parseHeaders           bool
+	analyze                bool
+	renderHTML             bool
+	summarize              bool
+	deliveryStatus         bool
+	calendar               bool
+	orderedHeaders         bool
+	mboxFormat             string
+	extractDir             string
+	attachmentBody         string
+	maxBodySize            int64
+	oversize               string
+	transferEncoding       string
+	dkimResolver           KeyResolver
+	security               *SecurityKeys
+	strict                 bool
+	maxDepth               int
+	depth                  int
 }
 
 func main() {
 	option := Option{
 		decodeTransferEncoding: false,
+		mboxFormat:             MboxRD,
+		attachmentBody:         AttachmentBodyRaw,
+		oversize:               OversizeTruncate,
+		maxDepth:               defaultMaxDepth,
 	}
 
 	flag.BoolVar(&option.decodeTransferEncoding, "decode", false, "decode contents")
 	flag.BoolVar(&option.decodeTransferEncoding, "d", false, "decode contents")
+	flag.BoolVar(&option.decodeHeader, "decode-header", false, "decode RFC 2047 encoded-words and RFC 2231 parameters in headers")
+	flag.BoolVar(&option.decodeHeader, "H", false, "decode RFC 2047 encoded-words and RFC 2231 parameters in headers")
+	flag.BoolVar(&option.parseHeaders, "parse-headers", false, "add structured address, date, message id and list headers")
+	flag.BoolVar(&option.parseHeaders, "P", false, "add structured address, date, message id and list headers")
+	flag.BoolVar(&option.analyze, "analysis", false, "add the hops of the Received headers and the Authentication-Results and ARC verdicts")
+	flag.BoolVar(&option.renderHTML, "html", false, "add a text rendering, the links and the image references of HTML parts")
+	flag.BoolVar(&option.summarize, "summary", false, "annotate alternative and related parts and add the text body, HTML body and attachments of the message")
+	flag.BoolVar(&option.summarize, "S", false, "annotate alternative and related parts and add the text body, HTML body and attachments of the message")
+	flag.BoolVar(&option.deliveryStatus, "dsn", false, "add the per-recipient delivery status of bounces")
+	flag.BoolVar(&option.calendar, "calendar", false, "add the events of iCalendar parts and the contacts of vCards")
+	flag.BoolVar(&option.orderedHeaders, "ordered-headers", false, "add the header fields in their original order and the byte offsets of each part")
+	flag.BoolVar(&option.orderedHeaders, "O", false, "add the header fields in their original order and the byte offsets of each part")
+	flag.StringVar(&option.mboxFormat, "mbox-format", MboxRD, "mbox variant (mboxo, mboxrd, mboxcl, mboxcl2)")
+	flag.StringVar(&option.extractDir, "extract", "", "write decoded attachments to the directory")
+	flag.StringVar(&option.attachmentBody, "attachment-body", AttachmentBodyRaw, "body of attachments in the output (raw, base64, omit)")
+	flag.Int64Var(&option.maxBodySize, "max-body-size", 0, "maximum size in bytes of each body in the output (0: unlimited)")
+	flag.StringVar(&option.oversize, "oversize", OversizeTruncate, "how bodies over -max-body-size are written (truncate, skip)")
+	flag.BoolVar(&option.strict, "strict", false, "fail on malformed messages instead of reporting defects")
+	flag.IntVar(&option.maxDepth, "max-depth", defaultMaxDepth, "maximum nesting depth of embedded messages to parse")
+	verifyDKIM := false
+	flag.BoolVar(&verifyDKIM, "dkim", false, "verify DKIM signatures, looking up the keys in the DNS")
+	dkimKeys := ""
+	flag.StringVar(&dkimKeys, "dkim-keys", "", "verify DKIM signatures with the keys in the file instead of the DNS")
+	thread := false
+	flag.BoolVar(&thread, "thread", false, "add threadId and parentId of the messages by the JWZ threading algorithm")
+	checkSecurity := false
+	flag.BoolVar(&checkSecurity, "security", false, "verify S/MIME and PGP/MIME signatures and report encrypted parts")
+	smimeRoots := ""
+	flag.StringVar(&smimeRoots, "smime-roots", "", "verify S/MIME signers against the PEM encoded CA certificates in the file instead of the system roots")
+	smimeKey := ""
+	flag.StringVar(&smimeKey, "smime-key", "", "decrypt S/MIME parts with the PEM encoded certificate and private key in the file")
+	pgpKeyring := ""
+	flag.StringVar(&pgpKeyring, "pgp-keyring", "", "verify and decrypt PGP/MIME parts with the keys in the file")
+	stream := false
+	flag.BoolVar(&stream, "stream", false, "write the output while reading each message, so that memory use does not grow with its size; otherwise each message and its JSON are held in memory whole (cannot be used with -dkim, -security, -thread, -json2mail, -redact, -summary, -dsn, -html, -calendar or -ordered-headers)")
+	listen := ""
+	flag.StringVar(&listen, "listen", "", "receive messages over SMTP on the address, or the Unix socket given as unix:/path")
+	lmtp := false
+	flag.BoolVar(&lmtp, "lmtp", false, "speak LMTP instead of SMTP with -listen")
+	hostname, _ := os.Hostname()
+	flag.StringVar(&hostname, "hostname", hostname, "host name announced by -listen")
+	maxMessageSize := int64(defaultMaxMessageSize)
+	flag.Int64Var(&maxMessageSize, "max-message-size", defaultMaxMessageSize, "maximum size in bytes of messages received by -listen (0: unlimited)")
+	maxConnections := defaultMaxConnections
+	flag.IntVar(&maxConnections, "max-connections", defaultMaxConnections, "maximum number of connections served at once by -listen")
+	tlsCert := ""
+	flag.StringVar(&tlsCert, "tls-cert", "", "offer STARTTLS with -listen using the PEM encoded certificate in the file")
+	tlsKey := ""
+	flag.StringVar(&tlsKey, "tls-key", "", "PEM encoded private key of -tls-cert")
+	outputDir := ""
+	flag.StringVar(&outputDir, "output-dir", "", "write each message received by -listen to a JSON file in the directory instead of stdout")
+	webhook := ""
+	flag.StringVar(&webhook, "webhook", "", "post each message received by -listen to the URL instead of writing it to stdout")
+	var imapConfig IMAPConfig
+	flag.StringVar(&imapConfig.Auth, "imap-auth", "", "authentication for imap:// and imaps:// arguments (plain, login; default: plain if offered)")
+	imapSince := ""
+	flag.StringVar(&imapSince, "imap-since", "", "fetch only IMAP messages received on or after the date (2006-01-02)")
+	flag.StringVar(&imapConfig.From, "imap-from", "", "fetch only IMAP messages whose From contains the string")
+	flag.BoolVar(&imapConfig.Unseen, "imap-unseen", false, "fetch only IMAP messages without the \\Seen flag")
+	flag.StringVar(&imapConfig.Checkpoint, "imap-checkpoint", "", "keep the last fetched UID in the file and fetch only newer IMAP messages (a single IMAP URL, not with -thread)")
+	flag.BoolVar(&imapConfig.AllowPlaintext, "imap-plaintext", false, "allow imap:// without STARTTLS")
+	redactRules := ""
+	flag.StringVar(&redactRules, "redact", "", "remove headers, pseudonymize addresses and mask text and attachments by the rule file")
+	mimeOutput := false
+	flag.BoolVar(&mimeOutput, "mime", false, "write the message read from stdin as a MIME message instead of JSON, e.g. with -redact")
+	json2mail := false
+	flag.BoolVar(&json2mail, "json2mail", false, "read a message in the JSON form from stdin and write it as a MIME message")
+	flag.StringVar(&option.transferEncoding, "transfer-encoding", "", "Content-Transfer-Encoding of bodies written by -json2mail (base64, quoted-printable; default: chosen by content)")
 	flag.Parse()
 
-	r := os.Stdin
+	switch option.attachmentBody {
+	case AttachmentBodyRaw, AttachmentBodyBase64, AttachmentBodyOmit:
+	default:
+		log.Fatalf("invalid -attachment-body: %s", option.attachmentBody)
+	}
+	switch option.mboxFormat {
+	case MboxO, MboxRD, MboxCL, MboxCL2:
+	default:
+		log.Fatalf("invalid -mbox-format: %s", option.mboxFormat)
+	}
+	switch option.oversize {
+	case OversizeTruncate, OversizeSkip:
+	default:
+		log.Fatalf("invalid -oversize: %s", option.oversize)
+	}
+	switch imapConfig.Auth {
+	case "", "plain", "login":
+	default:
+		log.Fatalf("invalid -imap-auth: %s", imapConfig.Auth)
+	}
+	if imapSince != "" {
+		since, err := time.Parse("2006-01-02", imapSince)
+		if err != nil {
+			log.Fatalf("invalid -imap-since: %s", imapSince)
+		}
+		imapConfig.Since = since
+	}
+	if imapConfig.Checkpoint != "" && thread {
+		// threading writes the messages after the checkpoint has moved past them
+		log.Fatal("-imap-checkpoint cannot be used with -thread")
+	}
+	if imapConfig.Checkpoint != "" {
+		// the file keeps the state of a single mailbox
+		n := 0
+		for _, path := range flag.Args() {
+			if IsIMAPURL(path) {
+				n++
+			}
+		}
+		if n > 1 {
+			log.Fatal("-imap-checkpoint can only be used with a single IMAP URL")
+		}
+	}
+	imapConfig.Password = os.Getenv("MAIL2JSON_IMAP_PASSWORD")
+	switch option.transferEncoding {
+	case "", "base64", "quoted-printable":
+	default:
+		log.Fatalf("invalid -transfer-encoding: %s", option.transferEncoding)
+	}
+
+	if dkimKeys != "" {
+		resolver, err := LoadKeyFile(dkimKeys)
+		if err != nil {
+			log.Fatal(err)
+		}
+		option.dkimResolver = resolver
+	} else if verifyDKIM {
+		option.dkimResolver = DNSResolver{Timeout: 10 * time.Second}
+	}
 
-	msg, err := ReadMail(r, option)
-	if err != nil {
-		log.Fatal(err)
+	if checkSecurity || smimeRoots != "" || smimeKey != "" || pgpKeyring != "" {
+		keys, err := loadSecurityKeys(smimeRoots, smimeKey, pgpKeyring)
+		if err != nil {
+			log.Fatal(err)
+		}
+		option.security = keys
 	}
 
-	v, err := json.Marshal(msg)
-	if err != nil {
-		log.Fatal(err)
+	var redactor *Redactor
+	if redactRules != "" {
+		profile, err := LoadRedactionProfile(redactRules)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if redactor, err = NewRedactor(profile); err != nil {
+			log.Fatalf("%s: %v", redactRules, err)
+		}
+	}
+	if mimeOutput && (flag.NArg() > 0 || listen != "" || stream || json2mail) {
+		log.Fatal("-mime can only be used with a message read from stdin")
+	}
+
+	if listen != "" {
+		if stream || thread || json2mail || flag.NArg() > 0 {
+			log.Fatal("-listen cannot be used with -stream, -thread, -json2mail or files")
+		}
+		server := &Server{
+			Hostname:       hostname,
+			LMTP:           lmtp,
+			MaxSize:        maxMessageSize,
+			MaxConnections: maxConnections,
+			Option:         option,
+			Deliver:        WriteDelivery(os.Stdout),
+			ErrorLog:       func(err error) { log.Print(err) },
+		}
+		switch {
+		case outputDir != "" && webhook != "":
+			log.Fatal("-output-dir and -webhook cannot be used together")
+		case outputDir != "":
+			if err := os.MkdirAll(outputDir, 0o700); err != nil {
+				log.Fatal(err)
+			}
+			server.Deliver = DirDelivery(outputDir)
+		case webhook != "":
+			server.Deliver = WebhookDelivery(webhook, &http.Client{Timeout: time.Minute})
+		}
+		if tlsCert != "" {
+			cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+			if err != nil {
+				log.Fatal(err)
+			}
+			server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+		if redactor != nil {
+			deliver := server.Deliver
+			server.Deliver = func(msg *Part) error {
+				redactor.Redact(msg)
+				return deliver(msg)
+			}
+		}
+
+		l, err := Listen(listen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := server.Serve(l); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if stream {
+		if option.dkimResolver != nil || option.security != nil || thread || json2mail || redactor != nil || option.summarize || option.deliveryStatus || option.renderHTML || option.calendar || option.orderedHeaders {
+			log.Fatal("-stream cannot be used with -dkim, -security, -thread, -json2mail, -redact, -summary, -dsn, -html, -calendar or -ordered-headers")
+		}
+		streamMain(option)
+		return
+	}
+
+	if json2mail {
+		var part Part
+		if err := json.NewDecoder(os.Stdin).Decode(&part); err != nil {
+			log.Fatal(err)
+		}
+		if redactor != nil {
+			redactor.Redact(&part)
+		}
+		if err := WriteMail(os.Stdout, &part, option); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if flag.NArg() == 0 {
+		r := os.Stdin
+
+		msg, err := ReadMail(r, option)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if redactor != nil {
+			redactor.Redact(msg)
+		}
+		if mimeOutput {
+			if err := WriteMail(os.Stdout, msg, option); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		if thread {
+			Thread([]*Part{msg})
+		}
+
+		v, err := json.Marshal(msg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Print(string(v))
+		return
+	}
+
+	// multiple messages are written as newline delimited JSON
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	imapConfig.Flush = w.Flush
+
+	write := func(msg *Part) error {
+		v, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		w.Write(v)
+		return w.WriteByte('\n')
+	}
+
+	// threading needs all the messages before writing any of them
+	var messages []*Part
+	emit := write
+	if thread {
+		emit = func(msg *Part) error {
+			messages = append(messages, msg)
+			return nil
+		}
+	}
+	if redactor != nil {
+		next := emit
+		emit = func(msg *Part) error {
+			redactor.Redact(msg)
+			return next(msg)
+		}
+	}
+
+	failed := false
+	onError := func(err error) {
+		log.Print(err)
+		failed = true
+	}
+
+	for _, path := range flag.Args() {
+		process := ProcessPath
+		if IsIMAPURL(path) {
+			process = func(path string, option Option, emit func(*Part) error, onError func(error)) error {
+				return FetchIMAP(path, imapConfig, option, emit, onError)
+			}
+		}
+		if err := process(path, option, emit, onError); err != nil {
+			w.Flush()
+			log.Fatal(err)
+		}
+	}
+
+	if thread {
+		Thread(messages)
+		for _, msg := range messages {
+			if err := write(msg); err != nil {
+				w.Flush()
+				log.Fatal(err)
+			}
+		}
+	}
+
+	if failed {
+		w.Flush()
+		os.Exit(1)
 	}
-	fmt.Print(string(v))
 }
 
+// streamMain writes the messages of stdin or the arguments while reading
+// them.
+func streamMain(option Option) {
+	if flag.NArg() == 0 {
+		if err := StreamMail(os.Stdin, os.Stdout, option); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	failed := false
+	onError := func(err error) {
+		log.Print(err)
+		failed = true
+	}
+	for _, path := range flag.Args() {
+		if IsIMAPURL(path) {
+			w.Flush()
+			log.Fatalf("%s: -stream cannot read IMAP mailboxes", path)
+		}
+		if err := StreamPath(path, w, option, onError); err != nil {
+			w.Flush()
+			log.Fatal(err)
+		}
+	}
+	w.Flush()
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// header returns the header as found in the message.
+func (p *Part) header() textproto.MIMEHeader {
+	if p.RawHeader != nil {
+		return p.RawHeader
+	}
+	return p.Header
+}
+
+// SetHeader stores the header of the part, decoded if requested. The raw
+// header is kept alongside the decoded one.
+func (p *Part) SetHeader(header map[string][]string, option Option) {
+	if !option.decodeHeader {
+		p.Header = header
+		return
+	}
+	p.Header = DecodeHeader(header)
+	p.RawHeader = header
+}
+
+// setMessageHeader stores the header of a message and, if requested, its
+// structured values.
+func (p *Part) setMessageHeader(header map[string][]string, option Option) {
+	p.SetHeader(header, option)
+	if option.parseHeaders {
+		p.Parsed = ParseHeaders(p.header())
+	}
+	if option.analyze {
+		p.Analysis = Analyze(p.header())
+	}
+}
+
+// ReadMail reads a whole message into memory and parses it. StreamMail is
+// the bounded alternative for the options it supports.
 func ReadMail(r io.Reader, option Option) (*Part, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return readMessage(b, 0, option)
+}
+
+// readMessage parses a message which starts at offset in the source message.
+// A negative offset means the position is unknown.
+func readMessage(b []byte, offset int64, option Option) (*Part, error) {
 	var part Part
 
-	msg, err := mail.ReadMessage(r)
+	header, bodyStart, err := part.readMessageHeader(b, option)
 	if err != nil {
 		return nil, err
 	}
+	body := b[bodyStart:]
+
+	part.setMessageHeader(header, option)
+	part.setLayout(b, bodyStart, offset, option)
+	if option.dkimResolver != nil {
+		part.DKIM = VerifyDKIM(ReadHeaderFields(b[:bodyStart]), body, option.dkimResolver, time.Now())
+	}
+	if err := readContent(body, &part, textproto.MIMEHeader(header), shiftOffset(offset, bodyStart), option); err != nil {
+		return nil, err
+	}
+	if option.summarize {
+		Summarize(&part)
+	}
+	if option.deliveryStatus {
+		part.DeliveryStatus = ReadDeliveryStatus(&part)
+	}
+	return &part, nil
+}
+
+func shiftOffset(offset int64, n int) int64 {
+	if offset < 0 {
+		return offset
+	}
+	return offset + int64(n)
+}
+
+// readContent reads the body of a message or a part according to its
+// Content-Type header. A multipart without a boundary is read as plain text.
+func readContent(body []byte, part *Part, header textproto.MIMEHeader, offset int64, option Option) error {
+	mediaType, params, err := ParseContentType(header)
+	if err != nil {
+		if err := part.defect(option, InvalidHeaderDefect, err); err != nil {
+			return err
+		}
+		if mediaType == "" {
+			mediaType = "text/plain"
+		}
+	}
 
-	part.Header = msg.Header
-	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	encoding := header.Get("Content-Transfer-Encoding")
 	if !strings.HasPrefix(mediaType, "multipart/") {
-		encoding := msg.Header.Get("Content-Transfer-Encoding")
-		body, err := ReadBody(msg.Body, mediaType, encoding, option)
-		if err != nil {
-			return nil, err
+		return ReadBody(body, part, mediaType, params, encoding, offset, option)
+	}
+
+	boundary, ok := params["boundary"]
+	if !ok {
+		if err := part.defect(option, NoBoundaryInMultipartDefect, fmt.Errorf("boundary not found")); err != nil {
+			return err
 		}
-		part.Body = body
-		return &part, nil
+		return ReadBody(body, part, "text/plain", params, encoding, offset, option)
+	}
+	if err := ReadMultiPart(body, part, boundary, offset, option); err != nil {
+		return err
+	}
+	if option.security != nil {
+		return part.readSecurity(body, mediaType, params, boundary, option)
+	}
+	return nil
+}
+
+// ReadMultiPart reads the parts of a multipart body into part.Parts. A body
+// without the start boundary is kept as plain text, and parts read before a
+// missing close boundary are kept.
+func ReadMultiPart(body []byte, part *Part, boundary string, offset int64, option Option) error {
+	spans, closed := splitMultipart(body, boundary)
+	if len(spans) == 0 && !closed {
+		if err := part.defect(option, StartBoundaryNotFoundDefect, fmt.Errorf("multipart: start boundary not found")); err != nil {
+			return err
+		}
+		return ReadBody(body, part, "text/plain", map[string]string{}, "", offset, option)
 	}
 
-	var boundary string
-	var ok bool
+	for _, span := range spans {
+		b := body[span[0]:span[1]]
+		partOffset := shiftOffset(offset, span[0])
 
-	if boundary, ok = params["boundary"]; !ok {
-		return nil, fmt.Errorf("boundary not found")
+		var child Part
+		header, bodyStart, err := child.readPartHeader(b, option)
+		if err != nil {
+			return err
+		}
+		content := b[bodyStart:]
+
+		child.SetHeader(header, option)
+		child.setLayout(b, bodyStart, partOffset, option)
+		if err := readContent(content, &child, header, shiftOffset(partOffset, bodyStart), option); err != nil {
+			return err
+		}
+		part.Parts = append(part.Parts, child)
 	}
 
-	if part.Parts, err = ReadMultiPart(msg.Body, boundary, option); err != nil {
-		return nil, err
+	if !closed {
+		return part.defect(option, CloseBoundaryNotFoundDefect, fmt.Errorf("multipart: close boundary not found"))
 	}
-	return &part, nil
+	return nil
 }
 
-func ReadMultiPart(r io.Reader, boundary string, option Option) ([]Part, error) {
-	var ret []Part
+// ReadBody stores a single part body which starts at offset in the source
+// message.
+func ReadBody(raw []byte, part *Part, mediaType string, params map[string]string, contentTransferEncoding string, offset int64, option Option) error {
+	var err error
 
-	reader := multipart.NewReader(r, boundary)
-	for {
-		var part Part
-		rawPart, err := reader.NextRawPart()
-		if err == io.EOF {
-			break
-		} else if err != nil {
-			return nil, err
-		}
-		part.Header = rawPart.Header
+	isText := strings.HasPrefix(mediaType, "text/")
+	isAttachment := IsAttachment(mediaType, part.header())
+	isEmbedded := IsEmbeddedMessage(mediaType) && option.depth < option.maxDepth
+	isHTML := option.renderHTML && mediaType == "text/html"
+	isPKCS7 := option.security != nil && IsPKCS7(mediaType)
+	kind := ""
+	if option.calendar {
+		kind = CalendarKind(mediaType, AttachmentFilename(part.header()))
+	}
 
-		mediaType, params, err := mime.ParseMediaType(rawPart.Header.Get("Content-Type"))
-		if !strings.HasPrefix(mediaType, "multipart/") {
+	var b []byte
+	if isAttachment || isEmbedded || isHTML || kind != "" || (option.decodeTransferEncoding && isText) {
+		if b, err = DecodeTransferEncoding(raw, contentTransferEncoding); err != nil {
+			if option.strict {
+				return err
+			}
+			var defects []Defect
+			b, defects = DecodeTransferEncodingLeniently(raw, contentTransferEncoding)
+			part.Defects = append(part.Defects, defects...)
+		}
+	}
 
-			encoding := rawPart.Header.Get("Content-Transfer-Encoding")
-			body, err := ReadBody(rawPart, mediaType, encoding, option)
-			if err != nil {
-				return nil, err
+	if isAttachment {
+		part.Attachment = NewAttachment(b, mediaType, AttachmentFilename(part.header()))
+		if option.extractDir != "" {
+			if part.Attachment.Path, err = ExtractAttachment(option.extractDir, part.Attachment, b); err != nil {
+				return err
 			}
-			part.Body = body
-			ret = append(ret, part)
-			continue
 		}
+	}
 
-		var subboundary string
-		var ok bool
+	if isEmbedded {
+		// a message which cannot be parsed is kept as an opaque body
+		// offsets are only known when the message is not transfer encoded
+		if !bytes.Equal(b, raw) {
+			offset = -1
+		}
+		message, err := ReadEmbeddedMessage(b, mediaType, offset, option)
+		if err == nil {
+			part.Message = message
+			return nil
+		}
+		if err := part.defect(option, InvalidEmbeddedMessageDefect, err); err != nil {
+			return err
+		}
+	}
 
-		if subboundary, ok = params["boundary"]; !ok {
-			return nil, fmt.Errorf("boundary not found")
+	if isPKCS7 {
+		if err := part.readPKCS7(b, option); err != nil {
+			return err
 		}
+	}
 
-		part.Parts, err = ReadMultiPart(rawPart, subboundary, option)
+	if kind != "" {
+		if err := part.readCalendar(b, kind, params["charset"]); err != nil {
+			if err := part.defect(option, InvalidCalendarDefect, err); err != nil {
+				return err
+			}
+		}
+	}
+
+	if option.deliveryStatus && isDeliveryStatus(mediaType) {
+		dsn, err := ParseDeliveryStatus(b)
 		if err != nil {
-			return nil, err
+			if err := part.defect(option, InvalidHeaderDefect, fmt.Errorf("delivery status: %w", err)); err != nil {
+				return err
+			}
 		}
-		ret = append(ret, part)
+		part.deliveryStatus = dsn
 	}
 
-	return ret, nil
-}
+	if isAttachment && !isText {
+		switch option.attachmentBody {
+		case AttachmentBodyBase64:
+			b, part.Truncated = limitBody(b, option)
+			part.Body = base64.StdEncoding.EncodeToString(b)
+		case AttachmentBodyOmit:
+		default:
+			raw, part.Truncated = limitBody(raw, option)
+			part.Body = string(raw)
+		}
+		return nil
+	}
 
-func ReadBody(r io.Reader, mediaType string, contentTransferEncoding string, option Option) (string, error) {
+	if isHTML {
+		text, _, _ := DecodeText(b, params["charset"])
+		part.Text, part.Links, part.Images = RenderHTML(text)
+	}
 
-	b, err := io.ReadAll(r)
-	if err != nil {
-		return "", err
+	if !option.decodeTransferEncoding || !isText {
+		raw, part.Truncated = limitBody(raw, option)
+		part.Body = string(raw)
+		return nil
 	}
 
-	if !option.decodeTransferEncoding || !strings.HasPrefix(mediaType, "text/") {
-		return string(b), nil
+	part.Body, part.Charset, part.DecodeWarnings = DecodeText(b, params["charset"])
+	part.Body, part.Truncated = limitText(part.Body, option)
+	return nil
+}
+
+// ParseContentType parses the Content-Type header. A part without the header
+// is plain text as defined in RFC 2045.
+func ParseContentType(header textproto.MIMEHeader) (string, map[string]string, error) {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		return "text/plain", map[string]string{}, nil
 	}
+	return mime.ParseMediaType(contentType)
+}
 
-	if contentTransferEncoding == "base64" {
+func DecodeTransferEncoding(b []byte, contentTransferEncoding string) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(contentTransferEncoding)) {
+	case "base64":
 		dst := make([]byte, base64.StdEncoding.DecodedLen(len(b)))
 		n, err := base64.StdEncoding.Decode(dst, b)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		dst = dst[:n]
-		return string(dst), nil
-	} else if contentTransferEncoding == "quoted-printable" {
+		return dst[:n], nil
+	case "quoted-printable":
 		qr := quotedprintable.NewReader(bytes.NewReader(b))
-		q, err := io.ReadAll(qr)
-		if err != nil {
-			return "", err
-		}
-		return string(q), nil
-	} else {
-		return string(b), nil
+		return io.ReadAll(qr)
+	default:
+		return b, nil
 	}
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func readTestMail(t *testing.T, input string, option Option) *Part {
+	t.Helper()
+	part, err := ReadMail(strings.NewReader(input), option)
+	assert.Nil(t, err)
+	return part
+}
+
+func TestReadMail(t *testing.T) {
+	input := "Subject: test\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"aGVsbG8=\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"caf=C3=A9\r\n" +
+		"--b--\r\n"
+
+	part := readTestMail(t, input, Option{decodeTransferEncoding: true})
+	assert.Equal(t, []string{"test"}, part.Header["Subject"])
+	assert.Equal(t, 2, len(part.Parts))
+	assert.Equal(t, "hello", part.Parts[0].Body)
+	assert.Equal(t, "café", part.Parts[1].Body)
+
+	part = readTestMail(t, input, Option{})
+	assert.Equal(t, "aGVsbG8=", part.Parts[0].Body)
+}
+
+func TestReadMailCharset(t *testing.T) {
+	input := "Content-Type: text/plain; charset=ISO-2022-JP\r\n" +
+		"Content-Transfer-Encoding: 7bit\r\n" +
+		"\r\n" +
+		"\x1b$B$\"$$$&\x1b(B\r\n"
+
+	part := readTestMail(t, input, Option{decodeTransferEncoding: true})
+	assert.Equal(t, "あいう\r\n", part.Body)
+	assert.Equal(t, "iso-2022-jp", part.Charset)
+	assert.Empty(t, part.DecodeWarnings)
+
+	part = readTestMail(t, input, Option{})
+	assert.Equal(t, "\x1b$B$\"$$$&\x1b(B\r\n", part.Body)
+	assert.Equal(t, "", part.Charset)
+}
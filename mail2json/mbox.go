@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type Source struct {
+	File   string `json:"file"`
+	Offset int64  `json:"offset"`
+}
+
+// mbox variants, see https://www.loc.gov/preservation/digital/formats/fdd/fdd000383.shtml
+const (
+	MboxO   = "mboxo"
+	MboxRD  = "mboxrd"
+	MboxCL  = "mboxcl"
+	MboxCL2 = "mboxcl2"
+)
+
+type MboxMessage struct {
+	Data   []byte
+	Offset int64
+}
+
+type MboxReader struct {
+	r      *bufio.Reader
+	format string
+	offset int64
+	// the next line, or a piece of it when it does not fit in the buffer
+	line      []byte
+	continued bool
+	err       error
+	current   *mboxMessageReader
+}
+
+func NewMboxReader(r io.Reader, format string) (*MboxReader, error) {
+	switch format {
+	case MboxO, MboxRD, MboxCL, MboxCL2:
+	default:
+		return nil, fmt.Errorf("unknown mbox format: %s", format)
+	}
+
+	m := &MboxReader{r: bufio.NewReader(r), format: format}
+	m.readLine()
+	return m, nil
+}
+
+// readLine reads the next line, or the next piece of a line longer than the
+// buffer, which continues the previous one.
+func (m *MboxReader) readLine() {
+	m.continued = len(m.line) > 0 && m.line[len(m.line)-1] != '\n'
+	line, err := m.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		err = nil
+	}
+	m.line, m.err = append([]byte(nil), line...), err
+}
+
+func isFromLine(line []byte) bool {
+	return bytes.HasPrefix(line, []byte("From "))
+}
+
+func isBlankLine(line []byte) bool {
+	return len(bytes.TrimRight(line, "\r\n")) == 0
+}
+
+// unescapeFrom removes the quoting of "From " lines in the message body.
+func (m *MboxReader) unescapeFrom(line []byte) []byte {
+	switch m.format {
+	case MboxRD:
+		trimmed := bytes.TrimLeft(line, ">")
+		if len(trimmed) < len(line) && isFromLine(trimmed) {
+			return line[1:]
+		}
+	case MboxO, MboxCL:
+		if bytes.HasPrefix(line, []byte(">From ")) {
+			return line[1:]
+		}
+	}
+	return line
+}
+
+// Next returns the next message of the mailbox, or io.EOF after the last one.
+func (m *MboxReader) Next() (*MboxMessage, error) {
+	offset, r, err := m.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return &MboxMessage{Data: data, Offset: offset}, nil
+}
+
+// NextReader returns the offset of the next message of the mailbox and a
+// reader of the message, or io.EOF after the last one. The message is read
+// from the mailbox as the reader is read, and the rest of it is skipped by
+// the next call.
+func (m *MboxReader) NextReader() (int64, io.Reader, error) {
+	if m.current != nil {
+		if _, err := io.Copy(io.Discard, m.current); err != nil {
+			return 0, nil, err
+		}
+		m.current = nil
+	}
+
+	// skip blank lines between messages
+	for len(m.line) > 0 && !m.continued && isBlankLine(m.line) {
+		m.offset += int64(len(m.line))
+		m.readLine()
+	}
+
+	if len(m.line) == 0 {
+		if m.err == io.EOF {
+			return 0, nil, io.EOF
+		}
+		return 0, nil, m.err
+	}
+	if m.continued || !isFromLine(m.line) {
+		return 0, nil, fmt.Errorf("mbox: expected From line at offset %d", m.offset)
+	}
+
+	offset := m.offset
+	for {
+		m.offset += int64(len(m.line))
+		m.readLine()
+		if len(m.line) == 0 || !m.continued {
+			break
+		}
+	}
+	m.current = &mboxMessageReader{m: m, inHeader: true, contentLength: -1}
+	return offset, m.current, nil
+}
+
+// mboxMessageReader reads a message from the mailbox line by line. The blank
+// line which separates the message from the next From line is held back
+// until the end of the message is known, and dropped.
+type mboxMessageReader struct {
+	m             *MboxReader
+	pending       []byte
+	held          []byte
+	tail          []byte
+	inHeader      bool
+	contentLength int
+	// the rest of a body of the length given by the Content-Length header
+	body          *bufio.Reader
+	bodyLimit     *io.LimitedReader
+	bodyContinued bool
+	done          bool
+}
+
+func (r *mboxMessageReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// next reads the next line of the message.
+func (r *mboxMessageReader) next() error {
+	m := r.m
+	if r.body != nil {
+		return r.nextBodyLine()
+	}
+	if len(m.line) == 0 {
+		if m.err != nil && m.err != io.EOF {
+			return m.err
+		}
+		r.finish()
+		return nil
+	}
+
+	line := m.line
+	atStart := !m.continued
+	switch {
+	case r.inHeader && atStart && isBlankLine(line):
+		r.inHeader = false
+		if r.contentLength >= 0 && (m.format == MboxCL || m.format == MboxCL2) {
+			r.write(line)
+			m.offset += int64(len(line))
+			r.bodyLimit = &io.LimitedReader{R: m.r, N: int64(r.contentLength)}
+			r.body = bufio.NewReader(r.bodyLimit)
+			return nil
+		}
+		r.add(line, true)
+	case r.inHeader:
+		if name, value, ok := strings.Cut(string(line), ":"); ok && atStart &&
+			textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name)) == "Content-Length" {
+			if n, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+				r.contentLength = n
+			}
+		}
+		r.add(line, false)
+	case atStart && isFromLine(line):
+		r.finish()
+		return nil
+	case atStart:
+		r.add(m.unescapeFrom(line), true)
+	default:
+		r.add(line, false)
+	}
+
+	m.offset += int64(len(line))
+	m.readLine()
+	return nil
+}
+
+// nextBodyLine reads the next line of a body of the length given by the
+// Content-Length header.
+func (r *mboxMessageReader) nextBodyLine() error {
+	m := r.m
+	line, err := r.body.ReadSlice('\n')
+	if len(line) > 0 {
+		continued := line[len(line)-1] != '\n'
+		if m.format == MboxCL && !r.bodyContinued {
+			line = m.unescapeFrom(line)
+		}
+		r.write(line)
+		r.bodyContinued = continued
+	}
+	switch err {
+	case nil, bufio.ErrBufferFull:
+		return nil
+	case io.EOF:
+		m.offset += int64(r.contentLength) - r.bodyLimit.N
+		r.body = nil
+		r.done = true
+		m.readLine()
+		return nil
+	default:
+		return err
+	}
+}
+
+// add adds a line to the message. A blank line may be the separator before
+// the next message, and is held back.
+func (r *mboxMessageReader) add(line []byte, blank bool) {
+	if r.held != nil {
+		r.write(r.held)
+		r.held = nil
+	}
+	if blank && (string(line) == "\n" || string(line) == "\r\n") {
+		r.held = line
+		return
+	}
+	r.write(line)
+}
+
+func (r *mboxMessageReader) write(b []byte) {
+	r.pending = append(r.pending, b...)
+	tail := append(r.tail, b...)
+	if len(tail) > 2 {
+		tail = tail[len(tail)-2:]
+	}
+	r.tail = append([]byte(nil), tail...)
+}
+
+// finish ends the message, without the blank line which separates it from
+// the following From line.
+func (r *mboxMessageReader) finish() {
+	held := string(r.held)
+	tail := string(r.tail)
+	separator := held == "\r\n" && tail == "\r\n" || held == "\n" && strings.HasSuffix(tail, "\n")
+	if r.held != nil && !separator {
+		r.write(r.held)
+	}
+	r.held = nil
+	r.done = true
+}
+
+func isMaildir(dir string) bool {
+	for _, sub := range []string{"cur", "new"} {
+		if info, err := os.Stat(filepath.Join(dir, sub)); err == nil && info.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// MaildirFiles returns the message files in the cur and new folders of a
+// Maildir, sorted by name.
+func MaildirFiles(dir string) ([]string, error) {
+	var files []string
+	for _, sub := range []string{"cur", "new"} {
+		entries, err := os.ReadDir(filepath.Join(dir, sub))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.Type().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+				files = append(files, filepath.Join(dir, sub, entry.Name()))
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// ProcessPath reads the messages of a Maildir, an mbox file or a single
+// message file and passes each of them to emit. A message which cannot be
+// parsed is reported to onError and skipped.
+func ProcessPath(path string, option Option, emit func(*Part) error, onError func(error)) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		if !isMaildir(path) {
+			return fmt.Errorf("%s: not a Maildir", path)
+		}
+		files, err := MaildirFiles(path)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if err := processFile(file, option, emit, onError); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return processFile(path, option, emit, onError)
+}
+
+func processFile(path string, option Option, emit func(*Part) error, onError func(error)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	head, err := br.Peek(5)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	if !isFromLine(head) {
+		part, err := ReadMail(br, option)
+		if err != nil {
+			onError(fmt.Errorf("%s: %w", path, err))
+			return nil
+		}
+		part.Source = &Source{File: path}
+		return emit(part)
+	}
+
+	mbox, err := NewMboxReader(br, option.mboxFormat)
+	if err != nil {
+		return err
+	}
+	for {
+		msg, err := mbox.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		part, err := ReadMail(bytes.NewReader(msg.Data), option)
+		if err != nil {
+			onError(fmt.Errorf("%s at offset %d: %w", path, msg.Offset, err))
+			continue
+		}
+		part.Source = &Source{File: path, Offset: msg.Offset}
+		if err := emit(part); err != nil {
+			return err
+		}
+	}
+}
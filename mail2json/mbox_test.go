@@ -0,0 +1,181 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func readMbox(t *testing.T, input string, format string) []*MboxMessage {
+	t.Helper()
+
+	r, err := NewMboxReader(strings.NewReader(input), format)
+	assert.Nil(t, err)
+
+	var messages []*MboxMessage
+	for {
+		msg, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		messages = append(messages, msg)
+	}
+	return messages
+}
+
+func TestMboxRD(t *testing.T) {
+	input := "From a@example.com Mon Jan  1 00:00:00 2024\n" +
+		"Subject: 1\n" +
+		"\n" +
+		">From here\n" +
+		">>From there\n" +
+		"\n" +
+		"From b@example.com Mon Jan  1 00:00:00 2024\n" +
+		"Subject: 2\n" +
+		"\n" +
+		"body\n"
+
+	messages := readMbox(t, input, MboxRD)
+	assert.Equal(t, 2, len(messages))
+	assert.Equal(t, "Subject: 1\n\nFrom here\n>From there\n", string(messages[0].Data))
+	assert.Equal(t, int64(0), messages[0].Offset)
+	assert.Equal(t, "Subject: 2\n\nbody\n", string(messages[1].Data))
+	assert.Equal(t, int64(strings.Index(input, "From b")), messages[1].Offset)
+}
+
+func TestMboxO(t *testing.T) {
+	input := "From a@example.com Mon Jan  1 00:00:00 2024\n" +
+		"Subject: 1\n" +
+		"\n" +
+		">From here\n" +
+		">>From there\n"
+
+	messages := readMbox(t, input, MboxO)
+	assert.Equal(t, 1, len(messages))
+	assert.Equal(t, "Subject: 1\n\nFrom here\n>>From there\n", string(messages[0].Data))
+}
+
+func TestMboxCL2(t *testing.T) {
+	input := "From a@example.com Mon Jan  1 00:00:00 2024\n" +
+		"Subject: 1\n" +
+		"Content-Length: 22\n" +
+		"\n" +
+		"From here\n" +
+		">From there\n" +
+		"\n" +
+		"From b@example.com Mon Jan  1 00:00:00 2024\n" +
+		"Subject: 2\n" +
+		"\n" +
+		"body\n"
+
+	messages := readMbox(t, input, MboxCL2)
+	assert.Equal(t, 2, len(messages))
+	assert.Equal(t, "Subject: 1\nContent-Length: 22\n\nFrom here\n>From there\n", string(messages[0].Data))
+	assert.Equal(t, "Subject: 2\n\nbody\n", string(messages[1].Data))
+	assert.Equal(t, int64(strings.Index(input, "From b")), messages[1].Offset)
+}
+
+func TestMboxLongLines(t *testing.T) {
+	// lines longer than the read buffer, with "From " in their pieces
+	long := "x" + strings.Repeat("From ", 5000) + "\n"
+	input := "From a@example.com Mon Jan  1 00:00:00 2024\n" +
+		"Subject: 1\n" +
+		"\n" +
+		long +
+		"\n" +
+		"From b@example.com Mon Jan  1 00:00:00 2024\n" +
+		"X-Long: " + long +
+		"\n" +
+		"body\n"
+
+	messages := readMbox(t, input, MboxRD)
+	assert.Equal(t, 2, len(messages))
+	assert.Equal(t, "Subject: 1\n\n"+long, string(messages[0].Data))
+	assert.Equal(t, "X-Long: "+long+"\nbody\n", string(messages[1].Data))
+	assert.Equal(t, int64(strings.Index(input, "From b")), messages[1].Offset)
+}
+
+func TestMboxNextReader(t *testing.T) {
+	input := "From a@example.com Mon Jan  1 00:00:00 2024\n" +
+		"Subject: 1\n" +
+		"\n" +
+		"body\n" +
+		"\n" +
+		"From b@example.com Mon Jan  1 00:00:00 2024\n" +
+		"Subject: 2\n"
+
+	m, err := NewMboxReader(strings.NewReader(input), MboxRD)
+	assert.Nil(t, err)
+	_, r, err := m.NextReader()
+	assert.Nil(t, err)
+	b := make([]byte, 4)
+	_, err = io.ReadFull(r, b)
+	assert.Nil(t, err)
+	assert.Equal(t, "Subj", string(b))
+
+	// the rest of the first message is skipped
+	offset, r, err := m.NextReader()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(strings.Index(input, "From b")), offset)
+	b, err = io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "Subject: 2\n", string(b))
+
+	_, _, err = m.NextReader()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestMboxInvalid(t *testing.T) {
+	r, err := NewMboxReader(strings.NewReader("Subject: 1\n\nbody\n"), MboxRD)
+	assert.Nil(t, err)
+	_, err = r.Next()
+	assert.NotNil(t, err)
+
+	_, err = NewMboxReader(strings.NewReader(""), "mbox")
+	assert.NotNil(t, err)
+}
+
+func TestProcessPath(t *testing.T) {
+	dir := t.TempDir()
+
+	maildir := filepath.Join(dir, "Maildir")
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		assert.Nil(t, os.MkdirAll(filepath.Join(maildir, sub), 0o700))
+	}
+	assert.Nil(t, os.WriteFile(filepath.Join(maildir, "cur", "1:2,S"), []byte("Subject: 1\n\nbody1\n"), 0o600))
+	assert.Nil(t, os.WriteFile(filepath.Join(maildir, "new", "2"), []byte("Subject: 2\n\nbody2\n"), 0o600))
+	assert.Nil(t, os.WriteFile(filepath.Join(maildir, "tmp", "3"), []byte("Subject: 3\n\nbody3\n"), 0o600))
+
+	mbox := filepath.Join(dir, "mbox")
+	mboxContent := "From a\nSubject: 4\n\nbody4\n\nFrom b\nSubject: 5\n\nbody5\n"
+	assert.Nil(t, os.WriteFile(mbox, []byte(mboxContent), 0o600))
+
+	var parts []*Part
+	var errs []error
+	emit := func(part *Part) error {
+		parts = append(parts, part)
+		return nil
+	}
+	onError := func(err error) {
+		errs = append(errs, err)
+	}
+
+	option := Option{mboxFormat: MboxRD}
+	assert.Nil(t, ProcessPath(maildir, option, emit, onError))
+	assert.Nil(t, ProcessPath(mbox, option, emit, onError))
+	assert.NotNil(t, ProcessPath(filepath.Join(dir, "none"), option, emit, onError))
+	assert.Empty(t, errs)
+
+	var subjects []string
+	for _, part := range parts {
+		subjects = append(subjects, part.Header["Subject"][0])
+	}
+	assert.Equal(t, []string{"1", "2", "4", "5"}, subjects)
+	assert.Equal(t, &Source{File: filepath.Join(maildir, "cur", "1:2,S")}, parts[0].Source)
+	assert.Equal(t, &Source{File: mbox, Offset: int64(strings.Index(mboxContent, "From b"))}, parts[3].Source)
+	assert.Equal(t, "body5\n", parts[3].Body)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/textproto"
+	"strings"
+)
+
+// defaultMaxDepth limits the nesting of embedded messages, so that a crafted
+// message cannot make the parser recurse without bound.
+const defaultMaxDepth = 10
+
+// IsEmbeddedMessage reports whether a part contains another message or the
+// header of another message, as forwarded mail and delivery reports do.
+func IsEmbeddedMessage(mediaType string) bool {
+	switch strings.ToLower(mediaType) {
+	case "message/rfc822", "message/global", "text/rfc822-headers":
+		return true
+	}
+	return false
+}
+
+// ReadEmbeddedMessage parses the decoded body of an embedded message one level
+// deeper than the enclosing part. The offset is the position of the body in
+// the source message, or negative if unknown. A text/rfc822-headers part yields a part
+// with the header only.
+func ReadEmbeddedMessage(b []byte, mediaType string, offset int64, option Option) (*Part, error) {
+	option.depth++
+
+	if !strings.EqualFold(mediaType, "text/rfc822-headers") {
+		return readMessage(b, offset, option)
+	}
+
+	// the header may lack the terminating blank line
+	r := io.MultiReader(bytes.NewReader(b), strings.NewReader("\r\n\r\n"))
+	header, err := textproto.NewReader(bufio.NewReader(r)).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	var part Part
+	part.setMessageHeader(header, option)
+	part.setLayout(b, len(b), offset, option)
+	return &part, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestReadMailEmbeddedMessage(t *testing.T) {
+	input := "Subject: Fwd: hello\r\n" +
+		"Content-Type: multipart/mixed; boundary=outer\r\n" +
+		"\r\n" +
+		"--outer\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"see below\r\n" +
+		"--outer\r\n" +
+		"Content-Type: message/rfc822\r\n" +
+		"\r\n" +
+		"From: Alice <alice@example.com>\r\n" +
+		"Subject: hello\r\n" +
+		"Content-Type: multipart/alternative; boundary=inner\r\n" +
+		"\r\n" +
+		"--inner\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"aGVsbG8=\r\n" +
+		"--inner--\r\n" +
+		"--outer\r\n" +
+		"Content-Type: text/rfc822-headers\r\n" +
+		"\r\n" +
+		"From: Bob <bob@example.com>\r\n" +
+		"Subject: bounced\r\n" +
+		"--outer--\r\n"
+
+	part := readTestMail(t, input, Option{decodeTransferEncoding: true, parseHeaders: true, maxDepth: defaultMaxDepth})
+	assert.Equal(t, 3, len(part.Parts))
+
+	forwarded := part.Parts[1]
+	assert.Equal(t, "", forwarded.Body)
+	assert.NotNil(t, forwarded.Attachment)
+	if assert.NotNil(t, forwarded.Message) {
+		assert.Equal(t, []string{"hello"}, forwarded.Message.Header["Subject"])
+		assert.Equal(t, []Address{{Name: "Alice", Address: "alice@example.com"}}, forwarded.Message.Parsed.From)
+		assert.Equal(t, 1, len(forwarded.Message.Parts))
+		assert.Equal(t, "hello", forwarded.Message.Parts[0].Body)
+	}
+
+	headers := part.Parts[2]
+	assert.Equal(t, "", headers.Body)
+	if assert.NotNil(t, headers.Message) {
+		assert.Equal(t, []string{"bounced"}, headers.Message.Header["Subject"])
+		assert.Nil(t, headers.Message.Parts)
+	}
+}
+
+func TestReadMailMaxDepth(t *testing.T) {
+	input := "Subject: inner\r\n\r\nbody\r\n"
+	for i := 0; i < 3; i++ {
+		input = "Content-Type: message/global\r\n\r\n" + input
+	}
+
+	for _, tt := range []struct {
+		maxDepth int
+		depth    int
+	}{
+		{0, 0},
+		{2, 2},
+		{3, 3},
+		{10, 3},
+	} {
+		part := readTestMail(t, input, Option{maxDepth: tt.maxDepth})
+		depth := 0
+		for part.Message != nil {
+			part = part.Message
+			depth++
+		}
+		assert.Equal(t, tt.depth, depth)
+		if depth < 3 {
+			assert.Contains(t, part.Body, "Subject: inner\r\n")
+		} else {
+			assert.Equal(t, "body\r\n", part.Body)
+		}
+	}
+}
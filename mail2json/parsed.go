@@ -0,0 +1,241 @@
+package main
+
+import (
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type Address struct {
+	Name    string `json:"name,omitempty"`
+	Address string `json:"address"`
+}
+
+type ListHeaders struct {
+	ID              string   `json:"id,omitempty"`
+	Archive         []string `json:"archive,omitempty"`
+	Help            []string `json:"help,omitempty"`
+	Owner           []string `json:"owner,omitempty"`
+	Post            []string `json:"post,omitempty"`
+	Subscribe       []string `json:"subscribe,omitempty"`
+	Unsubscribe     []string `json:"unsubscribe,omitempty"`
+	UnsubscribePost string   `json:"unsubscribePost,omitempty"`
+}
+
+// Parsed holds the structured values of the address, date, identification
+// and mailing list headers of a message.
+type Parsed struct {
+	From       []Address    `json:"from,omitempty"`
+	Sender     []Address    `json:"sender,omitempty"`
+	ReplyTo    []Address    `json:"replyTo,omitempty"`
+	To         []Address    `json:"to,omitempty"`
+	Cc         []Address    `json:"cc,omitempty"`
+	Bcc        []Address    `json:"bcc,omitempty"`
+	Date       string       `json:"date,omitempty"`
+	MessageID  []string     `json:"messageId,omitempty"`
+	InReplyTo  []string     `json:"inReplyTo,omitempty"`
+	References []string     `json:"references,omitempty"`
+	List       *ListHeaders `json:"list,omitempty"`
+}
+
+var addressParser = &mail.AddressParser{WordDecoder: wordDecoder}
+
+func ParseHeaders(header textproto.MIMEHeader) *Parsed {
+	var parsed Parsed
+
+	parsed.From = ParseAddressList(header.Values("From"))
+	parsed.Sender = ParseAddressList(header.Values("Sender"))
+	parsed.ReplyTo = ParseAddressList(header.Values("Reply-To"))
+	parsed.To = ParseAddressList(header.Values("To"))
+	parsed.Cc = ParseAddressList(header.Values("Cc"))
+	parsed.Bcc = ParseAddressList(header.Values("Bcc"))
+
+	if date := header.Get("Date"); date != "" {
+		if t, err := ParseDate(date); err == nil {
+			parsed.Date = t.UTC().Format(time.RFC3339)
+		}
+	}
+
+	parsed.MessageID = ParseMessageIDs(header.Values("Message-Id"))
+	parsed.InReplyTo = ParseMessageIDs(header.Values("In-Reply-To"))
+	parsed.References = ParseMessageIDs(header.Values("References"))
+
+	list := ListHeaders{
+		Archive:         ParseListURLs(header.Get("List-Archive")),
+		Help:            ParseListURLs(header.Get("List-Help")),
+		Owner:           ParseListURLs(header.Get("List-Owner")),
+		Post:            ParseListURLs(header.Get("List-Post")),
+		Subscribe:       ParseListURLs(header.Get("List-Subscribe")),
+		Unsubscribe:     ParseListURLs(header.Get("List-Unsubscribe")),
+		UnsubscribePost: strings.TrimSpace(header.Get("List-Unsubscribe-Post")),
+	}
+	if listID := header.Get("List-Id"); listID != "" {
+		if ids := angleBracketPattern.FindAllStringSubmatch(listID, -1); len(ids) > 0 {
+			list.ID = ids[len(ids)-1][1]
+		} else {
+			list.ID = strings.TrimSpace(listID)
+		}
+	}
+	if list.ID != "" || list.Archive != nil || list.Help != nil || list.Owner != nil ||
+		list.Post != nil || list.Subscribe != nil || list.Unsubscribe != nil || list.UnsubscribePost != "" {
+		parsed.List = &list
+	}
+
+	return &parsed
+}
+
+var (
+	angleBracketPattern = regexp.MustCompile(`<([^<>]*)>`)
+	addrSpecPattern     = regexp.MustCompile(`[^\s<>,;:"()\[\]]+@[^\s<>,;:"()\[\]]+`)
+)
+
+// ParseAddressList parses address header values with net/mail, falling back
+// to parsing each address on its own and finally to picking anything which
+// looks like an address, so that malformed headers still yield the addresses.
+func ParseAddressList(values []string) []Address {
+	var addresses []Address
+	for _, value := range values {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+
+		if list, err := addressParser.ParseList(value); err == nil {
+			for _, a := range list {
+				addresses = append(addresses, Address{Name: a.Name, Address: a.Address})
+			}
+			continue
+		}
+
+		for _, field := range splitAddressList(value) {
+			if a, err := addressParser.Parse(field); err == nil {
+				addresses = append(addresses, Address{Name: a.Name, Address: a.Address})
+			} else if a, ok := parseAddressLeniently(field); ok {
+				addresses = append(addresses, a)
+			}
+		}
+	}
+	return addresses
+}
+
+// splitAddressList splits at commas outside of quoted strings, comments and
+// angle brackets.
+func splitAddressList(s string) []string {
+	var fields []string
+	start := 0
+	quoted := false
+	depth := 0
+	angle := false
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		case c == '<':
+			angle = true
+		case c == '>':
+			angle = false
+		case (c == ',' || c == ';') && depth == 0 && !angle:
+			fields = append(fields, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(fields, s[start:])
+}
+
+func parseAddressLeniently(s string) (Address, bool) {
+	addr := addrSpecPattern.FindString(s)
+	if addr == "" {
+		return Address{}, false
+	}
+
+	name := s
+	if m := angleBracketPattern.FindStringIndex(s); m != nil {
+		name = s[:m[0]] + s[m[1]:]
+	} else {
+		name = strings.Replace(name, addr, "", 1)
+	}
+	name = strings.Trim(strings.TrimSpace(name), `"'<> `)
+	if decoded, err := wordDecoder.DecodeHeader(name); err == nil {
+		name = decoded
+	}
+	return Address{Name: name, Address: addr}, true
+}
+
+var dateLayouts = []string{
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"Mon, 2 Jan 2006 15:04 -0700",
+	"Mon, 2 Jan 06 15:04:05 -0700",
+	"2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04:05 MST",
+	"Mon, 2 Jan 2006 15:04:05",
+	"Mon Jan 2 15:04:05 2006",
+	"Mon Jan 2 15:04:05 MST 2006",
+	"Mon Jan 2 15:04:05 -0700 2006",
+	"2006-01-02 15:04:05 -0700",
+	time.RFC3339,
+}
+
+var commentPattern = regexp.MustCompile(`\([^()]*\)`)
+
+// ParseDate parses a Date header with net/mail and falls back to formats seen
+// in the wild, such as ctime dates and dates without a time zone.
+func ParseDate(s string) (time.Time, error) {
+	t, err := mail.ParseDate(s)
+	if err == nil {
+		return t, nil
+	}
+
+	cleaned := strings.Join(strings.Fields(commentPattern.ReplaceAllString(s, "")), " ")
+	cleaned = strings.TrimSuffix(cleaned, " UT")
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, cleaned); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// ParseMessageIDs returns the identifiers of Message-ID, In-Reply-To and
+// References headers without the angle brackets.
+func ParseMessageIDs(values []string) []string {
+	var ids []string
+	for _, value := range values {
+		matches := angleBracketPattern.FindAllStringSubmatch(value, -1)
+		if len(matches) == 0 {
+			// some mailers omit the angle brackets
+			for _, field := range strings.Fields(commentPattern.ReplaceAllString(value, "")) {
+				if strings.Contains(field, "@") {
+					ids = append(ids, strings.Trim(field, ","))
+				}
+			}
+			continue
+		}
+		for _, m := range matches {
+			if id := strings.TrimSpace(m[1]); id != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// ParseListURLs returns the URLs of an RFC 2369 List-* header.
+func ParseListURLs(value string) []string {
+	var urls []string
+	for _, m := range angleBracketPattern.FindAllStringSubmatch(value, -1) {
+		if url := strings.Join(strings.Fields(m[1]), ""); url != "" {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/textproto"
+	"testing"
+)
+
+func TestParseAddressList(t *testing.T) {
+	testcases := []struct {
+		value    string
+		expected []Address
+	}{
+		{
+			`"Alice" <alice@example.com>, bob@example.com`,
+			[]Address{{Name: "Alice", Address: "alice@example.com"}, {Address: "bob@example.com"}},
+		},
+		{
+			`=?UTF-8?B?44GC44GE?= <a@example.com>`,
+			[]Address{{Name: "あい", Address: "a@example.com"}},
+		},
+		{
+			`=?ISO-2022-JP?B?GyRCJCIbKEI=?= <a@example.com>`,
+			[]Address{{Name: "あ", Address: "a@example.com"}},
+		},
+		{
+			`Team: alice@example.com, bob@example.com;`,
+			[]Address{{Address: "alice@example.com"}, {Address: "bob@example.com"}},
+		},
+		{
+			`Alice Smith (Sales) <alice@example.com>, broken <>, Bob <bob@example.com`,
+			[]Address{{Name: "Alice Smith", Address: "alice@example.com"}, {Name: "Bob", Address: "bob@example.com"}},
+		},
+		{
+			`"Last, First" <first.last@example.com>; "x@y" <x@example.com>`,
+			[]Address{{Name: "Last, First", Address: "first.last@example.com"}, {Name: "x@y", Address: "x@example.com"}},
+		},
+		{
+			`undisclosed-recipients:;`,
+			nil,
+		},
+	}
+
+	for _, tt := range testcases {
+		t.Run(tt.value, func(t *testing.T) {
+			assert.Equal(t, tt.expected, ParseAddressList([]string{tt.value}))
+		})
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	testcases := []struct {
+		value    string
+		expected string
+	}{
+		{"Mon, 2 Jan 2006 15:04:05 +0900", "2006-01-02T06:04:05Z"},
+		{"Mon, 2 Jan 2006 15:04:05 +0900 (JST)", "2006-01-02T06:04:05Z"},
+		{"2 Jan 2006 15:04:05 -0000", "2006-01-02T15:04:05Z"},
+		{"Mon Jan  2 15:04:05 2006", "2006-01-02T15:04:05Z"},
+		{"Mon, 2 Jan 2006 15:04:05", "2006-01-02T15:04:05Z"},
+		{"2006-01-02T15:04:05+01:00", "2006-01-02T14:04:05Z"},
+	}
+
+	for _, tt := range testcases {
+		t.Run(tt.value, func(t *testing.T) {
+			parsed := ParseHeaders(textproto.MIMEHeader{"Date": {tt.value}})
+			assert.Equal(t, tt.expected, parsed.Date)
+		})
+	}
+
+	_, err := ParseDate("yesterday")
+	assert.NotNil(t, err)
+}
+
+func TestParseMessageIDs(t *testing.T) {
+	assert.Equal(t, []string{"a@example.com"}, ParseMessageIDs([]string{"<a@example.com>"}))
+	assert.Equal(t,
+		[]string{"a@example.com", "b@example.com", "c@example.com"},
+		ParseMessageIDs([]string{"<a@example.com>\r\n <b@example.com>", "<c@example.com> (comment)"}),
+	)
+	assert.Equal(t, []string{"a@example.com", "b@example.com"}, ParseMessageIDs([]string{"a@example.com b@example.com"}))
+	assert.Nil(t, ParseMessageIDs(nil))
+}
+
+func TestParseHeadersList(t *testing.T) {
+	parsed := ParseHeaders(textproto.MIMEHeader{
+		"List-Id":               {`Example List <list.example.com>`},
+		"List-Unsubscribe":      {`<mailto:leave@example.com?subject=unsubscribe>, <https://example.com/unsub/ abc>`},
+		"List-Unsubscribe-Post": {`List-Unsubscribe=One-Click`},
+		"List-Post":             {`NO (posting not allowed)`},
+	})
+
+	assert.Equal(t, &ListHeaders{
+		ID:              "list.example.com",
+		Unsubscribe:     []string{"mailto:leave@example.com?subject=unsubscribe", "https://example.com/unsub/abc"},
+		UnsubscribePost: "List-Unsubscribe=One-Click",
+	}, parsed.List)
+
+	parsed = ParseHeaders(textproto.MIMEHeader{})
+	assert.Nil(t, parsed.List)
+}
+
+func TestReadMailParseHeaders(t *testing.T) {
+	input := "From: Alice <alice@example.com>\r\n" +
+		"To: bob@example.com\r\n" +
+		"Date: Mon, 2 Jan 2006 15:04:05 +0900\r\n" +
+		"Message-ID: <1@example.com>\r\n" +
+		"\r\n" +
+		"body\r\n"
+
+	part := readTestMail(t, input, Option{parseHeaders: true})
+	assert.Equal(t, &Parsed{
+		From:      []Address{{Name: "Alice", Address: "alice@example.com"}},
+		To:        []Address{{Address: "bob@example.com"}},
+		Date:      "2006-01-02T06:04:05Z",
+		MessageID: []string{"1@example.com"},
+	}, part.Parsed)
+
+	part = readTestMail(t, input, Option{})
+	assert.Nil(t, part.Parsed)
+}
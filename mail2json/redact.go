@@ -0,0 +1,497 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// how attachments are redacted
+const (
+	RedactKeep = "keep"
+	RedactHash = "hash"
+	RedactDrop = "drop"
+)
+
+// RedactionProfile is a rule file for Redact:
+//
+//	{
+//	  "key": "secret for the pseudonyms",
+//	  "pseudonymizeAddresses": true,
+//	  "keepDomains": ["example.com"],
+//	  "removeHeaders": ["Received", "X-Originating-IP"],
+//	  "attachments": "hash",
+//	  "maskPhones": true,
+//	  "patterns": [{"pattern": "\\b\\d{4}-\\d{4}-\\d{4}-\\d{4}\\b", "replacement": "[card]"}]
+//	}
+//
+// Addresses are replaced with pseudonyms derived from the key by HMAC, so
+// that the same address gets the same pseudonym in every message redacted
+// with the key. The key may also be given by MAIL2JSON_REDACT_KEY.
+type RedactionProfile struct {
+	Key                   string             `json:"key"`
+	PseudonymizeAddresses bool               `json:"pseudonymizeAddresses"`
+	KeepDomains           []string           `json:"keepDomains"`
+	RemoveHeaders         []string           `json:"removeHeaders"`
+	Attachments           string             `json:"attachments"`
+	MaskPhones            bool               `json:"maskPhones"`
+	Patterns              []RedactionPattern `json:"patterns"`
+}
+
+// RedactionPattern replaces the matches of a regular expression in text
+// bodies and unstructured headers. The replacement may refer to submatches
+// as in regexp.Regexp.ReplaceAllString, and defaults to "[redacted]".
+type RedactionPattern struct {
+	Pattern     string `json:"pattern"`
+	Replacement string `json:"replacement"`
+}
+
+// Redactor applies a redaction profile to messages.
+type Redactor struct {
+	profile       RedactionProfile
+	key           []byte
+	keepDomains   map[string]bool
+	removeHeaders map[string]bool
+	patterns      []*regexp.Regexp
+	replacements  []string
+}
+
+var (
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9.!#$%&'*+/=?^_{|}~-]+@[A-Za-z0-9](?:[A-Za-z0-9-]*[A-Za-z0-9])?(?:\.[A-Za-z0-9](?:[A-Za-z0-9-]*[A-Za-z0-9])?)+`)
+	// an address in a URL, where the local part stops at the delimiters of
+	// the URL
+	urlEmailPattern = regexp.MustCompile(`[A-Za-z0-9._+-]+@[A-Za-z0-9](?:[A-Za-z0-9-]*[A-Za-z0-9])?(?:\.[A-Za-z0-9](?:[A-Za-z0-9-]*[A-Za-z0-9])?)+`)
+	// an address with the @ escaped, as in the query of a tracking link
+	escapedEmailPattern = regexp.MustCompile(`[A-Za-z0-9._+-]+%40[A-Za-z0-9](?:[A-Za-z0-9-]*[A-Za-z0-9])?(?:\.[A-Za-z0-9](?:[A-Za-z0-9-]*[A-Za-z0-9])?)+`)
+	// e.g. +81 90-1234-5678, (555) 123-4567, 03-1234-5678
+	phonePattern = regexp.MustCompile(`(?:\+\d{1,3}[ .-]?)?(?:\(\d{1,4}\)[ .-]?|\d{1,4}[ .-])\d{2,4}[ .-]\d{3,4}\b`)
+)
+
+// unstructuredHeaders are the headers the patterns are applied to, besides
+// the text bodies. Other headers hold tokens, such as dates and signatures,
+// which the patterns might mangle.
+var unstructuredHeaders = map[string]bool{
+	"Comments":            true,
+	"Keywords":            true,
+	"Subject":             true,
+	"Thread-Topic":        true,
+	"X-Mailer":            true,
+	"Organization":        true,
+	"X-Originator":        true,
+	"Content-Description": true,
+}
+
+// LoadRedactionProfile reads a rule file.
+func LoadRedactionProfile(path string) (RedactionProfile, error) {
+	var profile RedactionProfile
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return profile, err
+	}
+	if err := json.Unmarshal(b, &profile); err != nil {
+		return profile, fmt.Errorf("%s: %w", path, err)
+	}
+	if profile.Key == "" {
+		profile.Key = os.Getenv("MAIL2JSON_REDACT_KEY")
+	}
+	return profile, nil
+}
+
+// NewRedactor checks a profile and compiles its patterns.
+func NewRedactor(profile RedactionProfile) (*Redactor, error) {
+	switch profile.Attachments {
+	case "":
+		profile.Attachments = RedactKeep
+	case RedactKeep, RedactHash, RedactDrop:
+	default:
+		return nil, fmt.Errorf("invalid attachments: %s", profile.Attachments)
+	}
+	// pseudonyms without a secret key can be reversed by trying addresses
+	if profile.PseudonymizeAddresses && profile.Key == "" {
+		return nil, errors.New("key is required to pseudonymize addresses")
+	}
+
+	r := &Redactor{
+		profile:       profile,
+		key:           []byte(profile.Key),
+		keepDomains:   map[string]bool{},
+		removeHeaders: map[string]bool{},
+	}
+	for _, domain := range profile.KeepDomains {
+		r.keepDomains[strings.ToLower(domain)] = true
+	}
+	for _, name := range profile.RemoveHeaders {
+		r.removeHeaders[textproto.CanonicalMIMEHeaderKey(name)] = true
+	}
+	for _, p := range profile.Patterns {
+		re, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		replacement := p.Replacement
+		if replacement == "" {
+			replacement = "[redacted]"
+		}
+		r.patterns = append(r.patterns, re)
+		r.replacements = append(r.replacements, replacement)
+	}
+	// after the patterns, which may match more specific numbers
+	if profile.MaskPhones {
+		r.patterns = append(r.patterns, phonePattern)
+		r.replacements = append(r.replacements, "[phone]")
+	}
+	return r, nil
+}
+
+// Pseudonymize replaces an address with a pseudonym such as
+// u1a2b3c4d5e@d6f7a8b9c0d.invalid. The domains to keep are kept.
+func (r *Redactor) Pseudonymize(address string) string {
+	local, domain, ok := strings.Cut(address, "@")
+	if !ok {
+		return "u" + r.hash("local:"+strings.ToLower(address))
+	}
+	domain = strings.ToLower(domain)
+	local = "u" + r.hash("address:"+strings.ToLower(local)+"@"+domain)
+	if r.keepDomains[domain] {
+		return local + "@" + domain
+	}
+	return local + "@d" + r.hash("domain:"+domain) + ".invalid"
+}
+
+func (r *Redactor) hash(s string) string {
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil))[:10]
+}
+
+// RedactText pseudonymizes the addresses in a text and replaces the matches
+// of the patterns.
+func (r *Redactor) RedactText(text string) string {
+	return r.replacePatterns(r.redactAddresses(text))
+}
+
+// redactURL pseudonymizes the addresses in a URL and replaces the matches of
+// the patterns.
+func (r *Redactor) redactURL(u string) string {
+	if r.profile.PseudonymizeAddresses {
+		u = urlEmailPattern.ReplaceAllStringFunc(u, r.Pseudonymize)
+		u = r.redactEscapedAddresses(u)
+	}
+	return r.replacePatterns(u)
+}
+
+func (r *Redactor) replacePatterns(text string) string {
+	for i, re := range r.patterns {
+		text = re.ReplaceAllString(text, r.replacements[i])
+	}
+	return text
+}
+
+func (r *Redactor) redactAddresses(text string) string {
+	if !r.profile.PseudonymizeAddresses {
+		return text
+	}
+	return r.redactEscapedAddresses(emailPattern.ReplaceAllStringFunc(text, r.Pseudonymize))
+}
+
+// redactEscapedAddresses gives an escaped address the pseudonym of the plain
+// one.
+func (r *Redactor) redactEscapedAddresses(text string) string {
+	return escapedEmailPattern.ReplaceAllStringFunc(text, func(address string) string {
+		return r.Pseudonymize(strings.Replace(address, "%40", "@", 1))
+	})
+}
+
+// redactAddressList pseudonymizes an address header. The display names are
+// replaced as well, since they usually are names of people.
+func (r *Redactor) redactAddressList(value string) string {
+	if !r.profile.PseudonymizeAddresses {
+		return value
+	}
+	list, err := addressParser.ParseList(value)
+	if err != nil {
+		return r.redactAddresses(value)
+	}
+	values := make([]string, len(list))
+	for i, a := range list {
+		address := r.Pseudonymize(a.Address)
+		name := ""
+		if a.Name != "" {
+			name, _, _ = strings.Cut(address, "@")
+		}
+		values[i] = (&mail.Address{Name: name, Address: address}).String()
+	}
+	return strings.Join(values, ", ")
+}
+
+// redactHeaderValue redacts a decoded header value.
+func (r *Redactor) redactHeaderValue(name string, value string) string {
+	name = textproto.CanonicalMIMEHeaderKey(name)
+	switch {
+	case addressHeaders[name]:
+		return r.redactAddressList(value)
+	case unstructuredHeaders[name]:
+		return r.RedactText(value)
+	case parameterizedHeaders[name]:
+		return r.redactParams(value)
+	default:
+		return r.redactAddresses(value)
+	}
+}
+
+// redactParams redacts a Content-Type or Content-Disposition value. File
+// names are free text, so the patterns are applied to them as well.
+func (r *Redactor) redactParams(value string) string {
+	token, params, err := ParseParams(value)
+	if err != nil {
+		return r.redactAddresses(value)
+	}
+	m := map[string]string{}
+	changed := false
+	for _, p := range params {
+		v := r.redactAddresses(p.Value)
+		if p.Name == "filename" || p.Name == "name" {
+			v = r.RedactText(p.Value)
+		}
+		changed = changed || v != p.Value
+		m[p.Name] = v
+	}
+	if !changed {
+		return value
+	}
+	if formatted := mime.FormatMediaType(token, m); formatted != "" {
+		return formatted
+	}
+	return r.redactAddresses(value)
+}
+
+// redactRawHeaderValue redacts a header value as found in the message. The
+// value is only encoded anew if the redaction changes it.
+func (r *Redactor) redactRawHeaderValue(name string, value string) string {
+	if addressHeaders[textproto.CanonicalMIMEHeaderKey(name)] {
+		return r.redactAddressList(value)
+	}
+	decoded := DecodeHeaderValue(name, value)
+	redacted := r.redactHeaderValue(name, decoded)
+	if redacted == decoded {
+		return value
+	}
+	return EncodeHeaderValue(name, redacted)
+}
+
+func (r *Redactor) redactHeader(header map[string][]string, redact func(string, string) string) map[string][]string {
+	if header == nil {
+		return nil
+	}
+	redacted := make(map[string][]string, len(header))
+	for name, values := range header {
+		if r.removeHeaders[textproto.CanonicalMIMEHeaderKey(name)] {
+			continue
+		}
+		redactedValues := make([]string, len(values))
+		for i, value := range values {
+			redactedValues[i] = redact(name, value)
+		}
+		redacted[name] = redactedValues
+	}
+	return redacted
+}
+
+// Redact applies the profile to a message in place: headers are removed,
+// addresses pseudonymized, patterns replaced in text bodies and attachments
+// dropped or hashed as configured. Structured values derived from the
+// headers are derived again from the redacted ones, and vCards are removed.
+// Delivery status reports are redacted like text bodies.
+func (r *Redactor) Redact(p *Part) {
+	if p.RawHeader != nil {
+		p.Header = r.redactHeader(p.Header, r.redactHeaderValue)
+		p.RawHeader = r.redactHeader(p.RawHeader, r.redactRawHeaderValue)
+	} else {
+		p.Header = r.redactHeader(p.Header, r.redactRawHeaderValue)
+	}
+	p.Headers = r.redactHeaderFields(p.Headers)
+	if p.Parsed != nil {
+		p.Parsed = ParseHeaders(p.header())
+	}
+	if p.Analysis != nil {
+		p.Analysis = Analyze(p.header())
+	}
+
+	for i := range p.DKIM {
+		p.DKIM[i].Identity = r.redactAddresses(p.DKIM[i].Identity)
+	}
+	if p.Attachment != nil {
+		p.Attachment.Filename = r.RedactText(p.Attachment.Filename)
+	}
+
+	if e := p.Envelope; e != nil {
+		e.MailFrom = r.redactAddresses(e.MailFrom)
+		for i, to := range e.RcptTo {
+			e.RcptTo[i] = r.redactAddresses(to)
+		}
+	}
+
+	r.redactBody(p)
+	p.Text = r.RedactText(p.Text)
+	for i := range p.Links {
+		p.Links[i].URL = r.redactURL(p.Links[i].URL)
+		p.Links[i].Text = r.RedactText(p.Links[i].Text)
+	}
+	for i := range p.Images {
+		p.Images[i].Src = r.redactURL(p.Images[i].Src)
+		p.Images[i].Alt = r.RedactText(p.Images[i].Alt)
+	}
+	// content IDs stay consistent with the redacted Content-ID headers
+	for i := range p.CIDReferences {
+		p.CIDReferences[i].CID = r.redactAddresses(p.CIDReferences[i].CID)
+	}
+	if s := p.Summary; s != nil {
+		for _, list := range [][]BodyPart{s.TextBody, s.HTMLBody, s.Attachments} {
+			for i := range list {
+				list[i].Name = r.RedactText(list[i].Name)
+				list[i].CID = r.redactAddresses(list[i].CID)
+			}
+		}
+	}
+	if p.Calendar != nil {
+		r.redactCalendar(p.Calendar)
+	}
+	p.Contacts = nil
+	if p.Security != nil {
+		for i := range p.Security.Signers {
+			s := &p.Security.Signers[i]
+			s.Name = r.RedactText(s.Name)
+			s.Email = r.redactAddresses(s.Email)
+		}
+		if p.Security.Content != nil {
+			r.Redact(p.Security.Content)
+		}
+	}
+
+	if p.Message != nil {
+		r.Redact(p.Message)
+		if a := p.Attachment; a != nil && r.profile.Attachments == RedactDrop {
+			*a = Attachment{Filename: a.Filename, ContentType: a.ContentType}
+		}
+	}
+	for i := range p.Parts {
+		r.Redact(&p.Parts[i])
+	}
+	if p.DeliveryStatus != nil {
+		r.redactDeliveryStatus(p.DeliveryStatus)
+	}
+}
+
+// redactDeliveryStatus redacts the recipients of a report, and the message ID
+// like the Message-ID header.
+func (r *Redactor) redactDeliveryStatus(d *DeliveryStatus) {
+	d.OriginalMessageID = r.redactAddresses(d.OriginalMessageID)
+	for i := range d.Recipients {
+		recipient := &d.Recipients[i]
+		recipient.FinalRecipient = r.redactAddresses(recipient.FinalRecipient)
+		recipient.OriginalRecipient = r.redactAddresses(recipient.OriginalRecipient)
+		recipient.DiagnosticCode = r.RedactText(recipient.DiagnosticCode)
+	}
+}
+
+// redactHeaderFields redacts the ordered header fields. A changed field is
+// written anew on a single line.
+func (r *Redactor) redactHeaderFields(fields []HeaderField) []HeaderField {
+	if fields == nil {
+		return nil
+	}
+	redacted := []HeaderField{}
+	for _, field := range fields {
+		if r.removeHeaders[textproto.CanonicalMIMEHeaderKey(field.Name)] {
+			continue
+		}
+		value := r.redactRawHeaderValue(field.Name, field.Value)
+		if value != field.Value {
+			field.Value = value
+			field.Raw = field.Name + ": " + value + "\r\n"
+		}
+		redacted = append(redacted, field)
+	}
+	return redacted
+}
+
+// redactBody drops or hashes an attachment, or redacts a text body or a
+// delivery status report. A body which is still transfer encoded is decoded
+// first.
+func (r *Redactor) redactBody(p *Part) {
+	if p.Message != nil || p.Parts != nil {
+		return
+	}
+
+	if a := p.Attachment; a != nil {
+		switch r.profile.Attachments {
+		case RedactHash:
+			p.Body = ""
+			a.Path = ""
+			a.Redacted = RedactHash
+			return
+		case RedactDrop:
+			p.Body = ""
+			*a = Attachment{Filename: a.Filename, ContentType: a.ContentType, Redacted: RedactDrop}
+			return
+		}
+	}
+
+	mediaType, params := contentTypeParams(textproto.MIMEHeader(p.header()))
+	if !strings.HasPrefix(mediaType, "text/") && !isDeliveryStatus(mediaType) || p.Body == "" {
+		return
+	}
+
+	text := p.Body
+	if p.Charset == "" {
+		content, err := partContent(p)
+		if err != nil {
+			return
+		}
+		var charset string
+		var warnings []string
+		text, charset, warnings = DecodeText(content, params["charset"])
+		if charset == "" {
+			charset = "utf-8"
+		}
+		p.Charset = charset
+		p.DecodeWarnings = append(p.DecodeWarnings, warnings...)
+	}
+
+	p.Body = r.RedactText(text)
+	if p.Attachment != nil {
+		// the attachment describes the redacted content
+		a := NewAttachment([]byte(p.Body), p.Attachment.ContentType, p.Attachment.Filename)
+		*p.Attachment = *a
+	}
+}
+
+func (r *Redactor) redactCalendar(c *Calendar) {
+	redactAttendee := func(a *Attendee) {
+		a.Email = r.redactAddresses(a.Email)
+		if a.Name != "" && r.profile.PseudonymizeAddresses {
+			a.Name, _, _ = strings.Cut(a.Email, "@")
+		}
+	}
+	for i := range c.Events {
+		e := &c.Events[i]
+		e.Summary = r.RedactText(e.Summary)
+		e.Description = r.RedactText(e.Description)
+		e.Location = r.RedactText(e.Location)
+		if e.Organizer != nil {
+			redactAttendee(e.Organizer)
+		}
+		for j := range e.Attendees {
+			redactAttendee(&e.Attendees[j])
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const redactTestMail = "From: Alice Liddell <alice@example.com>\r\n" +
+	"To: bob@example.org, \"Carol\" <carol@wonderland.example>\r\n" +
+	"Subject: call me at 03-1234-5678\r\n" +
+	"Message-ID: <1234@example.com>\r\n" +
+	"Received: from mx.example.com by mx.example.org\r\n" +
+	"Content-Type: multipart/mixed; boundary=b\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"V3JpdGUgdG8gYm9iQGV4YW1wbGUub3JnLCBjYXJkIDEyMzQtNTY3OC05MDEyLTM0NTYu\r\n" +
+	"--b\r\n" +
+	"Content-Type: application/pdf\r\n" +
+	"Content-Disposition: attachment; filename=secret.pdf\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"c2VjcmV0IGNvbnRlbnQ=\r\n" +
+	"--b--\r\n"
+
+func newTestRedactor(t *testing.T, profile RedactionProfile) *Redactor {
+	t.Helper()
+	r, err := NewRedactor(profile)
+	assert.Nil(t, err)
+	return r
+}
+
+func TestPseudonymize(t *testing.T) {
+	r := newTestRedactor(t, RedactionProfile{Key: "key", PseudonymizeAddresses: true, KeepDomains: []string{"Example.com"}})
+
+	alice := r.Pseudonymize("alice@example.com")
+	assert.Equal(t, alice, r.Pseudonymize("Alice@EXAMPLE.com"))
+	assert.True(t, strings.HasSuffix(alice, "@example.com"), alice)
+	assert.NotContains(t, alice, "alice")
+
+	bob := r.Pseudonymize("bob@example.org")
+	assert.Regexp(t, `^u[0-9a-f]{10}@d[0-9a-f]{10}\.invalid$`, bob)
+	assert.NotEqual(t, bob, newTestRedactor(t, RedactionProfile{Key: "other", PseudonymizeAddresses: true}).Pseudonymize("bob@example.org"))
+}
+
+func TestRedact(t *testing.T) {
+	profile := RedactionProfile{
+		Key:                   "key",
+		PseudonymizeAddresses: true,
+		RemoveHeaders:         []string{"received"},
+		Attachments:           RedactHash,
+		MaskPhones:            true,
+		Patterns:              []RedactionPattern{{Pattern: `\b\d{4}-\d{4}-\d{4}-\d{4}\b`, Replacement: "[card]"}},
+	}
+	r := newTestRedactor(t, profile)
+	msg := readTestMail(t, redactTestMail, Option{maxDepth: defaultMaxDepth, orderedHeaders: true})
+	r.Redact(msg)
+
+	bob := r.Pseudonymize("bob@example.org")
+	carol := r.Pseudonymize("carol@wonderland.example")
+	carolName, _, _ := strings.Cut(carol, "@")
+	assert.Equal(t, []string{"<" + bob + ">, \"" + carolName + "\" <" + carol + ">"}, msg.Header["To"])
+	assert.Equal(t, []string{"call me at [phone]"}, msg.Header["Subject"])
+	// message IDs stay consistent with the In-Reply-To and References of replies
+	assert.Equal(t, []string{"<" + r.Pseudonymize("1234@example.com") + ">"}, msg.Header["Message-Id"])
+	assert.NotContains(t, msg.Header, "Received")
+	for _, field := range msg.Headers {
+		assert.NotEqual(t, "Received", field.Name)
+	}
+
+	text := msg.Parts[0]
+	assert.Equal(t, "Write to "+bob+", card [card].", text.Body)
+	assert.Equal(t, "utf-8", text.Charset)
+
+	attachment := msg.Parts[1]
+	assert.Equal(t, "", attachment.Body)
+	assert.Equal(t, RedactHash, attachment.Attachment.Redacted)
+	assert.NotEmpty(t, attachment.Attachment.SHA256)
+}
+
+func TestRedactCompose(t *testing.T) {
+	for _, mode := range []string{RedactHash, RedactDrop} {
+		t.Run(mode, func(t *testing.T) {
+			r := newTestRedactor(t, RedactionProfile{Key: "key", PseudonymizeAddresses: true, Attachments: mode})
+			msg := readTestMail(t, redactTestMail, Option{maxDepth: defaultMaxDepth})
+			r.Redact(msg)
+
+			b, err := ComposePart(msg, Option{})
+			assert.Nil(t, err)
+			for _, s := range []string{"alice", "bob@", "carol@", "c2VjcmV0"} {
+				assert.NotContains(t, string(b), s)
+			}
+
+			reparsed := readTestMail(t, string(b), Option{maxDepth: defaultMaxDepth, decodeTransferEncoding: true})
+			assert.Empty(t, reparsed.Defects)
+			assert.Equal(t, msg.Header["From"], reparsed.Header["From"])
+			assert.Equal(t, "Write to "+r.Pseudonymize("bob@example.org")+", card 1234-5678-9012-3456.", reparsed.Parts[0].Body)
+			assert.Equal(t, "secret.pdf", reparsed.Parts[1].Attachment.Filename)
+		})
+	}
+}
+
+func TestRedactBounce(t *testing.T) {
+	for _, mode := range []string{RedactKeep, RedactHash} {
+		t.Run(mode, func(t *testing.T) {
+			r := newTestRedactor(t, RedactionProfile{Key: "key", PseudonymizeAddresses: true, Attachments: mode})
+			msg := readTestMail(t, deliveryStatusTestMail, Option{maxDepth: defaultMaxDepth, deliveryStatus: true})
+			r.Redact(msg)
+
+			b, err := json.Marshal(msg)
+			assert.Nil(t, err)
+			for _, s := range []string{"alice@", "Alice@", "bob@", "original@"} {
+				assert.NotContains(t, string(b), s)
+			}
+
+			alice := r.Pseudonymize("alice@example.org")
+			dsn := msg.DeliveryStatus
+			assert.Equal(t, 2, len(dsn.Recipients))
+			assert.Equal(t, alice, dsn.Recipients[0].FinalRecipient)
+			assert.Equal(t, "550 5.1.1 <"+alice+">: Recipient address rejected: User unknown", dsn.Recipients[0].DiagnosticCode)
+			assert.Equal(t, r.Pseudonymize("original@example.com"), dsn.OriginalMessageID)
+			if mode == RedactKeep {
+				assert.Contains(t, msg.Parts[1].Body, "Final-Recipient: rfc822; "+alice+"\r\n")
+			}
+		})
+	}
+}
+
+func TestRedactFilenameAndDKIM(t *testing.T) {
+	r := newTestRedactor(t, RedactionProfile{Key: "key", PseudonymizeAddresses: true, MaskPhones: true})
+	msg := readTestMail(t, "Content-Type: application/pdf; name=\"call 03-1234-5678.pdf\"\r\n"+
+		"Content-Disposition: attachment; filename=\"call 03-1234-5678.pdf\"\r\n"+
+		"\r\n"+
+		"data\r\n", Option{maxDepth: defaultMaxDepth})
+	msg.DKIM = []DKIMResult{{Result: "pass", Domain: "example.com", Identity: "alice@example.com"}}
+	r.Redact(msg)
+
+	assert.Equal(t, "call [phone].pdf", msg.Attachment.Filename)
+	assert.Equal(t, "call [phone].pdf", AttachmentFilename(msg.header()))
+	assert.NotContains(t, msg.Header["Content-Type"][0], "5678")
+	assert.Equal(t, r.Pseudonymize("alice@example.com"), msg.DKIM[0].Identity)
+}
+
+func TestRedactSummaryAndImages(t *testing.T) {
+	r := newTestRedactor(t, RedactionProfile{Key: "key", PseudonymizeAddresses: true, MaskPhones: true})
+	msg := readTestMail(t, "Content-Type: multipart/mixed; boundary=b\r\n"+
+		"\r\n"+
+		"--b\r\n"+
+		"Content-Type: text/html\r\n"+
+		"\r\n"+
+		"<p><a href=\"https://example.net/unsubscribe?u=alice%40example.com\">hello</a></p><img src=\"https://track.example.net/open?u=alice@example.com\" alt=\"for alice@example.com\">\r\n"+
+		"--b\r\n"+
+		"Content-Type: application/pdf\r\n"+
+		"Content-Disposition: attachment; filename=\"call 03-1234-5678.pdf\"\r\n"+
+		"\r\n"+
+		"data\r\n"+
+		"--b--\r\n", Option{maxDepth: defaultMaxDepth, summarize: true, renderHTML: true})
+	r.Redact(msg)
+
+	alice := r.Pseudonymize("alice@example.com")
+	images := msg.Parts[0].Images
+	assert.Equal(t, 1, len(images))
+	assert.Equal(t, "https://track.example.net/open?u="+alice, images[0].Src)
+	assert.Equal(t, "for "+alice, images[0].Alt)
+	assert.Equal(t, "https://example.net/unsubscribe?u="+alice, msg.Parts[0].Links[0].URL)
+	assert.Equal(t, "call [phone].pdf", msg.Summary.Attachments[0].Name)
+
+	b, err := json.Marshal(msg)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(b), "alice")
+	assert.NotContains(t, string(b), "5678")
+}
+
+func TestNewRedactorErrors(t *testing.T) {
+	testcases := []struct {
+		name    string
+		profile RedactionProfile
+		err     string
+	}{
+		{"pattern", RedactionProfile{Patterns: []RedactionPattern{{Pattern: "("}}}, "missing closing )"},
+		{"key", RedactionProfile{PseudonymizeAddresses: true}, "key is required"},
+		{"attachments", RedactionProfile{Attachments: "remove"}, "invalid attachments: remove"},
+	}
+
+	for _, tt := range testcases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewRedactor(tt.profile)
+			assert.ErrorContains(t, err, tt.err)
+		})
+	}
+}
+
+func TestLoadRedactionProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	assert.Nil(t, os.WriteFile(path, []byte(`{"pseudonymizeAddresses": true, "attachments": "drop"}`), 0o600))
+	t.Setenv("MAIL2JSON_REDACT_KEY", "from env")
+
+	profile, err := LoadRedactionProfile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, RedactionProfile{Key: "from env", PseudonymizeAddresses: true, Attachments: RedactDrop}, profile)
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"go.mozilla.org/pkcs7"
+	"io"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+// kinds of signed and encrypted parts
+const (
+	SecuritySMIME = "smime"
+	SecurityPGP   = "pgp"
+)
+
+// Security is the result of checking a signed or encrypted part. Content is
+// the MIME tree wrapped in an opaque signature or in an encrypted part which
+// could be decrypted.
+type Security struct {
+	Type      string   `json:"type"`
+	Signed    bool     `json:"signed,omitempty"`
+	Encrypted bool     `json:"encrypted,omitempty"`
+	Decrypted bool     `json:"decrypted,omitempty"`
+	Signers   []Signer `json:"signers,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	Content   *Part    `json:"content,omitempty"`
+}
+
+// Signer is a signature of a part. Valid is set when the signature matches
+// the content, and Trusted when the certificate of the signer chains up to
+// the trust store (S/MIME) or the key is in the keyring (PGP).
+type Signer struct {
+	Name      string `json:"name,omitempty"`
+	Email     string `json:"email,omitempty"`
+	Issuer    string `json:"issuer,omitempty"`
+	Serial    string `json:"serial,omitempty"`
+	KeyID     string `json:"keyId,omitempty"`
+	Algorithm string `json:"algorithm,omitempty"`
+	SignedAt  string `json:"signedAt,omitempty"`
+	Valid     bool   `json:"valid"`
+	Trusted   bool   `json:"trusted"`
+	Error     string `json:"error,omitempty"`
+}
+
+// SecurityKeys are the certificates and keys signed and encrypted parts are
+// checked with. S/MIME signers are untrusted when Roots is nil.
+type SecurityKeys struct {
+	Roots       *x509.CertPool
+	Certificate *x509.Certificate
+	PrivateKey  crypto.PrivateKey
+	Keyring     openpgp.EntityList
+}
+
+// LoadTrustStore reads the PEM encoded CA certificates S/MIME signers are
+// verified against.
+func LoadTrustStore(path string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("%s: no certificate found", path)
+	}
+	return roots, nil
+}
+
+// LoadSMIMEKey reads the PEM encoded certificate and private key S/MIME parts
+// are decrypted with.
+func LoadSMIMEKey(path string) (*x509.Certificate, crypto.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var cert *x509.Certificate
+	var key crypto.PrivateKey
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "CERTIFICATE":
+			if cert == nil {
+				if cert, err = x509.ParseCertificate(block.Bytes); err != nil {
+					return nil, nil, fmt.Errorf("%s: %w", path, err)
+				}
+			}
+		case "PRIVATE KEY":
+			if key, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+				return nil, nil, fmt.Errorf("%s: %w", path, err)
+			}
+		case "RSA PRIVATE KEY":
+			if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+				return nil, nil, fmt.Errorf("%s: %w", path, err)
+			}
+		}
+	}
+	if cert == nil || key == nil {
+		return nil, nil, fmt.Errorf("%s: certificate or private key not found", path)
+	}
+	return cert, key, nil
+}
+
+// LoadKeyring reads an armored or binary OpenPGP keyring. Secret keys must
+// not be protected by a passphrase.
+func LoadKeyring(path string) (openpgp.EntityList, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keyring openpgp.EntityList
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("-----BEGIN")) {
+		keyring, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(b))
+	} else {
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(b))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return keyring, nil
+}
+
+// loadSecurityKeys loads the keys given by the command line options. The
+// system roots are the trust store unless rootsPath is given.
+func loadSecurityKeys(rootsPath string, keyPath string, keyringPath string) (*SecurityKeys, error) {
+	keys := &SecurityKeys{}
+	var err error
+	if rootsPath != "" {
+		if keys.Roots, err = LoadTrustStore(rootsPath); err != nil {
+			return nil, err
+		}
+	} else if roots, err := x509.SystemCertPool(); err == nil {
+		keys.Roots = roots
+	}
+	if keyPath != "" {
+		if keys.Certificate, keys.PrivateKey, err = LoadSMIMEKey(keyPath); err != nil {
+			return nil, err
+		}
+	}
+	if keyringPath != "" {
+		if keys.Keyring, err = LoadKeyring(keyringPath); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// IsPKCS7 tells whether a part is an opaque signed or an encrypted S/MIME part.
+func IsPKCS7(mediaType string) bool {
+	return mediaType == "application/pkcs7-mime" || mediaType == "application/x-pkcs7-mime"
+}
+
+// readSecurity checks a multipart/signed or multipart/encrypted body as
+// defined in RFC 1847.
+func (p *Part) readSecurity(body []byte, mediaType string, params map[string]string, boundary string, option Option) error {
+	if mediaType != "multipart/signed" && mediaType != "multipart/encrypted" {
+		return nil
+	}
+
+	protocol := strings.ToLower(params["protocol"])
+	security := &Security{Type: SecuritySMIME}
+	if strings.HasPrefix(protocol, "application/pgp-") {
+		security.Type = SecurityPGP
+	}
+	p.Security = security
+
+	spans, _ := splitMultipart(body, boundary)
+	if len(spans) != 2 {
+		security.Error = fmt.Sprintf("%s has %d parts", mediaType, len(spans))
+		return nil
+	}
+	_, control, err := spanContent(body[spans[1][0]:spans[1][1]])
+	if err != nil {
+		security.Error = err.Error()
+		return nil
+	}
+
+	if mediaType == "multipart/signed" {
+		security.Signed = true
+		// signatures are computed over the entity with CRLF line breaks
+		signed := toCRLF(body[spans[0][0]:spans[0][1]])
+		switch protocol {
+		case "application/pgp-signature":
+			security.Signers = []Signer{VerifyPGPSignature(signed, control, option.security.Keyring)}
+		case "application/pkcs7-signature", "application/x-pkcs7-signature":
+			p7, err := pkcs7.Parse(control)
+			if err != nil {
+				security.Error = err.Error()
+				return nil
+			}
+			p7.Content = signed
+			security.Signers = VerifySMIME(p7, option.security.Roots)
+		default:
+			security.Error = fmt.Sprintf("unsupported protocol: %s", protocol)
+		}
+		return nil
+	}
+
+	security.Encrypted = true
+	if protocol != "application/pgp-encrypted" {
+		security.Error = fmt.Sprintf("unsupported protocol: %s", protocol)
+		return nil
+	}
+	content, signer, err := DecryptPGP(control, option.security.Keyring)
+	if err != nil {
+		security.Error = err.Error()
+		return nil
+	}
+	security.Decrypted = true
+	if signer != nil {
+		security.Signed = true
+		security.Signers = []Signer{*signer}
+	}
+	return p.readSecureContent(content, option)
+}
+
+// readPKCS7 checks an application/pkcs7-mime body: signed data is verified
+// and enveloped data decrypted with the key of option.security.
+func (p *Part) readPKCS7(b []byte, option Option) error {
+	security := &Security{Type: SecuritySMIME}
+	p.Security = security
+
+	p7, err := pkcs7.Parse(b)
+	if err != nil {
+		security.Error = err.Error()
+		return nil
+	}
+
+	var content []byte
+	switch {
+	case len(p7.Signers) > 0:
+		security.Signed = true
+		security.Signers = VerifySMIME(p7, option.security.Roots)
+		content = p7.Content
+	case len(p7.Certificates) > 0:
+		// a certs-only part carries no content
+		return nil
+	default:
+		security.Encrypted = true
+		if option.security.Certificate == nil {
+			security.Error = "no private key to decrypt with"
+			return nil
+		}
+		if content, err = p7.Decrypt(option.security.Certificate, option.security.PrivateKey); err != nil {
+			security.Error = err.Error()
+			return nil
+		}
+		security.Decrypted = true
+	}
+	return p.readSecureContent(content, option)
+}
+
+// readSecureContent parses the MIME entity unwrapped from a signed or
+// encrypted part.
+func (p *Part) readSecureContent(content []byte, option Option) error {
+	if option.depth >= option.maxDepth {
+		return nil
+	}
+	inner, err := ReadEmbeddedMessage(content, "message/rfc822", -1, option)
+	if err != nil {
+		return p.defect(option, InvalidEmbeddedMessageDefect, err)
+	}
+	p.Security.Content = inner
+	return nil
+}
+
+// spanContent returns the header and the decoded body of a part of a
+// multipart body.
+func spanContent(b []byte) (textproto.MIMEHeader, []byte, error) {
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(b)))
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, nil, err
+	}
+	content, err := io.ReadAll(tp.R)
+	if err != nil {
+		return nil, nil, err
+	}
+	content, err = DecodeTransferEncoding(content, header.Get("Content-Transfer-Encoding"))
+	return header, content, err
+}
+
+var digestAlgorithms = []struct {
+	oid  asn1.ObjectIdentifier
+	hash crypto.Hash
+}{
+	{pkcs7.OIDDigestAlgorithmSHA1, crypto.SHA1},
+	{pkcs7.OIDDigestAlgorithmSHA256, crypto.SHA256},
+	{pkcs7.OIDDigestAlgorithmSHA384, crypto.SHA384},
+	{pkcs7.OIDDigestAlgorithmSHA512, crypto.SHA512},
+}
+
+// hashName returns the name of a hash as used in algorithm names, e.g.
+// "sha256".
+func hashName(hash crypto.Hash) string {
+	return strings.ToLower(strings.ReplaceAll(hash.String(), "-", ""))
+}
+
+// VerifySMIME verifies each signature of signed data whose Content is set.
+// The chains of the signers are verified when roots is not nil.
+func VerifySMIME(p7 *pkcs7.PKCS7, roots *x509.CertPool) []Signer {
+	var signers []Signer
+	for i, info := range p7.Signers {
+		var signer Signer
+
+		var cert *x509.Certificate
+		for _, c := range p7.Certificates {
+			if c.SerialNumber.Cmp(info.IssuerAndSerialNumber.SerialNumber) == 0 &&
+				bytes.Equal(c.RawIssuer, info.IssuerAndSerialNumber.IssuerName.FullBytes) {
+				cert = c
+				break
+			}
+		}
+
+		algorithm := info.DigestAlgorithm.Algorithm.String()
+		for _, d := range digestAlgorithms {
+			if d.oid.Equal(info.DigestAlgorithm.Algorithm) {
+				algorithm = hashName(d.hash)
+			}
+		}
+		if cert != nil {
+			signer.Name = cert.Subject.CommonName
+			if len(cert.EmailAddresses) > 0 {
+				signer.Email = cert.EmailAddresses[0]
+			}
+			signer.Issuer = cert.Issuer.String()
+			algorithm = strings.ToLower(cert.PublicKeyAlgorithm.String()) + "-" + algorithm
+		}
+		signer.Serial = fmt.Sprintf("%X", info.IssuerAndSerialNumber.SerialNumber)
+		signer.Algorithm = algorithm
+
+		for _, attr := range info.AuthenticatedAttributes {
+			var t time.Time
+			if attr.Type.Equal(pkcs7.OIDAttributeSigningTime) {
+				if _, err := asn1.Unmarshal(attr.Value.Bytes, &t); err == nil {
+					signer.SignedAt = t.UTC().Format(time.RFC3339)
+				}
+			}
+		}
+
+		// verify the signatures one by one
+		single := *p7
+		single.Signers = p7.Signers[i : i+1]
+		if err := single.Verify(); err != nil {
+			signer.Error = err.Error()
+		} else {
+			signer.Valid = true
+			if roots != nil {
+				if err := single.VerifyWithChain(roots); err != nil {
+					signer.Error = err.Error()
+				} else {
+					signer.Trusted = true
+				}
+			}
+		}
+		signers = append(signers, signer)
+	}
+	return signers
+}
+
+var pgpAlgorithms = map[packet.PublicKeyAlgorithm]string{
+	packet.PubKeyAlgoRSA:         "rsa",
+	packet.PubKeyAlgoRSASignOnly: "rsa",
+	packet.PubKeyAlgoDSA:         "dsa",
+	packet.PubKeyAlgoECDSA:       "ecdsa",
+	packet.PubKeyAlgoEdDSA:       "eddsa",
+}
+
+// pgpSigner describes the signature packet, and the signer if it is known.
+func pgpSigner(sig *packet.Signature, keyID uint64, entity *openpgp.Entity) Signer {
+	signer := Signer{KeyID: fmt.Sprintf("%016X", keyID)}
+	if sig != nil {
+		signer.Algorithm = pgpAlgorithms[sig.PubKeyAlgo] + "-" + hashName(sig.Hash)
+		signer.SignedAt = sig.CreationTime.UTC().Format(time.RFC3339)
+	}
+	if entity != nil {
+		if identity := entity.PrimaryIdentity(); identity != nil {
+			signer.Name = identity.UserId.Name
+			signer.Email = identity.UserId.Email
+		}
+	}
+	return signer
+}
+
+// VerifyPGPSignature verifies an armored detached signature of PGP/MIME.
+func VerifyPGPSignature(signed []byte, signature []byte, keyring openpgp.EntityList) Signer {
+	var sig *packet.Signature
+	var keyID uint64
+	if block, err := armor.Decode(bytes.NewReader(signature)); err == nil {
+		if p, err := packet.Read(block.Body); err == nil {
+			if sig, _ = p.(*packet.Signature); sig != nil && sig.IssuerKeyId != nil {
+				keyID = *sig.IssuerKeyId
+			}
+		}
+	}
+
+	entity, err := openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(signed), bytes.NewReader(signature), nil)
+	signer := pgpSigner(sig, keyID, entity)
+	if err != nil {
+		signer.Error = err.Error()
+	} else {
+		signer.Valid, signer.Trusted = true, true
+	}
+	return signer
+}
+
+var errNoPGPKey = errors.New("no private key to decrypt with")
+
+// DecryptPGP decrypts an armored PGP/MIME message. The signer is returned
+// when the message was signed before encryption.
+func DecryptPGP(b []byte, keyring openpgp.EntityList) ([]byte, *Signer, error) {
+	block, err := armor.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(keyring.DecryptionKeys()) == 0 {
+		return nil, nil, errNoPGPKey
+	}
+	md, err := openpgp.ReadMessage(block.Body, keyring, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the integrity (MDC) check of the ciphertext fails the read at its end
+	content, err := io.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return nil, nil, fmt.Errorf("integrity check failed: %w", err)
+	}
+	if !md.IsSigned {
+		return content, nil, nil
+	}
+
+	var entity *openpgp.Entity
+	if md.SignedBy != nil {
+		entity = md.SignedBy.Entity
+	}
+	signer := pgpSigner(md.Signature, md.SignedByKeyId, entity)
+	switch {
+	case md.SignedBy == nil:
+		signer.Error = "signed by unknown key"
+	case md.SignatureError != nil:
+		signer.Error = md.SignatureError.Error()
+	default:
+		signer.Valid, signer.Trusted = true, true
+	}
+	return content, &signer, nil
+}
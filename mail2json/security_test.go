@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/stretchr/testify/assert"
+	"go.mozilla.org/pkcs7"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCertificate(t *testing.T, name string, email string) (*x509.Certificate, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(42),
+		Subject:               pkix.Name{CommonName: name},
+		EmailAddresses:        []string{email},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	return cert, key
+}
+
+func signPKCS7(t *testing.T, content []byte, cert *x509.Certificate, key *rsa.PrivateKey, detached bool) []byte {
+	t.Helper()
+	sd, err := pkcs7.NewSignedData(content)
+	assert.Nil(t, err)
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	assert.Nil(t, sd.AddSigner(cert, key, pkcs7.SignerInfoConfig{}))
+	if detached {
+		sd.Detach()
+	}
+	b, err := sd.Finish()
+	assert.Nil(t, err)
+	return b
+}
+
+func wrapBase64(b []byte) string {
+	s := base64.StdEncoding.EncodeToString(b)
+	var sb strings.Builder
+	for len(s) > 76 {
+		sb.WriteString(s[:76] + "\r\n")
+		s = s[76:]
+	}
+	sb.WriteString(s + "\r\n")
+	return sb.String()
+}
+
+func armorMessage(t *testing.T, b []byte) string {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, "PGP MESSAGE", nil)
+	assert.Nil(t, err)
+	w.Write(b)
+	w.Close()
+	return buf.String() + "\r\n"
+}
+
+func TestReadMailSMIME(t *testing.T) {
+	cert, key := newTestCertificate(t, "Alice", "alice@example.com")
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	option := Option{security: &SecurityKeys{Roots: roots, Certificate: cert, PrivateKey: key}, maxDepth: defaultMaxDepth}
+
+	// the line break before the boundary is not signed
+	inner := "Content-Type: text/plain\r\n\r\nsecret\r\n"
+	signature := signPKCS7(t, []byte(strings.TrimSuffix(inner, "\r\n")), cert, key, true)
+	signed := "Subject: signed\r\n" +
+		"Content-Type: multipart/signed; protocol=\"application/pkcs7-signature\"; micalg=sha-256; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		inner +
+		"--b\r\n" +
+		"Content-Type: application/pkcs7-signature; name=smime.p7s\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		wrapBase64(signature) +
+		"--b--\r\n"
+
+	part := readTestMail(t, signed, option)
+	if assert.NotNil(t, part.Security) && assert.Len(t, part.Security.Signers, 1) {
+		signer := part.Security.Signers[0]
+		assert.True(t, part.Security.Signed)
+		assert.Equal(t, SecuritySMIME, part.Security.Type)
+		assert.Equal(t, "Alice", signer.Name)
+		assert.Equal(t, "alice@example.com", signer.Email)
+		assert.Equal(t, "rsa-sha256", signer.Algorithm)
+		assert.Equal(t, "2A", signer.Serial)
+		assert.True(t, signer.Valid)
+		assert.True(t, signer.Trusted)
+		assert.Empty(t, signer.Error)
+	}
+
+	// LF line endings are verified as CRLF
+	part = readTestMail(t, strings.ReplaceAll(signed, "\r\n", "\n"), option)
+	assert.True(t, part.Security.Signers[0].Valid)
+
+	tampered := strings.Replace(signed, "secret", "public", 1)
+	part = readTestMail(t, tampered, option)
+	assert.False(t, part.Security.Signers[0].Valid)
+	assert.NotEmpty(t, part.Security.Signers[0].Error)
+
+	untrusted := option
+	untrusted.security = &SecurityKeys{Roots: x509.NewCertPool()}
+	part = readTestMail(t, signed, untrusted)
+	assert.True(t, part.Security.Signers[0].Valid)
+	assert.False(t, part.Security.Signers[0].Trusted)
+
+	part = readTestMail(t, signed, Option{})
+	assert.Nil(t, part.Security)
+
+	opaque := "Subject: opaque\r\n" +
+		"Content-Type: application/pkcs7-mime; smime-type=signed-data; name=smime.p7m\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		wrapBase64(signPKCS7(t, []byte(inner), cert, key, false))
+	part = readTestMail(t, opaque, option)
+	if assert.NotNil(t, part.Security) && assert.NotNil(t, part.Security.Content) {
+		assert.True(t, part.Security.Signers[0].Valid)
+		assert.Equal(t, "secret\r\n", part.Security.Content.Body)
+	}
+
+	encrypted, err := pkcs7.Encrypt([]byte(inner), []*x509.Certificate{cert})
+	assert.Nil(t, err)
+	enveloped := "Subject: encrypted\r\n" +
+		"Content-Type: application/pkcs7-mime; smime-type=enveloped-data; name=smime.p7m\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		wrapBase64(encrypted)
+	part = readTestMail(t, enveloped, option)
+	if assert.NotNil(t, part.Security) && assert.NotNil(t, part.Security.Content) {
+		assert.True(t, part.Security.Encrypted)
+		assert.True(t, part.Security.Decrypted)
+		assert.Equal(t, "secret\r\n", part.Security.Content.Body)
+	}
+
+	part = readTestMail(t, enveloped, untrusted)
+	assert.True(t, part.Security.Encrypted)
+	assert.False(t, part.Security.Decrypted)
+	assert.Nil(t, part.Security.Content)
+	assert.Equal(t, "no private key to decrypt with", part.Security.Error)
+}
+
+func TestReadMailPGP(t *testing.T) {
+	config := &packet.Config{RSABits: 1024}
+	alice, err := openpgp.NewEntity("Alice", "", "alice@example.com", config)
+	assert.Nil(t, err)
+	bob, err := openpgp.NewEntity("Bob", "", "bob@example.com", config)
+	assert.Nil(t, err)
+	option := Option{security: &SecurityKeys{Keyring: openpgp.EntityList{alice, bob}}, maxDepth: defaultMaxDepth}
+
+	inner := "Content-Type: text/plain\r\n\r\nsecret\r\n"
+	var signature bytes.Buffer
+	assert.Nil(t, openpgp.ArmoredDetachSign(&signature, alice, strings.NewReader(strings.TrimSuffix(inner, "\r\n")), nil))
+	signed := "Subject: signed\r\n" +
+		"Content-Type: multipart/signed; protocol=\"application/pgp-signature\"; micalg=pgp-sha256; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		inner +
+		"--b\r\n" +
+		"Content-Type: application/pgp-signature; name=signature.asc\r\n" +
+		"\r\n" +
+		signature.String() + "\r\n" +
+		"--b--\r\n"
+
+	part := readTestMail(t, signed, option)
+	if assert.NotNil(t, part.Security) && assert.Len(t, part.Security.Signers, 1) {
+		signer := part.Security.Signers[0]
+		assert.Equal(t, SecurityPGP, part.Security.Type)
+		assert.Equal(t, "Alice", signer.Name)
+		assert.Equal(t, "alice@example.com", signer.Email)
+		assert.Equal(t, alice.PrimaryKey.KeyIdString(), signer.KeyID)
+		assert.Equal(t, "rsa-sha256", signer.Algorithm)
+		assert.True(t, signer.Valid)
+		assert.True(t, signer.Trusted)
+	}
+
+	unknown := Option{security: &SecurityKeys{Keyring: openpgp.EntityList{bob}}, maxDepth: defaultMaxDepth}
+	part = readTestMail(t, signed, unknown)
+	assert.False(t, part.Security.Signers[0].Valid)
+	assert.Equal(t, alice.PrimaryKey.KeyIdString(), part.Security.Signers[0].KeyID)
+
+	var ciphertext bytes.Buffer
+	w, err := openpgp.Encrypt(&ciphertext, []*openpgp.Entity{bob}, alice, nil, config)
+	assert.Nil(t, err)
+	w.Write([]byte(inner))
+	w.Close()
+	encrypted := "Subject: encrypted\r\n" +
+		"Content-Type: multipart/encrypted; protocol=\"application/pgp-encrypted\"; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/pgp-encrypted\r\n" +
+		"\r\n" +
+		"Version: 1\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/octet-stream; name=encrypted.asc\r\n" +
+		"\r\n" +
+		armorMessage(t, ciphertext.Bytes()) +
+		"--b--\r\n"
+
+	part = readTestMail(t, encrypted, option)
+	if assert.NotNil(t, part.Security) && assert.NotNil(t, part.Security.Content) {
+		assert.True(t, part.Security.Encrypted)
+		assert.True(t, part.Security.Decrypted)
+		assert.True(t, part.Security.Signed)
+		assert.Equal(t, "Alice", part.Security.Signers[0].Name)
+		assert.True(t, part.Security.Signers[0].Valid)
+		assert.Equal(t, "secret\r\n", part.Security.Content.Body)
+	}
+
+	// a change of the signature fails the signature and the integrity check
+	tampered := append([]byte(nil), ciphertext.Bytes()...)
+	tampered[len(tampered)-60] ^= 1
+	_, _, err = DecryptPGP([]byte(armorMessage(t, tampered)), option.security.Keyring)
+	assert.ErrorContains(t, err, "integrity check failed")
+	part = readTestMail(t, strings.Replace(encrypted, armorMessage(t, ciphertext.Bytes()), armorMessage(t, tampered), 1), option)
+	assert.True(t, part.Security.Encrypted)
+	assert.False(t, part.Security.Decrypted)
+	assert.Nil(t, part.Security.Content)
+
+	aliceOnly := Option{security: &SecurityKeys{Keyring: openpgp.EntityList{alice}}, maxDepth: defaultMaxDepth}
+	part = readTestMail(t, encrypted, aliceOnly)
+	assert.True(t, part.Security.Encrypted)
+	assert.False(t, part.Security.Decrypted)
+	assert.NotEmpty(t, part.Security.Error)
+}
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Envelope is the SMTP envelope of a received message.
+type Envelope struct {
+	MailFrom   string    `json:"mailFrom"`
+	RcptTo     []string  `json:"rcptTo"`
+	Helo       string    `json:"helo,omitempty"`
+	RemoteAddr string    `json:"remoteAddr,omitempty"`
+	TLS        bool      `json:"tls,omitempty"`
+	ReceivedAt time.Time `json:"receivedAt"`
+}
+
+const (
+	defaultMaxMessageSize = 25 << 20
+	maxRecipients         = 100
+	// RFC 5321 4.5.3.1.4 limits a command line to 512 octets with the CRLF
+	maxCommandLine        = 512
+	defaultMaxConnections = 100
+	// RFC 5321 4.5.3.2 suggests at least 5 minutes for most commands
+	defaultServerTimeout = 5 * time.Minute
+)
+
+var (
+	errMessageTooLarge = errors.New("message too large")
+	errLineTooLong     = errors.New("line too long")
+)
+
+// Server receives messages over SMTP, or LMTP as defined in RFC 2033, and
+// hands each of them to Deliver in its JSON form. It supports the 8BITMIME,
+// SIZE and, when TLSConfig is set, STARTTLS extensions.
+type Server struct {
+	Hostname  string
+	LMTP      bool
+	MaxSize   int64
+	TLSConfig *tls.Config
+	Timeout   time.Duration
+	// MaxConnections limits the connections served at once; further
+	// connections wait to be accepted
+	MaxConnections int
+	Option         Option
+	Deliver        func(*Part) error
+	// ErrorLog receives the errors of connections and deliveries
+	ErrorLog func(error)
+}
+
+// Listen listens on a TCP address, or on a Unix socket given as
+// "unix:/path". A stale socket file is replaced.
+func Listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// Serve accepts connections until the listener is closed. Temporary errors
+// of Accept, such as running out of file descriptors, are retried after a
+// delay as net/http does.
+func (s *Server) Serve(l net.Listener) error {
+	limit := s.MaxConnections
+	if limit <= 0 {
+		limit = defaultMaxConnections
+	}
+	sem := make(chan struct{}, limit)
+	var delay time.Duration
+	for {
+		sem <- struct{}{}
+		conn, err := l.Accept()
+		if err != nil {
+			<-sem
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				s.logError(fmt.Errorf("accept: %w; retrying in %v", err, delay))
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		go func() {
+			defer func() { <-sem }()
+			s.serveConn(conn)
+		}()
+	}
+}
+
+func (s *Server) logError(err error) {
+	if s.ErrorLog != nil {
+		s.ErrorLog(err)
+	}
+}
+
+// session is the state of an SMTP connection.
+type session struct {
+	server   *Server
+	conn     net.Conn
+	r        *bufio.Reader
+	w        *bufio.Writer
+	helo     string
+	tls      bool
+	mailFrom *string
+	rcptTo   []string
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	sess := &session{server: s, conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	_, sess.tls = conn.(*tls.Conn)
+	greeting := "ESMTP"
+	if s.LMTP {
+		greeting = "LMTP"
+	}
+	sess.reply(220, "%s %s mail2json ready", s.Hostname, greeting)
+
+	for {
+		line, err := sess.readLine()
+		if err == errLineTooLong {
+			sess.reply(500, "5.5.2 line too long")
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				s.logError(fmt.Errorf("%s: %w", conn.RemoteAddr(), err))
+			}
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		if !sess.handle(strings.ToUpper(verb), strings.TrimSpace(arg)) {
+			return
+		}
+	}
+}
+
+// handle runs a command and reports whether the connection stays open.
+func (sess *session) handle(verb string, arg string) bool {
+	s := sess.server
+
+	switch verb {
+	case "HELO", "EHLO", "LHLO":
+		if (verb == "LHLO") != s.LMTP {
+			sess.reply(500, "5.5.1 command not recognized")
+			return true
+		}
+		if arg == "" {
+			sess.reply(501, "5.5.4 %s requires a domain", verb)
+			return true
+		}
+		sess.helo = arg
+		sess.reset()
+		if verb == "HELO" {
+			sess.reply(250, "%s", s.Hostname)
+			return true
+		}
+		lines := []string{s.Hostname, "PIPELINING", "8BITMIME", "ENHANCEDSTATUSCODES"}
+		if s.MaxSize > 0 {
+			lines = append(lines, "SIZE "+strconv.FormatInt(s.MaxSize, 10))
+		}
+		if s.TLSConfig != nil && !sess.tls {
+			lines = append(lines, "STARTTLS")
+		}
+		sess.replyLines(250, lines)
+
+	case "STARTTLS":
+		if s.TLSConfig == nil || sess.tls {
+			sess.reply(502, "5.5.1 STARTTLS not available")
+			return true
+		}
+		// commands sent after STARTTLS would be read as if protected by
+		// TLS, see RFC 3207 4
+		if arg != "" || sess.r.Buffered() > 0 {
+			sess.reply(501, "5.5.4 STARTTLS takes no parameters and cannot be pipelined")
+			return true
+		}
+		sess.reply(220, "2.0.0 ready to start TLS")
+		conn := tls.Server(sess.conn, s.TLSConfig)
+		if err := conn.Handshake(); err != nil {
+			s.logError(fmt.Errorf("%s: %w", sess.conn.RemoteAddr(), err))
+			return false
+		}
+		// the client starts over after the handshake, see RFC 3207 4.2
+		sess.conn = conn
+		sess.r = bufio.NewReader(conn)
+		sess.w = bufio.NewWriter(conn)
+		sess.tls = true
+		sess.helo = ""
+		sess.reset()
+
+	case "MAIL":
+		if sess.helo == "" {
+			sess.reply(503, "5.5.1 send %s first", sess.heloVerb())
+			return true
+		}
+		if sess.mailFrom != nil {
+			sess.reply(503, "5.5.1 nested MAIL command")
+			return true
+		}
+		from, params, err := parsePath(arg, "FROM:")
+		if err != nil {
+			sess.reply(501, "5.5.4 %s", err)
+			return true
+		}
+		for _, param := range params {
+			key, value, _ := strings.Cut(param, "=")
+			switch strings.ToUpper(key) {
+			case "SIZE":
+				size, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					sess.reply(501, "5.5.4 invalid SIZE")
+					return true
+				}
+				if s.MaxSize > 0 && size > s.MaxSize {
+					sess.reply(552, "5.3.4 message size exceeds fixed maximum message size")
+					return true
+				}
+			case "BODY":
+				switch strings.ToUpper(value) {
+				case "7BIT", "8BITMIME":
+				default:
+					sess.reply(501, "5.5.4 unsupported BODY")
+					return true
+				}
+			default:
+				sess.reply(555, "5.5.4 unsupported parameter %s", key)
+				return true
+			}
+		}
+		sess.mailFrom = &from
+		sess.reply(250, "2.1.0 ok")
+
+	case "RCPT":
+		if sess.mailFrom == nil {
+			sess.reply(503, "5.5.1 send MAIL first")
+			return true
+		}
+		to, params, err := parsePath(arg, "TO:")
+		if err != nil || to == "" {
+			sess.reply(501, "5.5.4 invalid recipient")
+			return true
+		}
+		if len(params) > 0 {
+			sess.reply(555, "5.5.4 unsupported parameter %s", params[0])
+			return true
+		}
+		if len(sess.rcptTo) >= maxRecipients {
+			sess.reply(452, "4.5.3 too many recipients")
+			return true
+		}
+		sess.rcptTo = append(sess.rcptTo, to)
+		sess.reply(250, "2.1.5 ok")
+
+	case "DATA":
+		if len(sess.rcptTo) == 0 {
+			sess.reply(503, "5.5.1 send RCPT first")
+			return true
+		}
+		sess.reply(354, "end data with <CR><LF>.<CR><LF>")
+		sess.data()
+		sess.reset()
+
+	case "RSET":
+		sess.reset()
+		sess.reply(250, "2.0.0 ok")
+
+	case "NOOP":
+		sess.reply(250, "2.0.0 ok")
+
+	case "VRFY":
+		sess.reply(252, "2.5.0 cannot verify the user")
+
+	case "QUIT":
+		sess.reply(221, "2.0.0 bye")
+		return false
+
+	default:
+		sess.reply(500, "5.5.1 command not recognized")
+	}
+	return true
+}
+
+// data reads the message after DATA and delivers it.
+func (sess *session) data() {
+	s := sess.server
+	envelope := &Envelope{
+		MailFrom:   *sess.mailFrom,
+		RcptTo:     sess.rcptTo,
+		Helo:       sess.helo,
+		RemoteAddr: sess.conn.RemoteAddr().String(),
+		TLS:        sess.tls,
+		ReceivedAt: time.Now().UTC(),
+	}
+
+	var code int
+	var status string
+	b, err := sess.readData()
+	switch {
+	case errors.Is(err, errMessageTooLarge):
+		code, status = 552, "5.3.4 message size exceeds fixed maximum message size"
+	case err != nil:
+		s.logError(fmt.Errorf("%s: %w", envelope.RemoteAddr, err))
+		return
+	default:
+		code, status = s.deliver(b, envelope)
+	}
+
+	// LMTP replies for each recipient, see RFC 2033 4.2
+	n := 1
+	if s.LMTP {
+		n = len(sess.rcptTo)
+	}
+	for i := 0; i < n; i++ {
+		sess.reply(code, "%s", status)
+	}
+}
+
+func (s *Server) deliver(b []byte, envelope *Envelope) (int, string) {
+	msg, err := ReadMail(bytes.NewReader(b), s.Option)
+	if err != nil {
+		s.logError(fmt.Errorf("%s: %w", envelope.RemoteAddr, err))
+		return 554, "5.6.0 message cannot be parsed"
+	}
+	msg.Envelope = envelope
+	if err := s.Deliver(msg); err != nil {
+		s.logError(err)
+		return 451, "4.3.0 delivery failed"
+	}
+	return 250, "2.0.0 ok"
+}
+
+// readData reads a message terminated by a line with a single dot and
+// removes the dot stuffing. The CRLF line endings are kept as they are. A
+// message over the size limit is read to its end before errMessageTooLarge
+// is returned.
+func (sess *session) readData() ([]byte, error) {
+	maxSize := sess.server.MaxSize
+	var buf bytes.Buffer
+	var size int64
+	lineStart := true
+	for {
+		sess.setDeadline()
+		line, err := sess.r.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		// a line longer than the buffer is read in pieces
+		complete := err == nil
+		if lineStart {
+			if complete && string(bytes.TrimRight(line, "\r\n")) == "." {
+				break
+			}
+			if line[0] == '.' {
+				line = line[1:]
+			}
+		}
+		lineStart = complete
+
+		size += int64(len(line))
+		if maxSize <= 0 || size <= maxSize {
+			buf.Write(line)
+		}
+	}
+	if maxSize > 0 && size > maxSize {
+		return nil, errMessageTooLarge
+	}
+	return buf.Bytes(), nil
+}
+
+func (sess *session) reset() {
+	sess.mailFrom = nil
+	sess.rcptTo = nil
+}
+
+func (sess *session) heloVerb() string {
+	if sess.server.LMTP {
+		return "LHLO"
+	}
+	return "EHLO"
+}
+
+func (sess *session) setDeadline() {
+	timeout := sess.server.Timeout
+	if timeout == 0 {
+		timeout = defaultServerTimeout
+	}
+	sess.conn.SetDeadline(time.Now().Add(timeout))
+}
+
+// readLine reads a command line. A line over maxCommandLine is read to its
+// end before errLineTooLong is returned.
+func (sess *session) readLine() (string, error) {
+	sess.setDeadline()
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := sess.r.ReadSlice('\n')
+		if !tooLong && len(line)+len(chunk) > maxCommandLine {
+			tooLong = true
+			line = nil
+		}
+		if !tooLong {
+			line = append(line, chunk...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && (len(line) > 0 || tooLong) {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		break
+	}
+	if tooLong {
+		return "", errLineTooLong
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+func (sess *session) reply(code int, format string, args ...interface{}) {
+	fmt.Fprintf(sess.w, "%d %s\r\n", code, fmt.Sprintf(format, args...))
+	sess.flush()
+}
+
+func (sess *session) replyLines(code int, lines []string) {
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		fmt.Fprintf(sess.w, "%d%s%s\r\n", code, sep, line)
+	}
+	sess.flush()
+}
+
+func (sess *session) flush() {
+	// pipelined commands are answered together, see RFC 2920 3.2
+	if sess.r.Buffered() == 0 {
+		sess.w.Flush()
+	}
+}
+
+// parsePath parses the argument of MAIL or RCPT: the prefix, a path in angle
+// brackets and the ESMTP parameters. The source route of RFC 5321 4.1.2 is
+// dropped.
+func parsePath(arg string, prefix string) (string, []string, error) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, fmt.Errorf("syntax: %s<address>", prefix)
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(arg, "<") {
+		return "", nil, fmt.Errorf("syntax: %s<address>", prefix)
+	}
+	end := strings.IndexByte(arg, '>')
+	if end < 0 {
+		return "", nil, fmt.Errorf("syntax: %s<address>", prefix)
+	}
+	path := arg[1:end]
+	if i := strings.IndexByte(path, ':'); i >= 0 && strings.HasPrefix(path, "@") {
+		path = path[i+1:]
+	}
+	return path, strings.Fields(arg[end+1:]), nil
+}
+
+// WriteDelivery writes each message as a line of JSON.
+func WriteDelivery(w io.Writer) func(*Part) error {
+	var mu sync.Mutex
+	return func(msg *Part) error {
+		v, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		_, err = w.Write(append(v, '\n'))
+		return err
+	}
+}
+
+// DirDelivery writes each message to a JSON file of its own in the
+// directory. Files are renamed into place once written, so that readers of
+// the directory never see a partial file.
+func DirDelivery(dir string) func(*Part) error {
+	return func(msg *Part) error {
+		v, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		f, err := os.CreateTemp(dir, "."+time.Now().UTC().Format("20060102T150405")+"-*.tmp")
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(v); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return err
+		}
+		if err := f.Close(); err != nil {
+			os.Remove(f.Name())
+			return err
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(f.Name()), "."), ".tmp") + ".json"
+		return os.Rename(f.Name(), filepath.Join(dir, name))
+	}
+}
+
+// WebhookDelivery posts each message to the URL. A response other than 2xx
+// fails the delivery, so that the client retries it later.
+func WebhookDelivery(url string, client *http.Client) func(*Part) error {
+	return func(msg *Part) error {
+		v, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Post(url, "application/json", bytes.NewReader(v))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("webhook: %s", resp.Status)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const serverTestMessage = "From: alice@example.com\r\n" +
+	"To: bob@example.com\r\n" +
+	"Subject: hello\r\n" +
+	"\r\n" +
+	".leading dot\r\n" +
+	"body\r\n"
+
+// startServer serves on a local port and returns its address and the
+// messages it delivers.
+func startServer(t *testing.T, server *Server) (string, <-chan *Part) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	delivered := make(chan *Part, 10)
+	if server.Deliver == nil {
+		server.Deliver = func(msg *Part) error {
+			delivered <- msg
+			return nil
+		}
+	}
+	server.Hostname = "mx.example.com"
+	server.ErrorLog = func(err error) { t.Log(err) }
+	go server.Serve(l)
+	return l.Addr().String(), delivered
+}
+
+func sendMail(t *testing.T, addr string, tlsConfig *tls.Config, message string) error {
+	t.Helper()
+	c, err := smtp.Dial(addr)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	assert.Nil(t, c.Hello("client.example.com"))
+	if tlsConfig != nil {
+		ok, _ := c.Extension("STARTTLS")
+		assert.True(t, ok)
+		assert.Nil(t, c.StartTLS(tlsConfig))
+	}
+	ok, _ := c.Extension("8BITMIME")
+	assert.True(t, ok)
+
+	if err := c.Mail("alice@example.com"); err != nil {
+		return err
+	}
+	for _, to := range []string{"bob@example.com", "carol@example.com"} {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	io.WriteString(w, message)
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func TestServer(t *testing.T) {
+	addr, delivered := startServer(t, &Server{MaxSize: 1 << 20})
+
+	assert.Nil(t, sendMail(t, addr, nil, serverTestMessage))
+	msg := <-delivered
+	assert.Equal(t, []string{"hello"}, msg.Header["Subject"])
+	assert.Equal(t, ".leading dot\r\nbody\r\n", msg.Body)
+	assert.Equal(t, "alice@example.com", msg.Envelope.MailFrom)
+	assert.Equal(t, []string{"bob@example.com", "carol@example.com"}, msg.Envelope.RcptTo)
+	assert.Equal(t, "client.example.com", msg.Envelope.Helo)
+	assert.False(t, msg.Envelope.TLS)
+}
+
+func TestServerStartTLS(t *testing.T) {
+	cert, key := newTestCertificate(t, "mx.example.com", "postmaster@example.com")
+	config := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}}}
+	addr, delivered := startServer(t, &Server{TLSConfig: config})
+
+	assert.Nil(t, sendMail(t, addr, &tls.Config{InsecureSkipVerify: true}, serverTestMessage))
+	msg := <-delivered
+	assert.True(t, msg.Envelope.TLS)
+	assert.Equal(t, []string{"hello"}, msg.Header["Subject"])
+}
+
+func TestServerStartTLSPipelined(t *testing.T) {
+	cert, key := newTestCertificate(t, "mx.example.com", "postmaster@example.com")
+	config := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}}}
+	addr, _ := startServer(t, &Server{TLSConfig: config})
+
+	conn, err := textproto.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	expectReply(t, conn, 220)
+	conn.PrintfLine("EHLO client.example.com")
+	expectReply(t, conn, 250)
+	conn.PrintfLine("STARTTLS now")
+	expectReply(t, conn, 501)
+	// a command sent with STARTTLS would be read after the handshake
+	io.WriteString(conn.W, "STARTTLS\r\nNOOP\r\n")
+	conn.W.Flush()
+	expectReply(t, conn, 501)
+	expectReply(t, conn, 250)
+}
+
+// temporaryErrorListener fails to accept the first connections with a
+// temporary error.
+type temporaryErrorListener struct {
+	net.Listener
+	failures int
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func (l *temporaryErrorListener) Accept() (net.Conn, error) {
+	if l.failures > 0 {
+		l.failures--
+		return nil, temporaryError{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestServerAcceptTemporaryError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	var logged []error
+	server := &Server{Hostname: "mx.example.com", ErrorLog: func(err error) { logged = append(logged, err) }}
+	done := make(chan error)
+	go func() { done <- server.Serve(&temporaryErrorListener{Listener: l, failures: 3}) }()
+
+	conn, err := textproto.Dial("tcp", l.Addr().String())
+	assert.Nil(t, err)
+	expectReply(t, conn, 220)
+	conn.Close()
+
+	l.Close()
+	assert.Nil(t, <-done)
+	assert.Len(t, logged, 3)
+}
+
+func TestServerSize(t *testing.T) {
+	addr, delivered := startServer(t, &Server{MaxSize: 100})
+
+	err := sendMail(t, addr, nil, serverTestMessage+strings.Repeat("x", 100)+"\r\n")
+	var protocolErr *textproto.Error
+	assert.True(t, errors.As(err, &protocolErr))
+	assert.Equal(t, 552, protocolErr.Code)
+	assert.Equal(t, 0, len(delivered))
+
+	// the declared size is checked by MAIL
+	conn, err := textproto.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	expectReply(t, conn, 220)
+	conn.PrintfLine("EHLO client.example.com")
+	_, message, err := conn.ReadResponse(250)
+	assert.Nil(t, err)
+	assert.Contains(t, message, "SIZE 100")
+	conn.PrintfLine("MAIL FROM:<alice@example.com> SIZE=1000")
+	expectReply(t, conn, 552)
+}
+
+func TestServerDeliveryFailure(t *testing.T) {
+	addr, _ := startServer(t, &Server{Deliver: func(*Part) error { return errors.New("unavailable") }})
+
+	err := sendMail(t, addr, nil, serverTestMessage)
+	var protocolErr *textproto.Error
+	assert.True(t, errors.As(err, &protocolErr))
+	assert.Equal(t, 451, protocolErr.Code)
+}
+
+func TestServerLMTP(t *testing.T) {
+	addr, delivered := startServer(t, &Server{LMTP: true})
+
+	conn, err := textproto.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	expectReply(t, conn, 220)
+	conn.PrintfLine("EHLO client.example.com")
+	expectReply(t, conn, 500)
+	conn.PrintfLine("LHLO client.example.com")
+	expectReply(t, conn, 250)
+	conn.PrintfLine("MAIL FROM:<>")
+	expectReply(t, conn, 250)
+	conn.PrintfLine("RCPT TO:<bob@example.com>")
+	expectReply(t, conn, 250)
+	conn.PrintfLine("RCPT TO:<carol@example.com>")
+	expectReply(t, conn, 250)
+	conn.PrintfLine("DATA")
+	expectReply(t, conn, 354)
+	w := conn.DotWriter()
+	io.WriteString(w, serverTestMessage)
+	assert.Nil(t, w.Close())
+
+	// a reply for each recipient
+	expectReply(t, conn, 250)
+	expectReply(t, conn, 250)
+
+	msg := <-delivered
+	assert.Equal(t, "", msg.Envelope.MailFrom)
+	assert.Equal(t, []string{"bob@example.com", "carol@example.com"}, msg.Envelope.RcptTo)
+}
+
+func TestServerCommandSequence(t *testing.T) {
+	addr, _ := startServer(t, &Server{})
+
+	conn, err := textproto.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	expectReply(t, conn, 220)
+	for _, tt := range []struct {
+		command string
+		code    int
+	}{
+		{"MAIL FROM:<alice@example.com>", 503},
+		{"HELO client.example.com", 250},
+		{"RCPT TO:<bob@example.com>", 503},
+		{"MAIL FROM:alice@example.com", 501},
+		{"MAIL FROM:<alice@example.com> BODY=BINARYMIME", 501},
+		{"MAIL FROM:<alice@example.com> BODY=8BITMIME", 250},
+		{"MAIL FROM:<alice@example.com>", 503},
+		{"DATA", 503},
+		{"RCPT TO:<@relay.example.com:bob@example.com>", 250},
+		{"RSET", 250},
+		{"DATA", 503},
+		{"STARTTLS", 502},
+		{"NOOP", 250},
+		{"QUIT", 221},
+	} {
+		conn.PrintfLine("%s", tt.command)
+		expectReply(t, conn, tt.code)
+	}
+}
+
+func TestServerLineTooLong(t *testing.T) {
+	addr, _ := startServer(t, &Server{})
+
+	conn, err := textproto.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	expectReply(t, conn, 220)
+	conn.PrintfLine("HELO %s", strings.Repeat("a", 8192))
+	expectReply(t, conn, 500)
+	// the connection goes on after the long line
+	conn.PrintfLine("HELO client.example.com")
+	expectReply(t, conn, 250)
+}
+
+func TestServerMaxConnections(t *testing.T) {
+	addr, _ := startServer(t, &Server{MaxConnections: 1})
+
+	first, err := textproto.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer first.Close()
+	expectReply(t, first, 220)
+
+	// the second connection waits until the first one is closed
+	c, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer c.Close()
+	second := textproto.NewConn(c)
+	c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err = second.ReadResponse(220)
+	assert.NotNil(t, err)
+
+	first.PrintfLine("QUIT")
+	expectReply(t, first, 221)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	expectReply(t, second, 220)
+}
+
+func expectReply(t *testing.T, conn *textproto.Conn, code int) {
+	t.Helper()
+	actual, message, _ := conn.ReadResponse(0)
+	assert.Equal(t, code, actual, message)
+}
+
+func TestDirDelivery(t *testing.T) {
+	dir := t.TempDir()
+	deliver := DirDelivery(dir)
+
+	assert.Nil(t, deliver(&Part{Header: map[string][]string{"Subject": {"hello"}}}))
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+	assert.True(t, strings.HasSuffix(files[0], ".json"))
+
+	b, err := os.ReadFile(files[0])
+	assert.Nil(t, err)
+	var part Part
+	assert.Nil(t, json.Unmarshal(b, &part))
+	assert.Equal(t, []string{"hello"}, part.Header["Subject"])
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	received := make(chan Part, 1)
+	status := http.StatusNoContent
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var part Part
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&part))
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		received <- part
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	deliver := WebhookDelivery(ts.URL, &http.Client{Timeout: 10 * time.Second})
+	msg := &Part{Header: map[string][]string{"Subject": {"hello"}}, Envelope: &Envelope{MailFrom: "alice@example.com"}}
+	assert.Nil(t, deliver(msg))
+	part := <-received
+	assert.Equal(t, "alice@example.com", part.Envelope.MailFrom)
+
+	status = http.StatusServiceUnavailable
+	assert.NotNil(t, deliver(msg))
+	<-received
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lmtp.sock")
+	l, err := Listen("unix:" + path)
+	assert.Nil(t, err)
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	// a stale socket is replaced
+	l, err = Listen("unix:" + path)
+	assert.Nil(t, err)
+	l.Close()
+}
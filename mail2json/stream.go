@@ -0,0 +1,863 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"mime/quotedprintable"
+	"net/textproto"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// how bodies over the -max-body-size limit are written
+const (
+	OversizeTruncate = "truncate"
+	OversizeSkip     = "skip"
+)
+
+// Truncated marks a body cut to the size limit, or left out when Skipped is
+// set. Size is the size of the whole body: the raw body, the decoded
+// attachment or the decoded text, as the body is written.
+type Truncated struct {
+	Size    int64 `json:"size"`
+	Skipped bool  `json:"skipped,omitempty"`
+}
+
+// limitBody applies the body size limit of the option to the content of a
+// body.
+func limitBody(b []byte, option Option) ([]byte, *Truncated) {
+	if option.maxBodySize <= 0 || int64(len(b)) <= option.maxBodySize {
+		return b, nil
+	}
+	truncated := &Truncated{Size: int64(len(b))}
+	if option.oversize == OversizeSkip {
+		truncated.Skipped = true
+		return nil, truncated
+	}
+	return b[:option.maxBodySize], truncated
+}
+
+// limitText applies the body size limit to a text body, which is cut at a
+// character boundary.
+func limitText(s string, option Option) (string, *Truncated) {
+	b, truncated := limitBody([]byte(s), option)
+	if truncated == nil {
+		return s, nil
+	}
+	return strings.ToValidUTF8(string(b), ""), truncated
+}
+
+// StreamMail writes the JSON form of a message while reading it, in the
+// form ReadMail produces. Bodies are copied to the output, the extraction
+// directory and the attachment hashes as they are read, so memory use does
+// not grow with the size of the message; only the options which need the
+// header alone are supported.
+func StreamMail(r io.Reader, w io.Writer, option Option) error {
+	bw := bufio.NewWriter(w)
+	_, err := streamMessage(bufio.NewReader(r), bw, "", nil, option)
+	if err != nil {
+		bw.Flush()
+		return err
+	}
+	return bw.Flush()
+}
+
+// StreamPath streams the messages of a file, an mbox or a Maildir as newline
+// delimited JSON. Messages whose header cannot be read are reported to
+// onError before anything is written for them. The messages of an mbox are
+// streamed from the file as well.
+func StreamPath(path string, w *bufio.Writer, option Option, onError func(error)) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	files := []string{path}
+	if info.IsDir() {
+		if !isMaildir(path) {
+			return fmt.Errorf("%s: not a Maildir", path)
+		}
+		if files, err = MaildirFiles(path); err != nil {
+			return err
+		}
+	}
+
+	for _, file := range files {
+		if err := streamFile(file, w, option, onError); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func streamFile(path string, w *bufio.Writer, option Option, onError func(error)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	head, err := br.Peek(5)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	stream := func(br *bufio.Reader, source *Source) error {
+		started, err := streamMessage(br, w, "", source, option)
+		if !started && err != nil {
+			onError(err)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return w.WriteByte('\n')
+	}
+
+	if !isFromLine(head) {
+		return stream(br, &Source{File: path})
+	}
+
+	mbox, err := NewMboxReader(br, option.mboxFormat)
+	if err != nil {
+		return err
+	}
+	for {
+		offset, r, err := mbox.NextReader()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if err := stream(bufio.NewReader(r), &Source{File: path, Offset: offset}); err != nil {
+			return err
+		}
+	}
+}
+
+// streamMessage writes a message as a JSON object after the prefix. It
+// reports whether anything was written: a message whose header cannot be
+// read, or is malformed in strict mode, is not.
+func streamMessage(br *bufio.Reader, w *bufio.Writer, prefix string, source *Source, option Option) (bool, error) {
+	b, rest, err := readHeaderBlock(br)
+	if err != nil {
+		return false, err
+	}
+	part := Part{Source: source}
+	if rest != nil {
+		if err := part.defect(option, InvalidHeaderDefect, errHeaderTooLong); err != nil {
+			return false, err
+		}
+	}
+	header, bodyStart, err := part.readMessageHeader(b, option)
+	if err != nil {
+		return false, err
+	}
+	if bodyStart < len(b) || rest != nil {
+		// the lines after a malformed header line belong to the body
+		br = bufio.NewReader(io.MultiReader(bytes.NewReader(b[bodyStart:]), bytes.NewReader(rest), br))
+	}
+
+	part.setMessageHeader(header, option)
+	w.WriteString(prefix)
+	if err := writeHead(w, &part); err != nil {
+		return true, err
+	}
+	if err := streamContent(br, w, &part, textproto.MIMEHeader(header), option); err != nil {
+		return true, err
+	}
+	return true, writeTail(w, &part)
+}
+
+// the largest header read while streaming
+const maxHeaderBlock = 1 << 20
+
+var errHeaderTooLong = fmt.Errorf("header longer than %d bytes", maxHeaderBlock)
+
+// readHeaderBlock reads the lines of a header up to and including the blank
+// line after it, or the first line which cannot belong to a header. A header
+// over maxHeaderBlock is cut before the line which exceeds it, and the part
+// of that line read so far is returned as rest, to be read as the body.
+func readHeaderBlock(br *bufio.Reader) ([]byte, []byte, error) {
+	var b []byte
+	lineStart := 0
+	for {
+		chunk, err := br.ReadSlice('\n')
+		if len(b)+len(chunk) > maxHeaderBlock {
+			rest := append(b[lineStart:len(b):len(b)], chunk...)
+			return b[:lineStart], rest, nil
+		}
+		b = append(b, chunk...)
+		if err == io.EOF {
+			return b, nil, nil
+		} else if err == bufio.ErrBufferFull {
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		line := b[lineStart:]
+		if len(bytes.TrimRight(line, "\r\n")) == 0 || !isHeaderLine(line, lineStart == 0) {
+			return b, nil, nil
+		}
+		lineStart = len(b)
+	}
+}
+
+// writeHead writes the header fields of a part and leaves its JSON object
+// open for the fields written while reading the body.
+func writeHead(w *bufio.Writer, part *Part) error {
+	b, err := json.Marshal(part)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b[:len(b)-1])
+	return err
+}
+
+// writeTail writes the fields of a part known once its body has been read,
+// and closes its JSON object.
+func writeTail(w *bufio.Writer, part *Part) error {
+	b, err := json.Marshal(struct {
+		Charset        string      `json:"charset,omitempty"`
+		DecodeWarnings []string    `json:"decodeWarnings,omitempty"`
+		Attachment     *Attachment `json:"attachment,omitempty"`
+		Truncated      *Truncated  `json:"truncated,omitempty"`
+		Defects        []Defect    `json:"defects,omitempty"`
+	}{part.Charset, part.DecodeWarnings, part.Attachment, part.Truncated, part.Defects})
+	if err != nil {
+		return err
+	}
+	if len(b) > 2 {
+		w.WriteByte(',')
+		w.Write(b[1 : len(b)-1])
+	}
+	return w.WriteByte('}')
+}
+
+// streamContent writes the body of a message or a part according to its
+// Content-Type header, like readContent.
+func streamContent(r io.Reader, w *bufio.Writer, part *Part, header textproto.MIMEHeader, option Option) error {
+	mediaType, params, err := ParseContentType(header)
+	if err != nil {
+		if err := part.defect(option, InvalidHeaderDefect, err); err != nil {
+			return err
+		}
+		if mediaType == "" {
+			mediaType = "text/plain"
+		}
+	}
+
+	encoding := header.Get("Content-Transfer-Encoding")
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return streamBody(r, w, part, mediaType, params, encoding, option)
+	}
+
+	boundary, ok := params["boundary"]
+	if !ok {
+		if err := part.defect(option, NoBoundaryInMultipartDefect, fmt.Errorf("boundary not found")); err != nil {
+			return err
+		}
+		return streamBody(r, w, part, "text/plain", params, encoding, option)
+	}
+	return streamMultipart(r, w, part, boundary, option)
+}
+
+// streamMultipart writes the parts of a multipart body like ReadMultiPart.
+// The body before the first delimiter is kept in case there is none, when
+// the body is written as text.
+func streamMultipart(r io.Reader, w *bufio.Writer, part *Part, boundary string, option Option) error {
+	preamble := &spillBuffer{}
+	defer preamble.Close()
+	s := newMultipartScanner(r, boundary)
+	s.preamble = preamble
+
+	n := 0
+	for ; ; n++ {
+		ok, err := s.Next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			break
+		}
+
+		if n == 0 {
+			s.preamble = nil
+			preamble.Close()
+			w.WriteString(`,"parts":[`)
+		} else {
+			w.WriteByte(',')
+		}
+		if err := streamPart(s, w, option); err != nil {
+			return err
+		}
+	}
+
+	if n == 0 && !s.closed {
+		if err := part.defect(option, StartBoundaryNotFoundDefect, fmt.Errorf("multipart: start boundary not found")); err != nil {
+			return err
+		}
+		body, err := preamble.Reader()
+		if err != nil {
+			return err
+		}
+		return streamBody(body, w, part, "text/plain", map[string]string{}, "", option)
+	}
+	if n > 0 {
+		w.WriteByte(']')
+	}
+	if !s.closed {
+		return part.defect(option, CloseBoundaryNotFoundDefect, fmt.Errorf("multipart: close boundary not found"))
+	}
+	return nil
+}
+
+// streamPart writes a body part of a multipart body.
+func streamPart(r io.Reader, w *bufio.Writer, option Option) error {
+	br := bufio.NewReader(r)
+	b, rest, err := readHeaderBlock(br)
+	if err != nil {
+		return err
+	}
+	var child Part
+	if rest != nil {
+		if err := child.defect(option, InvalidHeaderDefect, fmt.Errorf("multipart: %w", errHeaderTooLong)); err != nil {
+			return err
+		}
+	}
+	header, bodyStart, err := child.readPartHeader(b, option)
+	if err != nil {
+		return err
+	}
+	var body io.Reader = br
+	if bodyStart < len(b) || rest != nil {
+		body = io.MultiReader(bytes.NewReader(b[bodyStart:]), bytes.NewReader(rest), br)
+	}
+
+	child.SetHeader(header, option)
+	if err := writeHead(w, &child); err != nil {
+		return err
+	}
+	if err := streamContent(body, w, &child, header, option); err != nil {
+		return err
+	}
+	return writeTail(w, &child)
+}
+
+// streamBody writes a single part body like ReadBody does, copying the
+// decoded content to the attachment hashes and the extracted file as it is
+// read.
+func streamBody(r io.Reader, w *bufio.Writer, part *Part, mediaType string, params map[string]string, contentTransferEncoding string, option Option) error {
+	isText := strings.HasPrefix(mediaType, "text/")
+	isAttachment := IsAttachment(mediaType, part.header())
+
+	if IsEmbeddedMessage(mediaType) && option.depth < option.maxDepth {
+		embedded, held, err := streamEmbeddedMessage(r, w, part, mediaType, contentTransferEncoding, option)
+		if embedded || err != nil {
+			return err
+		}
+		// a message which cannot be parsed is kept as an opaque body
+		r = io.MultiReader(bytes.NewReader(held), r)
+	}
+
+	var sink *attachmentSink
+	if isAttachment {
+		var err error
+		if sink, err = newAttachmentSink(part, mediaType, option); err != nil {
+			return err
+		}
+		defer sink.discard()
+	}
+
+	body := &jsonStringWriter{w: w, key: "body"}
+	var dst io.Writer = io.Discard
+	var src io.Reader
+
+	var limit *limitWriter
+	var encoder io.WriteCloser
+	switch {
+	case isAttachment && !isText && option.attachmentBody == AttachmentBodyOmit:
+		src = newTransferDecoder(r, contentTransferEncoding)
+	case isAttachment && !isText && option.attachmentBody == AttachmentBodyBase64:
+		encoder = base64.NewEncoder(base64.StdEncoding, body)
+		limit = newLimitWriter(encoder, option)
+		dst = limit
+		src = newTransferDecoder(r, contentTransferEncoding)
+	case option.decodeTransferEncoding && isText:
+		limit = newLimitWriter(body, option)
+		dst = limit
+		src = newTransferDecoder(r, contentTransferEncoding)
+	default:
+		// the raw body is written while decoding it for the attachment
+		limit = newLimitWriter(body, option)
+		r = io.TeeReader(r, limit)
+		src = r
+		if isAttachment {
+			src = newTransferDecoder(r, contentTransferEncoding)
+		}
+	}
+	if sink != nil {
+		src = io.TeeReader(src, sink)
+	}
+	var text *textSniffer
+	if option.decodeTransferEncoding && isText {
+		src, text = part.textReader(src, params["charset"])
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		var writeErr *sinkError
+		if errors.As(err, &writeErr) {
+			return writeErr.err
+		}
+		if err := part.defect(option, transferEncodingDefect(contentTransferEncoding), err); err != nil {
+			return err
+		}
+		// keep the raw body complete
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return err
+		}
+	}
+
+	if limit != nil {
+		if err := limit.Close(); err != nil {
+			return err
+		}
+		part.Truncated = limit.truncated()
+	}
+	if encoder != nil {
+		if err := encoder.Close(); err != nil {
+			return err
+		}
+	}
+	if err := body.Close(limit != nil && limit.exceeded); err != nil {
+		return err
+	}
+	if text != nil {
+		text.finish(part)
+	}
+	if sink != nil {
+		return sink.Close()
+	}
+	return nil
+}
+
+// streamEmbeddedMessage writes an embedded message one level deeper than the
+// enclosing part, and reports whether it did. When the header of the message
+// cannot be read, nothing is written and the raw body read so far is
+// returned. A text/rfc822-headers part holds a header only, and is read
+// into memory.
+func streamEmbeddedMessage(r io.Reader, w *bufio.Writer, part *Part, mediaType string, contentTransferEncoding string, option Option) (bool, []byte, error) {
+	if strings.EqualFold(mediaType, "text/rfc822-headers") {
+		raw, err := io.ReadAll(r)
+		if err != nil {
+			return false, nil, err
+		}
+		b, err := DecodeTransferEncoding(raw, contentTransferEncoding)
+		if err == nil {
+			var message *Part
+			if message, err = ReadEmbeddedMessage(b, mediaType, -1, option); err == nil {
+				v, err := json.Marshal(message)
+				if err != nil {
+					return false, nil, err
+				}
+				if IsAttachment(mediaType, part.header()) {
+					part.Attachment = NewAttachment(b, mediaType, AttachmentFilename(part.header()))
+					if option.extractDir != "" {
+						if part.Attachment.Path, err = ExtractAttachment(option.extractDir, part.Attachment, b); err != nil {
+							return false, nil, err
+						}
+					}
+				}
+				w.WriteString(`,"message":`)
+				w.Write(v)
+				return true, nil, nil
+			}
+		}
+		return false, raw, part.defect(option, InvalidEmbeddedMessageDefect, err)
+	}
+
+	sink, err := newAttachmentSink(part, mediaType, option)
+	if err != nil {
+		return false, nil, err
+	}
+	defer sink.discard()
+
+	// the raw body is held until the header is read
+	held := &holdWriter{}
+	decoded := io.TeeReader(newTransferDecoder(io.TeeReader(r, held), contentTransferEncoding), sink)
+
+	option.depth++
+	started, err := streamMessage(bufio.NewReader(decoded), w, `,"message":`, nil, option)
+	if !started {
+		part.Attachment = nil
+		return false, held.b, part.defect(option, InvalidEmbeddedMessageDefect, err)
+	}
+	held.b = nil
+	held.done = true
+	if err != nil {
+		return true, nil, err
+	}
+	// the rest of the message, such as the padding of the transfer encoding
+	if _, err = io.Copy(io.Discard, decoded); err != nil {
+		var writeErr *sinkError
+		if errors.As(err, &writeErr) {
+			return true, nil, writeErr.err
+		}
+		if err := part.defect(option, transferEncodingDefect(contentTransferEncoding), err); err != nil {
+			return true, nil, err
+		}
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return true, nil, err
+		}
+	}
+	return true, nil, sink.Close()
+}
+
+// holdWriter keeps what is written to it until done.
+type holdWriter struct {
+	b    []byte
+	done bool
+}
+
+func (h *holdWriter) Write(p []byte) (int, error) {
+	if !h.done {
+		h.b = append(h.b, p...)
+	}
+	return len(p), nil
+}
+
+// spillBuffer keeps what is written to it in memory up to maxSpillMemory,
+// and in a temporary file beyond that.
+type spillBuffer struct {
+	buf  bytes.Buffer
+	file *os.File
+}
+
+const maxSpillMemory = 64 << 10
+
+func (s *spillBuffer) Write(p []byte) (int, error) {
+	if s.file == nil && s.buf.Len()+len(p) <= maxSpillMemory {
+		return s.buf.Write(p)
+	}
+	if s.file == nil {
+		f, err := os.CreateTemp("", "mail2json-")
+		if err != nil {
+			return 0, err
+		}
+		s.file = f
+		if _, err := s.buf.WriteTo(f); err != nil {
+			return 0, err
+		}
+	}
+	return s.file.Write(p)
+}
+
+// Reader returns a reader of what was written.
+func (s *spillBuffer) Reader() (io.Reader, error) {
+	if s.file == nil {
+		return &s.buf, nil
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return s.file, nil
+}
+
+// Close drops what was written and removes the temporary file.
+func (s *spillBuffer) Close() error {
+	s.buf = bytes.Buffer{}
+	if s.file == nil {
+		return nil
+	}
+	f := s.file
+	s.file = nil
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// attachmentSink computes the size and the hashes of a decoded attachment and
+// writes it to the extraction directory.
+type attachmentSink struct {
+	attachment *Attachment
+	sha256     hash.Hash
+	md5        hash.Hash
+	size       int
+	file       *os.File
+}
+
+func newAttachmentSink(part *Part, mediaType string, option Option) (*attachmentSink, error) {
+	part.Attachment = &Attachment{Filename: AttachmentFilename(part.header()), ContentType: mediaType}
+	s := &attachmentSink{attachment: part.Attachment, sha256: sha256.New(), md5: md5.New()}
+	if option.extractDir != "" {
+		var err error
+		if s.file, err = createAttachmentFile(option.extractDir, part.Attachment); err != nil {
+			return nil, err
+		}
+		part.Attachment.Path = s.file.Name()
+	}
+	return s, nil
+}
+
+func (s *attachmentSink) Write(p []byte) (int, error) {
+	s.sha256.Write(p)
+	s.md5.Write(p)
+	s.size += len(p)
+	if s.file != nil {
+		if _, err := s.file.Write(p); err != nil {
+			return 0, &sinkError{err}
+		}
+	}
+	return len(p), nil
+}
+
+// Close completes the attachment.
+func (s *attachmentSink) Close() error {
+	s.attachment.Size = s.size
+	s.attachment.SHA256 = hex.EncodeToString(s.sha256.Sum(nil))
+	s.attachment.MD5 = hex.EncodeToString(s.md5.Sum(nil))
+	if s.file == nil {
+		return nil
+	}
+	f := s.file
+	s.file = nil
+	return f.Close()
+}
+
+// discard removes the extracted file of an attachment which was not
+// completed.
+func (s *attachmentSink) discard() {
+	if s.file != nil {
+		s.file.Close()
+		os.Remove(s.file.Name())
+		s.file = nil
+	}
+}
+
+// textReader converts a text body from its declared charset to UTF-8. The
+// charset cannot be guessed while streaming, so text without a supported
+// charset is passed through, and checked to be ASCII or UTF-8 instead.
+func (p *Part) textReader(r io.Reader, charset string) (io.Reader, *textSniffer) {
+	charset = normalizeCharset(charset)
+	if charset != "" && !isUTF8Charset(charset) {
+		tr, err := NewCharsetReader(charset, r)
+		if err == nil {
+			p.Charset = charset
+			return tr, nil
+		}
+		p.DecodeWarnings = append(p.DecodeWarnings, err.Error())
+	}
+	sniffer := &textSniffer{declared: charset, ascii: true}
+	return io.TeeReader(r, sniffer), sniffer
+}
+
+// textSniffer checks whether a text passed through is ASCII or valid UTF-8.
+type textSniffer struct {
+	declared string
+	ascii    bool
+	invalid  bool
+	// an incomplete UTF-8 sequence at the end of the last write
+	pending []byte
+}
+
+func (t *textSniffer) Write(p []byte) (int, error) {
+	b := append(t.pending, p...)
+	t.pending = nil
+	if t.ascii && !isASCII(b) {
+		t.ascii = false
+	}
+	if !t.invalid {
+		b, t.pending = splitIncompleteRune(b)
+		t.pending = append([]byte(nil), t.pending...)
+		t.invalid = !utf8.Valid(b)
+	}
+	return len(p), nil
+}
+
+// finish sets the charset and the warnings of the part like DecodeText.
+func (t *textSniffer) finish(p *Part) {
+	invalid := t.invalid || len(t.pending) > 0
+	switch {
+	case t.ascii && t.declared == "":
+		p.Charset = "us-ascii"
+	case invalid:
+		p.Charset = t.declared
+		p.DecodeWarnings = append(p.DecodeWarnings, "text contains invalid characters")
+	case t.declared == "":
+		p.Charset = "utf-8"
+		p.DecodeWarnings = append(p.DecodeWarnings, "charset not declared, detected utf-8")
+	default:
+		p.Charset = t.declared
+	}
+}
+
+// splitIncompleteRune splits an incomplete UTF-8 sequence from the end of b.
+func splitIncompleteRune(b []byte) ([]byte, []byte) {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return b[:i], b[i:]
+			}
+			break
+		}
+	}
+	return b, nil
+}
+
+func newTransferDecoder(r io.Reader, contentTransferEncoding string) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(contentTransferEncoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	default:
+		return r
+	}
+}
+
+func transferEncodingDefect(contentTransferEncoding string) string {
+	if strings.EqualFold(strings.TrimSpace(contentTransferEncoding), "quoted-printable") {
+		return InvalidQuotedPrintableDefect
+	}
+	return InvalidBase64CharactersDefect
+}
+
+// sinkError is a failure to write the output, as opposed to a failure to
+// decode the input.
+type sinkError struct {
+	err error
+}
+
+func (e *sinkError) Error() string {
+	return e.err.Error()
+}
+
+// limitWriter applies the body size limit while streaming. Bodies to be
+// skipped are held back until they are known to fit, so up to the limit is
+// kept in memory.
+type limitWriter struct {
+	w        io.Writer
+	max      int64
+	skip     bool
+	n        int64
+	held     []byte
+	exceeded bool
+}
+
+func newLimitWriter(w io.Writer, option Option) *limitWriter {
+	return &limitWriter{w: w, max: option.maxBodySize, skip: option.oversize == OversizeSkip}
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	l.n += int64(n)
+	switch {
+	case l.max <= 0:
+		return n, l.write(p)
+	case l.exceeded:
+		return n, nil
+	case l.n > l.max:
+		l.exceeded = true
+		if l.skip {
+			l.held = nil
+			return n, nil
+		}
+		return n, l.write(p[:int64(len(p))-(l.n-l.max)])
+	case l.skip:
+		l.held = append(l.held, p...)
+		return n, nil
+	default:
+		return n, l.write(p)
+	}
+}
+
+func (l *limitWriter) write(p []byte) error {
+	if _, err := l.w.Write(p); err != nil {
+		return &sinkError{err}
+	}
+	return nil
+}
+
+// Close writes a held back body which fit in the limit.
+func (l *limitWriter) Close() error {
+	if l.held == nil {
+		return nil
+	}
+	held := l.held
+	l.held = nil
+	if _, err := l.w.Write(held); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (l *limitWriter) truncated() *Truncated {
+	if !l.exceeded {
+		return nil
+	}
+	return &Truncated{Size: l.n, Skipped: l.skip}
+}
+
+// jsonStringWriter writes a JSON string field escaped as encoding/json does.
+// The field is only written when the string is not empty, like a field
+// marked omitempty.
+type jsonStringWriter struct {
+	w       *bufio.Writer
+	key     string
+	started bool
+	// an incomplete UTF-8 sequence at the end of the last write
+	pending []byte
+}
+
+func (j *jsonStringWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if !j.started {
+		j.started = true
+		j.w.WriteString(`,"` + j.key + `":"`)
+	}
+
+	b, pending := splitIncompleteRune(append(j.pending, p...))
+	j.pending = append([]byte(nil), pending...)
+	if err := j.writeEscaped(b); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (j *jsonStringWriter) writeEscaped(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	escaped, err := json.Marshal(string(b))
+	if err != nil {
+		return err
+	}
+	_, err = j.w.Write(escaped[1 : len(escaped)-1])
+	return err
+}
+
+// Close ends the string. An incomplete character at the end is dropped when
+// the string was truncated, and written as U+FFFD otherwise.
+func (j *jsonStringWriter) Close(truncated bool) error {
+	if !truncated {
+		if err := j.writeEscaped(j.pending); err != nil {
+			return err
+		}
+	}
+	if !j.started {
+		return nil
+	}
+	return j.w.WriteByte('"')
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const streamMultipartMessage = "From: a@example.com\r\n" +
+	"Subject: test\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"b\"\r\n" +
+	"\r\n" +
+	"--b\r\n" +
+	"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"caf=E9 \"quoted\"\r\n" +
+	"--b\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"Content-Disposition: attachment; filename=\"data.bin\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"AAECAwQFBgcICQ==\r\n" +
+	"--b\r\n" +
+	"Content-Type: message/rfc822\r\n" +
+	"\r\n" +
+	"Subject: inner\r\n" +
+	"\r\n" +
+	"inner body\r\n" +
+	"--b--\r\n"
+
+// streamJSON streams a message and returns the output as a generic value.
+func streamJSON(t *testing.T, message string, option Option) map[string]interface{} {
+	var buf bytes.Buffer
+	err := StreamMail(strings.NewReader(message), &buf, option)
+	assert.Nil(t, err)
+
+	var v map[string]interface{}
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &v), buf.String())
+	return v
+}
+
+// readJSON reads a message and returns its JSON form as a generic value.
+func readJSON(t *testing.T, message string, option Option) map[string]interface{} {
+	part, err := ReadMail(strings.NewReader(message), option)
+	assert.Nil(t, err)
+	b, err := json.Marshal(part)
+	assert.Nil(t, err)
+
+	var v map[string]interface{}
+	assert.Nil(t, json.Unmarshal(b, &v))
+	return v
+}
+
+func TestStreamMail(t *testing.T) {
+	testcases := []struct {
+		name   string
+		option Option
+	}{
+		{"raw", Option{maxDepth: defaultMaxDepth}},
+		{"decode", Option{decodeTransferEncoding: true, maxDepth: defaultMaxDepth}},
+		{"base64", Option{decodeTransferEncoding: true, attachmentBody: AttachmentBodyBase64, maxDepth: defaultMaxDepth}},
+		{"omit", Option{attachmentBody: AttachmentBodyOmit, maxDepth: defaultMaxDepth}},
+		{"headers", Option{decodeHeader: true, parseHeaders: true, analyze: true, maxDepth: defaultMaxDepth}},
+		{"depth", Option{maxDepth: 0}},
+	}
+
+	for _, tt := range testcases {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, readJSON(t, streamMultipartMessage, tt.option), streamJSON(t, streamMultipartMessage, tt.option))
+		})
+	}
+}
+
+func TestStreamMailDefects(t *testing.T) {
+	testcases := []struct {
+		name    string
+		message string
+	}{
+		{
+			"close boundary not found",
+			"Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\n\r\npart\r\n",
+		},
+		{
+			"invalid base64",
+			"Content-Type: application/pdf\r\nContent-Transfer-Encoding: base64\r\n\r\n!!!!\r\n",
+		},
+		{
+			"invalid embedded message",
+			"Content-Type: message/rfc822\r\n\r\nnot a header\r\n",
+		},
+		{
+			"malformed header",
+			"Subject: test\r\nnot a header\r\n\r\nbody\r\n",
+		},
+		{
+			"invalid embedded header",
+			"Content-Type: message/rfc822\r\n\r\nSubject: inner\r\nnot a header\r\n",
+		},
+		{
+			"rfc822 headers",
+			"Content-Type: text/rfc822-headers\r\n\r\nSubject: inner\r\n",
+		},
+	}
+
+	option := Option{maxDepth: defaultMaxDepth}
+	for _, tt := range testcases {
+		t.Run(tt.name, func(t *testing.T) {
+			expected := readJSON(t, tt.message, option)
+			actual := streamJSON(t, tt.message, option)
+			assert.Equal(t, expected["defects"] != nil, actual["defects"] != nil)
+			assert.Equal(t, expected["body"], actual["body"])
+			assert.Equal(t, expected["message"], actual["message"])
+		})
+	}
+}
+
+func TestStreamMailMultipart(t *testing.T) {
+	long := strings.Repeat("--b ", 3000)
+	testcases := []struct {
+		name    string
+		message string
+	}{
+		{
+			"start boundary not found",
+			"Content-Type: multipart/mixed; boundary=b\r\n\r\npreamble\r\n--b--\r\n",
+		},
+		{
+			"no delimiter",
+			"Content-Type: multipart/mixed; boundary=b\r\n\r\n" + long + "\r\n",
+		},
+		{
+			"broken part header",
+			"Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\nnot a header\r\n\r\nbody\r\n--b--\r\n",
+		},
+		{
+			"truncated part",
+			"Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\n\r\none\r\n--b\r\n\r\ntwo\r\n",
+		},
+		{
+			"long lines",
+			"Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\n\r\nx" + long + "\r\n--b\r\n\r\n" + long + "\r\n--b--\r\n",
+		},
+		{
+			"nested",
+			"Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\nContent-Type: multipart/alternative; boundary=c\r\n\r\n--c\r\n\r\ninner\r\n--c--\r\n--b--\r\n",
+		},
+	}
+
+	option := Option{maxDepth: defaultMaxDepth}
+	for _, tt := range testcases {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, readJSON(t, tt.message, option), streamJSON(t, tt.message, option))
+		})
+	}
+}
+
+func TestStreamMailLongHeader(t *testing.T) {
+	long := strings.Repeat("a", 3<<20)
+	message := "Subject: test\r\nX-Long: " + long + "\r\n\r\nbody\r\n"
+
+	v := streamJSON(t, message, Option{maxDepth: defaultMaxDepth})
+	assert.Equal(t, map[string]interface{}{"Subject": []interface{}{"test"}}, v["header"])
+	assert.Equal(t, "InvalidHeaderDefect", v["defects"].([]interface{})[0].(map[string]interface{})["code"])
+	// the header cut at the limit is read as the body
+	assert.Equal(t, "X-Long: "+long+"\r\n\r\nbody\r\n", v["body"])
+
+	// a part header as well
+	part := "Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\nX-Long: " + long + "\r\n\r\npart\r\n--b--\r\n"
+	v = streamJSON(t, part, Option{maxDepth: defaultMaxDepth})
+	child := v["parts"].([]interface{})[0].(map[string]interface{})
+	assert.NotNil(t, child["defects"])
+	assert.Equal(t, "X-Long: "+long+"\r\n\r\npart", child["body"])
+}
+
+func TestStreamMailLimit(t *testing.T) {
+	message := "Content-Type: text/plain; charset=utf-8\r\n\r\n日本語のテキスト"
+
+	testcases := []struct {
+		name      string
+		option    Option
+		body      interface{}
+		truncated interface{}
+	}{
+		{
+			"fits",
+			Option{decodeTransferEncoding: true, maxBodySize: 100, oversize: OversizeTruncate},
+			"日本語のテキスト",
+			nil,
+		},
+		{
+			"truncate",
+			Option{decodeTransferEncoding: true, maxBodySize: 10, oversize: OversizeTruncate},
+			"日本語",
+			map[string]interface{}{"size": float64(24)},
+		},
+		{
+			"skip",
+			Option{decodeTransferEncoding: true, maxBodySize: 10, oversize: OversizeSkip},
+			nil,
+			map[string]interface{}{"size": float64(24), "skipped": true},
+		},
+	}
+
+	for _, tt := range testcases {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, v := range []map[string]interface{}{readJSON(t, message, tt.option), streamJSON(t, message, tt.option)} {
+				assert.Equal(t, tt.body, v["body"])
+				assert.Equal(t, tt.truncated, v["truncated"])
+			}
+		})
+	}
+}
+
+func TestStreamMailExtract(t *testing.T) {
+	dir := t.TempDir()
+	option := Option{extractDir: dir, attachmentBody: AttachmentBodyOmit, maxDepth: defaultMaxDepth}
+
+	v := streamJSON(t, streamMultipartMessage, option)
+	attachment := v["parts"].([]interface{})[1].(map[string]interface{})["attachment"].(map[string]interface{})
+	assert.Equal(t, filepath.Join(dir, "data.bin"), attachment["path"])
+	assert.Equal(t, float64(10), attachment["size"])
+
+	b, err := os.ReadFile(filepath.Join(dir, "data.bin"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, b)
+}
+
+func TestStreamPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mbox")
+	mbox := "From a@example.com Thu Jan  1 00:00:00 2015\n" +
+		"Subject: first\n\nbody\n\n" +
+		"From a@example.com Thu Jan  1 00:00:00 2015\n" +
+		"Subject: second\n\nbody\n"
+	assert.Nil(t, os.WriteFile(path, []byte(mbox), 0o600))
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	err := StreamPath(path, w, Option{mboxFormat: MboxRD, maxDepth: defaultMaxDepth}, func(err error) { t.Error(err) })
+	assert.Nil(t, err)
+	assert.Nil(t, w.Flush())
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	assert.Equal(t, 2, len(lines))
+	for i, subject := range []string{"first", "second"} {
+		var part Part
+		assert.Nil(t, json.Unmarshal([]byte(lines[i]), &part))
+		assert.Equal(t, []string{subject}, part.Header["Subject"])
+		assert.Equal(t, path, part.Source.File)
+	}
+}
+
+func TestJSONStringWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	j := &jsonStringWriter{w: w, key: "body"}
+
+	// a character split across writes
+	s := "a\"\n日本"
+	for i := 0; i < len(s); i++ {
+		j.Write([]byte{s[i]})
+	}
+	assert.Nil(t, j.Close(false))
+	assert.Nil(t, w.Flush())
+	assert.Equal(t, `,"body":"a\"\n日本"`, buf.String())
+}
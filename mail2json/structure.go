@@ -0,0 +1,318 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// BodyPart refers to a part from the summary of a message.
+type BodyPart struct {
+	PartID      string `json:"partId"`
+	Type        string `json:"type"`
+	Name        string `json:"name,omitempty"`
+	Disposition string `json:"disposition,omitempty"`
+	CID         string `json:"cid,omitempty"`
+}
+
+// Summary lists the parts to display as the text or the HTML body of a
+// message and its attachments, like the Email object of JMAP (RFC 8621).
+type Summary struct {
+	TextBody    []BodyPart `json:"textBody"`
+	HTMLBody    []BodyPart `json:"htmlBody"`
+	Attachments []BodyPart `json:"attachments"`
+}
+
+// CIDReference is a cid: URL in an HTML part and the part it resolves to
+// within the multipart/related.
+type CIDReference struct {
+	CID    string `json:"cid"`
+	PartID string `json:"partId,omitempty"`
+}
+
+// what an alternative is preferred for
+const (
+	PreferredText = "text"
+	PreferredHTML = "html"
+)
+
+func (p *Part) mediaType() string {
+	mediaType, _, err := ParseContentType(p.header())
+	if err != nil && mediaType == "" {
+		return "text/plain"
+	}
+	return strings.ToLower(mediaType)
+}
+
+func (p *Part) contentID() string {
+	return strings.Trim(strings.TrimSpace(p.header().Get("Content-Id")), "<>")
+}
+
+func (p *Part) bodyPart() BodyPart {
+	return BodyPart{
+		PartID:      p.PartID,
+		Type:        p.mediaType(),
+		Name:        AttachmentFilename(p.header()),
+		Disposition: p.Disposition,
+		CID:         p.contentID(),
+	}
+}
+
+// Summarize numbers the parts like IMAP sections, annotates the alternatives
+// and related parts and adds the summary of the message.
+func Summarize(part *Part) {
+	if part.Parts == nil {
+		part.PartID = "1"
+	}
+	assignPartIDs(part, "")
+	annotate(part)
+
+	summary := Summary{TextBody: []BodyPart{}, HTMLBody: []BodyPart{}, Attachments: []BodyPart{}}
+	parseStructure([]*Part{part}, "multipart/mixed", false, &summary.TextBody, &summary.HTMLBody, &summary.Attachments)
+	part.Summary = &summary
+}
+
+func children(part *Part) []*Part {
+	var parts []*Part
+	for i := range part.Parts {
+		parts = append(parts, &part.Parts[i])
+	}
+	return parts
+}
+
+func assignPartIDs(part *Part, prefix string) {
+	for i := range part.Parts {
+		child := &part.Parts[i]
+		child.PartID = prefix + strconv.Itoa(i+1)
+		assignPartIDs(child, child.PartID+".")
+	}
+}
+
+func annotate(part *Part) {
+	if part.Parts == nil {
+		disposition, _, err := ParseParams(part.header().Get("Content-Disposition"))
+		if err == nil && disposition != "" {
+			part.Disposition = strings.ToLower(disposition)
+		}
+		return
+	}
+
+	for i := range part.Parts {
+		annotate(&part.Parts[i])
+	}
+	switch part.mediaType() {
+	case "multipart/alternative":
+		markPreferred(part)
+	case "multipart/related":
+		resolveRelated(part)
+	}
+}
+
+// displayType returns the kind of body an alternative provides: that of the
+// root of a multipart/related and of the first part of other multiparts.
+func displayType(part *Part) string {
+	switch mediaType := part.mediaType(); {
+	case mediaType == "multipart/related":
+		if root := relatedRoot(part); root != nil {
+			return displayType(root)
+		}
+	case strings.HasPrefix(mediaType, "multipart/") && len(part.Parts) > 0:
+		return displayType(&part.Parts[0])
+	case mediaType == "text/plain":
+		return PreferredText
+	case mediaType == "text/html":
+		return PreferredHTML
+	}
+	return ""
+}
+
+// markPreferred marks the best alternatives for text and for HTML display.
+// The last alternative of a kind is the preferred one (RFC 2046), and either
+// kind stands in for the other if one is missing.
+func markPreferred(part *Part) {
+	text, html := -1, -1
+	for i := range part.Parts {
+		switch displayType(&part.Parts[i]) {
+		case PreferredText:
+			text = i
+		case PreferredHTML:
+			html = i
+		}
+	}
+	if text < 0 {
+		text = html
+	}
+	if html < 0 {
+		html = text
+	}
+	if text >= 0 {
+		part.Parts[text].Preferred = append(part.Parts[text].Preferred, PreferredText)
+	}
+	if html >= 0 {
+		part.Parts[html].Preferred = append(part.Parts[html].Preferred, PreferredHTML)
+	}
+}
+
+// relatedRoot returns the part named by the start parameter, or the first
+// part (RFC 2387).
+func relatedRoot(part *Part) *Part {
+	_, params, _ := ParseContentType(part.header())
+	if start := strings.Trim(params["start"], "<>"); start != "" {
+		for i := range part.Parts {
+			if part.Parts[i].contentID() == start {
+				return &part.Parts[i]
+			}
+		}
+	}
+	if len(part.Parts) == 0 {
+		return nil
+	}
+	return &part.Parts[0]
+}
+
+// htmlParts returns the HTML parts of a subtree.
+func htmlParts(part *Part) []*Part {
+	if part.Parts == nil {
+		if part.mediaType() == "text/html" {
+			return []*Part{part}
+		}
+		return nil
+	}
+	var parts []*Part
+	for i := range part.Parts {
+		parts = append(parts, htmlParts(&part.Parts[i])...)
+	}
+	return parts
+}
+
+func cidImages(part *Part) []Image {
+	if part.Images != nil {
+		return part.Images
+	}
+	content, err := partContent(part)
+	if err != nil {
+		return nil
+	}
+	_, _, images := RenderHTML(string(content))
+	return images
+}
+
+// resolveRelated resolves the cid: references of the HTML in the root of a
+// multipart/related. Referenced parts are inline, the others attachments
+// unless their Content-Disposition says otherwise.
+func resolveRelated(part *Part) {
+	root := relatedRoot(part)
+	if root == nil {
+		return
+	}
+
+	referenced := map[*Part]bool{}
+	for _, html := range htmlParts(root) {
+		html.CIDReferences = nil
+		for _, image := range cidImages(html) {
+			if image.Kind != ImageCID {
+				continue
+			}
+			cid, err := url.PathUnescape(image.Src[len("cid:"):])
+			if err != nil {
+				cid = image.Src[len("cid:"):]
+			}
+			reference := CIDReference{CID: cid}
+			for i := range part.Parts {
+				if sibling := &part.Parts[i]; sibling != root && strings.EqualFold(sibling.contentID(), cid) {
+					reference.PartID = sibling.PartID
+					referenced[sibling] = true
+				}
+			}
+			html.CIDReferences = append(html.CIDReferences, reference)
+		}
+	}
+
+	for i := range part.Parts {
+		sibling := &part.Parts[i]
+		if sibling == root || sibling.Parts != nil || sibling.Disposition != "" {
+			continue
+		}
+		if referenced[sibling] {
+			sibling.Disposition = "inline"
+		} else {
+			sibling.Disposition = "attachment"
+		}
+	}
+}
+
+func isInlineMediaType(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "image/") ||
+		strings.HasPrefix(mediaType, "audio/") ||
+		strings.HasPrefix(mediaType, "video/")
+}
+
+// parseStructure is the algorithm of RFC 8621 section 4.1.4 which sorts the
+// parts into the text body, the HTML body and the attachments.
+func parseStructure(parts []*Part, multipartType string, inAlternative bool, textBody *[]BodyPart, htmlBody *[]BodyPart, attachments *[]BodyPart) {
+	textLength, htmlLength := -1, -1
+	if textBody != nil {
+		textLength = len(*textBody)
+	}
+	if htmlBody != nil {
+		htmlLength = len(*htmlBody)
+	}
+
+	for i, part := range parts {
+		mediaType := part.mediaType()
+		name := AttachmentFilename(part.header())
+		isInline := part.Disposition != "attachment" &&
+			(mediaType == "text/plain" || mediaType == "text/html" || isInlineMediaType(mediaType)) &&
+			(i == 0 || multipartType != "multipart/related" && (isInlineMediaType(mediaType) || name == ""))
+
+		switch {
+		case strings.HasPrefix(mediaType, "multipart/"):
+			parseStructure(children(part), mediaType, inAlternative || mediaType == "multipart/alternative", textBody, htmlBody, attachments)
+		case isInline:
+			if multipartType == "multipart/alternative" {
+				switch mediaType {
+				case "text/plain":
+					if textBody != nil {
+						*textBody = append(*textBody, part.bodyPart())
+					}
+				case "text/html":
+					if htmlBody != nil {
+						*htmlBody = append(*htmlBody, part.bodyPart())
+					}
+				default:
+					*attachments = append(*attachments, part.bodyPart())
+				}
+				continue
+			}
+			if inAlternative {
+				if mediaType == "text/plain" {
+					htmlBody = nil
+				}
+				if mediaType == "text/html" {
+					textBody = nil
+				}
+			}
+			if textBody != nil {
+				*textBody = append(*textBody, part.bodyPart())
+			}
+			if htmlBody != nil {
+				*htmlBody = append(*htmlBody, part.bodyPart())
+			}
+			if (textBody == nil || htmlBody == nil) && isInlineMediaType(mediaType) {
+				*attachments = append(*attachments, part.bodyPart())
+			}
+		default:
+			*attachments = append(*attachments, part.bodyPart())
+		}
+	}
+
+	if multipartType == "multipart/alternative" && textBody != nil && htmlBody != nil {
+		// an alternative without one of the kinds uses the other one for it
+		if textLength == len(*textBody) && htmlLength != len(*htmlBody) {
+			*textBody = append(*textBody, (*htmlBody)[htmlLength:]...)
+		}
+		if htmlLength == len(*htmlBody) && textLength != len(*textBody) {
+			*htmlBody = append(*htmlBody, (*textBody)[textLength:]...)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func partIDs(parts []BodyPart) []string {
+	ids := []string{}
+	for _, p := range parts {
+		ids = append(ids, p.PartID)
+	}
+	return ids
+}
+
+func TestSummarize(t *testing.T) {
+	input := "Content-Type: multipart/mixed; boundary=mixed\r\n" +
+		"\r\n" +
+		"--mixed\r\n" +
+		"Content-Type: multipart/alternative; boundary=alt\r\n" +
+		"\r\n" +
+		"--alt\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"text\r\n" +
+		"--alt\r\n" +
+		"Content-Type: multipart/related; boundary=rel\r\n" +
+		"\r\n" +
+		"--rel\r\n" +
+		"Content-Type: text/html\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"<img src=3D\"cid:logo%40example.com\"><img src=3D\"cid:missing\">\r\n" +
+		"--rel\r\n" +
+		"Content-Type: image/png\r\n" +
+		"Content-ID: <logo@example.com>\r\n" +
+		"\r\n" +
+		"png\r\n" +
+		"--rel\r\n" +
+		"Content-Type: image/gif\r\n" +
+		"Content-ID: <unused@example.com>\r\n" +
+		"\r\n" +
+		"gif\r\n" +
+		"--rel--\r\n" +
+		"--alt--\r\n" +
+		"--mixed\r\n" +
+		"Content-Type: application/pdf\r\n" +
+		"Content-Disposition: attachment; filename=a.pdf\r\n" +
+		"\r\n" +
+		"pdf\r\n" +
+		"--mixed--\r\n"
+
+	part := readTestMail(t, input, Option{summarize: true})
+
+	alternative := part.Parts[0]
+	assert.Equal(t, "1", alternative.PartID)
+	assert.Equal(t, []string{PreferredText}, alternative.Parts[0].Preferred)
+	assert.Equal(t, []string{PreferredHTML}, alternative.Parts[1].Preferred)
+
+	related := alternative.Parts[1]
+	assert.Equal(t, []CIDReference{
+		{CID: "logo@example.com", PartID: "1.2.2"},
+		{CID: "missing"},
+	}, related.Parts[0].CIDReferences)
+	assert.Equal(t, "", related.Parts[0].Disposition)
+	assert.Equal(t, "inline", related.Parts[1].Disposition)
+	assert.Equal(t, "attachment", related.Parts[2].Disposition)
+	assert.Equal(t, "attachment", part.Parts[1].Disposition)
+
+	assert.Equal(t, []string{"1.1"}, partIDs(part.Summary.TextBody))
+	assert.Equal(t, []string{"1.2.1"}, partIDs(part.Summary.HTMLBody))
+	assert.Equal(t, []string{"1.2.2", "1.2.3", "2"}, partIDs(part.Summary.Attachments))
+	assert.Equal(t, BodyPart{PartID: "2", Type: "application/pdf", Name: "a.pdf", Disposition: "attachment"}, part.Summary.Attachments[2])
+	assert.Equal(t, "logo@example.com", part.Summary.Attachments[0].CID)
+
+	part = readTestMail(t, input, Option{})
+	assert.Nil(t, part.Summary)
+	assert.Equal(t, "", part.Parts[0].PartID)
+}
+
+func TestSummarizeSinglePart(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		textBody    []string
+		htmlBody    []string
+		attachments []string
+	}{
+		{
+			"plain text",
+			"Subject: test\r\n\r\nbody\r\n",
+			[]string{"1"}, []string{"1"}, []string{},
+		},
+		{
+			"html only alternative",
+			"Content-Type: multipart/alternative; boundary=b\r\n\r\n" +
+				"--b\r\nContent-Type: text/html\r\n\r\n<p>html</p>\r\n--b--\r\n",
+			[]string{"1"}, []string{"1"}, []string{},
+		},
+		{
+			"mixed with inline image",
+			"Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+				"--b\r\nContent-Type: text/plain\r\n\r\nbefore\r\n" +
+				"--b\r\nContent-Type: image/jpeg\r\nContent-Disposition: inline\r\n\r\njpeg\r\n" +
+				"--b\r\nContent-Type: text/plain\r\n\r\nafter\r\n" +
+				"--b--\r\n",
+			[]string{"1", "2", "3"}, []string{"1", "2", "3"}, []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		part := readTestMail(t, tt.input, Option{summarize: true})
+		assert.Equal(t, tt.textBody, partIDs(part.Summary.TextBody), tt.name)
+		assert.Equal(t, tt.htmlBody, partIDs(part.Summary.HTMLBody), tt.name)
+		assert.Equal(t, tt.attachments, partIDs(part.Summary.Attachments), tt.name)
+	}
+
+	part := readTestMail(t, "Content-Type: multipart/alternative; boundary=b\r\n\r\n"+
+		"--b\r\nContent-Type: text/html\r\n\r\n<p>html</p>\r\n--b--\r\n", Option{summarize: true})
+	assert.Equal(t, []string{PreferredText, PreferredHTML}, part.Parts[0].Preferred)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// container is a node of the thread tree of the JWZ threading algorithm, see
+// https://www.jwz.org/doc/threading.html. A container without a part stands
+// for a message which is referenced but not in the mailbox.
+type container struct {
+	id       string
+	part     *Part
+	subject  string
+	reply    bool
+	parent   *container
+	children []*container
+}
+
+func (c *container) isAncestorOf(other *container) bool {
+	for p := other; p != nil; p = p.parent {
+		if p == c {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *container) setParent(parent *container) {
+	if c.parent != nil {
+		siblings := c.parent.children
+		for i, sibling := range siblings {
+			if sibling == c {
+				c.parent.children = append(siblings[:i:i], siblings[i+1:]...)
+				break
+			}
+		}
+	}
+	c.parent = parent
+	if parent != nil {
+		parent.children = append(parent.children, c)
+	}
+}
+
+// threadSubject returns the subject of the first message in the subtree.
+func (c *container) threadSubject() (string, bool) {
+	if c.part != nil {
+		return c.subject, c.reply
+	}
+	for _, child := range c.children {
+		if subject, reply := child.threadSubject(); subject != "" {
+			return subject, reply
+		}
+	}
+	return "", false
+}
+
+var subjectPrefixPattern = regexp.MustCompile(`(?i)^\s*(?:((?:re|aw)(?:\[\d+\])?:)|(?:fwd?|wg):|\[[^\]]*\])\s*`)
+
+// NormalizeSubject strips reply and forward prefixes and mailing list tags
+// from a subject, and reports whether it was a reply.
+func NormalizeSubject(subject string) (string, bool) {
+	reply := false
+	for {
+		loc := subjectPrefixPattern.FindStringSubmatchIndex(subject)
+		if loc == nil {
+			break
+		}
+		if loc[2] >= 0 {
+			reply = true
+		}
+		subject = subject[loc[1]:]
+	}
+	return strings.ToLower(strings.Join(strings.Fields(subject), " ")), reply
+}
+
+// Thread sets ThreadID and ParentID of the messages by the JWZ threading
+// algorithm over the Message-ID, In-Reply-To and References headers, and
+// groups threads with the same subject. Messages without a Message-ID, or
+// with a duplicate one, are given an identifier ending in ".invalid".
+func Thread(parts []*Part) {
+	containers := map[string]*container{}
+	var order []*container
+	get := func(id string) *container {
+		c, ok := containers[id]
+		if !ok {
+			c = &container{id: id}
+			containers[id] = c
+			order = append(order, c)
+		}
+		return c
+	}
+
+	for i, part := range parts {
+		header := part.header()
+
+		var c *container
+		if ids := ParseMessageIDs(header.Values("Message-Id")); len(ids) > 0 && (containers[ids[0]] == nil || containers[ids[0]].part == nil) {
+			c = get(ids[0])
+		} else {
+			c = get(fmt.Sprintf("mail2json-%d.invalid", i))
+		}
+		c.part = part
+		c.subject, c.reply = NormalizeSubject(DecodeHeaderValue("Subject", header.Get("Subject")))
+
+		references := ParseMessageIDs(header.Values("References"))
+		if inReplyTo := ParseMessageIDs(header.Values("In-Reply-To")); len(inReplyTo) > 0 &&
+			(len(references) == 0 || references[len(references)-1] != inReplyTo[0]) {
+			references = append(references, inReplyTo[0])
+		}
+
+		// link the references, keeping existing links and avoiding loops
+		var prev *container
+		for _, id := range references {
+			ref := get(id)
+			if prev != nil && ref.parent == nil && ref != prev && !ref.isAncestorOf(prev) {
+				ref.setParent(prev)
+			}
+			prev = ref
+		}
+
+		// the last reference is the parent of the message
+		if prev == c || prev != nil && c.isAncestorOf(prev) {
+			prev = nil
+		}
+		c.setParent(prev)
+	}
+
+	var roots []*container
+	for _, c := range order {
+		if c.parent == nil {
+			roots = append(roots, c)
+		}
+	}
+	roots = pruneContainers(roots, true)
+	roots = groupBySubject(roots)
+
+	for _, root := range roots {
+		threadID := root.id
+		if threadID == "" {
+			// a container created for the subject grouping
+			threadID = root.children[0].id
+		}
+		assignThread(root, threadID)
+	}
+}
+
+// pruneContainers removes containers of missing messages without children
+// and promotes the children of the others, except for those at the root with
+// several children, which keep the thread together.
+func pruneContainers(containers []*container, root bool) []*container {
+	var result []*container
+	for _, c := range containers {
+		c.children = pruneContainers(c.children, false)
+		for _, child := range c.children {
+			child.parent = c
+		}
+
+		if c.part == nil {
+			if len(c.children) == 0 {
+				continue
+			}
+			if !root || len(c.children) == 1 {
+				for _, child := range c.children {
+					child.parent = c.parent
+				}
+				result = append(result, c.children...)
+				continue
+			}
+		}
+		result = append(result, c)
+	}
+	return result
+}
+
+// groupBySubject merges root containers whose messages have the same subject
+// after removing reply prefixes.
+func groupBySubject(roots []*container) []*container {
+	table := map[string]*container{}
+	for _, c := range roots {
+		subject, reply := c.threadSubject()
+		if subject == "" {
+			continue
+		}
+		old, ok := table[subject]
+		if !ok {
+			table[subject] = c
+			continue
+		}
+		// prefer a container of missing messages, then a message which is
+		// not a reply
+		_, oldReply := old.threadSubject()
+		if c.part == nil && old.part != nil || old.part != nil && c.part != nil && oldReply && !reply {
+			table[subject] = c
+		}
+	}
+
+	var result []*container
+	for _, c := range roots {
+		if c.parent != nil {
+			// merged into a container created for an earlier root
+			continue
+		}
+		subject, reply := c.threadSubject()
+		t := table[subject]
+		if subject == "" || t == c {
+			result = append(result, c)
+			continue
+		}
+
+		_, tReply := t.threadSubject()
+		switch {
+		case t.part == nil && c.part == nil:
+			for _, child := range c.children {
+				child.parent = t
+			}
+			t.children = append(t.children, c.children...)
+		case t.part == nil:
+			c.setParent(t)
+		case reply && !tReply:
+			c.setParent(t)
+		default:
+			// neither is a reply to the other: make them siblings
+			dummy := &container{}
+			replaced := false
+			for i, r := range result {
+				if r == t {
+					result[i] = dummy
+					replaced = true
+				}
+			}
+			if !replaced {
+				result = append(result, dummy)
+			}
+			t.setParent(dummy)
+			c.setParent(dummy)
+			table[subject] = dummy
+		}
+	}
+	return result
+}
+
+func assignThread(c *container, threadID string) {
+	if c.part != nil {
+		c.part.ThreadID = threadID
+		c.part.ParentID = ""
+		if c.parent != nil {
+			c.part.ParentID = c.parent.id
+		}
+	}
+	for _, child := range c.children {
+		assignThread(child, threadID)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNormalizeSubject(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		reply    bool
+	}{
+		{"Hello", "hello", false},
+		{"Re: Hello", "hello", true},
+		{"RE: Fwd: [list]  Hello  World", "hello world", true},
+		{"[list] Re[2]: Hello", "hello", true},
+		{"Fwd: Hello", "hello", false},
+		{"Regarding: Hello", "regarding: hello", false},
+	}
+
+	for _, tt := range tests {
+		actual, reply := NormalizeSubject(tt.input)
+		assert.Equal(t, tt.expected, actual, tt.input)
+		assert.Equal(t, tt.reply, reply, tt.input)
+	}
+}
+
+func TestThread(t *testing.T) {
+	inputs := []string{
+		"Message-ID: <a>\r\nSubject: Hello\r\n\r\n",
+		"Message-ID: <b>\r\nIn-Reply-To: <a>\r\nSubject: Re: Hello\r\n\r\n",
+		"Message-ID: <c>\r\nReferences: <a> <b>\r\nSubject: Re: Hello\r\n\r\n",
+		"Message-ID: <d>\r\nReferences: <missing>\r\nSubject: Other\r\n\r\n",
+		"Message-ID: <e>\r\nReferences: <missing>\r\nSubject: Re: Other\r\n\r\n",
+		"Subject: Re: Hello\r\n\r\n",
+		"Message-ID: <g>\r\nSubject: Topic\r\n\r\n",
+		"Message-ID: <h>\r\nSubject: Topic\r\n\r\n",
+		"Message-ID: <a>\r\nSubject: Duplicate\r\n\r\n",
+		"Message-ID: <x>\r\nReferences: <y>\r\nSubject: Loop\r\n\r\n",
+		"Message-ID: <y>\r\nReferences: <x>\r\nSubject: Loop\r\n\r\n",
+		"Message-ID: <z>\r\nReferences: <gone> <b>\r\nSubject: Re: Hello\r\n\r\n",
+	}
+
+	var parts []*Part
+	for _, input := range inputs {
+		parts = append(parts, readTestMail(t, input, Option{}))
+	}
+	Thread(parts)
+
+	var actual [][2]string
+	for _, part := range parts {
+		actual = append(actual, [2]string{part.ThreadID, part.ParentID})
+	}
+	assert.Equal(t, [][2]string{
+		{"a", ""},
+		{"a", "a"},
+		{"a", "b"},
+		{"missing", "missing"},
+		{"missing", "missing"},
+		{"a", "a"},
+		{"g", ""},
+		{"g", ""},
+		{"mail2json-8.invalid", ""},
+		{"y", "y"},
+		{"y", ""},
+		{"a", "b"},
+	}, actual)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime/quotedprintable"
+	"strings"
+)
+
+// Contact is a vCard as defined in RFC 6350. Cards of version 2.1 and 3.0
+// are read as well.
+type Contact struct {
+	UID           string           `json:"uid,omitempty"`
+	FormattedName string           `json:"formattedName,omitempty"`
+	FamilyName    string           `json:"familyName,omitempty"`
+	GivenName     string           `json:"givenName,omitempty"`
+	Organization  string           `json:"organization,omitempty"`
+	Title         string           `json:"title,omitempty"`
+	Emails        []ContactValue   `json:"emails,omitempty"`
+	Phones        []ContactValue   `json:"phones,omitempty"`
+	Addresses     []ContactAddress `json:"addresses,omitempty"`
+	URLs          []string         `json:"urls,omitempty"`
+	Birthday      string           `json:"birthday,omitempty"`
+	Note          string           `json:"note,omitempty"`
+}
+
+// ContactValue is an email address or a phone number with its types such as
+// "work" or "cell".
+type ContactValue struct {
+	Value     string   `json:"value"`
+	Types     []string `json:"types,omitempty"`
+	Preferred bool     `json:"preferred,omitempty"`
+}
+
+type ContactAddress struct {
+	Types      []string `json:"types,omitempty"`
+	Street     string   `json:"street,omitempty"`
+	Locality   string   `json:"locality,omitempty"`
+	Region     string   `json:"region,omitempty"`
+	PostalCode string   `json:"postalCode,omitempty"`
+	Country    string   `json:"country,omitempty"`
+}
+
+var errNoVCard = errors.New("VCARD not found")
+
+// ParseContacts parses the vCards of a .vcf file.
+func ParseContacts(text string) ([]Contact, error) {
+	roots, err := parseComponents(text)
+	if err != nil {
+		return nil, err
+	}
+
+	contacts := []Contact{}
+	for _, c := range roots {
+		if c.name == "VCARD" {
+			contacts = append(contacts, parseContact(c))
+		}
+	}
+	if len(contacts) == 0 {
+		return nil, errNoVCard
+	}
+	return contacts, nil
+}
+
+func parseContact(c *component) Contact {
+	var contact Contact
+	for _, l := range c.lines {
+		value := vcardValue(l)
+		switch l.name {
+		case "UID":
+			contact.UID = value
+		case "FN":
+			contact.FormattedName = unescapeText(value)
+		case "N":
+			n := splitValue(value, ';')
+			contact.FamilyName = unescapeText(n[0])
+			if len(n) > 1 {
+				contact.GivenName = unescapeText(n[1])
+			}
+		case "ORG":
+			contact.Organization = strings.Join(unescapeValues(splitValue(value, ';')), ", ")
+		case "TITLE":
+			contact.Title = unescapeText(value)
+		case "EMAIL":
+			contact.Emails = append(contact.Emails, contactValue(l, value))
+		case "TEL":
+			contact.Phones = append(contact.Phones, contactValue(l, value))
+		case "ADR":
+			contact.Addresses = append(contact.Addresses, contactAddress(l, value))
+		case "URL":
+			contact.URLs = append(contact.URLs, value)
+		case "BDAY":
+			contact.Birthday = value
+		case "NOTE":
+			contact.Note = unescapeText(value)
+		}
+	}
+	if contact.FormattedName == "" {
+		contact.FormattedName = strings.TrimSpace(contact.GivenName + " " + contact.FamilyName)
+	}
+	return contact
+}
+
+// vcardValue decodes the quoted-printable values of vCard 2.1, whose charset
+// is given by the CHARSET parameter.
+func vcardValue(l contentLine) string {
+	if !strings.EqualFold(l.param("ENCODING"), "QUOTED-PRINTABLE") && !hasType(l, "quoted-printable") {
+		return l.value
+	}
+	b, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(l.value)))
+	if err != nil {
+		return l.value
+	}
+	if charset := l.param("CHARSET"); charset != "" {
+		if text, err := NewCharsetReader(charset, bytes.NewReader(b)); err == nil {
+			if decoded, err := io.ReadAll(text); err == nil {
+				return string(decoded)
+			}
+		}
+	}
+	return string(b)
+}
+
+// types returns the lower-cased TYPE parameters, which may also be given as
+// a comma separated list.
+func types(l contentLine) []string {
+	var types []string
+	for _, t := range l.params["TYPE"] {
+		for _, v := range strings.Split(t, ",") {
+			v = strings.ToLower(v)
+			switch v {
+			case "", "pref", "internet", "quoted-printable":
+			default:
+				types = append(types, v)
+			}
+		}
+	}
+	return types
+}
+
+func hasType(l contentLine, name string) bool {
+	for _, t := range l.params["TYPE"] {
+		for _, v := range strings.Split(t, ",") {
+			if strings.EqualFold(v, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func contactValue(l contentLine, value string) ContactValue {
+	return ContactValue{
+		Value:     unescapeText(value),
+		Types:     types(l),
+		Preferred: hasType(l, "pref") || l.param("PREF") == "1",
+	}
+}
+
+func contactAddress(l contentLine, value string) ContactAddress {
+	// post office box; extended address; street; locality; region; postal code; country
+	adr := unescapeValues(splitValue(value, ';'))
+	for len(adr) < 7 {
+		adr = append(adr, "")
+	}
+	return ContactAddress{
+		Types:      types(l),
+		Street:     adr[2],
+		Locality:   adr[3],
+		Region:     adr[4],
+		PostalCode: adr[5],
+		Country:    adr[6],
+	}
+}
+
+func unescapeValues(values []string) []string {
+	for i, v := range values {
+		values[i] = unescapeText(v)
+	}
+	return values
+}
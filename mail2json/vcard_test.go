@@ -0,0 +1,112 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseContacts(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []Contact
+	}{
+		{
+			"vCard 4.0",
+			"BEGIN:VCARD\r\n" +
+				"VERSION:4.0\r\n" +
+				"UID:urn:uuid:4fbe8971-0bc3-424c-9c26-36c3e1eff6b1\r\n" +
+				"FN:Alice Smith\r\n" +
+				"N:Smith;Alice;;;\r\n" +
+				"ORG:Example\\, Inc.;Sales\r\n" +
+				"TITLE:Manager\r\n" +
+				"EMAIL;TYPE=work;PREF=1:alice@example.com\r\n" +
+				"item1.EMAIL;TYPE=home:alice@example.org\r\n" +
+				"TEL;TYPE=\"cell,voice\":tel:+1-555-0100\r\n" +
+				"ADR;TYPE=work:;;1 Main St;Springfield;IL;62701;USA\r\n" +
+				"URL:https://example.com/\r\n" +
+				"BDAY:19800102\r\n" +
+				"NOTE:first line\\nsecond line\r\n" +
+				"END:VCARD\r\n",
+			[]Contact{{
+				UID:           "urn:uuid:4fbe8971-0bc3-424c-9c26-36c3e1eff6b1",
+				FormattedName: "Alice Smith",
+				FamilyName:    "Smith",
+				GivenName:     "Alice",
+				Organization:  "Example, Inc., Sales",
+				Title:         "Manager",
+				Emails: []ContactValue{
+					{Value: "alice@example.com", Types: []string{"work"}, Preferred: true},
+					{Value: "alice@example.org", Types: []string{"home"}},
+				},
+				Phones:    []ContactValue{{Value: "tel:+1-555-0100", Types: []string{"cell", "voice"}}},
+				Addresses: []ContactAddress{{Types: []string{"work"}, Street: "1 Main St", Locality: "Springfield", Region: "IL", PostalCode: "62701", Country: "USA"}},
+				URLs:      []string{"https://example.com/"},
+				Birthday:  "19800102",
+				Note:      "first line\nsecond line",
+			}},
+		},
+		{
+			"vCard 2.1",
+			"BEGIN:VCARD\r\n" +
+				"VERSION:2.1\r\n" +
+				"N;CHARSET=SHIFT_JIS;ENCODING=QUOTED-PRINTABLE:=8E=52=93=63;=91=BE=98=59\r\n" +
+				"TEL;WORK;VOICE:03-1234-5678\r\n" +
+				"EMAIL;INTERNET;PREF:taro@example.jp\r\n" +
+				"NOTE;ENCODING=QUOTED-PRINTABLE:long =\r\n" +
+				"note\r\n" +
+				"END:VCARD\r\n" +
+				"BEGIN:VCARD\r\n" +
+				"VERSION:3.0\r\n" +
+				"FN:Bob\r\n" +
+				"EMAIL;TYPE=INTERNET,WORK:bob@example.com\r\n" +
+				"END:VCARD\r\n",
+			[]Contact{
+				{
+					FormattedName: "太郎 山田",
+					FamilyName:    "山田",
+					GivenName:     "太郎",
+					Phones:        []ContactValue{{Value: "03-1234-5678", Types: []string{"work", "voice"}}},
+					Emails:        []ContactValue{{Value: "taro@example.jp", Preferred: true}},
+					Note:          "long note",
+				},
+				{
+					FormattedName: "Bob",
+					Emails:        []ContactValue{{Value: "bob@example.com", Types: []string{"work"}}},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		contacts, err := ParseContacts(tt.input)
+		assert.Nil(t, err, tt.name)
+		assert.Equal(t, tt.expected, contacts, tt.name)
+	}
+
+	_, err := ParseContacts("BEGIN:VCALENDAR\r\nEND:VCALENDAR\r\n")
+	assert.Equal(t, errNoVCard, err)
+}
+
+func TestReadMailVCard(t *testing.T) {
+	input := "Subject: contact\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"see attached\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/x-vcard; charset=utf-8; name=bob.vcf\r\n" +
+		"Content-Disposition: attachment; filename=bob.vcf\r\n" +
+		"\r\n" +
+		"BEGIN:VCARD\r\n" +
+		"FN:Bob\r\n" +
+		"END:VCARD\r\n" +
+		"--b--\r\n"
+
+	part := readTestMail(t, input, Option{calendar: true})
+	assert.Nil(t, part.Parts[0].Contacts)
+	assert.Equal(t, []Contact{{FormattedName: "Bob"}}, part.Parts[1].Contacts)
+	assert.NotNil(t, part.Parts[1].Attachment)
+}